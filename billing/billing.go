@@ -0,0 +1,204 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/logging"
+	"github.com/learc83/toastyserver/metrics"
+	"github.com/learc83/toastyserver/notify"
+	"time"
+)
+
+var logger = logging.For("billing")
+
+//how often due cycles are invoiced and due invoices are charged
+const runInterval = 15 * time.Minute
+
+//dunning schedule, how long to wait after each declined charge before trying
+//again. Once these run out the invoice fails and the customer is suspended
+var retryDelays = []time.Duration{
+	1 * 24 * time.Hour,
+	3 * 24 * time.Hour,
+	5 * 24 * time.Hour,
+}
+
+//how long to wait after the processor couldn't be reached, which isn't a
+//dunning attempt
+const outageRetry = 15 * time.Minute
+
+//how long a charge can take. A started charge isn't cancelled with the
+//caller's context, the processor may already have taken the money
+const chargeTimeout = 1 * time.Minute
+
+const (
+	outcomePaid     = "paid"
+	outcomeDeclined = "declined"
+	outcomeError    = "error"
+)
+
+var charges = metrics.NewCounterVec("toasty_billing_charges_total",
+	"Membership charges by outcome", "outcome")
+
+//Run invoices and charges memberships every runInterval until ctx is
+//cancelled. Returns nil straight away if there is no gateway, so billing is
+//off
+func Run(ctx context.Context) error {
+	if currentGateway() == nil {
+		logger.Info("billing disabled, no payment gateway")
+		return nil
+	}
+
+	logger.Info("billing started")
+
+	ticker := time.NewTicker(runInterval)
+	defer ticker.Stop()
+
+	for {
+		err := RunOnce(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+//RunOnce creates the invoices due at now and charges the open invoices that
+//are due. A failed charge is dunning not an error, errors are db failures
+func RunOnce(ctx context.Context, now time.Time) (err error) {
+	created, err := database.CreateDueInvoices(now.Unix())
+	if err != nil {
+		return
+	}
+	if created > 0 {
+		logger.Info("invoices created", "count", created)
+	}
+
+	invoices, err := database.InvoicesToCharge(now.Unix())
+	if err != nil {
+		return
+	}
+
+	for _, inv := range invoices {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		//a desk retry may have charged it since the list was read
+		_, err = charge(ctx, inv.Id, now)
+		if err == errNotChargeable {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+//Retry charges an open or failed invoice right away, e.g. after the customer
+//updated their card. Paying a failed invoice reinstates the customer. paid is
+//false if the charge failed, err is only for things like db failures
+func Retry(ctx context.Context, id int) (paid bool, err error) {
+	paid, err = charge(ctx, id, time.Now())
+	if err == errNotChargeable {
+		var inv database.Invoice
+		inv, err = database.FindInvoice(id)
+		if err == nil && inv.Id == 0 {
+			err = errors.New("invoice not found")
+		} else if err == nil {
+			err = fmt.Errorf("invoice is %s", inv.Status)
+		}
+	}
+	return
+}
+
+//the invoice isn't open or failed, or is being charged by someone else
+var errNotChargeable = errors.New("invoice can't be charged")
+
+//claims the invoice first so a desk retry and a billing run can't both
+//charge the card
+func charge(ctx context.Context, id int, now time.Time) (paid bool, err error) {
+	g := currentGateway()
+	if g == nil {
+		return false, errors.New("billing disabled, no payment gateway")
+	}
+
+	inv, claimed, err := database.ClaimInvoice(id)
+	if err != nil {
+		return
+	}
+	if !claimed {
+		return false, errNotChargeable
+	}
+
+	attempt := inv.Attempts + 1
+	log := logger.With("invoice_id", inv.Id, "customer_id", inv.Customer_id,
+		"amount", inv.Amount, "attempt", attempt)
+
+	chargeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), chargeTimeout)
+	defer cancel()
+
+	reference := fmt.Sprintf("invoice-%d", inv.Id)
+	transaction, chargeErr := g.Charge(chargeCtx, inv.Customer_id, inv.Amount, reference)
+	if chargeErr == nil {
+		charges.Inc(outcomePaid)
+
+		//the card was charged, if this fails the payment has to be matched up
+		//by hand so log everything needed to do that
+		var sale_id int
+		sale_id, err = database.PayInvoice(inv.Id, transaction)
+		if err != nil {
+			log.Error("charged but not recorded", "transaction", transaction, "err", err)
+			return
+		}
+
+		log.Info("invoice paid", "transaction", transaction)
+
+		if rerr := notify.Receipt(sale_id); rerr != nil {
+			log.Warn("receipt not queued", "sale_id", sale_id, "err", rerr)
+		}
+		return true, nil
+	}
+
+	//the card may be fine, try again soon without using up an attempt. A
+	//failed invoice stays failed
+	var declined DeclinedError
+	if !errors.As(chargeErr, &declined) {
+		charges.Inc(outcomeError)
+
+		if inv.Status == database.InvoiceFailed {
+			log.Warn("processor unreachable", "err", chargeErr)
+			err = database.FailInvoice(inv.Id, inv.Attempts, chargeErr.Error())
+			return
+		}
+
+		next := now.Add(outageRetry)
+		log.Warn("processor unreachable, will retry", "err", chargeErr, "next_attempt", next)
+		err = database.RetryInvoice(inv.Id, inv.Attempts, next.Unix(), chargeErr.Error())
+		return
+	}
+	charges.Inc(outcomeDeclined)
+
+	//a failed invoice that is retried by hand stays failed, the customer is
+	//already suspended
+	if inv.Status == database.InvoiceFailed || attempt > len(retryDelays) {
+		log.Warn("charge declined, customer suspended", "err", chargeErr)
+		err = database.FailInvoice(inv.Id, attempt, chargeErr.Error())
+		return
+	}
+
+	next := now.Add(retryDelays[attempt-1])
+	log.Warn("charge declined, will retry", "err", chargeErr, "next_attempt", next)
+	err = database.RetryInvoice(inv.Id, attempt, next.Unix(), chargeErr.Error())
+
+	return
+}
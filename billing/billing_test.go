@@ -0,0 +1,283 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1700000000, 0)
+
+const day = 24 * time.Hour
+
+//a fresh db with the fake gateway
+func setup(t *testing.T) *FakeGateway {
+	t.Helper()
+
+	database.SetPath(filepath.Join(t.TempDir(), "toasty.sqlite"))
+	database.CreateAndOpenDB()
+	t.Cleanup(database.CloseDB)
+
+	err := database.UpgradeSchema()
+	if err != nil {
+		t.Fatalf("UpgradeSchema: %v", err)
+	}
+
+	g := NewFakeGateway()
+	SetGateway(g)
+	t.Cleanup(func() { SetGateway(nil) })
+
+	return g
+}
+
+//a customer billed monthly for a membership from start, returns their id
+func member(t *testing.T, fob uint64) int {
+	t.Helper()
+
+	err := database.CreateRecord(database.Customer{Name: "Member", Status: true,
+		Level: 1, Fob_num: fob, Location_id: 1})
+	if err != nil {
+		t.Fatalf("CreateRecord customer: %v", err)
+	}
+	cust_id, _, _, _, err := database.FindCustomer(fob)
+	if err != nil || cust_id == 0 {
+		t.Fatalf("FindCustomer: %d %v", cust_id, err)
+	}
+
+	err = database.CreateRecord(database.Product{Name: "Monthly", Kind: database.KindMembership,
+		Price: 3000, Days: 30, Active: true})
+	if err != nil {
+		t.Fatalf("CreateRecord product: %v", err)
+	}
+	products, err := database.ListProducts(true)
+	if err != nil || len(products) == 0 {
+		t.Fatalf("ListProducts: %v %v", products, err)
+	}
+
+	err = database.StartBillingCycle(cust_id, products[len(products)-1].Id, start.Unix())
+	if err != nil {
+		t.Fatalf("StartBillingCycle: %v", err)
+	}
+
+	return cust_id
+}
+
+//the customer's only invoice
+func invoice(t *testing.T, cust_id int) database.Invoice {
+	t.Helper()
+
+	invoices, err := database.CustomerInvoices(cust_id)
+	if err != nil || len(invoices) != 1 {
+		t.Fatalf("CustomerInvoices: %v %v", invoices, err)
+	}
+	return invoices[0]
+}
+
+func check(t *testing.T, cust_id int, invoiceStatus string, cycleStatus string, active bool) {
+	t.Helper()
+
+	if inv := invoice(t, cust_id); inv.Status != invoiceStatus {
+		t.Errorf("invoice status = %q, want %q", inv.Status, invoiceStatus)
+	}
+
+	c, _, err := database.FindBillingCycle(cust_id)
+	if err != nil {
+		t.Fatalf("FindBillingCycle: %v", err)
+	}
+	if c.Status != cycleStatus {
+		t.Errorf("cycle status = %q, want %q", c.Status, cycleStatus)
+	}
+
+	cust, err := database.FindCustomerById(cust_id)
+	if err != nil {
+		t.Fatalf("FindCustomerById: %v", err)
+	}
+	if cust.Billing_suspended == active {
+		t.Errorf("billing suspended = %v, want %v", cust.Billing_suspended, !active)
+	}
+	if !cust.Status {
+		t.Error("billing turned off the customer's status")
+	}
+}
+
+func TestPaid(t *testing.T) {
+	g := setup(t)
+	cust_id := member(t, 101)
+
+	err := RunOnce(context.Background(), start)
+	if err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+
+	check(t, cust_id, database.InvoicePaid, database.BillingActive, true)
+	if n := len(g.Charges()); n != 1 {
+		t.Fatalf("%d charges, want 1", n)
+	}
+
+	a, err := database.FindAccount(cust_id)
+	if err != nil {
+		t.Fatalf("FindAccount: %v", err)
+	}
+	if a.Member_until <= time.Now().Unix() {
+		t.Errorf("membership not extended, member until %d", a.Member_until)
+	}
+}
+
+func TestDunningSuspends(t *testing.T) {
+	g := setup(t)
+	cust_id := member(t, 102)
+	g.Decline(cust_id, "expired card")
+
+	ctx := context.Background()
+
+	//one attempt a run, each waits out its retry delay
+	runs := []struct {
+		at      time.Time
+		charges int
+		invoice string
+		cycle   string
+		active  bool
+	}{
+		{start, 1, database.InvoiceOpen, database.BillingPastDue, true},
+		{start.Add(12 * time.Hour), 1, database.InvoiceOpen, database.BillingPastDue, true},
+		{start.Add(1 * day), 2, database.InvoiceOpen, database.BillingPastDue, true},
+		{start.Add(4 * day), 3, database.InvoiceOpen, database.BillingPastDue, true},
+		{start.Add(9 * day), 4, database.InvoiceFailed, database.BillingSuspended, false},
+		{start.Add(20 * day), 4, database.InvoiceFailed, database.BillingSuspended, false},
+	}
+
+	for _, r := range runs {
+		err := RunOnce(ctx, r.at)
+		if err != nil {
+			t.Fatalf("RunOnce at %v: %v", r.at, err)
+		}
+
+		if n := len(g.Charges()); n != r.charges {
+			t.Errorf("at %v: %d charges, want %d", r.at, n, r.charges)
+		}
+		check(t, cust_id, r.invoice, r.cycle, r.active)
+	}
+
+	//every attempt is the same charge as far as the processor is concerned
+	for _, c := range g.Charges() {
+		if c.Reference != fmt.Sprintf("invoice-%d", invoice(t, cust_id).Id) {
+			t.Errorf("charge reference = %q", c.Reference)
+		}
+	}
+
+	inv := invoice(t, cust_id)
+	if inv.Attempts != len(retryDelays)+1 {
+		t.Errorf("attempts = %d, want %d", inv.Attempts, len(retryDelays)+1)
+	}
+	if inv.Last_error != "declined: expired card" {
+		t.Errorf("last error = %q", inv.Last_error)
+	}
+}
+
+func TestOutageNotCounted(t *testing.T) {
+	g := setup(t)
+	cust_id := member(t, 105)
+	g.Down(true)
+
+	ctx := context.Background()
+
+	//more outages than there are retries, each tried again soon
+	for i := 0; i <= len(retryDelays)+1; i++ {
+		at := start.Add(time.Duration(i) * outageRetry)
+		err := RunOnce(ctx, at)
+		if err != nil {
+			t.Fatalf("RunOnce: %v", err)
+		}
+
+		inv := invoice(t, cust_id)
+		if inv.Attempts != 0 || inv.Next_attempt != at.Add(outageRetry).Unix() {
+			t.Fatalf("after an outage at %v: attempts %d, next attempt %d", at,
+				inv.Attempts, inv.Next_attempt)
+		}
+		check(t, cust_id, database.InvoiceOpen, database.BillingPastDue, true)
+	}
+
+	g.Down(false)
+	err := RunOnce(ctx, start.Add(day))
+	if err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	check(t, cust_id, database.InvoicePaid, database.BillingActive, true)
+}
+
+func TestRetryReinstates(t *testing.T) {
+	g := setup(t)
+	cust_id := member(t, 103)
+	g.Decline(cust_id, "insufficient funds")
+
+	ctx := context.Background()
+	for _, d := range []time.Duration{0, 1 * day, 4 * day, 9 * day} {
+		err := RunOnce(ctx, start.Add(d))
+		if err != nil {
+			t.Fatalf("RunOnce: %v", err)
+		}
+	}
+	check(t, cust_id, database.InvoiceFailed, database.BillingSuspended, false)
+
+	//a retry by hand that fails again leaves them suspended
+	inv := invoice(t, cust_id)
+	paid, err := Retry(ctx, inv.Id)
+	if err != nil || paid {
+		t.Fatalf("Retry declined = %v %v, want false nil", paid, err)
+	}
+	check(t, cust_id, database.InvoiceFailed, database.BillingSuspended, false)
+
+	g.Decline(cust_id, "")
+	paid, err = Retry(ctx, inv.Id)
+	if err != nil || !paid {
+		t.Fatalf("Retry = %v %v, want true nil", paid, err)
+	}
+	check(t, cust_id, database.InvoicePaid, database.BillingActive, true)
+
+	_, err = Retry(ctx, inv.Id)
+	if err == nil || err.Error() != "invoice is paid" {
+		t.Errorf("Retry paid invoice err = %v", err)
+	}
+
+	_, err = Retry(ctx, inv.Id+1000)
+	if err == nil || err.Error() != "invoice not found" {
+		t.Errorf("Retry missing invoice err = %v", err)
+	}
+}
+
+func TestClaimedInvoiceNotCharged(t *testing.T) {
+	g := setup(t)
+	cust_id := member(t, 104)
+
+	_, err := database.CreateDueInvoices(start.Unix())
+	if err != nil {
+		t.Fatalf("CreateDueInvoices: %v", err)
+	}
+	inv := invoice(t, cust_id)
+
+	_, claimed, err := database.ClaimInvoice(inv.Id)
+	if err != nil || !claimed {
+		t.Fatalf("ClaimInvoice = %v %v, want true nil", claimed, err)
+	}
+	_, claimed, err = database.ClaimInvoice(inv.Id)
+	if err != nil || claimed {
+		t.Fatalf("second ClaimInvoice = %v %v, want false nil", claimed, err)
+	}
+
+	//a run while a desk retry is charging skips the invoice
+	err = RunOnce(context.Background(), start)
+	if err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if n := len(g.Charges()); n != 0 {
+		t.Errorf("%d charges, want 0", n)
+	}
+
+	_, err = Retry(context.Background(), inv.Id)
+	if err == nil || err.Error() != "invoice is charging" {
+		t.Errorf("Retry charging invoice err = %v", err)
+	}
+}
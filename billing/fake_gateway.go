@@ -0,0 +1,77 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//FakeGateway approves every charge except for customers in Decline. It keeps
+//what was charged so it can be checked, for development and trying out
+//dunning without a processor
+type FakeGateway struct {
+	mu      sync.Mutex
+	decline map[int]string
+	down    bool
+	charges []FakeCharge
+	next    int
+}
+
+type FakeCharge struct {
+	Customer_id int
+	Amount      int
+	Reference   string
+	Transaction string //blank if declined
+}
+
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{decline: make(map[int]string)}
+}
+
+//Decline makes charges to the customer fail with reason, a blank reason
+//approves them again
+func (g *FakeGateway) Decline(cust_id int, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if reason == "" {
+		delete(g.decline, cust_id)
+		return
+	}
+	g.decline[cust_id] = reason
+}
+
+//Down makes every charge fail as if the processor couldn't be reached
+func (g *FakeGateway) Down(down bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.down = down
+}
+
+func (g *FakeGateway) Charge(ctx context.Context, cust_id int, amount int, reference string) (transaction string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.down {
+		return "", errors.New("processor unreachable")
+	}
+
+	if reason, ok := g.decline[cust_id]; ok {
+		err = DeclinedError{reason}
+	} else {
+		g.next++
+		transaction = fmt.Sprintf("fake-%d", g.next)
+	}
+
+	g.charges = append(g.charges, FakeCharge{cust_id, amount, reference, transaction})
+	return
+}
+
+//every charge attempted so far, oldest first
+func (g *FakeGateway) Charges() []FakeCharge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]FakeCharge(nil), g.charges...)
+}
@@ -0,0 +1,43 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+//Gateway charges a customer's card on file. Implementations wrap a payment
+//processor. reference is the same for every attempt at an invoice so a
+//processor can drop a charge it already took, the returned transaction id is
+//recorded on the sale
+type Gateway interface {
+	Charge(ctx context.Context, cust_id int, amount int, reference string) (transaction string, err error)
+}
+
+//DeclinedError is returned by a gateway when the processor turned the charge
+//down, e.g. an expired card. Any other error is treated as the processor being
+//unreachable. Both are retried, only declines count toward suspending the
+//customer
+type DeclinedError struct {
+	Reason string
+}
+
+func (e DeclinedError) Error() string {
+	return fmt.Sprintf("declined: %s", e.Reason)
+}
+
+var mu sync.Mutex
+var gateway = defaultGateway()
+
+//SetGateway replaces the gateway the build started with, nil turns billing off
+func SetGateway(g Gateway) {
+	mu.Lock()
+	defer mu.Unlock()
+	gateway = g
+}
+
+func currentGateway() Gateway {
+	mu.Lock()
+	defer mu.Unlock()
+	return gateway
+}
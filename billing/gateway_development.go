@@ -0,0 +1,10 @@
+// +build development
+
+//use go install -tags production
+
+package billing
+
+func defaultGateway() Gateway {
+	logger.Info("fake payment gateway started")
+	return NewFakeGateway()
+}
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"fmt"
+)
+
+//aggregates for the admin dashboard, all ranges are unix times with from
+//inclusive and to exclusive. Grouping is done in local time. A location_id
+//of 0 adds up every location
+
+type PeriodCount struct {
+	Period    string //2006-01-02 for days and weeks (their Monday), 2006-01 for months
+	Sessions  int    //not cancelled
+	Cancelled int
+}
+
+type BedUsage struct {
+	Location_id int
+	Bed_num     int
+	Name        string
+	Sessions    int
+	Minutes     int
+}
+
+type CancellationStats struct {
+	Sessions  int //including cancelled
+	Cancelled int
+}
+
+type CustomerActivity struct {
+	Active int //tanned within the activity window
+	Lapsed int //tanned before but not within the window
+	Never  int //no sessions at all
+}
+
+//weeks run Monday to Sunday and are named by their Monday, so the week
+//around New Year isn't split in two
+var periodExprs = map[string]string{
+	"day":   "date(Time_stamp, 'unixepoch', 'localtime')",
+	"week":  "date(Time_stamp, 'unixepoch', 'localtime', 'weekday 0', '-6 days')",
+	"month": "strftime('%Y-%m', Time_stamp, 'unixepoch', 'localtime')",
+}
+
+func SessionsPerPeriod(period string, from int64, to int64, location_id int) (counts []PeriodCount, err error) {
+	defer timeQuery("SessionsPerPeriod")()
+
+	expr, ok := periodExprs[period]
+	if !ok {
+		err = fmt.Errorf("period must be day, week or month, not %q", period)
+		return
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT %s AS Period,
+							 SUM(Cancelled = 0), SUM(Cancelled = 1)
+						   FROM Session
+						   WHERE Time_stamp >= ? AND Time_stamp < ?
+						   AND (Location_id = ? OR ? = 0)
+						   GROUP BY Period
+						   ORDER BY Period`, expr), from, to, location_id, location_id)
+	if err != nil {
+		logger.Error("query failed", "query", "SessionsPerPeriod", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c PeriodCount
+		err = rows.Scan(&c.Period, &c.Sessions, &c.Cancelled)
+		if err != nil {
+			return
+		}
+
+		counts = append(counts, c)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//minutes of tanning per bed, cancelled sessions don't count. Beds without
+//sessions are included with 0 minutes
+func BedUtilization(from int64, to int64, location_id int) (usage []BedUsage, err error) {
+	defer timeQuery("BedUtilization")()
+
+	rows, err := db.Query(`SELECT Bed.Location_id, Bed.Bed_num, Bed.Name,
+							 COUNT(Session.Id), IFNULL(SUM(Session.Session_time), 0)
+						   FROM Bed
+						   LEFT OUTER JOIN Session
+						   ON Session.Location_id = Bed.Location_id
+						   AND Session.Bed_num = Bed.Bed_num
+						   AND Session.Cancelled = 0
+						   AND Session.Time_stamp >= ? AND Session.Time_stamp < ?
+						   WHERE (Bed.Location_id = ? OR ? = 0)
+						   GROUP BY Bed.Location_id, Bed.Bed_num
+						   ORDER BY Bed.Location_id, Bed.Bed_num`,
+		from, to, location_id, location_id)
+	if err != nil {
+		logger.Error("query failed", "query", "BedUtilization", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u BedUsage
+		err = rows.Scan(&u.Location_id, &u.Bed_num, &u.Name, &u.Sessions, &u.Minutes)
+		if err != nil {
+			return
+		}
+
+		usage = append(usage, u)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//session starts by day of week (0 is Sunday) and hour of the day
+func PeakHours(from int64, to int64, location_id int) (heatmap [7][24]int, err error) {
+	defer timeQuery("PeakHours")()
+
+	rows, err := db.Query(`SELECT CAST(strftime('%w', Time_stamp, 'unixepoch', 'localtime') AS INTEGER) AS Weekday,
+							 CAST(strftime('%H', Time_stamp, 'unixepoch', 'localtime') AS INTEGER) AS Hour,
+							 COUNT(*)
+						   FROM Session
+						   WHERE Cancelled = 0
+						   AND Time_stamp >= ? AND Time_stamp < ?
+						   AND (Location_id = ? OR ? = 0)
+						   GROUP BY Weekday, Hour`, from, to, location_id, location_id)
+	if err != nil {
+		logger.Error("query failed", "query", "PeakHours", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var weekday, hour, count int
+		err = rows.Scan(&weekday, &hour, &count)
+		if err != nil {
+			return
+		}
+
+		heatmap[weekday][hour] = count
+	}
+	err = rows.Err()
+
+	return
+}
+
+func Cancellations(from int64, to int64, location_id int) (c CancellationStats, err error) {
+	defer timeQuery("Cancellations")()
+
+	err = db.QueryRow(`SELECT COUNT(*), IFNULL(SUM(Cancelled = 1), 0)
+					   FROM Session
+					   WHERE Time_stamp >= ? AND Time_stamp < ?
+					   AND (Location_id = ? OR ? = 0)`,
+		from, to, location_id, location_id).Scan(
+		&c.Sessions, &c.Cancelled)
+
+	return
+}
+
+//customers are active if they have a session that wasn't cancelled on or
+//after since. For one location it's the customers whose home is there
+func CustomerActivitySince(since int64, location_id int) (a CustomerActivity, err error) {
+	defer timeQuery("CustomerActivitySince")()
+
+	err = db.QueryRow(`SELECT IFNULL(SUM(Last >= ?), 0),
+						 IFNULL(SUM(Last < ?), 0),
+						 IFNULL(SUM(Last IS NULL), 0)
+					   FROM (SELECT MAX(Session.Time_stamp) AS Last
+							 FROM Customer
+							 LEFT OUTER JOIN Session
+							 ON Session.Customer_id = Customer.Id
+							 AND Session.Cancelled = 0
+							 WHERE (Customer.Location_id = ? OR ? = 0)
+							 GROUP BY Customer.Id)`, since, since, location_id, location_id).Scan(
+		&a.Active, &a.Lapsed, &a.Never)
+
+	return
+}
+
+//sessions that weren't cancelled and the number of different customers who
+//had them
+func Visits(from int64, to int64, location_id int) (sessions int, customers int, err error) {
+	defer timeQuery("Visits")()
+
+	err = db.QueryRow(`SELECT COUNT(*), COUNT(DISTINCT Customer_id)
+					   FROM Session
+					   WHERE Cancelled = 0
+					   AND Time_stamp >= ? AND Time_stamp < ?
+					   AND (Location_id = ? OR ? = 0)`,
+		from, to, location_id, location_id).Scan(
+		&sessions, &customers)
+
+	return
+}
@@ -0,0 +1,484 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//recurring membership billing. The billing package decides when to charge,
+//these keep the cycles, invoices and the customer's access in step
+
+//starts billing a customer for a membership product, the first invoice is
+//created at firstBill. Replaces any cycle the customer already had
+func StartBillingCycle(cust_id int, product_id int, firstBill int64) (err error) {
+	defer timeQuery("StartBillingCycle")()
+
+	var p Product
+	err = db.QueryRow(`SELECT Kind, Active FROM Product WHERE Product.Id = ?`,
+		product_id).Scan(&p.Kind, &p.Active)
+	if err == sql.ErrNoRows || (err == nil && (!p.Active || p.Kind != KindMembership)) {
+		err = fmt.Errorf("product %d is not a membership for sale", product_id)
+	}
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`INSERT OR REPLACE INTO BillingCycle
+						(Customer_id, Product_id, Next_bill, Status, Created)
+					  VALUES (?, ?, ?, ?, ?)`,
+		cust_id, product_id, firstBill, BillingActive, time.Now().Unix())
+	if err != nil {
+		logger.Error("query failed", "query", "StartBillingCycle", "err", err)
+	}
+
+	return
+}
+
+//stops billing and voids invoices that haven't been paid. Access the
+//customer already paid for is left alone
+func CancelBillingCycle(cust_id int) (err error) {
+	defer timeQuery("CancelBillingCycle")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "CancelBillingCycle", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.Exec(`UPDATE BillingCycle SET Status = ?
+						 WHERE Customer_id = ?`, BillingCancelled, cust_id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("customer isn't being billed")
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Invoice SET Status = ?
+					  WHERE Customer_id = ? AND Status IN (?, ?)`,
+		InvoiceVoid, cust_id, InvoiceOpen, InvoiceFailed)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//found is false if the customer has never been billed
+func FindBillingCycle(cust_id int) (c BillingCycle, found bool, err error) {
+	defer timeQuery("FindBillingCycle")()
+
+	err = db.QueryRow(`SELECT Customer_id, Product_id, Next_bill, Status, Created
+					   FROM BillingCycle
+					   WHERE Customer_id = ?`, cust_id).Scan(&c.Customer_id,
+		&c.Product_id, &c.Next_bill, &c.Status, &c.Created)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindBillingCycle")
+		return c, false, nil
+	}
+
+	return c, err == nil, err
+}
+
+//cycles in one of the given statuses, e.g. past due and suspended for
+//dunning
+func BillingCyclesByStatus(statuses ...string) (cycles []BillingCycle, err error) {
+	defer timeQuery("BillingCyclesByStatus")()
+
+	for _, status := range statuses {
+		var rows *sql.Rows
+		rows, err = db.Query(`SELECT Customer_id, Product_id, Next_bill, Status, Created
+							  FROM BillingCycle
+							  WHERE Status = ?
+							  ORDER BY Customer_id`, status)
+		if err != nil {
+			logger.Error("query failed", "query", "BillingCyclesByStatus", "err", err)
+			return
+		}
+
+		for rows.Next() {
+			var c BillingCycle
+			err = rows.Scan(&c.Customer_id, &c.Product_id, &c.Next_bill, &c.Status,
+				&c.Created)
+			if err != nil {
+				rows.Close()
+				return
+			}
+
+			cycles = append(cycles, c)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+//creates invoices for every cycle that is due at now and moves the cycles on
+//to their next bill. Suspended and cancelled cycles aren't invoiced, a
+//suspended customer has to pay their failed invoice first
+func CreateDueInvoices(now int64) (created int, err error) {
+	defer timeQuery("CreateDueInvoices")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "CreateDueInvoices", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`SELECT BillingCycle.Customer_id, BillingCycle.Product_id,
+							 BillingCycle.Next_bill, Product.Price, Product.Days
+						   FROM BillingCycle
+						   INNER JOIN Product
+						   ON BillingCycle.Product_id = Product.Id
+						   WHERE BillingCycle.Status IN (?, ?)
+						   AND BillingCycle.Next_bill <= ?`,
+		BillingActive, BillingPastDue, now)
+	if err != nil {
+		return
+	}
+
+	var due []Invoice
+	for rows.Next() {
+		var inv Invoice
+		var days int
+		err = rows.Scan(&inv.Customer_id, &inv.Product_id, &inv.Period_start,
+			&inv.Amount, &days)
+		if err != nil {
+			rows.Close()
+			return
+		}
+
+		inv.Period_end = inv.Period_start + int64(days)*secondsPerDay
+		due = append(due, inv)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return
+	}
+
+	for _, inv := range due {
+		_, err = tx.Exec(`INSERT INTO Invoice
+							(Customer_id, Product_id, Amount, Period_start, Period_end,
+							 Status, Attempts, Next_attempt, Last_error, Sale_id, Created)
+						  VALUES (?, ?, ?, ?, ?, ?, 0, ?, '', 0, ?)`,
+			inv.Customer_id, inv.Product_id, inv.Amount, inv.Period_start,
+			inv.Period_end, InvoiceOpen, now, now)
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE BillingCycle SET Next_bill = ?
+						  WHERE Customer_id = ?`, inv.Period_end, inv.Customer_id)
+		if err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return len(due), err
+}
+
+const invoiceColumns = `Id, Customer_id, Product_id, Amount, Period_start, Period_end,
+						Status, Attempts, Next_attempt, Last_error, Sale_id, Created`
+
+func scanInvoices(rows *sql.Rows) (invoices []Invoice, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		var inv Invoice
+		err = rows.Scan(&inv.Id, &inv.Customer_id, &inv.Product_id, &inv.Amount,
+			&inv.Period_start, &inv.Period_end, &inv.Status, &inv.Attempts,
+			&inv.Next_attempt, &inv.Last_error, &inv.Sale_id, &inv.Created)
+		if err != nil {
+			return
+		}
+
+		invoices = append(invoices, inv)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//open invoices whose next charge attempt is due at now
+func InvoicesToCharge(now int64) (invoices []Invoice, err error) {
+	defer timeQuery("InvoicesToCharge")()
+
+	rows, err := db.Query(`SELECT `+invoiceColumns+`
+						   FROM Invoice
+						   WHERE Status = ? AND Next_attempt <= ?
+						   ORDER BY Next_attempt`, InvoiceOpen, now)
+	if err != nil {
+		logger.Error("query failed", "query", "InvoicesToCharge", "err", err)
+		return
+	}
+
+	return scanInvoices(rows)
+}
+
+//most recent first
+func CustomerInvoices(cust_id int) (invoices []Invoice, err error) {
+	defer timeQuery("CustomerInvoices")()
+
+	rows, err := db.Query(`SELECT `+invoiceColumns+`
+						   FROM Invoice
+						   WHERE Customer_id = ?
+						   ORDER BY Id DESC`, cust_id)
+	if err != nil {
+		logger.Error("query failed", "query", "CustomerInvoices", "err", err)
+		return
+	}
+
+	return scanInvoices(rows)
+}
+
+//Id is 0 if not found
+func FindInvoice(id int) (inv Invoice, err error) {
+	defer timeQuery("FindInvoice")()
+
+	rows, err := db.Query(`SELECT `+invoiceColumns+`
+						   FROM Invoice
+						   WHERE Id = ?`, id)
+	if err != nil {
+		logger.Error("query failed", "query", "FindInvoice", "err", err)
+		return
+	}
+
+	invoices, err := scanInvoices(rows)
+	if len(invoices) > 0 {
+		inv = invoices[0]
+	}
+
+	return
+}
+
+//ClaimInvoice marks an open or failed invoice as charging so nothing else
+//charges it at the same time. inv is the invoice as it was before, Id is 0 if
+//not found. claimed is false if it wasn't open or failed. A claimed invoice
+//ends up paid, open or failed, see PayInvoice, RetryInvoice and FailInvoice.
+//One left charging was charged but not recorded and is sorted out by hand
+func ClaimInvoice(id int) (inv Invoice, claimed bool, err error) {
+	defer timeQuery("ClaimInvoice")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "ClaimInvoice", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`SELECT `+invoiceColumns+`
+						   FROM Invoice
+						   WHERE Id = ?`, id)
+	if err != nil {
+		return
+	}
+	invoices, err := scanInvoices(rows)
+	if err != nil || len(invoices) == 0 {
+		return
+	}
+	inv = invoices[0]
+
+	res, err := tx.Exec(`UPDATE Invoice SET Status = ?
+						 WHERE Id = ? AND Status IN (?, ?)`,
+		InvoiceCharging, id, InvoiceOpen, InvoiceFailed)
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return inv, n == 1, err
+}
+
+//records a successful charge as a card sale of the membership, which extends
+//the membership and lets the customer tan again. The cycle goes back to
+//active. Returns the sale id
+func PayInvoice(id int, reference string) (sale_id int, err error) {
+	defer timeQuery("PayInvoice")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "PayInvoice", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	var inv Invoice
+	err = tx.QueryRow(`SELECT Customer_id, Product_id, Amount, Status
+					   FROM Invoice
+					   WHERE Id = ?`, id).Scan(&inv.Customer_id, &inv.Product_id,
+		&inv.Amount, &inv.Status)
+	if err == sql.ErrNoRows {
+		err = errors.New("invoice not found")
+	}
+	if err != nil {
+		return
+	}
+	if inv.Status != InvoiceCharging {
+		err = fmt.Errorf("invoice is %s", inv.Status)
+		return
+	}
+
+	//the product may have been taken off sale since it was invoiced, the
+	//customer is still owed what they paid for
+	var p Product
+	err = tx.QueryRow(`SELECT Id, Kind, Sessions, Days FROM Product WHERE Product.Id = ?`,
+		inv.Product_id).Scan(&p.Id, &p.Kind, &p.Sessions, &p.Days)
+	if err != nil {
+		return
+	}
+
+	line := SaleLine{Product_id: p.Id, Quantity: 1, Unit_price: inv.Amount,
+		Amount: inv.Amount}
+	line.Sessions, line.Days, line.Roaming = lineCredits(p)
+	reinstated, err := creditLine(tx, inv.Customer_id, p, line)
+	if err != nil {
+		return
+	}
+
+	s := Sale{
+		Customer_id: inv.Customer_id,
+		Total:       inv.Amount,
+		Reinstated:  reinstated,
+		Lines:       []SaleLine{line},
+		Payments: []Payment{{Method: MethodCard, Amount: inv.Amount,
+			Reference: reference}},
+	}
+	sale_id, err = insertSale(tx, s)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Invoice SET Status = ?, Sale_id = ?, Last_error = ''
+					  WHERE Id = ?`, InvoicePaid, sale_id, id)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE BillingCycle SET Status = ?
+					  WHERE Customer_id = ? AND Status != ?`,
+		BillingActive, inv.Customer_id, BillingCancelled)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//records a failed charge that will be tried again at next. The customer keeps
+//their access while past due
+func RetryInvoice(id int, attempts int, next int64, reason string) (err error) {
+	defer timeQuery("RetryInvoice")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "RetryInvoice", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	var cust_id int
+	err = tx.QueryRow(`SELECT Customer_id FROM Invoice WHERE Id = ?`, id).Scan(&cust_id)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Invoice SET Status = ?, Attempts = ?, Next_attempt = ?,
+					    Last_error = ?
+					  WHERE Id = ?`, InvoiceOpen, attempts, next, reason, id)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE BillingCycle SET Status = ?
+					  WHERE Customer_id = ? AND Status = ?`,
+		BillingPastDue, cust_id, BillingActive)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//records the last failed charge, retries have run out. The cycle is
+//suspended and the customer loses door and bed access until the invoice is
+//paid
+func FailInvoice(id int, attempts int, reason string) (err error) {
+	defer timeQuery("FailInvoice")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "FailInvoice", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	var cust_id int
+	err = tx.QueryRow(`SELECT Customer_id FROM Invoice WHERE Id = ?`, id).Scan(&cust_id)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Invoice SET Status = ?, Attempts = ?, Last_error = ?
+					  WHERE Id = ?`, InvoiceFailed, attempts, reason, id)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE BillingCycle SET Status = ?
+					  WHERE Customer_id = ? AND Status != ?`,
+		BillingSuspended, cust_id, BillingCancelled)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Customer SET Billing_suspended = 1 WHERE Customer.Id = ?`,
+		cust_id)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
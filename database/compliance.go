@@ -0,0 +1,109 @@
+package database
+
+import (
+	"database/sql"
+)
+
+//the customer's compliance profile, their latest signed consent form. found
+//is false if the customer has never filled one out
+func FindCompliance(cust_id int) (c CustomerCompliance, found bool, err error) {
+	defer timeQuery("FindCompliance")()
+
+	stmt, err := db.Prepare(`SELECT Id, Customer_id, Skin_type, Consent_signed,
+							   Consent_version, Eye_protection_ack, Minor,
+							   Parental_consent, Photosensitizing_meds, Updated
+							 FROM ConsentRecord
+							 WHERE ConsentRecord.Customer_id=?
+							 ORDER BY Consent_signed DESC, Updated DESC, Id DESC
+							 LIMIT 1`)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(cust_id).Scan(&c.Id, &c.Customer_id, &c.Skin_type,
+		&c.Consent_signed, &c.Consent_version, &c.Eye_protection_ack, &c.Minor,
+		&c.Parental_consent, &c.Photosensitizing_meds, &c.Updated)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindCompliance")
+		err = nil
+		return
+	}
+
+	found = err == nil
+	return
+}
+
+//every consent form the customer has signed, latest first
+func ConsentHistory(cust_id int) (records []CustomerCompliance, err error) {
+	defer timeQuery("ConsentHistory")()
+
+	rows, err := db.Query(`SELECT Id, Customer_id, Skin_type, Consent_signed,
+							 Consent_version, Eye_protection_ack, Minor,
+							 Parental_consent, Photosensitizing_meds, Updated
+						   FROM ConsentRecord
+						   WHERE Customer_id = ?
+						   ORDER BY Consent_signed DESC, Updated DESC, Id DESC`, cust_id)
+	if err != nil {
+		logger.Error("query failed", "query", "ConsentHistory", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c CustomerCompliance
+		err = rows.Scan(&c.Id, &c.Customer_id, &c.Skin_type, &c.Consent_signed,
+			&c.Consent_version, &c.Eye_protection_ack, &c.Minor, &c.Parental_consent,
+			&c.Photosensitizing_meds, &c.Updated)
+		if err != nil {
+			return
+		}
+
+		records = append(records, c)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//records a newly signed consent form. Earlier forms are kept, the latest
+//signed becomes the customer's profile
+func SaveCompliance(c CustomerCompliance) (id int, err error) {
+	defer timeQuery("SaveCompliance")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "SaveCompliance", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	id, err = insertConsentRecord(tx, c)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//adds c with the next id in this location's block
+func insertConsentRecord(tx *sql.Tx, c CustomerCompliance) (id int, err error) {
+	next, err := nextBlockId(tx, "ConsentRecord")
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`INSERT INTO ConsentRecord (Id, Customer_id, Skin_type,
+						Consent_signed, Consent_version, Eye_protection_ack, Minor,
+						Parental_consent, Photosensitizing_meds, Updated)
+					  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, next, c.Customer_id,
+		c.Skin_type, c.Consent_signed, c.Consent_version, c.Eye_protection_ack, c.Minor,
+		c.Parental_consent, c.Photosensitizing_meds, c.Updated)
+
+	return int(next), err
+}
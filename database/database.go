@@ -8,15 +8,46 @@ import (
 	//from initialization not calling anything in pkg directly
 	"fmt"
 	_ "github.com/learc83/go-sqlite3"
+	"github.com/learc83/toastyserver/logging"
+	"github.com/learc83/toastyserver/metrics"
 	"log"
+	"time"
 )
 
 const dbName string = "Toasty"
-const dbPath string = "./" + dbName + ".sqlite"
+
+//TOASTY_DB overrides where the db is, e.g. to run two servers on one machine
+var dbPath string = defaultPath()
+
+func defaultPath() string {
+	if p := os.Getenv("TOASTY_DB"); p != "" {
+		return p
+	}
+	return "./" + dbName + ".sqlite"
+}
+
+//SetPath points CreateAndOpenDB and OpenDB at p instead, e.g. a temp db for
+//tests. Call it before either
+func SetPath(p string) {
+	dbPath = p
+}
 
 //global variable for database pool
 var db *sql.DB
 
+var logger = logging.For("db")
+
+var queryDuration = metrics.NewHistogramVec("toasty_db_query_duration_seconds",
+	"Database query latency by query", metrics.DefaultBuckets, "query")
+
+//use at the top of a query function: defer timeQuery("FindCustomer")()
+func timeQuery(query string) func() {
+	start := time.Now()
+	return func() {
+		queryDuration.Observe(time.Since(start).Seconds(), query)
+	}
+}
+
 // func StartDB() {
 // 	//TODO add logic to run db schema
 // 	//Ueses GOENV environment variable to determine behavior
@@ -98,6 +129,26 @@ func CloseDB() {
 	db.Close()
 }
 
+//Ping checks the database is still reachable
+func Ping() error {
+	return db.Ping()
+}
+
+//WalSize returns the size in bytes of the write ahead log, 0 if there isn't one
+func WalSize() (size int64, err error) {
+	info, err := os.Stat(dbPath + "-wal")
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	size = info.Size()
+	return
+}
+
 func DeleteDB() (err error) {
 	fmt.Print("!!!WARNING!!! Delete the database? YES or NO: ")
 
@@ -123,8 +174,93 @@ func UpSchema() {
 		_, err := db.Exec(sql)
 
 		if err != nil {
-			log.Printf("%q: %s\n", err, sql)
+			logger.Error("create table failed", "sql", sql, "err", err)
+			return
+		}
+	}
+
+	err := ensureDefaultLocation()
+	if err != nil {
+		logger.Error("creating default location failed", "err", err)
+	}
+
+	err = ensureSync()
+	if err != nil {
+		logger.Error("creating sync triggers failed", "err", err)
+	}
+
+	//new tables already have every column, so no migrations to run
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version=%d", len(migrations())))
+	if err != nil {
+		logger.Error("setting schema version failed", "err", err)
+	}
+
+	err = ensureSearchIndex()
+	if err != nil {
+		logger.Error("creating search index failed", "err", err)
+	}
+}
+
+//UpgradeSchema brings an existing db up to date without losing data. Missing
+//tables are created, then any migrations newer than the db's user_version are
+//run in order, each in its own transaction. Last the default location, the
+//sync triggers and the search index are created if they're missing. Safe to
+//run on every start
+func UpgradeSchema() (err error) {
+	for k, v := range schema() {
+		_, err = db.Exec(fmt.Sprintf("create table if not exists %s %s", k, v))
+		if err != nil {
+			logger.Error("create table failed", "table", k, "err", err)
+			return
+		}
+	}
+
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return
+	}
+
+	m := migrations()
+	for version < len(m) {
+		logger.Info("running migration", "version", version+1)
+
+		var tx *sql.Tx
+		tx, err = db.Begin()
+		if err != nil {
+			return
+		}
+
+		err = m[version](tx)
+		if err != nil {
+			logger.Error("migration failed", "version", version+1, "err", err)
+			tx.Rollback()
+			return
+		}
+
+		//PRAGMA doesn't take ? parameters
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version=%d", version+1))
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
 			return
 		}
+		version++
 	}
+
+	err = ensureDefaultLocation()
+	if err != nil {
+		return
+	}
+
+	err = ensureSync()
+	if err != nil {
+		return
+	}
+
+	return ensureSearchIndex()
 }
@@ -0,0 +1,278 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+//DoorEntry is what the door needs to know about a keyfob's customer or
+//employee. Only one of the ids is set
+type DoorEntry struct {
+	Customer_id int
+	Employee_id int
+	Level       int  //employee level, 0 for customers
+	Status      bool //off for a customer turned off or billing suspended, or a deactivated employee
+	Allowed     bool //home location is this one, or they have a roaming plan
+}
+
+//DoorAllowList is every customer and employee keyfob with whether it opens
+//doors at location_id. Employees work at their own location
+func DoorAllowList(location_id int) (fobs map[uint64]DoorEntry, err error) {
+	defer timeQuery("DoorAllowList")()
+
+	rows, err := db.Query(`SELECT Customer.Fob_num, Customer.Id, 0, 0,
+							 Customer.Status AND NOT Customer.Billing_suspended,
+						     `+roamingExpr+` OR Customer.Location_id = ?
+						   FROM Customer
+						   LEFT OUTER JOIN Account
+						   ON Account.Customer_id = Customer.Id
+						   UNION ALL
+						   SELECT Fob_num, 0, Id, Level, Active, Location_id = ?
+						   FROM Employee`, time.Now().Unix(), location_id, location_id)
+	if err != nil {
+		logger.Error("query failed", "query", "DoorAllowList", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	fobs = make(map[uint64]DoorEntry)
+	for rows.Next() {
+		var fob uint64
+		var e DoorEntry
+		err = rows.Scan(&fob, &e.Customer_id, &e.Employee_id, &e.Level, &e.Status,
+			&e.Allowed)
+		if err != nil {
+			return
+		}
+
+		fobs[fob] = e
+	}
+	err = rows.Err()
+
+	return
+}
+
+//DoorAllowListVersion changes whenever a customer, employee, keyfob or
+//account does, including changes from sync, so the door knows when to reload
+//its list. A roaming plan running out doesn't change it, the door reloads
+//every so often anyway
+func DoorAllowListVersion() (version int64, err error) {
+	defer timeQuery("DoorAllowListVersion")()
+
+	err = db.QueryRow(`SELECT IFNULL(MAX(Seq), 0)
+					   FROM ChangeLog
+					   WHERE Table_name IN ('Customer', 'Employee', 'Keyfob', 'AccountEntry')`).Scan(&version)
+	if err != nil {
+		logger.Error("query failed", "query", "DoorAllowListVersion", "err", err)
+	}
+
+	return
+}
+
+//CreateDoorAccesses records a batch of door accesses and alerts, all or
+//none
+func CreateDoorAccesses(accesses []DoorAccess, alerts []DoorAlert) (err error) {
+	defer timeQuery("CreateDoorAccesses")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "CreateDoorAccesses", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	stmt, err := tx.Prepare(`INSERT INTO DoorAccess (Customer_id, Employee_id, Time_stamp,
+							   Location_id, Door_id, Action)
+							 VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for _, d := range accesses {
+		_, err = stmt.Exec(d.Customer_id, d.Employee_id, d.Time_stamp, d.Location_id,
+			d.Door_id, d.Action)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, a := range alerts {
+		_, err = tx.Exec(`INSERT INTO DoorAlert (Customer_id, Location_id, Door_id, Kind,
+							Detail, Denied, Resolved, Time_stamp)
+						  VALUES (?, ?, ?, ?, ?, ?, 0, ?)`, a.Customer_id, a.Location_id,
+			a.Door_id, a.Kind, a.Detail, a.Denied, a.Time_stamp)
+		if err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+func ListDoors(location_id int) (doors []Door, err error) {
+	defer timeQuery("ListDoors")()
+
+	rows, err := db.Query(`SELECT Id, Location_id, Name, Device, Policy, Opens, Closes,
+							 Grant_response, Deny_response, Active, Lockdown,
+							 Min_interval, Max_per_day, Passback_deny, Format, Time_clock
+						   FROM Door
+						   WHERE Location_id = ?
+						   ORDER BY Id`, location_id)
+	if err != nil {
+		logger.Error("query failed", "query", "ListDoors", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d Door
+		err = rows.Scan(&d.Id, &d.Location_id, &d.Name, &d.Device, &d.Policy, &d.Opens,
+			&d.Closes, &d.Grant_response, &d.Deny_response, &d.Active, &d.Lockdown,
+			&d.Min_interval, &d.Max_per_day, &d.Passback_deny, &d.Format, &d.Time_clock)
+		if err != nil {
+			return
+		}
+
+		doors = append(doors, d)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//Door with default values if not found, Id will be 0
+func FindDoor(id int) (d Door, err error) {
+	defer timeQuery("FindDoor")()
+
+	err = db.QueryRow(`SELECT Id, Location_id, Name, Device, Policy, Opens, Closes,
+						 Grant_response, Deny_response, Active, Lockdown,
+						 Min_interval, Max_per_day, Passback_deny, Format, Time_clock
+					   FROM Door
+					   WHERE Id = ?`, id).Scan(&d.Id, &d.Location_id, &d.Name, &d.Device,
+		&d.Policy, &d.Opens, &d.Closes, &d.Grant_response, &d.Deny_response, &d.Active,
+		&d.Lockdown, &d.Min_interval, &d.Max_per_day, &d.Passback_deny, &d.Format,
+		&d.Time_clock)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindDoor")
+		err = nil
+	}
+
+	return
+}
+
+//a door stays at its location, lockdown is changed with SetDoorLockdown
+func UpdateDoor(d Door) (err error) {
+	defer timeQuery("UpdateDoor")()
+
+	_, err = db.Exec(`UPDATE Door
+					  SET Name = ?, Device = ?, Policy = ?, Opens = ?, Closes = ?,
+						Grant_response = ?, Deny_response = ?, Active = ?,
+						Min_interval = ?, Max_per_day = ?, Passback_deny = ?, Format = ?,
+						Time_clock = ?
+					  WHERE Id = ?`, d.Name, d.Device, d.Policy, d.Opens, d.Closes,
+		d.Grant_response, d.Deny_response, d.Active, d.Min_interval, d.Max_per_day,
+		d.Passback_deny, d.Format, d.Time_clock, d.Id)
+	if err != nil {
+		logger.Error("query failed", "query", "UpdateDoor", "err", err)
+	}
+
+	return
+}
+
+//locks down or opens up door_id at location_id, or all its doors if door_id
+//is 0. Returns the doors changed
+func SetDoorLockdown(location_id int, door_id int, lockdown bool) (doors []int, err error) {
+	defer timeQuery("SetDoorLockdown")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "SetDoorLockdown", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(`SELECT Id
+						   FROM Door
+						   WHERE Location_id = ? AND (Id = ? OR ? = 0)`,
+		location_id, door_id, door_id)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		doors = append(doors, id)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Door
+					  SET Lockdown = ?
+					  WHERE Location_id = ? AND (Id = ? OR ? = 0)`,
+		lockdown, location_id, door_id, door_id)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//customers let in by fob at location_id since, oldest first
+func DoorGrantsSince(location_id int, since int64) (accesses []DoorAccess, err error) {
+	defer timeQuery("DoorGrantsSince")()
+
+	rows, err := db.Query(`SELECT Customer_id, Door_id, Time_stamp
+						   FROM DoorAccess
+						   WHERE Location_id = ? AND Time_stamp >= ?
+						   AND Action = 'fob' AND Customer_id != 0
+						   ORDER BY Time_stamp`, location_id, since)
+	if err != nil {
+		logger.Error("query failed", "query", "DoorGrantsSince", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d DoorAccess
+		err = rows.Scan(&d.Customer_id, &d.Door_id, &d.Time_stamp)
+		if err != nil {
+			return
+		}
+
+		accesses = append(accesses, d)
+	}
+	err = rows.Err()
+
+	return
+}
+
+func ResolveDoorAlert(id int) (err error) {
+	defer timeQuery("ResolveDoorAlert")()
+
+	_, err = db.Exec(`UPDATE DoorAlert
+					  SET Resolved = 1
+					  WHERE Id = ?`, id)
+	if err != nil {
+		logger.Error("query failed", "query", "ResolveDoorAlert", "err", err)
+	}
+
+	return
+}
@@ -0,0 +1,255 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+//every employee, active or not, by name
+func ListEmployees() (employees []Employee, err error) {
+	defer timeQuery("ListEmployees")()
+
+	rows, err := db.Query(`SELECT Id, Name, Level, Fob_num, Location_id, Active
+						   FROM Employee
+						   ORDER BY Name`)
+	if err != nil {
+		logger.Error("query failed", "query", "ListEmployees", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e Employee
+		err = rows.Scan(&e.Id, &e.Name, &e.Level, &e.Fob_num, &e.Location_id, &e.Active)
+		if err != nil {
+			return
+		}
+
+		employees = append(employees, e)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//Employee with default values if not found, Id will be 0
+func FindEmployeeById(id int) (e Employee, err error) {
+	defer timeQuery("FindEmployeeById")()
+
+	err = db.QueryRow(`SELECT Id, Name, Level, Fob_num, Location_id, Active
+					   FROM Employee
+					   WHERE Id = ?`, id).Scan(&e.Id, &e.Name, &e.Level, &e.Fob_num,
+		&e.Location_id, &e.Active)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindEmployeeById")
+		err = nil
+	}
+	if err != nil {
+		logger.Error("query failed", "query", "FindEmployeeById", "err", err)
+	}
+
+	return
+}
+
+//admin keyfobs no employee has
+func AvailableEmployeeKeyfobs() (base10 []uint64, base16 []string, err error) {
+	defer timeQuery("AvailableEmployeeKeyfobs")()
+
+	rows, err := db.Query(`SELECT Keyfob.Fob_num
+						   FROM Keyfob
+						   LEFT OUTER JOIN Employee
+						   ON Keyfob.Fob_num = Employee.Fob_num
+						   WHERE Employee.Id IS null
+						   AND Keyfob.Admin = 1
+						   ORDER BY Keyfob.Fob_num`)
+	if err != nil {
+		logger.Error("query failed", "query", "AvailableEmployeeKeyfobs", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fob uint64
+		err = rows.Scan(&fob)
+		if err != nil {
+			return
+		}
+
+		base10 = append(base10, fob)
+		base16 = append(base16, fmt.Sprintf("%X", fob))
+	}
+	err = rows.Err()
+
+	return
+}
+
+//CreateEmployee adds e with the next id in this location's block. Its fob
+//must be an admin keyfob nobody has
+func CreateEmployee(e Employee) (id int, err error) {
+	defer timeQuery("CreateEmployee")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "CreateEmployee", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	err = checkEmployeeFob(tx, e.Fob_num, 0)
+	if err != nil {
+		return
+	}
+
+	next, err := nextBlockId(tx, "Employee")
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`INSERT INTO Employee (Id, Name, Level, Fob_num, Location_id, Active)
+					  VALUES (?, ?, ?, ?, ?, ?)`, next, e.Name, e.Level, e.Fob_num,
+		e.Location_id, e.Active)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return int(next), err
+}
+
+//UpdateEmployee changes everything but e's id. Its fob must be an admin
+//keyfob nobody else has, and it can't leave no active employee at
+//ownerLevel or above
+func UpdateEmployee(e Employee, ownerLevel int) (err error) {
+	defer timeQuery("UpdateEmployee")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "UpdateEmployee", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	err = checkEmployeeFob(tx, e.Fob_num, e.Id)
+	if err != nil {
+		return
+	}
+
+	if !e.Active || e.Level < ownerLevel {
+		err = checkLastOwner(tx, e.Id, ownerLevel)
+		if err != nil {
+			return
+		}
+	}
+
+	res, err := tx.Exec(`UPDATE Employee
+						 SET Name = ?, Level = ?, Fob_num = ?, Location_id = ?, Active = ?
+						 WHERE Id = ?`, e.Name, e.Level, e.Fob_num, e.Location_id, e.Active,
+		e.Id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("employee not found")
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//DeleteEmployee deletes an employee unless they're the last active one at
+//ownerLevel or above. Their door accesses and time entries are kept
+func DeleteEmployee(id int, ownerLevel int) (err error) {
+	defer timeQuery("DeleteEmployee")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "DeleteEmployee", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	err = checkLastOwner(tx, id, ownerLevel)
+	if err != nil {
+		return
+	}
+
+	res, err := tx.Exec(`DELETE FROM Employee
+						 WHERE Id = ?`, id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("employee not found")
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//fob must be an admin keyfob nobody but employee_id has
+func checkEmployeeFob(tx *sql.Tx, fob uint64, employee_id int) (err error) {
+	var admin bool
+	err = tx.QueryRow(`SELECT Admin
+					   FROM Keyfob
+					   WHERE Fob_num = ?`, fob).Scan(&admin)
+	if err == sql.ErrNoRows {
+		return errors.New("keyfob not found")
+	}
+	if err != nil {
+		return
+	}
+	if !admin {
+		return errors.New("keyfob isn't an admin keyfob")
+	}
+
+	var taken string
+	err = tx.QueryRow(`SELECT Name
+					   FROM Employee
+					   WHERE Fob_num = ? AND Id != ?
+					   UNION ALL
+					   SELECT Name
+					   FROM Customer
+					   WHERE Fob_num = ?
+					   LIMIT 1`, fob, employee_id, fob).Scan(&taken)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	return errors.New("keyfob is already assigned to " + taken)
+}
+
+//an error if employee_id is the only active employee at ownerLevel or above
+func checkLastOwner(tx *sql.Tx, employee_id int, ownerLevel int) (err error) {
+	var owner bool
+	var others int
+	err = tx.QueryRow(`SELECT IFNULL(MAX(Id = ?), 0), IFNULL(SUM(Id != ?), 0)
+					   FROM Employee
+					   WHERE Active = 1 AND Level >= ?`,
+		employee_id, employee_id, ownerLevel).Scan(&owner, &others)
+	if err != nil {
+		return
+	}
+
+	if owner && others == 0 {
+		return errors.New("can't remove the last owner")
+	}
+	return
+}
@@ -0,0 +1,90 @@
+package database
+
+//every schedule row for a bed at the local location, ordered by skin type then
+//visit
+func BedExposureSchedule(bed_num int) (schedule []ExposureSchedule, err error) {
+	defer timeQuery("BedExposureSchedule")()
+
+	stmt, err := db.Prepare(`SELECT Location_id, Bed_num, Skin_type, Visit, Minutes
+							 FROM ExposureSchedule
+							 WHERE ExposureSchedule.Bed_num=?
+							 AND ExposureSchedule.Location_id=?
+							 ORDER BY Skin_type, Visit`)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(bed_num, localLocation)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e ExposureSchedule
+		err = rows.Scan(&e.Location_id, &e.Bed_num, &e.Skin_type, &e.Visit, &e.Minutes)
+		if err != nil {
+			return
+		}
+
+		schedule = append(schedule, e)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//minutes for a visit on a bed at the local location. Visits past the end of the schedule get the
+//last (maintenance) entry. found is false if the bed has no schedule for the
+//skin type
+func ExposureMinutes(bed_num int, skin_type int, visit int) (minutes int, found bool, err error) {
+	defer timeQuery("ExposureMinutes")()
+
+	rows, err := db.Query(`SELECT Minutes
+						   FROM ExposureSchedule
+						   WHERE Location_id=? AND Bed_num=? AND Skin_type=? AND Visit<=?
+						   ORDER BY Visit DESC
+						   LIMIT 1`, localLocation, bed_num, skin_type, visit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		err = rows.Scan(&minutes)
+		found = err == nil
+		return
+	}
+	err = rows.Err()
+
+	return
+}
+
+//sets minutes for a bed at the local location, e.Location_id is ignored
+func SetExposureMinutes(e ExposureSchedule) (err error) {
+	defer timeQuery("SetExposureMinutes")()
+
+	_, err = db.Exec(`INSERT OR REPLACE INTO ExposureSchedule
+						(Location_id, Bed_num, Skin_type, Visit, Minutes)
+					  VALUES (?, ?, ?, ?, ?)`,
+		localLocation, e.Bed_num, e.Skin_type, e.Visit, e.Minutes)
+	if err != nil {
+		logger.Error("query failed", "query", "SetExposureMinutes", "err", err)
+	}
+
+	return
+}
+
+func DeleteExposureMinutes(bed_num int, skin_type int, visit int) (err error) {
+	defer timeQuery("DeleteExposureMinutes")()
+
+	_, err = db.Exec(`DELETE FROM ExposureSchedule
+					  WHERE Location_id=? AND Bed_num=? AND Skin_type=? AND Visit=?`,
+		localLocation, bed_num, skin_type, visit)
+	if err != nil {
+		logger.Error("query failed", "query", "DeleteExposureMinutes", "err", err)
+	}
+
+	return
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//no 0/O or 1/I so codes can be read out over the phone
+const giftCardAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+//codes are stored upper case without blanks or dashes, so "abcd-efgh jklm"
+//finds ABCDEFGHJKLM
+func NormalizeCode(code string) string {
+	code = strings.Replace(code, "-", " ", -1)
+	return strings.ToUpper(strings.Join(strings.Fields(code), ""))
+}
+
+//ABCDEFGHJKLM as ABCD-EFGH-JKLM
+func FormatGiftCardCode(code string) string {
+	var groups []string
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	return strings.Join(append(groups, code), "-")
+}
+
+//random 12 letter code
+func newGiftCardCode() (code string, err error) {
+	b := make([]byte, 12)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+
+	for i := range b {
+		b[i] = giftCardAlphabet[int(b[i])%len(giftCardAlphabet)]
+	}
+
+	return string(b), nil
+}
+
+func issueGiftCard(tx *sql.Tx, amount int, sale_id int) (g GiftCard, err error) {
+	if amount <= 0 {
+		err = fmt.Errorf("gift card amount of %d must be more than 0", amount)
+		return
+	}
+
+	//collisions are very unlikely, but check rather than fail the sale
+	for tries := 0; ; tries++ {
+		if tries == 5 {
+			err = errors.New("couldn't make a unique gift card code")
+			return
+		}
+
+		g.Code, err = newGiftCardCode()
+		if err != nil {
+			return
+		}
+
+		var taken int
+		err = tx.QueryRow(`SELECT COUNT(*) FROM GiftCard WHERE Code = ?`,
+			g.Code).Scan(&taken)
+		if err != nil {
+			return
+		}
+		if taken == 0 {
+			break
+		}
+	}
+
+	g.Initial = amount
+	g.Balance = amount
+	g.Display = FormatGiftCardCode(g.Code)
+	g.Sale_id = sale_id
+	g.Active = true
+	g.Time_stamp = time.Now().Unix()
+
+	res, err := tx.Exec(`INSERT INTO GiftCard
+						   (Code, Initial, Balance, Sale_id, Active, Time_stamp)
+						 VALUES (?, ?, ?, ?, 1, ?)`,
+		g.Code, g.Initial, g.Balance, g.Sale_id, g.Time_stamp)
+	if err != nil {
+		return
+	}
+
+	id, err := res.LastInsertId()
+	g.Id = int(id)
+
+	return
+}
+
+//IssueGiftCard gives away a gift card without a sale, e.g. to make up for a
+//problem. Sold gift cards are issued by CreateSale
+func IssueGiftCard(amount int) (g GiftCard, err error) {
+	defer timeQuery("IssueGiftCard")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "IssueGiftCard", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	g, err = issueGiftCard(tx, amount, 0)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//Id is 0 if not found
+func FindGiftCard(code string) (g GiftCard, err error) {
+	defer timeQuery("FindGiftCard")()
+
+	err = db.QueryRow(`SELECT Id, Code, Initial, Balance, Sale_id, Active, Time_stamp
+					   FROM GiftCard
+					   WHERE Code = ?`, NormalizeCode(code)).Scan(&g.Id, &g.Code,
+		&g.Initial, &g.Balance, &g.Sale_id, &g.Active, &g.Time_stamp)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindGiftCard")
+		err = nil
+	}
+	g.Display = FormatGiftCardCode(g.Code)
+
+	return
+}
+
+//takes amount off the card's balance, a negative amount puts it back
+func chargeGiftCard(tx *sql.Tx, code string, amount int) (err error) {
+	var balance int
+	var active bool
+	err = tx.QueryRow(`SELECT Balance, Active FROM GiftCard WHERE Code = ?`,
+		NormalizeCode(code)).Scan(&balance, &active)
+	if err == sql.ErrNoRows || (err == nil && !active) {
+		err = fmt.Errorf("gift card %q not found", code)
+	}
+	if err != nil {
+		return
+	}
+
+	if balance < amount {
+		return fmt.Errorf("gift card balance of %d is less than %d", balance, amount)
+	}
+
+	_, err = tx.Exec(`UPDATE GiftCard SET Balance = Balance - ? WHERE Code = ?`,
+		amount, NormalizeCode(code))
+	return
+}
+
+func saleGiftCards(q queryer, sale_id int) (cards []GiftCard, err error) {
+	rows, err := q.Query(`SELECT Id, Code, Initial, Balance, Sale_id, Active, Time_stamp
+						  FROM GiftCard
+						  WHERE Sale_id = ?
+						  ORDER BY Id`, sale_id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g GiftCard
+		err = rows.Scan(&g.Id, &g.Code, &g.Initial, &g.Balance, &g.Sale_id,
+			&g.Active, &g.Time_stamp)
+		if err != nil {
+			return
+		}
+		g.Display = FormatGiftCardCode(g.Code)
+
+		cards = append(cards, g)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//cancels the gift cards a sale issued, only if none of them have been spent
+func cancelGiftCards(tx *sql.Tx, sale_id int) (err error) {
+	cards, err := saleGiftCards(tx, sale_id)
+	if err != nil {
+		return
+	}
+
+	for _, g := range cards {
+		if g.Balance != g.Initial {
+			return fmt.Errorf("gift card %s has already been spent", g.Display)
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE GiftCard SET Active = 0, Balance = 0
+					  WHERE Sale_id = ?`, sale_id)
+	return
+}
@@ -0,0 +1,222 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+//the location this server runs at. Beds, exposure schedules, new sessions and
+//door accesses are all for this location
+var localLocation = 1
+
+//SetLocalLocation sets the location this server runs at. A new location's
+//server may not have the location yet, it arrives from head office with the
+//first sync
+func SetLocalLocation(id int) (err error) {
+	if id < 1 {
+		return fmt.Errorf("location %d not valid", id)
+	}
+
+	l, err := FindLocation(id)
+	if err != nil {
+		return
+	}
+	if l.Id == 0 {
+		logger.Warn("location not set up here yet", "location_id", id)
+	}
+
+	localLocation = id
+	return setSyncNode(id)
+}
+
+func LocalLocation() int {
+	return localLocation
+}
+
+//every db has location 1, existing data was moved to it when locations were
+//added
+func ensureDefaultLocation() (err error) {
+	_, err = db.Exec(`INSERT OR IGNORE INTO Location (Id, Name, Address, Active)
+					  VALUES (1, 'Main', '', 1)`)
+	return
+}
+
+func ListLocations() (locations []Location, err error) {
+	defer timeQuery("ListLocations")()
+
+	rows, err := db.Query(`SELECT Id, Name, Address, Active
+						   FROM Location
+						   ORDER BY Id`)
+	if err != nil {
+		logger.Error("query failed", "query", "ListLocations", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l Location
+		err = rows.Scan(&l.Id, &l.Name, &l.Address, &l.Active)
+		if err != nil {
+			return
+		}
+
+		locations = append(locations, l)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//Location with default values if not found, Id will be 0
+func FindLocation(id int) (l Location, err error) {
+	defer timeQuery("FindLocation")()
+
+	err = db.QueryRow(`SELECT Id, Name, Address, Active
+					   FROM Location
+					   WHERE Id = ?`, id).Scan(&l.Id, &l.Name, &l.Address, &l.Active)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindLocation")
+		err = nil
+	}
+
+	return
+}
+
+func UpdateLocation(l Location) (err error) {
+	defer timeQuery("UpdateLocation")()
+
+	_, err = db.Exec(`UPDATE Location
+					  SET Name = ?, Address = ?, Active = ?
+					  WHERE Id = ?`, l.Name, l.Address, l.Active, l.Id)
+	if err != nil {
+		logger.Error("query failed", "query", "UpdateLocation", "err", err)
+	}
+
+	return
+}
+
+//customers can use their home location, and every location while they have
+//a roaming plan, see Account. allowed is false if the customer isn't found
+func CustomerCanUseLocation(cust_id int, location_id int) (allowed bool, err error) {
+	defer timeQuery("CustomerCanUseLocation")()
+
+	var home int
+	var roaming bool
+	err = db.QueryRow(`SELECT Customer.Location_id, `+roamingExpr+`
+					   FROM Customer
+					   LEFT OUTER JOIN Account
+					   ON Account.Customer_id = Customer.Id
+					   WHERE Customer.Id = ?`, time.Now().Unix(), cust_id).Scan(&home,
+		&roaming)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "CustomerCanUseLocation")
+		return false, nil
+	}
+	if err != nil {
+		logger.Error("query failed", "query", "CustomerCanUseLocation", "err", err)
+		return
+	}
+
+	return roaming || home == location_id, nil
+}
+
+//whether a customer roams, for a query joining Customer with Account. Takes
+//now as its one arg
+const roamingExpr = `(Customer.Roaming OR IFNULL(Account.Roaming_until > ?, 0)
+					 OR IFNULL(Account.Roaming_sessions > 0, 0))`
+
+//StartSession records a session. A customer away from their home location
+//who only roams on sessions they bought uses one up
+func StartSession(s Session) (err error) {
+	defer timeQuery("StartSession")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "StartSession", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(`INSERT INTO Session
+						(Bed_num, Customer_id, Session_time, Cancelled, Time_stamp,
+						 Skin_type, Location_id)
+					  VALUES (?, ?, ?, ?, ?, ?, ?)`, s.Bed_num, s.Customer_id,
+		s.Session_time, s.Cancelled, s.Time_stamp, s.Skin_type, s.Location_id)
+	if err != nil {
+		return
+	}
+
+	var uses int
+	err = tx.QueryRow(`SELECT COUNT(*)
+					   FROM Account
+					   JOIN Customer ON Customer.Id = Account.Customer_id
+					   WHERE Customer_id = ? AND Roaming_sessions > 0
+					   AND Roaming_until <= ?
+					   AND Customer.Location_id != ? AND NOT Customer.Roaming`,
+		s.Customer_id, s.Time_stamp, s.Location_id).Scan(&uses)
+	if err != nil {
+		return
+	}
+	if uses > 0 {
+		err = adjustRoaming(tx, s.Customer_id, -1, 0)
+		if err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//roaming is the customer's own, roaming plans they buy are kept apart on
+//their account
+func UpdateCustomerLocation(cust_id int, location_id int, roaming bool) (err error) {
+	defer timeQuery("UpdateCustomerLocation")()
+
+	_, err = db.Exec(`UPDATE Customer
+					  SET Location_id = ?, Roaming = ?
+					  WHERE Id = ?`, location_id, roaming, cust_id)
+	if err != nil {
+		logger.Error("query failed", "query", "UpdateCustomerLocation", "err", err)
+	}
+
+	return
+}
+
+//AddBed adds a bed to the local location numbered after the last one there
+func AddBed(b Bed) (bed_num int, err error) {
+	defer timeQuery("AddBed")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "AddBed", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.QueryRow(`SELECT IFNULL(MAX(Bed_num), 0) + 1
+					   FROM Bed
+					   WHERE Location_id = ?`, localLocation).Scan(&bed_num)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`INSERT INTO Bed (Location_id, Bed_num, Level, Max_time, Name)
+					  VALUES (?, ?, ?, ?, ?)`,
+		localLocation, bed_num, b.Level, b.Max_time, b.Name)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
@@ -0,0 +1,225 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+//prefs the customer has set, kinds and channels they haven't set aren't
+//included
+func NotificationPrefs(cust_id int) (prefs []NotificationPref, err error) {
+	defer timeQuery("NotificationPrefs")()
+
+	rows, err := db.Query(`SELECT Customer_id, Kind, Channel, Enabled
+						   FROM NotificationPref
+						   WHERE Customer_id = ?
+						   ORDER BY Kind, Channel`, cust_id)
+	if err != nil {
+		logger.Error("query failed", "query", "NotificationPrefs", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p NotificationPref
+		err = rows.Scan(&p.Customer_id, &p.Kind, &p.Channel, &p.Enabled)
+		if err != nil {
+			return
+		}
+
+		prefs = append(prefs, p)
+	}
+	err = rows.Err()
+
+	return
+}
+
+func SetNotificationPref(p NotificationPref) (err error) {
+	defer timeQuery("SetNotificationPref")()
+
+	_, err = db.Exec(`INSERT OR REPLACE INTO NotificationPref
+						(Customer_id, Kind, Channel, Enabled)
+					  VALUES (?, ?, ?, ?)`, p.Customer_id, p.Kind, p.Channel, p.Enabled)
+	if err != nil {
+		logger.Error("query failed", "query", "SetNotificationPref", "err", err)
+	}
+
+	return
+}
+
+//QueueMessages adds messages to the outbox to be sent now. A message whose
+//Dedupe_key has been queued before is dropped, so triggers can fire more
+//than once. Returns how many were queued
+func QueueMessages(msgs []Outbox) (queued int, err error) {
+	defer timeQuery("QueueMessages")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "QueueMessages", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	now := time.Now().Unix()
+	for _, m := range msgs {
+		var res sql.Result
+		res, err = tx.Exec(`INSERT OR IGNORE INTO Outbox
+							  (Customer_id, Kind, Channel, Address, Subject, Body, Status,
+							   Attempts, Next_attempt, Last_error, Dedupe_key, Created,
+							   Sent_at)
+							VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, '', ?, ?, 0)`,
+			m.Customer_id, m.Kind, m.Channel, m.Address, m.Subject, m.Body,
+			OutboxPending, now, m.Dedupe_key, now)
+		if err != nil {
+			return
+		}
+
+		n, _ := res.RowsAffected()
+		queued += int(n)
+	}
+
+	err = tx.Commit()
+	return
+}
+
+const outboxColumns = `Id, Customer_id, Kind, Channel, Address, Subject, Body, Status,
+					   Attempts, Next_attempt, Last_error, Dedupe_key, Created, Sent_at`
+
+func scanOutbox(rows *sql.Rows) (msgs []Outbox, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		var m Outbox
+		err = rows.Scan(&m.Id, &m.Customer_id, &m.Kind, &m.Channel, &m.Address,
+			&m.Subject, &m.Body, &m.Status, &m.Attempts, &m.Next_attempt,
+			&m.Last_error, &m.Dedupe_key, &m.Created, &m.Sent_at)
+		if err != nil {
+			return
+		}
+
+		msgs = append(msgs, m)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//pending messages whose next attempt is due at now, oldest first
+func DueMessages(now int64, limit int) (msgs []Outbox, err error) {
+	defer timeQuery("DueMessages")()
+
+	rows, err := db.Query(`SELECT `+outboxColumns+`
+						   FROM Outbox
+						   WHERE Status = ? AND Next_attempt <= ?
+						   ORDER BY Next_attempt, Id
+						   LIMIT ?`, OutboxPending, now, limit)
+	if err != nil {
+		logger.Error("query failed", "query", "DueMessages", "err", err)
+		return
+	}
+
+	return scanOutbox(rows)
+}
+
+//most recent first, blank status and 0 cust_id mean all
+func ListOutbox(status string, cust_id int, limit int) (msgs []Outbox, err error) {
+	defer timeQuery("ListOutbox")()
+
+	rows, err := db.Query(`SELECT `+outboxColumns+`
+						   FROM Outbox
+						   WHERE (Status = ? OR ? = '')
+						   AND (Customer_id = ? OR ? = 0)
+						   ORDER BY Id DESC
+						   LIMIT ?`, status, status, cust_id, cust_id, limit)
+	if err != nil {
+		logger.Error("query failed", "query", "ListOutbox", "err", err)
+		return
+	}
+
+	return scanOutbox(rows)
+}
+
+func MarkMessageSent(id int, attempts int) (err error) {
+	defer timeQuery("MarkMessageSent")()
+
+	_, err = db.Exec(`UPDATE Outbox SET Status = ?, Attempts = ?, Sent_at = ?,
+					    Last_error = ''
+					  WHERE Id = ?`, OutboxSent, attempts, time.Now().Unix(), id)
+	if err != nil {
+		logger.Error("query failed", "query", "MarkMessageSent", "err", err)
+	}
+
+	return
+}
+
+//records a failed send, the message is tried again at next. A next of 0
+//means retries have run out and the message is marked failed
+func MarkMessageFailed(id int, attempts int, next int64, reason string) (err error) {
+	defer timeQuery("MarkMessageFailed")()
+
+	status := OutboxPending
+	if next == 0 {
+		status = OutboxFailed
+	}
+
+	_, err = db.Exec(`UPDATE Outbox SET Status = ?, Attempts = ?, Next_attempt = ?,
+					    Last_error = ?
+					  WHERE Id = ?`, status, attempts, next, reason, id)
+	if err != nil {
+		logger.Error("query failed", "query", "MarkMessageFailed", "err", err)
+	}
+
+	return
+}
+
+//puts a failed message back in the queue to be sent now
+func RequeueMessage(id int) (err error) {
+	defer timeQuery("RequeueMessage")()
+
+	_, err = db.Exec(`UPDATE Outbox SET Status = ?, Next_attempt = ?
+					  WHERE Id = ? AND Status = ?`,
+		OutboxPending, time.Now().Unix(), id, OutboxFailed)
+	if err != nil {
+		logger.Error("query failed", "query", "RequeueMessage", "err", err)
+	}
+
+	return
+}
+
+//accounts whose membership runs out from from (inclusive) to to
+//(exclusive). Customers on recurring billing are left out since they renew
+//automatically
+func ExpiringMemberships(from int64, to int64) (accounts []Account, err error) {
+	defer timeQuery("ExpiringMemberships")()
+
+	rows, err := db.Query(`SELECT Account.Customer_id, Balance, Sessions, Member_until
+						   FROM Account
+						   LEFT OUTER JOIN BillingCycle
+						   ON BillingCycle.Customer_id = Account.Customer_id
+						   AND BillingCycle.Status IN (?, ?)
+						   WHERE Member_until >= ? AND Member_until < ?
+						   AND BillingCycle.Customer_id IS NULL`,
+		BillingActive, BillingPastDue, from, to)
+	if err != nil {
+		logger.Error("query failed", "query", "ExpiringMemberships", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Account
+		err = rows.Scan(&a.Customer_id, &a.Balance, &a.Sessions, &a.Member_until)
+		if err != nil {
+			return
+		}
+
+		accounts = append(accounts, a)
+	}
+	err = rows.Err()
+
+	return
+}
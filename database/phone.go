@@ -0,0 +1,154 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+//numbers without a country code are taken to be US numbers
+const defaultCountryCode = "1"
+
+//NormalizePhone turns a phone number as typed at the desk, e.g. 770-949-1622
+//or (770) 949.1622, into E.164 (+17709491622). Numbers starting with + keep
+//their country code, anything else must be a 10 digit US number with or
+//without the leading 1
+func NormalizePhone(raw string) (phone string, err error) {
+	international := strings.HasPrefix(strings.TrimSpace(raw), "+")
+
+	var digits strings.Builder
+	for _, r := range raw {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' || r == '-' || r == '.' || r == '(' || r == ')' || r == ' ':
+		default:
+			return "", fmt.Errorf("%q isn't a phone number", raw)
+		}
+	}
+	d := digits.String()
+
+	if international {
+		//E.164 allows up to 15 digits including the country code
+		if len(d) < 8 || len(d) > 15 || d[0] == '0' {
+			return "", fmt.Errorf("%q isn't a phone number", raw)
+		}
+		return "+" + d, nil
+	}
+
+	if len(d) == 11 && strings.HasPrefix(d, defaultCountryCode) {
+		d = d[1:]
+	}
+
+	//US area codes and exchanges can't start with 0 or 1
+	if len(d) != 10 || d[0] < '2' || d[3] < '2' {
+		return "", fmt.Errorf("%q isn't a 10 digit phone number", raw)
+	}
+
+	return "+" + defaultCountryCode + d, nil
+}
+
+//FindCustomersByPhone looks a customer up by their whole phone number, in any
+//format NormalizePhone takes, or by its last 4 digits, which can match more
+//than one customer
+func FindCustomersByPhone(phone string) (customers []Customer, err error) {
+	defer timeQuery("FindCustomersByPhone")()
+
+	var rows *sql.Rows
+	if isLastFour(phone) {
+		rows, err = db.Query(`SELECT Id, Name, Phone, Status, Level
+							  FROM Customer
+							  WHERE substr(Phone, -4) = ?
+							  ORDER BY Name`, phone)
+	} else {
+		var normalized string
+		normalized, err = NormalizePhone(phone)
+		if err != nil {
+			return
+		}
+
+		rows, err = db.Query(`SELECT Id, Name, Phone, Status, Level
+							  FROM Customer
+							  WHERE Phone = ?
+							  ORDER BY Name`, normalized)
+	}
+	if err != nil {
+		logger.Error("query failed", "query", "FindCustomersByPhone", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Customer
+		err = rows.Scan(&c.Id, &c.Name, &c.Phone, &c.Status, &c.Level)
+		if err != nil {
+			return
+		}
+
+		customers = append(customers, c)
+	}
+	err = rows.Err()
+
+	return
+}
+
+func isLastFour(s string) bool {
+	if len(s) != 4 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//migration that rewrites the free text phone numbers already stored in E.164.
+//Numbers that can't be understood are left alone and logged so they can be
+//fixed by hand
+func normalizePhones(tx *sql.Tx) (err error) {
+	rows, err := tx.Query(`SELECT Id, Phone FROM Customer`)
+	if err != nil {
+		return
+	}
+
+	phones := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var phone string
+		err = rows.Scan(&id, &phone)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		phones[id] = phone
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return
+	}
+
+	for id, phone := range phones {
+		if phone == "" {
+			continue
+		}
+
+		normalized, nerr := NormalizePhone(phone)
+		if nerr != nil {
+			logger.Warn("phone number not normalized", "customer_id", id, "phone", phone)
+			continue
+		}
+		if normalized == phone {
+			continue
+		}
+
+		_, err = tx.Exec(`UPDATE Customer SET Phone = ? WHERE Id = ?`, normalized, id)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,695 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const secondsPerDay = 24 * 60 * 60
+
+//DrawerReport totals the sales rung up in a time range, for closing out the
+//cash drawer at the end of the day
+type DrawerReport struct {
+	Sales        int            //sales not voided
+	Total        int            //cents, sales not voided
+	ByMethod     map[string]int //cents paid by payment method, voided sales left out
+	Voided       int
+	VoidedTotal  int //cents
+	SessionPacks int //session packs and memberships sold
+	Discounts    int //cents taken off by promotions, sales not voided
+	GiftCards    int //cents of gift cards sold, sales not voided
+}
+
+func ListProducts(activeOnly bool) (products []Product, err error) {
+	defer timeQuery("ListProducts")()
+
+	rows, err := db.Query(`SELECT Id, Name, Kind, Price, Sessions, Days, Active,
+						     Roaming
+						   FROM Product
+						   WHERE Active = 1 OR ? = 0
+						   ORDER BY Name`, activeOnly)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Product
+		err = rows.Scan(&p.Id, &p.Name, &p.Kind, &p.Price, &p.Sessions, &p.Days,
+			&p.Active, &p.Roaming)
+		if err != nil {
+			return
+		}
+
+		products = append(products, p)
+	}
+	err = rows.Err()
+
+	return
+}
+
+func UpdateProduct(p Product) (err error) {
+	defer timeQuery("UpdateProduct")()
+
+	_, err = db.Exec(`UPDATE Product
+					  SET Name = ?, Kind = ?, Price = ?, Sessions = ?, Days = ?,
+					    Active = ?, Roaming = ?
+					  WHERE Product.Id = ?`,
+		p.Name, p.Kind, p.Price, p.Sessions, p.Days, p.Active, p.Roaming, p.Id)
+	if err != nil {
+		logger.Error("query failed", "query", "UpdateProduct", "err", err)
+	}
+
+	return
+}
+
+//Account with zero values if the customer has never bought anything
+func FindAccount(cust_id int) (a Account, err error) {
+	defer timeQuery("FindAccount")()
+
+	a.Customer_id = cust_id
+	err = db.QueryRow(`SELECT Balance, Sessions, Member_until, Roaming_sessions,
+						 Roaming_until
+					   FROM Account
+					   WHERE Account.Customer_id = ?`, cust_id).Scan(&a.Balance,
+		&a.Sessions, &a.Member_until, &a.Roaming_sessions, &a.Roaming_until)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindAccount")
+		err = nil
+	}
+
+	return
+}
+
+//makes sure the customer has an Account row so it can be updated
+func ensureAccount(tx *sql.Tx, cust_id int) (err error) {
+	_, err = tx.Exec(`INSERT OR IGNORE INTO Account
+						(Customer_id, Balance, Sessions, Member_until, Roaming_sessions,
+						 Roaming_until)
+					  VALUES (?, 0, 0, 0, 0, 0)`, cust_id)
+	return
+}
+
+//changes a customer's account by the given amounts, sign included
+func adjustAccount(tx *sql.Tx, cust_id int, balance int, sessions int, days int) (err error) {
+	return addAccountEntry(tx, AccountEntry{Customer_id: cust_id, Balance: balance,
+		Sessions: sessions, Member_secs: int64(days) * secondsPerDay})
+}
+
+//changes the roaming sessions and days on a customer's account, sign
+//included. Days work like membership days
+func adjustRoaming(tx *sql.Tx, cust_id int, sessions int, days int) (err error) {
+	return addAccountEntry(tx, AccountEntry{Customer_id: cust_id,
+		Roaming_sessions: sessions, Roaming_secs: int64(days) * secondsPerDay})
+}
+
+func addAccountEntry(tx *sql.Tx, e AccountEntry) (err error) {
+	expr, args := blockIdExpr("AccountEntry")
+	_, err = tx.Exec(`INSERT INTO AccountEntry
+						(Id, Customer_id, Balance, Sessions, Member_secs, Roaming_sessions,
+						 Roaming_secs, Time_stamp)
+					  VALUES (`+expr+`, ?, ?, ?, ?, ?, ?, ?)`, append(args, e.Customer_id,
+		e.Balance, e.Sessions, e.Member_secs, e.Roaming_sessions, e.Roaming_secs,
+		time.Now().Unix())...)
+	if err != nil {
+		return
+	}
+
+	return rebuildAccount(tx, e.Customer_id)
+}
+
+//adds up the customer's entries, oldest first, into their Account. Time is
+//added on to the end of the current membership, or from the entry's time if
+//it has lapsed. Taking time away only takes from the end. Every location gets
+//the same total from the same entries whatever order they came in
+func rebuildAccount(tx *sql.Tx, cust_id int) (err error) {
+	rows, err := tx.Query(`SELECT Balance, Sessions, Member_secs, Roaming_sessions,
+							 Roaming_secs, Time_stamp
+						   FROM AccountEntry
+						   WHERE Customer_id = ?
+						   ORDER BY Time_stamp, Id`, cust_id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	extend := func(until int64, secs int64, at int64) int64 {
+		if secs > 0 && until < at {
+			return at + secs
+		}
+		return until + secs
+	}
+
+	a := Account{Customer_id: cust_id}
+	for rows.Next() {
+		var e AccountEntry
+		err = rows.Scan(&e.Balance, &e.Sessions, &e.Member_secs, &e.Roaming_sessions,
+			&e.Roaming_secs, &e.Time_stamp)
+		if err != nil {
+			return
+		}
+
+		a.Balance += e.Balance
+		a.Sessions += e.Sessions
+		a.Member_until = extend(a.Member_until, e.Member_secs, e.Time_stamp)
+		a.Roaming_sessions += e.Roaming_sessions
+		a.Roaming_until = extend(a.Roaming_until, e.Roaming_secs, e.Time_stamp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO Account
+						(Customer_id, Balance, Sessions, Member_until, Roaming_sessions,
+						 Roaming_until)
+					  VALUES (?, ?, ?, ?, ?, ?)`, a.Customer_id, a.Balance, a.Sessions,
+		a.Member_until, a.Roaming_sessions, a.Roaming_until)
+	return
+}
+
+//rebuildAccount for the customer an entry synced from another location is for
+func rebuildEntryAccount(tx *sql.Tx, id int64) (err error) {
+	var cust_id int
+	err = tx.QueryRow(`SELECT Customer_id FROM AccountEntry WHERE Id = ?`, id).Scan(&cust_id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	return rebuildAccount(tx, cust_id)
+}
+
+//what the sale will cost at current prices after the promotion, used to work
+//out change before the sale is rung up
+func PriceSale(s Sale) (total int, err error) {
+	defer timeQuery("PriceSale")()
+
+	_, err = priceLines(db, &s)
+	if err != nil {
+		return
+	}
+
+	err = applyPromotion(db, &s, time.Now().Unix())
+	return s.Total, err
+}
+
+//fills in the prices of the lines and the sale total from the products, which
+//are returned in line order
+func priceLines(q queryer, s *Sale) (products []Product, err error) {
+	s.Total = 0
+	for i := range s.Lines {
+		var p Product
+		err = q.QueryRow(`SELECT Id, Name, Kind, Price, Sessions, Days, Active,
+						    Roaming
+						  FROM Product
+						  WHERE Product.Id = ?`, s.Lines[i].Product_id).Scan(&p.Id,
+			&p.Name, &p.Kind, &p.Price, &p.Sessions, &p.Days, &p.Active, &p.Roaming)
+		if err == sql.ErrNoRows || (err == nil && !p.Active) {
+			err = fmt.Errorf("product %d not for sale", s.Lines[i].Product_id)
+		}
+		if err != nil {
+			return
+		}
+
+		if s.Lines[i].Quantity < 1 {
+			err = fmt.Errorf("quantity of %s must be at least 1", p.Name)
+			return
+		}
+
+		if p.Kind != KindRetail && p.Kind != KindGiftCard && s.Customer_id == 0 {
+			err = fmt.Errorf("%s can only be sold to a customer", p.Name)
+			return
+		}
+
+		s.Lines[i].Unit_price = p.Price
+		s.Lines[i].Amount = p.Price * s.Lines[i].Quantity
+		s.Lines[i].Name = p.Name
+		s.Lines[i].Kind = p.Kind
+		s.Lines[i].Sessions, s.Lines[i].Days, s.Lines[i].Roaming = lineCredits(p)
+		s.Total += s.Lines[i].Amount
+
+		products = append(products, p)
+	}
+
+	return
+}
+
+//CreateSale rings up a sale in one transaction. Only Product_id and Quantity
+//need to be set on the lines, prices come from the products. Payments must
+//add up to the total. Session packs, memberships and account credit are added
+//to the customer's account and account payments are taken out of it
+func CreateSale(s Sale) (id int, err error) {
+	defer timeQuery("CreateSale")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "CreateSale", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	products, err := priceLines(tx, &s)
+	if err != nil {
+		return
+	}
+
+	err = applyPromotion(tx, &s, time.Now().Unix())
+	if err != nil {
+		return
+	}
+
+	for i, p := range products {
+		var reinstated bool
+		reinstated, err = creditLine(tx, s.Customer_id, p, s.Lines[i])
+		if err != nil {
+			return
+		}
+		s.Reinstated = s.Reinstated || reinstated
+	}
+
+	paid := 0
+	for _, p := range s.Payments {
+		paid += p.Amount
+	}
+	if paid != s.Total {
+		err = fmt.Errorf("payments of %d don't match the total of %d", paid, s.Total)
+		return
+	}
+
+	id, err = insertSale(tx, s)
+	if err != nil {
+		return
+	}
+
+	for i, l := range s.Lines {
+		if products[i].Kind != KindGiftCard {
+			continue
+		}
+		for n := 0; n < l.Quantity; n++ {
+			_, err = issueGiftCard(tx, l.Unit_price, id)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//the sessions and days one of p adds to an account, and whether they can be
+//used at every location
+func lineCredits(p Product) (sessions int, days int, roaming bool) {
+	switch p.Kind {
+	case KindSessionPack:
+		return p.Sessions, 0, p.Roaming
+	case KindMembership:
+		return 0, p.Days, p.Roaming
+	}
+	return 0, 0, false
+}
+
+//adds what the line bought of p to the customer's account. The line's Amount
+//is what was paid, which is the credit for account credit. reinstated is true
+//if a membership lifted a billing suspension
+func creditLine(tx *sql.Tx, cust_id int, p Product, l SaleLine) (reinstated bool, err error) {
+	switch p.Kind {
+	case KindSessionPack:
+		err = adjustAccount(tx, cust_id, 0, l.Sessions*l.Quantity, 0)
+	case KindMembership:
+		err = adjustAccount(tx, cust_id, 0, 0, l.Days*l.Quantity)
+		if err == nil {
+			//members can tan, billing suspends them again if a payment fails.
+			//Status is staff's and is left alone
+			var res sql.Result
+			res, err = tx.Exec(`UPDATE Customer SET Billing_suspended = 0
+								WHERE Customer.Id = ? AND Billing_suspended = 1`, cust_id)
+			if err == nil {
+				n, _ := res.RowsAffected()
+				reinstated = n > 0
+			}
+		}
+	case KindCredit:
+		err = adjustAccount(tx, cust_id, l.Amount, 0, 0)
+	}
+
+	//a roaming plan lets the customer tan at every location while it lasts
+	if err == nil && l.Roaming {
+		err = adjustRoaming(tx, cust_id, l.Sessions*l.Quantity, l.Days*l.Quantity)
+	}
+
+	return
+}
+
+//inserts a priced sale with its lines and payments, taking the payments
+func insertSale(tx *sql.Tx, s Sale) (id int, err error) {
+	s.Time_stamp = time.Now().Unix()
+	res, err := tx.Exec(`INSERT INTO Sale
+						   (Customer_id, Total, Discount, Promotion_id, Voided,
+						    Void_reason, Time_stamp, Reinstated)
+						 VALUES (?, ?, ?, ?, 0, '', ?, ?)`, s.Customer_id, s.Total,
+		s.Discount, s.Promotion_id, s.Time_stamp, s.Reinstated)
+	if err != nil {
+		return
+	}
+	saleId, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	id = int(saleId)
+
+	for _, l := range s.Lines {
+		_, err = tx.Exec(`INSERT INTO SaleLine
+							(Sale_id, Product_id, Quantity, Unit_price, Amount,
+							 Sessions, Days, Roaming)
+						  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, l.Product_id, l.Quantity, l.Unit_price, l.Amount, l.Sessions, l.Days,
+			l.Roaming)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, p := range s.Payments {
+		err = takePayment(tx, s.Customer_id, p)
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec(`INSERT INTO Payment
+							(Sale_id, Method, Amount, Reference, Time_stamp)
+						  VALUES (?, ?, ?, ?, ?)`,
+			id, p.Method, p.Amount, p.Reference, s.Time_stamp)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+//side effects of a payment method, e.g. taking money out of the account
+func takePayment(tx *sql.Tx, cust_id int, p Payment) (err error) {
+	switch p.Method {
+	case MethodCash, MethodCard:
+		return
+	case MethodGiftCard:
+		return chargeGiftCard(tx, p.Reference, p.Amount)
+	case MethodAccount:
+		if cust_id == 0 {
+			return errors.New("walk in customers don't have an account")
+		}
+
+		err = ensureAccount(tx, cust_id)
+		if err != nil {
+			return
+		}
+
+		var balance int
+		err = tx.QueryRow(`SELECT Balance FROM Account WHERE Customer_id = ?`,
+			cust_id).Scan(&balance)
+		if err != nil {
+			return
+		}
+		if balance < p.Amount {
+			return fmt.Errorf("account balance of %d is less than %d", balance, p.Amount)
+		}
+
+		return adjustAccount(tx, cust_id, -p.Amount, 0, 0)
+	}
+
+	return fmt.Errorf("unknown payment method %q", p.Method)
+}
+
+//undoes what paying with a method did
+func refundPayment(tx *sql.Tx, cust_id int, p Payment) (err error) {
+	switch p.Method {
+	case MethodAccount:
+		return adjustAccount(tx, cust_id, p.Amount, 0, 0)
+	case MethodGiftCard:
+		return chargeGiftCard(tx, p.Reference, -p.Amount)
+	}
+
+	return
+}
+
+//Sale with its lines and payments, Id is 0 if not found
+func FindSale(id int) (s Sale, err error) {
+	defer timeQuery("FindSale")()
+
+	err = db.QueryRow(`SELECT Id, Customer_id, Total, Discount, Promotion_id, Voided,
+						 Void_reason, Time_stamp
+					   FROM Sale
+					   WHERE Sale.Id = ?`, id).Scan(&s.Id, &s.Customer_id, &s.Total,
+		&s.Discount, &s.Promotion_id, &s.Voided, &s.Void_reason, &s.Time_stamp)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindSale")
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	s.Lines, err = saleLines(db, id)
+	if err != nil {
+		return
+	}
+
+	s.Payments, err = salePayments(db, id)
+	if err != nil {
+		return
+	}
+
+	s.Gift_cards, err = saleGiftCards(db, id)
+	return
+}
+
+//lets the sale queries run on the db or inside a transaction
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func saleLines(q queryer, sale_id int) (lines []SaleLine, err error) {
+	rows, err := q.Query(`SELECT SaleLine.Id, Sale_id, Product_id, Quantity,
+							Unit_price, Amount, SaleLine.Sessions, SaleLine.Days,
+							SaleLine.Roaming, Product.Name, Product.Kind
+						  FROM SaleLine
+						  INNER JOIN Product
+						  ON SaleLine.Product_id = Product.Id
+						  WHERE SaleLine.Sale_id = ?`, sale_id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l SaleLine
+		err = rows.Scan(&l.Id, &l.Sale_id, &l.Product_id, &l.Quantity,
+			&l.Unit_price, &l.Amount, &l.Sessions, &l.Days, &l.Roaming, &l.Name, &l.Kind)
+		if err != nil {
+			return
+		}
+
+		lines = append(lines, l)
+	}
+	err = rows.Err()
+
+	return
+}
+
+func salePayments(q queryer, sale_id int) (payments []Payment, err error) {
+	rows, err := q.Query(`SELECT Id, Sale_id, Method, Amount, Reference, Time_stamp
+						  FROM Payment
+						  WHERE Payment.Sale_id = ?`, sale_id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Payment
+		err = rows.Scan(&p.Id, &p.Sale_id, &p.Method, &p.Amount, &p.Reference,
+			&p.Time_stamp)
+		if err != nil {
+			return
+		}
+
+		payments = append(payments, p)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//VoidSale marks a sale voided and takes back what it added to the customer's
+//account. Account and gift card payments go back onto the account or card,
+//cash and card refunds are handled at the register. Gift cards the sale
+//issued are cancelled, which fails if they have been spent
+func VoidSale(id int, reason string) (err error) {
+	defer timeQuery("VoidSale")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "VoidSale", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	var cust_id int
+	var voided, reinstated bool
+	err = tx.QueryRow(`SELECT Customer_id, Voided, Reinstated FROM Sale WHERE Sale.Id = ?`,
+		id).Scan(&cust_id, &voided, &reinstated)
+	if err == sql.ErrNoRows {
+		err = errors.New("sale not found")
+	}
+	if err != nil {
+		return
+	}
+	if voided {
+		err = errors.New("sale already voided")
+		return
+	}
+
+	lines, err := saleLines(tx, id)
+	if err != nil {
+		return
+	}
+
+	//takes back what the lines added when they were sold, even if the
+	//products have changed since
+	for _, l := range lines {
+		if l.Kind == KindCredit {
+			err = adjustAccount(tx, cust_id, -l.Amount, 0, 0)
+		} else if l.Sessions != 0 || l.Days != 0 {
+			err = adjustAccount(tx, cust_id, 0, -l.Sessions*l.Quantity, -l.Days*l.Quantity)
+		}
+		if err == nil && l.Roaming {
+			err = adjustRoaming(tx, cust_id, -l.Sessions*l.Quantity, -l.Days*l.Quantity)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	//a membership that lifted a billing suspension puts it back once there's
+	//no membership time left
+	if reinstated {
+		_, err = tx.Exec(`UPDATE Customer SET Billing_suspended = 1
+						  WHERE Customer.Id = ?
+						  AND (SELECT Member_until FROM Account
+							   WHERE Account.Customer_id = Customer.Id) <= ?`,
+			cust_id, time.Now().Unix())
+		if err != nil {
+			return
+		}
+	}
+
+	err = cancelGiftCards(tx, id)
+	if err != nil {
+		return
+	}
+
+	payments, err := salePayments(tx, id)
+	if err != nil {
+		return
+	}
+
+	for _, p := range payments {
+		err = refundPayment(tx, cust_id, p)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE Sale SET Voided = 1, Void_reason = ?
+					  WHERE Sale.Id = ?`, reason, id)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//totals for sales rung up from from (inclusive) to to (exclusive)
+func CashDrawer(from int64, to int64) (r DrawerReport, err error) {
+	defer timeQuery("CashDrawer")()
+
+	err = db.QueryRow(`SELECT IFNULL(SUM(Voided = 0), 0),
+						 IFNULL(SUM(CASE WHEN Voided = 0 THEN Total ELSE 0 END), 0),
+						 IFNULL(SUM(Voided = 1), 0),
+						 IFNULL(SUM(CASE WHEN Voided = 1 THEN Total ELSE 0 END), 0),
+						 IFNULL(SUM(CASE WHEN Voided = 0 THEN Discount ELSE 0 END), 0)
+					   FROM Sale
+					   WHERE Time_stamp >= ? AND Time_stamp < ?`, from, to).Scan(
+		&r.Sales, &r.Total, &r.Voided, &r.VoidedTotal, &r.Discounts)
+	if err != nil {
+		return
+	}
+
+	err = db.QueryRow(`SELECT IFNULL(SUM(SaleLine.Quantity), 0)
+					   FROM SaleLine
+					   INNER JOIN Sale ON SaleLine.Sale_id = Sale.Id
+					   INNER JOIN Product ON SaleLine.Product_id = Product.Id
+					   WHERE Sale.Voided = 0
+					   AND Product.Kind IN (?, ?)
+					   AND Sale.Time_stamp >= ? AND Sale.Time_stamp < ?`,
+		KindSessionPack, KindMembership, from, to).Scan(&r.SessionPacks)
+	if err != nil {
+		return
+	}
+
+	err = db.QueryRow(`SELECT IFNULL(SUM(SaleLine.Amount), 0)
+					   FROM SaleLine
+					   INNER JOIN Sale ON SaleLine.Sale_id = Sale.Id
+					   INNER JOIN Product ON SaleLine.Product_id = Product.Id
+					   WHERE Sale.Voided = 0
+					   AND Product.Kind = ?
+					   AND Sale.Time_stamp >= ? AND Sale.Time_stamp < ?`,
+		KindGiftCard, from, to).Scan(&r.GiftCards)
+	if err != nil {
+		return
+	}
+
+	rows, err := db.Query(`SELECT Method, SUM(Amount)
+						   FROM Payment
+						   INNER JOIN Sale ON Payment.Sale_id = Sale.Id
+						   WHERE Sale.Voided = 0
+						   AND Sale.Time_stamp >= ? AND Sale.Time_stamp < ?
+						   GROUP BY Method`, from, to)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	r.ByMethod = make(map[string]int)
+	for rows.Next() {
+		var method string
+		var amount int
+		err = rows.Scan(&method, &amount)
+		if err != nil {
+			return
+		}
+
+		r.ByMethod[method] = amount
+	}
+	err = rows.Err()
+
+	return
+}
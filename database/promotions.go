@@ -0,0 +1,193 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const promotionColumns = `Id, Code, Name, Percent_off, Amount_off, Product_id,
+						  Max_quantity, Starts, Ends, Max_uses, Max_uses_per_customer,
+						  New_customers_only, Active`
+
+func scanPromotion(row interface{ Scan(...interface{}) error }, p *Promotion) error {
+	return row.Scan(&p.Id, &p.Code, &p.Name, &p.Percent_off, &p.Amount_off,
+		&p.Product_id, &p.Max_quantity, &p.Starts, &p.Ends, &p.Max_uses,
+		&p.Max_uses_per_customer, &p.New_customers_only, &p.Active)
+}
+
+//every promotion with how many times it has been used, newest first
+func ListPromotions() (promotions []Promotion, err error) {
+	defer timeQuery("ListPromotions")()
+
+	rows, err := db.Query(`SELECT ` + promotionColumns + `
+						   FROM Promotion
+						   ORDER BY Id DESC`)
+	if err != nil {
+		logger.Error("query failed", "query", "ListPromotions", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Promotion
+		err = scanPromotion(rows, &p)
+		if err != nil {
+			return
+		}
+
+		promotions = append(promotions, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	for i := range promotions {
+		promotions[i].Uses, err = promotionUses(db, promotions[i].Id, 0)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func UpdatePromotion(p Promotion) (err error) {
+	defer timeQuery("UpdatePromotion")()
+
+	_, err = db.Exec(`UPDATE Promotion
+					  SET Code = ?, Name = ?, Percent_off = ?, Amount_off = ?,
+					    Product_id = ?, Max_quantity = ?, Starts = ?, Ends = ?,
+					    Max_uses = ?, Max_uses_per_customer = ?,
+					    New_customers_only = ?, Active = ?
+					  WHERE Promotion.Id = ?`,
+		p.Code, p.Name, p.Percent_off, p.Amount_off, p.Product_id, p.Max_quantity,
+		p.Starts, p.Ends, p.Max_uses, p.Max_uses_per_customer, p.New_customers_only,
+		p.Active, p.Id)
+	if err != nil {
+		logger.Error("query failed", "query", "UpdatePromotion", "err", err)
+	}
+
+	return
+}
+
+//sales that weren't voided, for one customer unless cust_id is 0
+func promotionUses(q queryer, promo_id int, cust_id int) (uses int, err error) {
+	err = q.QueryRow(`SELECT COUNT(*)
+					  FROM Sale
+					  WHERE Promotion_id = ? AND Voided = 0
+					  AND (Customer_id = ? OR ? = 0)`,
+		promo_id, cust_id, cust_id).Scan(&uses)
+	return
+}
+
+//new customers haven't bought anything or tanned yet
+func isNewCustomer(q queryer, cust_id int) (isNew bool, err error) {
+	var history int
+	err = q.QueryRow(`SELECT (SELECT COUNT(*) FROM Sale
+							  WHERE Customer_id = ? AND Voided = 0) +
+							 (SELECT COUNT(*) FROM Session
+							  WHERE Customer_id = ? AND Cancelled = 0)`,
+		cust_id, cust_id).Scan(&history)
+
+	return history == 0, err
+}
+
+//checks the sale's promotion code and takes the discount off the priced
+//sale. Account credit and gift cards are never discounted since they are as
+//good as cash. Does nothing if there is no code
+func applyPromotion(q queryer, s *Sale, now int64) (err error) {
+	s.Discount = 0
+	s.Promotion_id = 0
+	if s.Promotion_code == "" {
+		return
+	}
+
+	var p Promotion
+	err = scanPromotion(q.QueryRow(`SELECT `+promotionColumns+`
+									FROM Promotion
+									WHERE Code = ?`, NormalizeCode(s.Promotion_code)), &p)
+	if err == sql.ErrNoRows || (err == nil && !p.Active) {
+		err = fmt.Errorf("promotion %q not found", s.Promotion_code)
+	}
+	if err != nil {
+		return
+	}
+
+	if p.Starts != 0 && now < p.Starts {
+		return fmt.Errorf("promotion %s hasn't started yet", p.Code)
+	}
+	if p.Ends != 0 && now >= p.Ends {
+		return fmt.Errorf("promotion %s has ended", p.Code)
+	}
+
+	if p.Max_uses > 0 {
+		var uses int
+		uses, err = promotionUses(q, p.Id, 0)
+		if err != nil {
+			return
+		}
+		if uses >= p.Max_uses {
+			return fmt.Errorf("promotion %s has been used up", p.Code)
+		}
+	}
+
+	if (p.Max_uses_per_customer > 0 || p.New_customers_only) && s.Customer_id == 0 {
+		return fmt.Errorf("promotion %s is only for customers", p.Code)
+	}
+
+	if p.Max_uses_per_customer > 0 {
+		var uses int
+		uses, err = promotionUses(q, p.Id, s.Customer_id)
+		if err != nil {
+			return
+		}
+		if uses >= p.Max_uses_per_customer {
+			return fmt.Errorf("customer has already used promotion %s", p.Code)
+		}
+	}
+
+	if p.New_customers_only {
+		var isNew bool
+		isNew, err = isNewCustomer(q, s.Customer_id)
+		if err != nil {
+			return
+		}
+		if !isNew {
+			return fmt.Errorf("promotion %s is only for new customers", p.Code)
+		}
+	}
+
+	//Max_quantity counts units in line order
+	eligible := 0
+	units := 0
+	for _, l := range s.Lines {
+		if l.Kind == KindCredit || l.Kind == KindGiftCard {
+			continue
+		}
+		if p.Product_id != 0 && l.Product_id != p.Product_id {
+			continue
+		}
+
+		n := l.Quantity
+		if p.Max_quantity > 0 && units+n > p.Max_quantity {
+			n = p.Max_quantity - units
+		}
+		units += n
+		eligible += l.Unit_price * n
+	}
+	if eligible == 0 {
+		return fmt.Errorf("promotion %s doesn't apply to anything in the sale", p.Code)
+	}
+
+	discount := eligible*p.Percent_off/100 + p.Amount_off
+	if discount > eligible {
+		discount = eligible
+	}
+
+	s.Discount = discount
+	s.Promotion_id = p.Id
+	s.Total -= discount
+
+	return
+}
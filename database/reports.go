@@ -0,0 +1,367 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const defaultReportLimit = 50
+const maxReportLimit = 500
+
+//ReportFilter narrows and pages the customer list and the door and tan
+//reports. Zero values mean no filter. Filters that don't apply to a report
+//are ignored, e.g. Bed_num on the door report. With no Location_id reports
+//cover every location. Door ids are only unique within a location
+type ReportFilter struct {
+	From        int64 //unix time, inclusive
+	To          int64 //unix time, exclusive
+	Customer_id int
+	Location_id int //the customer's home location on the customer list
+	Bed_num     int
+	Door_id     int
+	Cancelled   *bool
+	Sort        string //one of the keys of the report's sort columns
+	Desc        *bool  //nil for the report's own default
+	Limit       int    //defaults to 50, at most 500
+	Offset      int
+}
+
+//columns each report can be sorted by, keyed by the sort param
+var doorSorts = map[string]string{
+	"time":     "DoorAccess.Time_stamp",
+	"name":     "IFNULL(Customer.Name, Employee.Name)",
+	"location": "DoorAccess.Location_id",
+	"door":     "DoorAccess.Door_id",
+}
+
+var alertSorts = map[string]string{
+	"time": "DoorAlert.Time_stamp",
+	"name": "Customer.Name",
+	"kind": "DoorAlert.Kind",
+}
+
+var tanSorts = map[string]string{
+	"time":         "Session.Time_stamp",
+	"name":         "Customer.Name",
+	"bed":          "Session.Bed_num",
+	"session_time": "Session.Session_time",
+	"location":     "Session.Location_id",
+}
+
+var customerSorts = map[string]string{
+	"id":       "Customer.Id",
+	"name":     "Customer.Name",
+	"level":    "Customer.Level",
+	"status":   "Customer.Status",
+	"location": "Customer.Location_id",
+}
+
+func (f ReportFilter) limit() int {
+	if f.Limit <= 0 {
+		return defaultReportLimit
+	}
+	if f.Limit > maxReportLimit {
+		return maxReportLimit
+	}
+	return f.Limit
+}
+
+//builds the ORDER BY clause, unknown sort keys are an error rather than being
+//put into the sql
+func (f ReportFilter) orderBy(sorts map[string]string, defaultSort string) (string, error) {
+	key := f.Sort
+	if key == "" {
+		key = defaultSort
+	}
+
+	col, ok := sorts[key]
+	if !ok {
+		var keys []string
+		for k := range sorts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return "", fmt.Errorf("can't sort by %q, use one of: %s", key,
+			strings.Join(keys, ", "))
+	}
+
+	dir := "ASC"
+	if f.Desc != nil && *f.Desc {
+		dir = "DESC"
+	}
+
+	//tie break on the first column, the id, so paging is stable
+	return fmt.Sprintf("ORDER BY %s %s, 1 %s", col, dir, dir), nil
+}
+
+//where clauses and their arguments for a report
+type whereBuilder struct {
+	clauses []string
+	args    []interface{}
+}
+
+func (w *whereBuilder) add(clause string, arg interface{}) {
+	w.clauses = append(w.clauses, clause)
+	w.args = append(w.args, arg)
+}
+
+func (w *whereBuilder) String() string {
+	if len(w.clauses) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(w.clauses, " AND ")
+}
+
+//blank column names skip that filter
+func (f ReportFilter) where(timeCol, customerCol, locationCol, bedCol, doorCol,
+	cancelledCol string) *whereBuilder {
+	w := &whereBuilder{}
+
+	if f.From != 0 && timeCol != "" {
+		w.add(timeCol+" >= ?", f.From)
+	}
+	if f.To != 0 && timeCol != "" {
+		w.add(timeCol+" < ?", f.To)
+	}
+	if f.Customer_id != 0 && customerCol != "" {
+		w.add(customerCol+" = ?", f.Customer_id)
+	}
+	if f.Location_id != 0 && locationCol != "" {
+		w.add(locationCol+" = ?", f.Location_id)
+	}
+	if f.Bed_num != 0 && bedCol != "" {
+		w.add(bedCol+" = ?", f.Bed_num)
+	}
+	if f.Door_id != 0 && doorCol != "" {
+		w.add(doorCol+" = ?", f.Door_id)
+	}
+	if f.Cancelled != nil && cancelledCol != "" {
+		w.add(cancelledCol+" = ?", *f.Cancelled)
+	}
+
+	return w
+}
+
+func count(from string, w *whereBuilder) (total int, err error) {
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) %s %s", from, w), w.args...).Scan(&total)
+	return
+}
+
+//page of the customer list plus the number of customers matching the filter
+func ListCustomers(f ReportFilter) (customers []Customer, total int, err error) {
+	defer timeQuery("ListCustomers")()
+
+	order, err := f.orderBy(customerSorts, "name")
+	if err != nil {
+		return
+	}
+
+	from := `FROM Customer`
+	w := f.where("", "Customer.Id", "Customer.Location_id", "", "", "")
+
+	total, err = count(from, w)
+	if err != nil {
+		logger.Error("query failed", "query", "ListCustomers", "err", err)
+		return
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT Id, Name, Phone, Status, Level,
+									     Location_id, Roaming
+									   %s %s %s LIMIT ? OFFSET ?`, from, w, order),
+		append(w.args, f.limit(), f.Offset)...)
+	if err != nil {
+		logger.Error("query failed", "query", "ListCustomers", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Customer
+		err = rows.Scan(&c.Id, &c.Name, &c.Phone, &c.Status, &c.Level,
+			&c.Location_id, &c.Roaming)
+		if err != nil {
+			return
+		}
+
+		customers = append(customers, c)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//page of the door report plus the number of accesses matching the filter.
+//Most recent first unless another sort is given
+func RecentDoorAccesses(f ReportFilter) (doorAccesses []DoorAccess, total int, err error) {
+	defer timeQuery("RecentDoorAccesses")()
+
+	if f.Sort == "" && f.Desc == nil {
+		desc := true
+		f.Desc = &desc
+	}
+	order, err := f.orderBy(doorSorts, "time")
+	if err != nil {
+		return
+	}
+
+	//employees come in through staff doors, they have no customer
+	from := `FROM DoorAccess
+			 LEFT JOIN Customer
+			 ON DoorAccess.Customer_id == Customer.Id
+			 LEFT JOIN Employee
+			 ON DoorAccess.Employee_id == Employee.Id
+			 LEFT JOIN Door
+			 ON DoorAccess.Door_id == Door.Id
+			 AND DoorAccess.Location_id == Door.Location_id`
+	w := f.where("DoorAccess.Time_stamp", "DoorAccess.Customer_id",
+		"DoorAccess.Location_id", "", "DoorAccess.Door_id", "")
+	//accesses by deleted customers and employees are left out
+	w.clauses = append(w.clauses, "(Customer.Id IS NOT NULL OR Employee.Id IS NOT NULL)")
+
+	total, err = count(from, w)
+	if err != nil {
+		logger.Error("query failed", "query", "RecentDoorAccesses", "err", err)
+		return
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT DoorAccess.Id, Customer_id, Employee_id,
+									     IFNULL(Customer.Name, Employee.Name),
+									     Time_stamp, IFNULL(Phone, ''),
+									     DoorAccess.Location_id, Door_id,
+									     IFNULL(Door.Name, ''), Action
+									   %s %s %s LIMIT ? OFFSET ?`, from, w, order),
+		append(w.args, f.limit(), f.Offset)...)
+	if err != nil {
+		logger.Error("query failed", "query", "RecentDoorAccesses", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d DoorAccess
+		err = rows.Scan(&d.Id, &d.Customer_id, &d.Employee_id, &d.Name, &d.Time_stamp,
+			&d.Phone, &d.Location_id, &d.Door_id, &d.Door_name, &d.Action)
+		if err != nil {
+			return
+		}
+
+		d.Local_time, d.Month, d.Day = localTime(d.Time_stamp)
+
+		doorAccesses = append(doorAccesses, d)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//page of the door alerts plus the number matching the filter. Newest first
+//unless another sort is given
+func DoorAlerts(f ReportFilter, unresolvedOnly bool) (alerts []DoorAlert, total int, err error) {
+	defer timeQuery("DoorAlerts")()
+
+	if f.Sort == "" && f.Desc == nil {
+		desc := true
+		f.Desc = &desc
+	}
+	order, err := f.orderBy(alertSorts, "time")
+	if err != nil {
+		return
+	}
+
+	from := `FROM DoorAlert
+			 LEFT JOIN Customer
+			 ON DoorAlert.Customer_id == Customer.Id`
+	w := f.where("DoorAlert.Time_stamp", "DoorAlert.Customer_id", "DoorAlert.Location_id",
+		"", "DoorAlert.Door_id", "")
+	if unresolvedOnly {
+		w.add("DoorAlert.Resolved = ?", false)
+	}
+
+	total, err = count(from, w)
+	if err != nil {
+		logger.Error("query failed", "query", "DoorAlerts", "err", err)
+		return
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT DoorAlert.Id, Customer_id, IFNULL(Name, ''),
+									     DoorAlert.Location_id, Door_id, Kind, Detail,
+									     Denied, Resolved, Time_stamp
+									   %s %s %s LIMIT ? OFFSET ?`, from, w, order),
+		append(w.args, f.limit(), f.Offset)...)
+	if err != nil {
+		logger.Error("query failed", "query", "DoorAlerts", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a DoorAlert
+		err = rows.Scan(&a.Id, &a.Customer_id, &a.Name, &a.Location_id, &a.Door_id,
+			&a.Kind, &a.Detail, &a.Denied, &a.Resolved, &a.Time_stamp)
+		if err != nil {
+			return
+		}
+
+		a.Local_time, a.Month, a.Day = localTime(a.Time_stamp)
+
+		alerts = append(alerts, a)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//page of the tan report plus the number of sessions matching the filter.
+//Most recent first unless another sort is given
+func RecentTanSessions(f ReportFilter) (sessions []Session, total int, err error) {
+	defer timeQuery("RecentTanSessions")()
+
+	if f.Sort == "" && f.Desc == nil {
+		desc := true
+		f.Desc = &desc
+	}
+	order, err := f.orderBy(tanSorts, "time")
+	if err != nil {
+		return
+	}
+
+	from := `FROM Session
+			 INNER JOIN Customer
+			 ON Session.Customer_id == Customer.Id`
+	w := f.where("Session.Time_stamp", "Session.Customer_id", "Session.Location_id",
+		"Session.Bed_num", "", "Session.Cancelled")
+
+	total, err = count(from, w)
+	if err != nil {
+		logger.Error("query failed", "query", "RecentTanSessions", "err", err)
+		return
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT Session.Id, Customer_id, Name, Bed_num,
+									     Cancelled, Time_stamp, Session_time,
+									     Session.Location_id
+									   %s %s %s LIMIT ? OFFSET ?`, from, w, order),
+		append(w.args, f.limit(), f.Offset)...)
+	if err != nil {
+		logger.Error("query failed", "query", "RecentTanSessions", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Session
+		err = rows.Scan(&s.Id, &s.Customer_id, &s.Name, &s.Bed_num, &s.Cancelled,
+			&s.Time_stamp, &s.Session_time, &s.Location_id)
+		if err != nil {
+			return
+		}
+
+		s.Local_time, s.Month, s.Day = localTime(s.Time_stamp)
+
+		sessions = append(sessions, s)
+	}
+	err = rows.Err()
+
+	return
+}
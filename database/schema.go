@@ -1,5 +1,10 @@
 package database
 
+import (
+	"database/sql"
+	"fmt"
+)
+
 //TODO restrict integer sizes
 
 func schema() map[string]string {
@@ -9,33 +14,528 @@ func schema() map[string]string {
 	s["Customer"] = `(Id integer primary key autoincrement,
 	 		 		  Name text not null,
 	 		 		  Phone text not null,
+	 		 		  Email text not null default '',
 			 		  Status boolean not null,
 			 		  Level integer not null,
-			 		  Fob_num integer not null unique)`
+			 		  Fob_num integer not null unique,
+			 		  Location_id integer not null default 1,
+			 		  Roaming boolean not null default 0,
+			 		  Billing_suspended boolean not null default 0)`
 
 	s["Employee"] = `(Id integer primary key autoincrement,
 	 		 		  Name text not null unique,
 			 		  Level integer not null,
-			 		  Fob_num integer not null unique)`
+			 		  Fob_num integer not null unique,
+			 		  Location_id integer not null default 1,
+			 		  Active boolean not null default 1)`
+
+	//a salon, every server runs at one of them. Beds are numbered within
+	//their location
+	s["Location"] = `(Id integer primary key autoincrement,
+					  Name text not null unique,
+					  Address text not null,
+					  Active boolean not null)`
 
 	s["Keyfob"] = `(Fob_num integer primary key,
 					Admin boolean not null)`
 
-	s["Bed"] = `(Bed_num integer primary key,
+	s["Bed"] = `(Location_id integer not null default 1,
+				 Bed_num integer not null,
 				 Level integer not null,
 				 Max_time integer not null,
-				 Name text not null)`
+				 Name text not null,
+				 primary key (Location_id, Bed_num))`
 
 	s["Session"] = `(Id integer primary key,
 					 Bed_num integer not null,
 					 Customer_id integer not null,
 					 Session_time integer not null,
 					 Cancelled boolean not null,
-					 Time_stamp integer not null)`
+					 Time_stamp integer not null,
+					 Skin_type integer not null default 0,
+					 Location_id integer not null default 1)`
+
+	//a door with its own reader, Format is what the reader sends, see
+	//readerproto. Employee taps at a Time_clock door clock them in or out.
+	//Policy is who it opens for, "members" or
+	//"staff". Customers only get in from Opens until Closes, minutes after
+	//midnight, and all day when they're the same. Grant and Deny responses
+	//are the hex bytes sent back to the reader. A locked down door only opens
+	//for owners. Anti-passback: a customer's fob used again within
+	//Min_interval seconds, or more than Max_per_day times a day, is flagged
+	//in DoorAlert and denied if Passback_deny. 0 turns a rule off
+	s["Door"] = `(Id integer primary key autoincrement,
+				  Location_id integer not null default 1,
+				  Name text not null,
+				  Device text not null,
+				  Policy text not null,
+				  Opens integer not null,
+				  Closes integer not null,
+				  Grant_response text not null,
+				  Deny_response text not null,
+				  Active boolean not null,
+				  Lockdown boolean not null default 0,
+				  Min_interval integer not null default 0,
+				  Max_per_day integer not null default 0,
+				  Passback_deny boolean not null default 0,
+				  Format text not null default 'hex',
+				  Time_clock boolean not null default 0)`
 
+	//a fob used suspiciously, e.g. shared between friends. Kind is passback
+	//or max_per_day
+	s["DoorAlert"] = `(Id integer primary key autoincrement,
+					   Customer_id integer not null,
+					   Location_id integer not null,
+					   Door_id integer not null,
+					   Kind text not null,
+					   Detail text not null,
+					   Denied boolean not null,
+					   Resolved boolean not null,
+					   Time_stamp integer not null)`
+
+	//Customer_id is 0 when an employee came in or did something to the door
+	//from the admin api, Employee_id is 0 otherwise. Action is fob for a fob
+	//read, or what the employee did
 	s["DoorAccess"] = `(Id integer primary key,
 						Customer_id integer not null,
-						Time_stamp integer not null)`
+						Time_stamp integer not null,
+						Location_id integer not null default 1,
+						Door_id integer not null default 1,
+						Employee_id integer not null default 0,
+						Action text not null default 'fob')`
+
+	//every consent form a customer has signed, never changed or deleted so
+	//they're kept for as long as the law asks. The latest signed is the
+	//customer's compliance profile
+	s["ConsentRecord"] = `(Id integer primary key autoincrement,
+						   Customer_id integer not null,
+						   Skin_type integer not null,
+						   Consent_signed integer not null,
+						   Consent_version integer not null,
+						   Eye_protection_ack boolean not null,
+						   Minor boolean not null,
+						   Parental_consent boolean not null,
+						   Photosensitizing_meds boolean not null,
+						   Updated integer not null)`
+
+	//max minutes per visit by skin type, from the label on each bed. Visit
+	//numbers start at 1, the highest visit is the maintenance schedule
+	s["ExposureSchedule"] = `(Location_id integer not null default 1,
+							  Bed_num integer not null,
+							  Skin_type integer not null,
+							  Visit integer not null,
+							  Minutes integer not null,
+							  primary key (Location_id, Bed_num, Skin_type, Visit))`
+
+	//point of sale, money is always in cents
+	s["Product"] = `(Id integer primary key autoincrement,
+					 Name text not null unique,
+					 Kind text not null,
+					 Price integer not null,
+					 Sessions integer not null,
+					 Days integer not null,
+					 Active boolean not null,
+					 Roaming boolean not null default 0)`
+
+	s["Sale"] = `(Id integer primary key autoincrement,
+				  Customer_id integer not null,
+				  Total integer not null,
+				  Discount integer not null default 0,
+				  Promotion_id integer not null default 0,
+				  Voided boolean not null,
+				  Void_reason text not null,
+				  Time_stamp integer not null,
+				  Reinstated boolean not null default 0)`
+
+	s["SaleLine"] = `(Id integer primary key autoincrement,
+					  Sale_id integer not null,
+					  Product_id integer not null,
+					  Quantity integer not null,
+					  Unit_price integer not null,
+					  Amount integer not null,
+					  Sessions integer not null default 0,
+					  Days integer not null default 0,
+					  Roaming boolean not null default 0)`
+
+	s["Payment"] = `(Id integer primary key autoincrement,
+					 Sale_id integer not null,
+					 Method text not null,
+					 Amount integer not null,
+					 Reference text not null,
+					 Time_stamp integer not null)`
+
+	//what a customer has prepaid for
+	s["Account"] = `(Customer_id integer primary key,
+					 Balance integer not null,
+					 Sessions integer not null,
+					 Member_until integer not null,
+					 Roaming_sessions integer not null default 0,
+					 Roaming_until integer not null default 0)`
+
+	//every change to an Account, which is their running total
+	s["AccountEntry"] = `(Id integer primary key autoincrement,
+						  Customer_id integer not null,
+						  Balance integer not null,
+						  Sessions integer not null,
+						  Member_secs integer not null,
+						  Roaming_sessions integer not null,
+						  Roaming_secs integer not null,
+						  Time_stamp integer not null)`
+
+	//recurring billing for memberships, Product_id is the membership product
+	//that is sold every cycle
+	s["BillingCycle"] = `(Customer_id integer primary key,
+						  Product_id integer not null,
+						  Next_bill integer not null,
+						  Status text not null,
+						  Created integer not null)`
+
+	s["Invoice"] = `(Id integer primary key autoincrement,
+					 Customer_id integer not null,
+					 Product_id integer not null,
+					 Amount integer not null,
+					 Period_start integer not null,
+					 Period_end integer not null,
+					 Status text not null,
+					 Attempts integer not null,
+					 Next_attempt integer not null,
+					 Last_error text not null,
+					 Sale_id integer not null,
+					 Created integer not null)`
+
+	//codes are stored upper case
+	s["GiftCard"] = `(Id integer primary key autoincrement,
+					  Code text not null unique,
+					  Initial integer not null,
+					  Balance integer not null,
+					  Sale_id integer not null,
+					  Active boolean not null,
+					  Time_stamp integer not null)`
+
+	s["Promotion"] = `(Id integer primary key autoincrement,
+					   Code text not null unique,
+					   Name text not null,
+					   Percent_off integer not null,
+					   Amount_off integer not null,
+					   Product_id integer not null,
+					   Max_quantity integer not null,
+					   Starts integer not null,
+					   Ends integer not null,
+					   Max_uses integer not null,
+					   Max_uses_per_customer integer not null,
+					   New_customers_only boolean not null,
+					   Active boolean not null)`
+
+	//notifications to customers, sent by the notify package
+	s["Outbox"] = `(Id integer primary key autoincrement,
+					Customer_id integer not null,
+					Kind text not null,
+					Channel text not null,
+					Address text not null,
+					Subject text not null,
+					Body text not null,
+					Status text not null,
+					Attempts integer not null,
+					Next_attempt integer not null,
+					Last_error text not null,
+					Dedupe_key text not null unique,
+					Created integer not null,
+					Sent_at integer not null)`
+
+	s["NotificationPref"] = `(Customer_id integer not null,
+							  Kind text not null,
+							  Channel text not null,
+							  Enabled boolean not null,
+							  primary key (Customer_id, Kind, Channel))`
+
+	//an employee's shift, Clock_out is 0 while they're clocked in. Source is
+	//door, desk, or manager for one a manager added
+	s["TimeEntry"] = `(Id integer primary key autoincrement,
+					   Employee_id integer not null,
+					   Location_id integer not null,
+					   Clock_in integer not null,
+					   Clock_out integer not null,
+					   Source text not null)`
+
+	//every change a manager makes to a TimeEntry, the times before and after.
+	//Old times are 0 for an entry the manager added, new times 0 for one they
+	//deleted
+	s["TimeEntryEdit"] = `(Id integer primary key autoincrement,
+						   Time_entry_id integer not null,
+						   Manager_id integer not null,
+						   Old_clock_in integer not null,
+						   Old_clock_out integer not null,
+						   New_clock_in integer not null,
+						   New_clock_out integer not null,
+						   Reason text not null,
+						   Time_stamp integer not null)`
+
+	//sync between locations, see sync.go. One row per changed row, replaced
+	//each time it changes, so it's both the change log and the row versions
+	s["ChangeLog"] = `(Table_name text not null,
+					   Row_key integer not null,
+					   Seq integer not null,
+					   Version integer not null,
+					   Origin integer not null,
+					   Deleted boolean not null,
+					   primary key (Table_name, Row_key))`
+
+	//one row, Applying turns the change log triggers off while remote
+	//changes are written
+	s["SyncState"] = `(Id integer primary key,
+					   Node_id integer not null,
+					   Applying boolean not null)`
+
+	//how far this server has pushed its own changes to and pulled changes
+	//from head office
+	s["SyncCursor"] = `(Peer text primary key,
+						Pushed integer not null,
+						Pulled integer not null)`
+
+	//log rows from other locations get new ids here, this finds them again
+	//when they change
+	s["SyncRowMap"] = `(Origin integer not null,
+						Table_name text not null,
+						Origin_key integer not null,
+						Row_key integer not null,
+						primary key (Origin, Table_name, Origin_key))`
+
+	//changes from other locations a constraint wouldn't take, until they're
+	//resolved. Row is the change's row as json, blank for deletes
+	s["SyncConflict"] = `(Id integer primary key autoincrement,
+						  Table_name text not null,
+						  Row_key integer not null,
+						  Version integer not null,
+						  Origin integer not null,
+						  Deleted boolean not null,
+						  Row text not null,
+						  Error text not null,
+						  Time_stamp integer not null,
+						  unique (Table_name, Row_key, Origin))`
 
 	return s
 }
+
+//changes to tables that already exist in older dbs, in order. Each change
+//must also be made to schema() so new dbs get it. Never edit or reorder a
+//migration once it has shipped, only append
+func migrations() []func(*sql.Tx) error {
+	return []func(*sql.Tx) error{
+		//1: record the skin type the session was allowed for
+		addColumn("Session", "Skin_type", "integer not null default 0"),
+		//2, 3: discounts from promotions
+		addColumn("Sale", "Discount", "integer not null default 0"),
+		addColumn("Sale", "Promotion_id", "integer not null default 0"),
+		//4: email address for notifications
+		addColumn("Customer", "Email", "text not null default ''"),
+		//5: phone numbers are stored in E.164
+		normalizePhones,
+		//6-13: locations, everything that exists so far is at location 1
+		rebuildWithLocation("Bed", "Bed_num, Level, Max_time, Name"),
+		rebuildWithLocation("ExposureSchedule", "Bed_num, Skin_type, Visit, Minutes"),
+		addColumn("Session", "Location_id", "integer not null default 1"),
+		addColumn("DoorAccess", "Location_id", "integer not null default 1"),
+		addColumn("Employee", "Location_id", "integer not null default 1"),
+		addColumn("Customer", "Location_id", "integer not null default 1"),
+		addColumn("Customer", "Roaming", "boolean not null default 0"),
+		addColumn("Product", "Roaming", "boolean not null default 0"),
+		//14, 15: more than one door, existing accesses were at the front door
+		addColumn("DoorAccess", "Door_id", "integer not null default 1"),
+		addColumn("DoorAccess", "Employee_id", "integer not null default 0"),
+		//16, 17: remote unlock and lockdown
+		addColumn("Door", "Lockdown", "boolean not null default 0"),
+		addColumn("DoorAccess", "Action", "text not null default 'fob'"),
+		//18-20: anti-passback
+		addColumn("Door", "Min_interval", "integer not null default 0"),
+		addColumn("Door", "Max_per_day", "integer not null default 0"),
+		addColumn("Door", "Passback_deny", "boolean not null default 0"),
+		//21: readers that send other formats
+		addColumn("Door", "Format", "text not null default 'hex'"),
+		//22: employee time clock
+		addColumn("Door", "Time_clock", "boolean not null default 0"),
+		//23: employees are deactivated instead of deleted to keep their history
+		addColumn("Employee", "Active", "boolean not null default 1"),
+		//24: consent forms are kept instead of replaced
+		moveConsentToRecords,
+		//25-28: voids take back what was sold, not what the product gives now
+		addColumn("SaleLine", "Sessions", "integer not null default 0"),
+		addColumn("SaleLine", "Days", "integer not null default 0"),
+		backfillSaleLineCredits,
+		addColumn("Sale", "Reinstated", "boolean not null default 0"),
+		//29: codes are kept without dashes
+		undashCodes,
+		//30-32: roaming lasts as long as the plan that gave it. Earlier plans
+		//set Customer.Roaming and keep it
+		addColumn("Account", "Roaming_sessions", "integer not null default 0"),
+		addColumn("Account", "Roaming_until", "integer not null default 0"),
+		addColumn("SaleLine", "Roaming", "boolean not null default 0"),
+		//33, 34: billing suspends customers without touching Status
+		addColumn("Customer", "Billing_suspended", "boolean not null default 0"),
+		moveBillingSuspensions,
+		//35: accounts are synced as the entries that change them
+		openAccountEntries,
+	}
+}
+
+//adds a column unless the table already has it. Tables that are new to an
+//older db are created from schema() with every column before the
+//migrations run
+func addColumn(table string, column string, def string) func(*sql.Tx) error {
+	return func(tx *sql.Tx) (err error) {
+		found, err := hasColumn(tx, table, column)
+		if err != nil || found {
+			return
+		}
+
+		_, err = tx.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, def))
+		return
+	}
+}
+
+//sqlite can't change a primary key, so tables keyed by Bed_num are copied
+//into a new table from schema() keyed by Location_id too. columns are the
+//ones copied, the rows all go to location 1
+func rebuildWithLocation(table string, columns string) func(*sql.Tx) error {
+	return func(tx *sql.Tx) (err error) {
+		found, err := hasColumn(tx, table, "Location_id")
+		if err != nil || found {
+			return
+		}
+
+		stmts := []string{
+			fmt.Sprintf("create table %s_new %s", table, schema()[table]),
+			fmt.Sprintf("insert into %s_new (Location_id, %s) select 1, %s from %s",
+				table, columns, columns, table),
+			fmt.Sprintf("drop table %s", table),
+			fmt.Sprintf("alter table %s_new rename to %s", table, table),
+		}
+		for _, stmt := range stmts {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				return
+			}
+		}
+
+		return
+	}
+}
+
+func hasColumn(tx *sql.Tx, table string, column string) (found bool, err error) {
+	cols, err := tableColumns(tx, table)
+	return cols[column], err
+}
+
+//copies each customer's one compliance row into ConsentRecord and drops the
+//old table. Dbs created after the change never had it
+func moveConsentToRecords(tx *sql.Tx) (err error) {
+	var n int
+	err = tx.QueryRow(`SELECT COUNT(*)
+					   FROM sqlite_master
+					   WHERE type = 'table' AND name = 'CustomerCompliance'`).Scan(&n)
+	if err != nil || n == 0 {
+		return
+	}
+
+	rows, err := tx.Query(`SELECT Customer_id, Skin_type, Consent_signed, Consent_version,
+							 Eye_protection_ack, Minor, Parental_consent,
+							 Photosensitizing_meds, Updated
+						   FROM CustomerCompliance`)
+	if err != nil {
+		return
+	}
+	var records []CustomerCompliance
+	for rows.Next() {
+		var c CustomerCompliance
+		err = rows.Scan(&c.Customer_id, &c.Skin_type, &c.Consent_signed,
+			&c.Consent_version, &c.Eye_protection_ack, &c.Minor, &c.Parental_consent,
+			&c.Photosensitizing_meds, &c.Updated)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		records = append(records, c)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return
+	}
+
+	for _, c := range records {
+		_, err = insertConsentRecord(tx, c)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = tx.Exec(`drop table CustomerCompliance`)
+	return
+}
+
+//codes used to be stored with dashes. A code that is only different by its
+//dashes from one already stored is left as it was
+func undashCodes(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`UPDATE OR IGNORE GiftCard SET Code = REPLACE(Code, '-', '')`)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE OR IGNORE Promotion SET Code = REPLACE(Code, '-', '')`)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Payment SET Reference = REPLACE(Reference, '-', '')
+					  WHERE Method = ?`, MethodGiftCard)
+	return
+}
+
+//customers billing turned off are moved to Billing_suspended. There's no
+//telling whether staff had also turned them off, billing did it last
+func moveBillingSuspensions(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`UPDATE Customer SET Status = 1, Billing_suspended = 1
+					  WHERE Status = 0
+					  AND Id IN (SELECT Customer_id FROM BillingCycle WHERE Status = ?)`,
+		BillingSuspended)
+	return
+}
+
+//each account starts with an entry for what it holds now. Every location
+//makes the same one, keyed by the negative customer id, so they sync as one
+//row. A first entry at time 0 sets the membership ends as they are. Account
+//rows aren't synced any more
+func openAccountEntries(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`INSERT OR IGNORE INTO AccountEntry
+						(Id, Customer_id, Balance, Sessions, Member_secs, Roaming_sessions,
+						 Roaming_secs, Time_stamp)
+					  SELECT -Customer_id, Customer_id, Balance, Sessions, Member_until,
+						Roaming_sessions, Roaming_until, 0
+					  FROM Account`)
+	if err != nil {
+		return
+	}
+
+	for _, name := range []string{"Insert", "Update", "Delete"} {
+		_, err = tx.Exec(`drop trigger if exists AccountSync` + name)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM ChangeLog WHERE Table_name = 'Account'`)
+	return
+}
+
+//lines sold before Sessions and Days were kept get the product's, the best
+//guess there is
+func backfillSaleLineCredits(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`UPDATE SaleLine
+					  SET Sessions = (SELECT CASE WHEN Kind = 'session_pack' THEN Sessions
+										ELSE 0 END
+									  FROM Product WHERE Product.Id = SaleLine.Product_id),
+						Days = (SELECT CASE WHEN Kind = 'membership' THEN Days ELSE 0 END
+								FROM Product WHERE Product.Id = SaleLine.Product_id)
+					  WHERE Sessions = 0 AND Days = 0
+					  AND Product_id IN (SELECT Id FROM Product)`)
+	return
+}
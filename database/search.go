@@ -0,0 +1,352 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const defaultSearchLimit = 20
+const maxSearchLimit = 100
+
+//most candidates pulled from the db for one search before ranking, results
+//past this aren't found
+const maxSearchCandidates = 500
+
+//CustomerSearch is an FTS5 index over the customer's name, phone and email.
+//It reads its content from Customer and the triggers keep it in sync. If the
+//sqlite driver was built without FTS5 searches fall back to LIKE
+var searchIndex = []string{
+	`create virtual table if not exists CustomerSearch using fts5(
+		Name, Phone, Email,
+		content='Customer', content_rowid='Id',
+		tokenize='unicode61 remove_diacritics 2', prefix='2 3')`,
+
+	`create trigger if not exists CustomerSearchInsert after insert on Customer begin
+		insert into CustomerSearch(rowid, Name, Phone, Email)
+		values (new.Id, new.Name, new.Phone, new.Email);
+	end`,
+
+	`create trigger if not exists CustomerSearchDelete after delete on Customer begin
+		insert into CustomerSearch(CustomerSearch, rowid, Name, Phone, Email)
+		values ('delete', old.Id, old.Name, old.Phone, old.Email);
+	end`,
+
+	`create trigger if not exists CustomerSearchUpdate after update on Customer begin
+		insert into CustomerSearch(CustomerSearch, rowid, Name, Phone, Email)
+		values ('delete', old.Id, old.Name, old.Phone, old.Email);
+		insert into CustomerSearch(rowid, Name, Phone, Email)
+		values (new.Id, new.Name, new.Phone, new.Email);
+	end`,
+}
+
+//creates the search index if it's missing and fills it from Customer. Safe
+//to run on every start, needs the Email column so run it after migrations
+func ensureSearchIndex() (err error) {
+	exists, err := hasSearchIndex()
+	if err != nil || exists {
+		return
+	}
+
+	for _, stmt := range searchIndex {
+		_, err = db.Exec(stmt)
+		if err != nil && strings.Contains(err.Error(), "fts5") {
+			logger.Warn("sqlite built without FTS5, customer search uses LIKE", "err", err)
+			return nil
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	logger.Info("building customer search index")
+	_, err = db.Exec(`insert into CustomerSearch(CustomerSearch) values ('rebuild')`)
+	return
+}
+
+func hasSearchIndex() (exists bool, err error) {
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+					   WHERE type = 'table' AND name = 'CustomerSearch'`).Scan(&n)
+	return n > 0, err
+}
+
+//lower case words and numbers, everything else separates them
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func isNumber(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+//quotes a term for an FTS5 query so it's never read as an operator
+func ftsPrefix(term string) string {
+	return `"` + strings.Replace(term, `"`, `""`, -1) + `"*`
+}
+
+//SearchCustomers finds customers by name, phone or email. Words match the
+//start of words, so "jon smi" finds Jonathan Smith, and words off by a typo or
+//two still match. Best matches first. Returns a page of limit results after
+//offset plus the total number found. Only maxSearchCandidates customers are
+//ranked, so for a broad search total is at least that many not all of them
+func SearchCustomers(query string, limit int, offset int) (customers []Customer, total int, err error) {
+	defer timeQuery("SearchCustomers")()
+
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return
+	}
+
+	candidates, err := searchCandidates(terms)
+	if err != nil {
+		logger.Error("query failed", "query", "SearchCustomers", "err", err)
+		return
+	}
+
+	type ranked struct {
+		c     Customer
+		score float64
+	}
+	var matches []ranked
+	for _, c := range candidates {
+		if s := matchScore(terms, c); s > 0 {
+			matches = append(matches, ranked{c, s})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].c.Name < matches[j].c.Name
+	})
+
+	total = len(matches)
+	for i := offset; i < total && i < offset+limit; i++ {
+		customers = append(customers, matches[i].c)
+	}
+
+	return
+}
+
+//customers that might match, the index narrows things down and matchScore
+//does the real ranking. Every term as a prefix finds the close matches, the
+//first two letters of any term finds the typos
+func searchCandidates(terms []string) (candidates []Customer, err error) {
+	var starts []string
+	for _, t := range terms {
+		if len([]rune(t)) > 2 && !isNumber(t) {
+			starts = append(starts, string([]rune(t)[:2]))
+		} else {
+			starts = append(starts, t)
+		}
+	}
+
+	useFts, err := hasSearchIndex()
+	if err != nil {
+		return
+	}
+
+	seen := make(map[int]bool)
+	add := func(where string, args ...interface{}) error {
+		if len(candidates) >= maxSearchCandidates {
+			return nil
+		}
+
+		rows, err := db.Query(fmt.Sprintf(`SELECT Customer.Id, Customer.Name,
+										     Customer.Phone, Customer.Email,
+										     Customer.Status, Customer.Level
+										   FROM Customer
+										   %s
+										   LIMIT %d`, where, maxSearchCandidates), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var c Customer
+			err = rows.Scan(&c.Id, &c.Name, &c.Phone, &c.Email, &c.Status, &c.Level)
+			if err != nil {
+				return err
+			}
+
+			if !seen[c.Id] && len(candidates) < maxSearchCandidates {
+				seen[c.Id] = true
+				candidates = append(candidates, c)
+			}
+		}
+		return rows.Err()
+	}
+
+	//phone numbers are stored as +1..., so digits can be anywhere in them
+	for _, t := range terms {
+		if isNumber(t) {
+			err = add(`WHERE Customer.Phone LIKE ?`, "%"+t+"%")
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if useFts {
+		var strict, loose []string
+		for i := range terms {
+			strict = append(strict, ftsPrefix(terms[i]))
+			loose = append(loose, ftsPrefix(starts[i]))
+		}
+
+		const match = `INNER JOIN CustomerSearch ON CustomerSearch.rowid = Customer.Id
+					   WHERE CustomerSearch MATCH ?
+					   ORDER BY CustomerSearch.rank`
+		err = add(match, strings.Join(strict, " AND "))
+		if err == nil {
+			err = add(match, strings.Join(loose, " OR "))
+		}
+		return
+	}
+
+	var clauses []string
+	var args []interface{}
+	for _, start := range starts {
+		clauses = append(clauses, "(Customer.Name LIKE ? OR Customer.Email LIKE ?)")
+		args = append(args, "%"+start+"%", "%"+start+"%")
+	}
+	err = add("WHERE "+strings.Join(clauses, " OR "), args...)
+
+	return
+}
+
+//how well a customer matches, 0 for not at all. Each term scores its best
+//match against the customer's words, a term that matches nothing makes the
+//whole customer not match
+func matchScore(terms []string, c Customer) float64 {
+	words := searchTerms(c.Name + " " + c.Email)
+	phone := strings.TrimPrefix(c.Phone, "+")
+
+	score := 0.0
+	for _, t := range terms {
+		best := 0.0
+		if isNumber(t) && strings.Contains(phone, t) {
+			best = 1
+		}
+
+		for _, w := range words {
+			best = maxScore(best, termScore(t, w))
+		}
+
+		if best == 0 {
+			return 0
+		}
+		score += best
+	}
+
+	return score
+}
+
+func maxScore(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+//exact words beat prefixes beat typos. Longer words are allowed more typos
+func termScore(term string, word string) float64 {
+	if term == word {
+		return 1
+	}
+	if strings.HasPrefix(word, term) {
+		return 0.8
+	}
+
+	t := []rune(term)
+	allowed := 0
+	if len(t) >= 3 {
+		allowed = 1
+	}
+	if len(t) >= 8 {
+		allowed = 2
+	}
+	if allowed == 0 {
+		return 0
+	}
+
+	//compare against the word and against the start of it, so typos in a
+	//prefix like "jonh" for Jonathan still match
+	w := []rune(word)
+	d := editDistance(t, w)
+	if len(w) > len(t) {
+		if pd := editDistance(t, w[:len(t)]); pd < d {
+			d = pd
+		}
+	}
+
+	switch {
+	case d == 1 && d <= allowed:
+		return 0.6
+	case d == 2 && d <= allowed:
+		return 0.4
+	}
+	return 0
+}
+
+//Damerau-Levenshtein distance (optimal string alignment), so swapped letters
+//count as one typo
+func editDistance(a []rune, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if t := d[i-2][j-2] + 1; t < d[i][j] {
+					d[i][j] = t
+				}
+			}
+		}
+	}
+
+	return d[len(a)][len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -2,8 +2,8 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"reflect"
 	"strings"
 	"time"
@@ -15,9 +15,11 @@ import (
 //TODO log calling function when logging sql errors
 
 func FindEmployee(keyNum uint64) (name string, err error) {
+	defer timeQuery("FindEmployee")()
+
 	stmt, err := db.Prepare(`SELECT Name
 							 FROM Employee
-							 WHERE Employee.Fob_num=?`)
+							 WHERE Employee.Fob_num=? AND Active = 1`)
 	if err != nil {
 		return
 	}
@@ -25,15 +27,34 @@ func FindEmployee(keyNum uint64) (name string, err error) {
 
 	err = stmt.QueryRow(keyNum).Scan(&name)
 	if err == sql.ErrNoRows {
-		log.Println(err)
+		logger.Debug("no rows", "query", "FindEmployee")
 		err = nil
 	}
 
 	return
 }
 
+//active Employee with default values if not found, Id will be 0
+func FindEmployeeByFob(keyNum uint64) (e Employee, err error) {
+	defer timeQuery("FindEmployeeByFob")()
+
+	err = db.QueryRow(`SELECT Id, Name, Level, Fob_num, Location_id, Active
+					   FROM Employee
+					   WHERE Fob_num = ? AND Active = 1`, keyNum).Scan(&e.Id, &e.Name,
+		&e.Level, &e.Fob_num, &e.Location_id, &e.Active)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindEmployeeByFob")
+		err = nil
+	}
+
+	return
+}
+
+//stat is false if staff turned the customer off or billing suspended them
 func FindCustomer(keyNum uint64) (id int, name string, stat bool, lvl int, err error) {
-	stmt, err := db.Prepare(`SELECT Id, Name, Status, Level
+	defer timeQuery("FindCustomer")()
+
+	stmt, err := db.Prepare(`SELECT Id, Name, Status AND NOT Billing_suspended, Level
 							 FROM Customer
 							 WHERE Customer.Fob_num=?`)
 	if err != nil {
@@ -43,7 +64,7 @@ func FindCustomer(keyNum uint64) (id int, name string, stat bool, lvl int, err e
 
 	err = stmt.QueryRow(keyNum).Scan(&id, &name, &stat, &lvl)
 	if err == sql.ErrNoRows {
-		log.Println(err)
+		logger.Debug("no rows", "query", "FindCustomer")
 		err = nil
 	}
 
@@ -51,6 +72,8 @@ func FindCustomer(keyNum uint64) (id int, name string, stat bool, lvl int, err e
 }
 
 func FindMostRecentSession(cust_id int) (id int, time int64, bed int, err error) {
+	defer timeQuery("FindMostRecentSession")()
+
 	stmt, err := db.Prepare(`SELECT Id, Time_stamp, Bed_num
 							 FROM Session
 							 WHERE Session.Customer_id=?
@@ -64,7 +87,7 @@ func FindMostRecentSession(cust_id int) (id int, time int64, bed int, err error)
 
 	err = stmt.QueryRow(cust_id).Scan(&id, &time, &bed)
 	if err == sql.ErrNoRows {
-		log.Println(err)
+		logger.Debug("no rows", "query", "FindMostRecentSession")
 		err = nil
 	}
 
@@ -72,6 +95,8 @@ func FindMostRecentSession(cust_id int) (id int, time int64, bed int, err error)
 }
 
 func LastCancelledSessionTime(cust_id int) (time int64, err error) {
+	defer timeQuery("LastCancelledSessionTime")()
+
 	stmt, err := db.Prepare(`SELECT Time_stamp
 							 FROM Session
 							 WHERE Session.Customer_id=?
@@ -85,68 +110,129 @@ func LastCancelledSessionTime(cust_id int) (time int64, err error) {
 
 	err = stmt.QueryRow(cust_id).Scan(&time)
 	if err == sql.ErrNoRows {
-		log.Println(err)
+		logger.Debug("no rows", "query", "LastCancelledSessionTime")
 		err = nil
 	}
 
 	return
 }
 
-//TODO limit results to 50
-//Work on error for no rows
-//TODO abstract out with ListRecords just like CreateRecord
-func RecentFiftyCustomers() (customers []Customer, err error) {
-	rows, err := db.Query(`SELECT Id, Name, Phone, Status, Level
-						   FROM Customer`)
+//Customer with default values if not found, Id will be 0
+func FindCustomerById(id int) (c Customer, err error) {
+	defer timeQuery("FindCustomerById")()
+
+	stmt, err := db.Prepare(`SELECT Id, Name, Phone, Email, Status, Level, Fob_num,
+							   Location_id, Roaming, Billing_suspended
+							 FROM Customer
+							 WHERE Customer.Id=?`)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(id).Scan(&c.Id, &c.Name, &c.Phone, &c.Email, &c.Status,
+		&c.Level, &c.Fob_num, &c.Location_id, &c.Roaming, &c.Billing_suspended)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindCustomerById")
+		err = nil
+	}
+
+	return
+}
+
+//most recent first, cancelled sessions included
+func CustomerSessions(cust_id int, limit int) (sessions []Session, err error) {
+	defer timeQuery("CustomerSessions")()
+
+	stmt, err := db.Prepare(`SELECT Id, Customer_id, Bed_num, Cancelled,
+							   Time_stamp, Session_time
+							 FROM Session
+							 WHERE Session.Customer_id=?
+							 ORDER BY Session.Time_stamp DESC
+							 LIMIT ?`)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(cust_id, limit)
 	if err != nil {
 		return
 	}
 	defer rows.Close()
 
-	//equivalent to while rows.Next() == true
 	for rows.Next() {
-		var c Customer
-		rows.Scan(&c.Id, &c.Name, &c.Phone, &c.Status, &c.Level)
+		var s Session
+		err = rows.Scan(&s.Id, &s.Customer_id, &s.Bed_num, &s.Cancelled,
+			&s.Time_stamp, &s.Session_time)
+		if err != nil {
+			return
+		}
+
+		s.Local_time, s.Month, s.Day = localTime(s.Time_stamp)
 
-		customers = append(customers, c)
+		sessions = append(sessions, s)
 	}
-	rows.Close()
+	err = rows.Err()
 
 	return
 }
 
-//TODO limit results to 50
-//TODO abstract out with ListRecords just like CreateRecord
-func FindCustomersByName(name string) (customers []Customer, err error) {
-	stmt, err := db.Prepare(`SELECT Id, Name, Phone, Status, Level
-						   	 FROM Customer
-						   	 WHERE Customer.Name LIKE ?`)
+//most recent first
+func CustomerDoorAccesses(cust_id int, limit int) (doorAccesses []DoorAccess, err error) {
+	defer timeQuery("CustomerDoorAccesses")()
+
+	stmt, err := db.Prepare(`SELECT Id, Customer_id, Time_stamp
+							 FROM DoorAccess
+							 WHERE DoorAccess.Customer_id=?
+							 ORDER BY DoorAccess.Time_stamp DESC
+							 LIMIT ?`)
 	if err != nil {
 		return
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query("%" + name + "%")
+	rows, err := stmt.Query(cust_id, limit)
 	if err != nil {
 		return
 	}
 	defer rows.Close()
 
-	//equivalent to while rows.Next() == true
 	for rows.Next() {
-		var c Customer
-		err = rows.Scan(&c.Id, &c.Name, &c.Phone, &c.Status, &c.Level)
+		var d DoorAccess
+		err = rows.Scan(&d.Id, &d.Customer_id, &d.Time_stamp)
 		if err != nil {
 			return
 		}
 
-		customers = append(customers, c)
+		d.Local_time, d.Month, d.Day = localTime(d.Time_stamp)
+
+		doorAccesses = append(doorAccesses, d)
 	}
-	if rows.Err() != nil {
-		err = rows.Err()
+	err = rows.Err()
+
+	return
+}
+
+//sessions that weren't cancelled since midnight on the first of the month,
+//local time
+func SessionsThisMonth(cust_id int) (count int, err error) {
+	defer timeQuery("SessionsThisMonth")()
+
+	stmt, err := db.Prepare(`SELECT COUNT(*)
+							 FROM Session
+							 WHERE Session.Customer_id=?
+							 AND Session.Cancelled=0
+							 AND Session.Time_stamp >= ?`)
+	if err != nil {
 		return
 	}
-	rows.Close()
+	defer stmt.Close()
+
+	t := time.Now()
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+
+	err = stmt.QueryRow(cust_id, first.Unix()).Scan(&count)
 
 	return
 }
@@ -154,6 +240,8 @@ func FindCustomersByName(name string) (customers []Customer, err error) {
 //TODO Change so that levels aren't ints but strings and there
 //is no level hierarchy
 func BedsCustomerCanAccess(cust_id int) (beds []Bed, err error) {
+	defer timeQuery("BedsCustomerCanAccess")()
+
 	stmt, err := db.Prepare(`SELECT Level
 							 FROM Customer
 							 WHERE Customer.Id=?`)
@@ -165,19 +253,19 @@ func BedsCustomerCanAccess(cust_id int) (beds []Bed, err error) {
 	var lvl int
 	err = stmt.QueryRow(cust_id).Scan(&lvl)
 	if err == sql.ErrNoRows {
-		log.Println(err)
+		logger.Debug("no rows", "query", "BedsCustomerCanAccess")
 		err = nil
 	}
 
-	stmt2, err := db.Prepare(`SELECT Bed_num, Level, Max_time, Name
+	stmt2, err := db.Prepare(`SELECT Location_id, Bed_num, Level, Max_time, Name
 						     FROM Bed
-						     WHERE Level <= ?`)
+						     WHERE Level <= ? AND Location_id = ?`)
 	if err != nil {
 		return
 	}
 	defer stmt2.Close()
 
-	rows, err := stmt2.Query(lvl)
+	rows, err := stmt2.Query(lvl, localLocation)
 	if err != nil {
 		return
 	}
@@ -186,7 +274,7 @@ func BedsCustomerCanAccess(cust_id int) (beds []Bed, err error) {
 	//equivalent to while rows.Next() == true
 	for rows.Next() {
 		var b Bed
-		err = rows.Scan(&b.Bed_num, &b.Level, &b.Max_time, &b.Name)
+		err = rows.Scan(&b.Location_id, &b.Bed_num, &b.Level, &b.Max_time, &b.Name)
 		if err != nil {
 			return
 		}
@@ -208,12 +296,14 @@ func BedsCustomerCanAccess(cust_id int) (beds []Bed, err error) {
 //the names and values of an arbitrary number of fields
 //TODO check for race condition when adding new customer--make sure keyfob exists
 func CreateRecord(record interface{}) (err error) {
+	defer timeQuery("Create" + reflect.TypeOf(record).Name())()
+
 	t := reflect.TypeOf(record)
 	v := reflect.ValueOf(record)
 
 	var fields []string
+	var qMarks []string
 	var values []interface{}
-	var qMarkSum int
 
 	for i := 0; i < t.NumField(); i++ {
 		//skip if StructTag metadata says non DB backed field
@@ -222,44 +312,75 @@ func CreateRecord(record interface{}) (err error) {
 		}
 
 		fields = append(fields, t.Field(i).Name)
-		qMarkSum = qMarkSum + 1
 
-		//set value to nill if auto increment field
-		if t.Field(i).Tag.Get("db") == "autoInc" {
+		//set value to nill if auto increment field, synced tables take the
+		//next id in this location's block in the insert itself so two
+		//inserts can't get the same one
+		if t.Field(i).Tag.Get("db") == "autoInc" && blockTables[t.Name()] {
+			expr, args := blockIdExpr(t.Name())
+			qMarks = append(qMarks, expr)
+			values = append(values, args...)
+		} else if t.Field(i).Tag.Get("db") == "autoInc" {
+			qMarks = append(qMarks, "?")
 			values = append(values, nil)
 		} else {
+			qMarks = append(qMarks, "?")
 			values = append(values, v.Field(i).Interface())
 		}
-		//qMarkSum = qMarkSum + 1
 	}
 
 	fieldStr := strings.Join(fields, ", ")
-	qMarks := strings.Repeat("?,", qMarkSum-1) + "?" //-1 for last ? with no comma
 
 	sqls := fmt.Sprintf(`INSERT INTO %s(%s)
-		                 values(%s)`, t.Name(), fieldStr, qMarks)
+		                 values(%s)`, t.Name(), fieldStr, strings.Join(qMarks, ", "))
 
 	stmt, err := db.Prepare(sqls)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "CreateRecord", "err", err)
 		return
 	}
 	defer stmt.Close()
 
 	_, err = stmt.Exec(values...)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "CreateRecord", "err", err)
 		return
 	}
 
 	return
 }
 
+func UpdateCustomerContact(id int, phone string, email string) (err error) {
+	defer timeQuery("UpdateCustomerContact")()
+
+	stmt, err := db.Prepare(`UPDATE Customer
+							 SET Phone = ?, Email = ?
+							 WHERE Customer.Id = ?`)
+	if err != nil {
+		logger.Error("query failed", "query", "UpdateCustomerContact", "err", err)
+		return
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(phone, email, id)
+	if err != nil {
+		logger.Error("query failed", "query", "UpdateCustomerContact", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = errors.New("customer not found")
+	}
+
+	return
+}
+
 func DeleteCustomer(id int) (err error) {
+	defer timeQuery("DeleteCustomer")()
+
 	stmt, err := db.Prepare(`DELETE FROM Customer
 							 WHERE Customer.Id = ?`)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "DeleteCustomer", "err", err)
 		return
 	}
 	defer stmt.Close()
@@ -268,7 +389,7 @@ func DeleteCustomer(id int) (err error) {
 	//TODO add error for no record found
 	_, err = stmt.Exec(id)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "DeleteCustomer", "err", err)
 		return
 	}
 
@@ -276,10 +397,12 @@ func DeleteCustomer(id int) (err error) {
 }
 
 func DeleteSession(id int) (err error) {
+	defer timeQuery("DeleteSession")()
+
 	stmt, err := db.Prepare(`DELETE FROM Session
 							 WHERE Session.Id = ?`)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "DeleteSession", "err", err)
 		return
 	}
 	defer stmt.Close()
@@ -288,7 +411,7 @@ func DeleteSession(id int) (err error) {
 	//TODO add error for no record found
 	_, err = stmt.Exec(id)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "DeleteSession", "err", err)
 		return
 	}
 
@@ -296,6 +419,8 @@ func DeleteSession(id int) (err error) {
 }
 
 func AvailableCustomerKeyfobs() (base10 []int32, base16 []string, err error) {
+	defer timeQuery("AvailableCustomerKeyfobs")()
+
 	rows, err := db.Query(`SELECT Keyfob.Fob_num
 						   FROM Keyfob
 						   LEFT OUTER JOIN Customer
@@ -327,126 +452,135 @@ func AvailableCustomerKeyfobs() (base10 []int32, base16 []string, err error) {
 	return
 }
 
-//Return most recent 500. 
-//TODO add date filter
-func RecentDoorAccesses() (doorAccesses []DoorAccess, err error) {
-	rows, err := db.Query(`SELECT DoorAccess.Id, Customer_id, Name, Time_stamp, Phone 
-						   FROM DoorAccess
-						   INNER JOIN Customer
-						   ON DoorAccess.Customer_id == Customer.Id
-						   ORDER BY DoorAccess.Id DESC
-						   LIMIT 500`)
+func CancelSession(id int) (err error) {
+	defer timeQuery("CancelSession")()
+
+	stmt, err := db.Prepare(`UPDATE Session
+							 SET Cancelled = 1
+							 WHERE Session.Id = ?`)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "CancelSession", "err", err)
 		return
 	}
-	defer rows.Close()
-
-	//equivalent to while rows.Next() == true
-	for rows.Next() {
-		var d DoorAccess
-		rows.Scan(&d.Id, &d.Customer_id, &d.Name, &d.Time_stamp, &d.Phone)
-
-		d.Local_time = time.Unix(d.Time_stamp, 0).Local().Format("3:04pm")
-		d.Month = time.Unix(d.Time_stamp, 0).Local().Format("01")
-		d.Day = time.Unix(d.Time_stamp, 0).Local().Format("02")
+	defer stmt.Close()
 
-		doorAccesses = append(doorAccesses, d)
+	_, err = stmt.Exec(id)
+	if err != nil {
+		logger.Error("query failed", "query", "CancelSession", "err", err)
+		return
 	}
-	rows.Close()
 
 	return
 }
 
-//Return most recent 500. 
-//TODO add date filter
-func RecentTanSessions() (sessions []Session, err error) {
-	rows, err := db.Query(`SELECT Session.Id, Customer_id, Name, Bed_num, 
-						     Cancelled, Time_stamp, Session_time 
-						   FROM Session
-						   INNER JOIN Customer
-						   ON Session.Customer_id == Customer.Id
-						   ORDER BY Session.Id DESC
-						   LIMIT 500`)
+func DeleteBed(id int) (err error) {
+	defer timeQuery("DeleteBed")()
+
+	stmt, err := db.Prepare(`DELETE FROM Bed
+							 WHERE Bed.Bed_num = ? AND Bed.Location_id = ?`)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "DeleteBed", "err", err)
 		return
 	}
-	defer rows.Close()
-
-	//equivalent to while rows.Next() == true
-	for rows.Next() {
-		var s Session
-		rows.Scan(&s.Id, &s.Customer_id, &s.Name, &s.Bed_num, &s.Cancelled, 
-			&s.Time_stamp, &s.Session_time)
+	defer stmt.Close()
 
-		s.Local_time = time.Unix(s.Time_stamp, 0).Local().Format("3:04pm")
-		s.Month = time.Unix(s.Time_stamp, 0).Local().Format("01")
-		s.Day = time.Unix(s.Time_stamp, 0).Local().Format("02")
+	//WARNING will not return error if record doesn't exist
+	//TODO add error for no record found
+	_, err = stmt.Exec(id, localLocation)
+	if err != nil {
+		logger.Error("query failed", "query", "DeleteBed", "err", err)
+		return
+	}
 
-		sessions = append(sessions, s)
+	_, err = db.Exec(`DELETE FROM ExposureSchedule
+					  WHERE ExposureSchedule.Bed_num = ?
+					  AND ExposureSchedule.Location_id = ?`, id, localLocation)
+	if err != nil {
+		logger.Error("query failed", "query", "DeleteBed", "err", err)
+		return
 	}
-	rows.Close()
 
 	return
 }
 
-func CancelSession(id int) (err error) {
-	stmt, err := db.Prepare(`UPDATE Session
-							 SET Cancelled = 1
-							 WHERE Session.Id = ?`)
+func UpdateBed(bed Bed) (err error) {
+	defer timeQuery("UpdateBed")()
+
+	stmt, err := db.Prepare(`UPDATE Bed
+							 SET Level = ?,
+							 Max_time = ?,
+							 Name = ?
+							 WHERE Bed.Bed_num = ? AND Bed.Location_id = ?`)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "UpdateBed", "err", err)
 		return
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(id)
+	_, err = stmt.Exec(bed.Level, bed.Max_time, bed.Name, bed.Bed_num, localLocation)
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "UpdateBed", "err", err)
 		return
 	}
 
 	return
 }
 
-func DeleteBed(id int) (err error) {
-	stmt, err := db.Prepare(`DELETE FROM Bed
-							 WHERE Bed.Bed_num = ?`)
+//Bed at the local location with default values if not found, Bed_num will be 0
+func FindBed(bed_num int) (b Bed, err error) {
+	defer timeQuery("FindBed")()
+
+	stmt, err := db.Prepare(`SELECT Location_id, Bed_num, Level, Max_time, Name
+							 FROM Bed
+							 WHERE Bed.Bed_num=? AND Bed.Location_id=?`)
 	if err != nil {
-		log.Println(err)
 		return
 	}
 	defer stmt.Close()
 
-	//WARNING will not return error if record doesn't exist
-	//TODO add error for no record found
-	_, err = stmt.Exec(id)
-	if err != nil {
-		log.Println(err)
-		return
+	err = stmt.QueryRow(bed_num, localLocation).Scan(&b.Location_id, &b.Bed_num,
+		&b.Level, &b.Max_time, &b.Name)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindBed")
+		err = nil
 	}
 
 	return
 }
 
-func UpdateBed(bed Bed) (err error) {
-	stmt, err := db.Prepare(`UPDATE Bed
-							 SET Level = ?,
-							 Max_time = ?,
-							 Name = ?
-							 WHERE Bed.Bed_num = ?`)
+//sessions at the local location that haven't been cancelled and whose time
+//hasn't run out yet, counted by bed
+func ActiveSessionsPerBed() (active map[int]int, err error) {
+	defer timeQuery("ActiveSessionsPerBed")()
+
+	stmt, err := db.Prepare(`SELECT Bed_num, COUNT(*)
+							 FROM Session
+							 WHERE Session.Cancelled=0
+							 AND Session.Location_id=?
+							 AND Session.Time_stamp + Session.Session_time * 60 > ?
+							 GROUP BY Bed_num`)
 	if err != nil {
-		log.Println(err)
 		return
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(bed.Level, bed.Max_time, bed.Name, bed.Bed_num)
+	rows, err := stmt.Query(localLocation, time.Now().Unix())
 	if err != nil {
-		log.Println(err)
 		return
 	}
+	defer rows.Close()
+
+	active = make(map[int]int)
+	for rows.Next() {
+		var bed, count int
+		err = rows.Scan(&bed, &count)
+		if err != nil {
+			return
+		}
+
+		active[bed] = count
+	}
+	err = rows.Err()
 
 	return
 }
@@ -455,8 +589,12 @@ func UpdateBed(bed Bed) (err error) {
 //Work on error for no rows
 //TODO abstract out with ListRecords just like CreateRecord
 func ListBeds() (beds []Bed, err error) {
-	rows, err := db.Query(`SELECT Bed_num, Level, Max_time, Name
-						   FROM Bed`)
+	defer timeQuery("ListBeds")()
+
+	rows, err := db.Query(`SELECT Location_id, Bed_num, Level, Max_time, Name
+						   FROM Bed
+						   WHERE Location_id = ?
+						   ORDER BY Bed_num`, localLocation)
 	if err != nil {
 		return
 	}
@@ -465,7 +603,7 @@ func ListBeds() (beds []Bed, err error) {
 	//equivalent to while rows.Next() == true
 	for rows.Next() {
 		var b Bed
-		rows.Scan(&b.Bed_num, &b.Level, &b.Max_time, &b.Name)
+		rows.Scan(&b.Location_id, &b.Bed_num, &b.Level, &b.Max_time, &b.Name)
 
 		beds = append(beds, b)
 	}
@@ -480,21 +618,36 @@ func ListBeds() (beds []Bed, err error) {
 //Swap Bed_num with the bed who's  Bed_num is one number higher
 //swapping using temporary value 999
 func MoveBedDown(bed_num int) (err error) {
+	defer timeQuery("MoveBedDown")()
+
 	tx, err := db.Begin()
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "MoveBedDown", "err", err)
 		return
 	}
 
 	stmt, err := tx.Prepare(`UPDATE Bed
 							 SET Bed_num = ?
-							 WHERE Bed_num = ?`)
-	_, err = stmt.Exec(999, bed_num+1)
-	_, err = stmt.Exec(bed_num+1, bed_num)
-	_, err = stmt.Exec(bed_num, 999)
+							 WHERE Bed_num = ? AND Location_id = ?`)
+	_, err = stmt.Exec(999, bed_num+1, localLocation)
+	_, err = stmt.Exec(bed_num+1, bed_num, localLocation)
+	_, err = stmt.Exec(bed_num, 999, localLocation)
+
+	//exposure schedules follow their beds
+	if err == nil {
+		var stmt2 *sql.Stmt
+		stmt2, err = tx.Prepare(`UPDATE ExposureSchedule
+								 SET Bed_num = ?
+								 WHERE Bed_num = ? AND Location_id = ?`)
+		if err == nil {
+			_, err = stmt2.Exec(999, bed_num+1, localLocation)
+			_, err = stmt2.Exec(bed_num+1, bed_num, localLocation)
+			_, err = stmt2.Exec(bed_num, 999, localLocation)
+		}
+	}
 
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "MoveBedDown", "err", err)
 		tx.Rollback()
 		return
 	}
@@ -509,21 +662,36 @@ func MoveBedDown(bed_num int) (err error) {
 //Swap Bed_num with the bed who's  Bed_num is one number higher
 //swapping using temporary value 999
 func MoveBedUp(bed_num int) (err error) {
+	defer timeQuery("MoveBedUp")()
+
 	tx, err := db.Begin()
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "MoveBedUp", "err", err)
 		return
 	}
 
 	stmt, err := tx.Prepare(`UPDATE Bed
 							 SET Bed_num = ?
-							 WHERE Bed_num = ?`)
-	_, err = stmt.Exec(999, bed_num-1)
-	_, err = stmt.Exec(bed_num-1, bed_num)
-	_, err = stmt.Exec(bed_num, 999)
+							 WHERE Bed_num = ? AND Location_id = ?`)
+	_, err = stmt.Exec(999, bed_num-1, localLocation)
+	_, err = stmt.Exec(bed_num-1, bed_num, localLocation)
+	_, err = stmt.Exec(bed_num, 999, localLocation)
+
+	//exposure schedules follow their beds
+	if err == nil {
+		var stmt2 *sql.Stmt
+		stmt2, err = tx.Prepare(`UPDATE ExposureSchedule
+								 SET Bed_num = ?
+								 WHERE Bed_num = ? AND Location_id = ?`)
+		if err == nil {
+			_, err = stmt2.Exec(999, bed_num-1, localLocation)
+			_, err = stmt2.Exec(bed_num-1, bed_num, localLocation)
+			_, err = stmt2.Exec(bed_num, 999, localLocation)
+		}
+	}
 
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "MoveBedUp", "err", err)
 		tx.Rollback()
 		return
 	}
@@ -533,22 +701,22 @@ func MoveBedUp(bed_num int) (err error) {
 }
 
 func AddFakeDoorAccesses() (err error) {
-	log.Println("Adding fake door access")
+	logger.Info("adding fake door accesses")
 
 	tx, err := db.Begin()
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "AddFakeDoorAccesses", "err", err)
 		return
 	}
 
-	stmt, err := tx.Prepare(`INSERT INTO DoorAccess (Customer_id, Time_stamp)
-							 VALUES (?, ?)`)
+	stmt, err := tx.Prepare(`INSERT INTO DoorAccess (Customer_id, Time_stamp, Location_id)
+							 VALUES (?, ?, ?)`)
 
 	for i := 0; i < 20000; i++ {
-		_, err = stmt.Exec(rand.Intn(7) + 1, time.Now().Unix() - int64(500000) + int64(609 * i))
+		_, err = stmt.Exec(rand.Intn(7) + 1, time.Now().Unix() - int64(500000) + int64(609 * i), localLocation)
 		
 		if err != nil {
-			log.Println(err)
+			logger.Error("query failed", "query", "AddFakeDoorAccesses", "err", err)
 			tx.Rollback()
 			return
 		}
@@ -560,22 +728,22 @@ func AddFakeDoorAccesses() (err error) {
 }
 
 func AddFakeSessions() (err error) {
-	log.Println("Adding fake sessions")
+	logger.Info("adding fake sessions")
 
 	tx, err := db.Begin()
 	if err != nil {
-		log.Println(err)
+		logger.Error("query failed", "query", "AddFakeSessions", "err", err)
 		return
 	}
 
-	stmt, err := tx.Prepare(`INSERT INTO Session (Bed_num, Session_time, Customer_id, Time_stamp, Cancelled)
-							 VALUES (?, ?, ?, ?, ?)`)
+	stmt, err := tx.Prepare(`INSERT INTO Session (Bed_num, Session_time, Customer_id, Time_stamp, Cancelled, Location_id)
+							 VALUES (?, ?, ?, ?, ?, ?)`)
 
 	for i := 0; i < 20000; i++ {
-		_, err = stmt.Exec(rand.Intn(5) + 1, rand.Intn(8) + 2, rand.Intn(7) + 1, time.Now().Unix() - int64(500000) + int64(609 * i), 0)
+		_, err = stmt.Exec(rand.Intn(5) + 1, rand.Intn(8) + 2, rand.Intn(7) + 1, time.Now().Unix() - int64(500000) + int64(609 * i), 0, localLocation)
 		
 		if err != nil {
-			log.Println(err)
+			logger.Error("query failed", "query", "AddFakeSessions", "err", err)
 			tx.Rollback()
 			return
 		}
@@ -584,4 +752,11 @@ func AddFakeSessions() (err error) {
 	tx.Commit()
 
 	return
-}
\ No newline at end of file
+}
+
+//formats a unix time stamp for reports as local clock time, month and day
+func localTime(timeStamp int64) (clock string, month string, day string) {
+	t := time.Unix(timeStamp, 0).Local()
+
+	return t.Format("3:04pm"), t.Format("01"), t.Format("02")
+}
@@ -4,19 +4,33 @@ package database
 //TODO add documentation on StructTag metadata
 
 type Customer struct {
-	Id      int `db:"autoInc"`
-	Name    string
-	Phone   string
-	Status  bool
-	Level   int
-	Fob_num uint64
+	Id          int `db:"autoInc"`
+	Name        string
+	Phone       string
+	Email       string
+	Status      bool
+	Level       int
+	Fob_num     uint64
+	Location_id int  //home location
+	Roaming     bool //can use every location, not just their home, set by hand
+	//billing retries ran out. Kept apart from Status, which is staff's
+	Billing_suspended bool
 }
 
 type Employee struct {
+	Id          int `db:"autoInc"`
+	Name        string
+	Level       int
+	Fob_num     uint64
+	Location_id int  //home location
+	Active      bool //a deactivated employee's fob doesn't work anywhere
+}
+
+type Location struct {
 	Id      int `db:"autoInc"`
 	Name    string
-	Level   int
-	Fob_num uint64
+	Address string
+	Active  bool
 }
 
 type Keyfob struct {
@@ -25,11 +39,13 @@ type Keyfob struct {
 }
 
 type Bed struct {
-	Bed_num  int `db:"autoInc"`
-	Level    int
-	Max_time int
-	Name     string
-	Status   bool `db:"false"` //not DB backed
+	Location_id      int
+	Bed_num          int //numbered from 1 at each location
+	Level            int
+	Max_time         int
+	Name             string
+	Status           bool `db:"false"` //not DB backed
+	Recommended_time int  `db:"false"`
 }
 
 type Session struct {
@@ -39,19 +55,317 @@ type Session struct {
 	Session_time int
 	Cancelled    bool
 	Time_stamp   int64
-	Name		 string `db:"false"`
+	Skin_type    int
+	Location_id  int
+	Name         string `db:"false"`
 	Local_time   string `db:"false"`
 	Month        string `db:"false"`
-	Day			 string `db:"false"`
+	Day          string `db:"false"`
+}
+
+type Door struct {
+	Id             int `db:"autoInc"`
+	Location_id    int
+	Name           string
+	Device         string
+	Policy         string
+	Opens          int
+	Closes         int
+	Grant_response string
+	Deny_response  string
+	Active         bool
+	Lockdown       bool
+	Min_interval   int //seconds
+	Max_per_day    int
+	Passback_deny  bool
+	Format         string
+	Time_clock     bool
+}
+
+type TimeEntry struct {
+	Id          int `db:"autoInc"`
+	Employee_id int
+	Location_id int
+	Clock_in    int64
+	Clock_out   int64
+	Source      string
+	Name        string `db:"false"`
+}
+
+type TimeEntryEdit struct {
+	Id            int `db:"autoInc"`
+	Time_entry_id int
+	Manager_id    int
+	Old_clock_in  int64
+	Old_clock_out int64
+	New_clock_in  int64
+	New_clock_out int64
+	Reason        string
+	Time_stamp    int64
+	Manager_name  string `db:"false"`
+}
+
+type DoorAlert struct {
+	Id          int `db:"autoInc"`
+	Customer_id int
+	Location_id int
+	Door_id     int
+	Kind        string
+	Detail      string
+	Denied      bool
+	Resolved    bool
+	Time_stamp  int64
+	Name        string `db:"false"`
+	Local_time  string `db:"false"`
+	Month       string `db:"false"`
+	Day         string `db:"false"`
 }
 
 type DoorAccess struct {
-	Id 			int `db:"autoInc"`
+	Id          int `db:"autoInc"`
 	Customer_id int
 	Time_stamp  int64
-	Name 		string `db:"false"`
+	Location_id int
+	Door_id     int
+	Employee_id int
+	Action      string
+	Name        string `db:"false"`
 	Phone       string `db:"false"`
+	Door_name   string `db:"false"`
 	Local_time  string `db:"false"`
 	Month       string `db:"false"`
-	Day			string `db:"false"`
+	Day         string `db:"false"`
+}
+
+//a signed consent form, a row of ConsentRecord
+type CustomerCompliance struct {
+	Id                    int
+	Customer_id           int
+	Skin_type             int   //Fitzpatrick 1-6
+	Consent_signed        int64 //unix time the consent form was signed
+	Consent_version       int
+	Eye_protection_ack    bool
+	Minor                 bool
+	Parental_consent      bool
+	Photosensitizing_meds bool
+	Updated               int64 //unix time it was entered
+}
+
+type ExposureSchedule struct {
+	Location_id int
+	Bed_num     int
+	Skin_type   int
+	Visit       int
+	Minutes     int
+}
+
+// Product.Kind values
+const (
+	KindRetail      = "retail"       //lotion, eyewear
+	KindSessionPack = "session_pack" //adds Sessions to the customer's account
+	KindMembership  = "membership"   //adds Days of unlimited tanning
+	KindCredit      = "credit"       //adds Price to the account balance
+	KindGiftCard    = "gift_card"    //issues a gift card worth Price
+)
+
+// Payment.Method values
+const (
+	MethodCash     = "cash"
+	MethodCard     = "card"      //Reference is the card processor's reference
+	MethodAccount  = "account"   //paid from the customer's account balance
+	MethodGiftCard = "gift_card" //Reference is the gift card code
+)
+
+type Product struct {
+	Id       int `db:"autoInc"`
+	Name     string
+	Kind     string
+	Price    int //cents
+	Sessions int
+	Days     int
+	Active   bool
+	Roaming  bool //memberships and session packs that work at every location
+}
+
+type Sale struct {
+	Id             int `db:"autoInc"`
+	Customer_id    int //0 for walk in customers
+	Total          int //cents, after the discount
+	Discount       int //cents taken off by the promotion
+	Promotion_id   int //0 if no promotion was used
+	Voided         bool
+	Void_reason    string
+	Time_stamp     int64
+	Reinstated     bool       //a membership on it lifted a billing suspension
+	Lines          []SaleLine `db:"false"`
+	Payments       []Payment  `db:"false"`
+	Gift_cards     []GiftCard `db:"false"` //issued by this sale
+	Promotion_code string     `db:"false"` //looked up to set Promotion_id
+}
+
+type SaleLine struct {
+	Id         int `db:"autoInc"`
+	Sale_id    int
+	Product_id int
+	Quantity   int
+	Unit_price int    //cents
+	Amount     int    //cents
+	Sessions   int    //each added to the account, as the product was when sold
+	Days       int    //each added to the membership, as the product was when sold
+	Roaming    bool   //the sessions and days can be used at every location
+	Name       string `db:"false"`
+	Kind       string `db:"false"`
+}
+
+type Payment struct {
+	Id         int `db:"autoInc"`
+	Sale_id    int
+	Method     string
+	Amount     int //cents
+	Reference  string
+	Time_stamp int64
+}
+
+//a customer roams, uses every location, while they have roaming sessions or
+//before Roaming_until, as well as when Customer.Roaming is set. Worked out
+//from the customer's AccountEntry rows, see rebuildAccount
+type Account struct {
+	Customer_id      int
+	Balance          int //cents
+	Sessions         int
+	Member_until     int64 //unix time unlimited tanning ends
+	Roaming_sessions int   //sessions from roaming packs, used up away from home
+	Roaming_until    int64 //unix time a roaming membership ends
+}
+
+//one change to an Account. Entries are only ever added and are synced, so
+//sales at two locations at once both count
+type AccountEntry struct {
+	Id               int `db:"autoInc"`
+	Customer_id      int
+	Balance          int //cents
+	Sessions         int
+	Member_secs      int64 //membership time, see rebuildAccount
+	Roaming_sessions int
+	Roaming_secs     int64 //roaming membership time
+	Time_stamp       int64
+}
+
+// BillingCycle.Status values
+const (
+	BillingActive    = "active"
+	BillingPastDue   = "past_due"  //a payment failed and is being retried
+	BillingSuspended = "suspended" //retries ran out, customer can't tan
+	BillingCancelled = "cancelled"
+)
+
+// Invoice.Status values
+const (
+	InvoiceOpen     = "open"
+	InvoiceCharging = "charging" //claimed by a charge, see ClaimInvoice
+	InvoicePaid     = "paid"
+	InvoiceFailed   = "failed" //retries ran out
+	InvoiceVoid     = "void"
+)
+
+type BillingCycle struct {
+	Customer_id int
+	Product_id  int
+	Next_bill   int64 //unix time the next invoice is created
+	Status      string
+	Created     int64
+}
+
+type Invoice struct {
+	Id           int `db:"autoInc"`
+	Customer_id  int
+	Product_id   int
+	Amount       int //cents
+	Period_start int64
+	Period_end   int64
+	Status       string
+	Attempts     int
+	Next_attempt int64 //unix time of the next charge attempt
+	Last_error   string
+	Sale_id      int //sale recorded when paid
+	Created      int64
+}
+
+type GiftCard struct {
+	Id         int `db:"autoInc"`
+	Code       string
+	Display    string `db:"false"` //Code with dashes, for people to read
+	Initial    int    //cents
+	Balance    int    //cents
+	Sale_id    int    //0 if given away rather than sold
+	Active     bool
+	Time_stamp int64
+}
+
+// Promotion takes Percent_off and then Amount_off off the products it applies
+// to. Zero values mean no limit, e.g. Product_id 0 applies to every product
+// and Ends 0 never ends
+type Promotion struct {
+	Id                    int `db:"autoInc"`
+	Code                  string
+	Name                  string
+	Percent_off           int
+	Amount_off            int   //cents
+	Product_id            int   //only discount this product
+	Max_quantity          int   //only discount this many units
+	Starts                int64 //unix time
+	Ends                  int64 //unix time, exclusive
+	Max_uses              int
+	Max_uses_per_customer int
+	New_customers_only    bool //no sales or sessions before this one
+	Active                bool
+	Uses                  int `db:"false"` //sales not voided
+}
+
+// Outbox.Status values
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed" //retries ran out
+)
+
+// Outbox is a notification waiting to be sent, or the record of one that was
+type Outbox struct {
+	Id           int `db:"autoInc"`
+	Customer_id  int
+	Kind         string //what it's about, e.g. receipt
+	Channel      string //sms or email
+	Address      string //phone number or email address
+	Subject      string //blank for sms
+	Body         string
+	Status       string
+	Attempts     int
+	Next_attempt int64
+	Last_error   string
+	Dedupe_key   string //the same key is only ever queued once
+	Created      int64
+	Sent_at      int64
+}
+
+// NotificationPref opts a customer in or out of one kind of notification on
+// one channel. Customers without a pref get the kind's default
+type NotificationPref struct {
+	Customer_id int
+	Kind        string
+	Channel     string
+	Enabled     bool
+}
+
+// SyncConflict is a change from another location that broke a constraint
+// here, e.g. a keyfob given to two customers at once
+type SyncConflict struct {
+	Id         int `db:"autoInc"`
+	Table_name string
+	Row_key    int64
+	Version    int64
+	Origin     int //location the change was made at
+	Deleted    bool
+	Row        string //the change's row as json, blank for deletes
+	Error      string
+	Time_stamp int64
 }
@@ -0,0 +1,826 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/learc83/go-sqlite3"
+	"strings"
+	"time"
+)
+
+//Sync between the servers at each location goes through head office. Triggers
+//record every insert, update and delete of a synced table in ChangeLog with a
+//version, the time of the change in ms, and the location it was made at.
+//
+//Shared tables go both ways, every location ends up with the same rows. When
+//two locations change the same row the later version wins the whole row, ties
+//go to the higher location id. Rows a unique constraint won't take, like a
+//keyfob given to two customers at once, are skipped and kept in SyncConflict
+//until they're resolved by hand, see ResolveSyncConflict. Accounts are totals
+//that two locations can add to at once, so their entries are synced instead
+//and each location adds them up, see rebuildAccount.
+//
+//Log tables only go up to head office. Every location numbers its own
+//sessions, door accesses and time entries, so they get new ids there and
+//SyncRowMap keeps track of them.
+//
+//Shared rows need the same id everywhere, so each location hands out ids from
+//its own block, see nextBlockId
+
+//synced tables and their keys, keys are always integers
+var sharedTables = map[string]string{
+	"Location":      "Id",
+	"Customer":      "Id",
+	"Employee":      "Id",
+	"Keyfob":        "Fob_num",
+	"AccountEntry":  "Id",
+	"ConsentRecord": "Id",
+	"Product":       "Id",
+}
+
+var logTables = map[string]string{
+	"Session":    "Id",
+	"DoorAccess": "Id",
+	"TimeEntry":  "Id",
+}
+
+//shared tables with autoincrement ids. Ids at location n are from
+//(n-1)*idBlock up, so the rows that were here before sync stay at location 1
+var blockTables = map[string]bool{
+	"Location":      true,
+	"Customer":      true,
+	"Employee":      true,
+	"Product":       true,
+	"ConsentRecord": true,
+	"AccountEntry":  true,
+}
+
+const idBlock = 1000000000
+
+//Change is one row as it is now, or a delete. Row is nil for deletes
+type Change struct {
+	Seq     int64
+	Table   string
+	Key     int64
+	Version int64 //unix ms when it changed at its origin
+	Origin  int   //location it changed at
+	Deleted bool
+	Row     map[string]interface{} `json:",omitempty"`
+}
+
+//later versions win, ties go to the higher location
+func (c Change) newerThan(version int64, origin int) bool {
+	return c.Version > version || (c.Version == version && c.Origin > origin)
+}
+
+func syncedKey(table string) (key string, shared bool, ok bool) {
+	if key, ok = sharedTables[table]; ok {
+		return key, true, true
+	}
+	key, ok = logTables[table]
+	return
+}
+
+const nowMs = `CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)`
+
+const nextSeq = `(SELECT IFNULL(MAX(Seq), 0) + 1 FROM ChangeLog)`
+
+func changeTriggers(table string, key string) (stmts []string) {
+	events := []struct {
+		name, event, row string
+		deleted          int
+	}{
+		{"Insert", "insert", "new", 0},
+		{"Update", "update", "new", 0},
+		{"Delete", "delete", "old", 1},
+	}
+
+	for _, e := range events {
+		stmts = append(stmts, fmt.Sprintf(`create trigger if not exists %[1]sSync%[2]s
+			after %[3]s on %[1]s
+			when (select Applying from SyncState) = 0 begin
+			insert or replace into ChangeLog
+				(Table_name, Row_key, Seq, Version, Origin, Deleted)
+			values ('%[1]s', %[4]s.%[5]s, %[6]s, %[7]s,
+				(select Node_id from SyncState), %[8]d);
+			end`, table, e.name, e.event, e.row, key, nextSeq, nowMs, e.deleted))
+	}
+
+	return
+}
+
+//creates the sync triggers if they're missing. Safe to run on every start
+func ensureSync() (err error) {
+	_, err = db.Exec(`INSERT OR IGNORE INTO SyncState (Id, Node_id, Applying)
+					  VALUES (1, ?, 0)`, localLocation)
+	if err != nil {
+		return
+	}
+
+	_, err = db.Exec(`create index if not exists ChangeLogSeq on ChangeLog (Seq)`)
+	if err != nil {
+		return
+	}
+
+	for _, tables := range []map[string]string{sharedTables, logTables} {
+		for table, key := range tables {
+			for _, stmt := range changeTriggers(table, key) {
+				_, err = db.Exec(stmt)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	return
+}
+
+//changes made here are recorded as this location's
+func setSyncNode(id int) (err error) {
+	_, err = db.Exec(`UPDATE SyncState SET Node_id = ?`, id)
+	return
+}
+
+//next id for a row made at this location in a block table
+func nextBlockId(q queryer, table string) (id int64, err error) {
+	expr, args := blockIdExpr(table)
+	err = q.QueryRow("SELECT "+expr, args...).Scan(&id)
+	return
+}
+
+//nextBlockId as a subquery with its args, so an insert can take the id in
+//the same statement
+func blockIdExpr(table string) (expr string, args []interface{}) {
+	floor := int64(localLocation-1) * idBlock
+	expr = fmt.Sprintf(`(SELECT IFNULL(MAX(Id), ?) + 1
+						 FROM %s
+						 WHERE Id > ? AND Id < ?)`, table)
+	return expr, []interface{}{floor, floor, floor + idBlock}
+}
+
+//TrackExistingRows adds rows that were there before sync, or were written
+//with the triggers missing, to the change log so they get synced too. Their
+//version is 1 so any real change beats them
+func TrackExistingRows() (tracked int, err error) {
+	defer timeQuery("TrackExistingRows")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "TrackExistingRows", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	for _, tables := range []map[string]string{sharedTables, logTables} {
+		for table, key := range tables {
+			var keys []int64
+			keys, err = untrackedKeys(tx, table, key)
+			if err != nil {
+				return
+			}
+
+			//one at a time so every change gets its own seq
+			for _, k := range keys {
+				_, err = tx.Exec(`INSERT INTO ChangeLog
+									(Table_name, Row_key, Seq, Version, Origin, Deleted)
+								  VALUES (?, ?, `+nextSeq+`, 1, ?, 0)`, table, k, localLocation)
+				if err != nil {
+					return
+				}
+			}
+			tracked += len(keys)
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+func untrackedKeys(tx *sql.Tx, table string, key string) (keys []int64, err error) {
+	rows, err := tx.Query(fmt.Sprintf(`SELECT %[2]s
+									   FROM %[1]s
+									   WHERE %[2]s NOT IN (SELECT Row_key FROM ChangeLog
+														WHERE Table_name = ?)
+									   ORDER BY %[2]s`, table, key), table)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k int64
+		err = rows.Scan(&k)
+		if err != nil {
+			return
+		}
+		keys = append(keys, k)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//reads a synced row as column name to value, nil if it's gone
+func readRow(q queryer, table string, key string, id int64) (row map[string]interface{}, err error) {
+	rows, err := q.Query(fmt.Sprintf(`SELECT * FROM %s WHERE %s = ?`, table, key), id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil || !rows.Next() {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	err = rows.Scan(ptrs...)
+	if err != nil {
+		return
+	}
+
+	row = make(map[string]interface{})
+	for i, c := range cols {
+		if b, ok := values[i].([]byte); ok {
+			row[c] = string(b)
+		} else {
+			row[c] = values[i]
+		}
+	}
+
+	return
+}
+
+func scanChanges(rows *sql.Rows) (changes []Change, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Change
+		err = rows.Scan(&c.Table, &c.Key, &c.Seq, &c.Version, &c.Origin, &c.Deleted)
+		if err != nil {
+			return
+		}
+
+		changes = append(changes, c)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//fills in the rows, a row deleted since it was logged is sent as a delete
+//since the delete is logged after it anyway
+func withRows(changes []Change) (err error) {
+	for i := range changes {
+		c := &changes[i]
+		if c.Deleted {
+			continue
+		}
+
+		key, _, _ := syncedKey(c.Table)
+		c.Row, err = readRow(db, c.Table, key, c.Key)
+		if err != nil {
+			return
+		}
+		c.Deleted = c.Row == nil
+	}
+
+	return
+}
+
+//LocalChanges are changes made at this location after seq, shared and log
+//tables both, in the order they were made
+func LocalChanges(since int64, limit int) (changes []Change, err error) {
+	defer timeQuery("LocalChanges")()
+
+	rows, err := db.Query(`SELECT Table_name, Row_key, Seq, Version, Origin, Deleted
+						   FROM ChangeLog
+						   WHERE Seq > ? AND Origin = ?
+						   ORDER BY Seq
+						   LIMIT ?`, since, localLocation, limit)
+	if err != nil {
+		logger.Error("query failed", "query", "LocalChanges", "err", err)
+		return
+	}
+
+	changes, err = scanChanges(rows)
+	if err == nil {
+		err = withRows(changes)
+	}
+
+	return
+}
+
+//ChangesFor are the changes to shared tables after seq for another location
+//to pull, leaving out the ones it made itself. last is the seq to pull from
+//next time, more is true if there are more after it
+func ChangesFor(node int, since int64, limit int) (changes []Change, last int64, more bool, err error) {
+	defer timeQuery("ChangesFor")()
+
+	var tables []string
+	for table := range sharedTables {
+		tables = append(tables, "'"+table+"'")
+	}
+
+	rows, err := db.Query(`SELECT Table_name, Row_key, Seq, Version, Origin, Deleted
+						   FROM ChangeLog
+						   WHERE Seq > ?
+						   AND Table_name IN (`+strings.Join(tables, ", ")+`)
+						   ORDER BY Seq
+						   LIMIT ?`, since, limit)
+	if err != nil {
+		logger.Error("query failed", "query", "ChangesFor", "err", err)
+		return
+	}
+
+	all, err := scanChanges(rows)
+	if err != nil {
+		return
+	}
+
+	last = since
+	more = len(all) == limit
+	for _, c := range all {
+		last = c.Seq
+		if c.Origin != node {
+			changes = append(changes, c)
+		}
+	}
+
+	err = withRows(changes)
+	return
+}
+
+//ApplyChanges writes changes from another location. Shared rows only change
+//if the incoming version is newer, so applying the same changes twice is
+//harmless. Returns how many changed something
+func ApplyChanges(changes []Change) (applied int, err error) {
+	defer timeQuery("ApplyChanges")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "ApplyChanges", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	applied, err = applyChanges(tx, changes)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+//ApplyPulled is ApplyChanges for changes pulled from head office, the pull
+//cursor moves to last in the same transaction so nothing is pulled twice or
+//missed
+func ApplyPulled(peer string, changes []Change, last int64) (applied int, err error) {
+	defer timeQuery("ApplyPulled")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "ApplyPulled", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	applied, err = applyChanges(tx, changes)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO SyncCursor (Peer, Pushed, Pulled)
+					  VALUES (?, 0, 0)`, peer)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`UPDATE SyncCursor SET Pulled = ? WHERE Peer = ?`, last, peer)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+func applyChanges(tx *sql.Tx, changes []Change) (applied int, err error) {
+	//the triggers would record these as this location's own changes
+	_, err = tx.Exec(`UPDATE SyncState SET Applying = 1`)
+	if err != nil {
+		return
+	}
+
+	columns := make(map[string]map[string]bool)
+	for _, c := range changes {
+		key, shared, ok := syncedKey(c.Table)
+		if !ok {
+			logger.Warn("sync change for unknown table", "table", c.Table)
+			continue
+		}
+
+		if columns[c.Table] == nil {
+			columns[c.Table], err = tableColumns(tx, c.Table)
+			if err != nil {
+				return
+			}
+		}
+
+		//a change that breaks a constraint is undone on its own, the rest
+		//still go in
+		_, err = tx.Exec(`SAVEPOINT change`)
+		if err != nil {
+			return
+		}
+
+		var changed bool
+		if shared {
+			changed, err = applyShared(tx, c, key, columns[c.Table])
+		} else {
+			changed, err = applyLog(tx, c, key, columns[c.Table])
+		}
+
+		if err != nil && isConstraintErr(err) {
+			logger.Warn("sync change rejected", "table", c.Table, "key", c.Key,
+				"origin", c.Origin, "err", err)
+			cause := err
+			_, err = tx.Exec(`ROLLBACK TO change`)
+			if err == nil {
+				err = recordConflict(tx, c, cause)
+			}
+			changed = false
+		}
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec(`RELEASE change`)
+		if err != nil {
+			return
+		}
+
+		if changed && c.Table == "AccountEntry" {
+			err = rebuildEntryAccount(tx, c.Key)
+			if err != nil {
+				return
+			}
+		}
+
+		if changed {
+			applied++
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE SyncState SET Applying = 0`)
+	return
+}
+
+func isConstraintErr(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && serr.Code == sqlite3.ErrConstraint
+}
+
+//keeps a rejected change to be resolved later. A later rejected change to
+//the same row from the same location replaces it
+func recordConflict(tx *sql.Tx, c Change, cause error) (err error) {
+	var row []byte
+	if c.Row != nil {
+		row, err = json.Marshal(c.Row)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO SyncConflict
+						(Table_name, Row_key, Version, Origin, Deleted, Row, Error, Time_stamp)
+					  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, c.Table, c.Key, c.Version, c.Origin,
+		c.Deleted, string(row), cause.Error(), time.Now().Unix())
+	return
+}
+
+//SyncConflicts are the changes from other locations that were rejected here,
+//oldest first
+func SyncConflicts() (conflicts []SyncConflict, err error) {
+	defer timeQuery("SyncConflicts")()
+
+	rows, err := db.Query(`SELECT Id, Table_name, Row_key, Version, Origin, Deleted, Row,
+							 Error, Time_stamp
+						   FROM SyncConflict
+						   ORDER BY Id`)
+	if err != nil {
+		logger.Error("query failed", "query", "SyncConflicts", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s SyncConflict
+		err = rows.Scan(&s.Id, &s.Table_name, &s.Row_key, &s.Version, &s.Origin,
+			&s.Deleted, &s.Row, &s.Error, &s.Time_stamp)
+		if err != nil {
+			return
+		}
+
+		conflicts = append(conflicts, s)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//ResolveSyncConflict offers a rejected change again once the rows it clashed
+//with have been fixed, or drops it if discard is set. applied is false if a
+//newer change to the row has come in since, the conflict is gone either way.
+//If the change is still rejected the conflict stays and err says why
+func ResolveSyncConflict(id int, discard bool) (applied bool, err error) {
+	defer timeQuery("ResolveSyncConflict")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "ResolveSyncConflict", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	var c Change
+	var row string
+	err = tx.QueryRow(`SELECT Table_name, Row_key, Version, Origin, Deleted, Row
+					   FROM SyncConflict
+					   WHERE Id = ?`, id).Scan(&c.Table, &c.Key, &c.Version, &c.Origin,
+		&c.Deleted, &row)
+	if err == sql.ErrNoRows {
+		err = errors.New("sync conflict not found")
+	}
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`DELETE FROM SyncConflict WHERE Id = ?`, id)
+	if err != nil {
+		return
+	}
+
+	if !discard {
+		if row != "" {
+			//numbers as json.Number, the same as rows that came in over http
+			d := json.NewDecoder(strings.NewReader(row))
+			d.UseNumber()
+			err = d.Decode(&c.Row)
+			if err != nil {
+				return
+			}
+		}
+
+		var n int
+		n, err = applyChanges(tx, []Change{c})
+		if err != nil {
+			return
+		}
+		applied = n > 0
+
+		var rejected string
+		err = tx.QueryRow(`SELECT Error
+						   FROM SyncConflict
+						   WHERE Table_name = ? AND Row_key = ? AND Origin = ?`,
+			c.Table, c.Key, c.Origin).Scan(&rejected)
+		if err == nil {
+			err = fmt.Errorf("%s %d is still rejected: %s", c.Table, c.Key, rejected)
+			return
+		}
+		if err != sql.ErrNoRows {
+			return
+		}
+		err = nil
+	}
+
+	err = tx.Commit()
+	return
+}
+
+func tableColumns(tx *sql.Tx, table string) (cols map[string]bool, err error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	cols = make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk)
+		if err != nil {
+			return
+		}
+		cols[name] = true
+	}
+	err = rows.Err()
+
+	return
+}
+
+func applyShared(tx *sql.Tx, c Change, key string, cols map[string]bool) (changed bool, err error) {
+	var version int64
+	var origin int
+	err = tx.QueryRow(`SELECT Version, Origin
+					   FROM ChangeLog
+					   WHERE Table_name = ? AND Row_key = ?`, c.Table, c.Key).Scan(&version,
+		&origin)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil || !c.newerThan(version, origin) {
+		return
+	}
+	if !c.Deleted && c.Row == nil {
+		return false, fmt.Errorf("%s %d has no row", c.Table, c.Key)
+	}
+
+	if c.Deleted {
+		_, err = tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s = ?`, c.Table, key), c.Key)
+	} else {
+		c.Row[key] = c.Key
+		_, err = upsertRow(tx, c.Table, key, c.Key, c.Row, cols)
+	}
+	if err != nil {
+		return
+	}
+
+	//recorded with its own version and origin so head office passes it on as
+	//it was made
+	_, err = tx.Exec(`INSERT OR REPLACE INTO ChangeLog
+						(Table_name, Row_key, Seq, Version, Origin, Deleted)
+					  VALUES (?, ?, `+nextSeq+`, ?, ?, ?)`,
+		c.Table, c.Key, c.Version, c.Origin, c.Deleted)
+
+	return err == nil, err
+}
+
+func applyLog(tx *sql.Tx, c Change, key string, cols map[string]bool) (changed bool, err error) {
+	var local int64
+	err = tx.QueryRow(`SELECT Row_key
+					   FROM SyncRowMap
+					   WHERE Origin = ? AND Table_name = ? AND Origin_key = ?`,
+		c.Origin, c.Table, c.Key).Scan(&local)
+	found := err == nil
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	if c.Deleted {
+		if found {
+			_, err = tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s = ?`, c.Table, key), local)
+		}
+		return found && err == nil, err
+	}
+
+	if c.Row == nil {
+		return false, fmt.Errorf("%s %d has no row", c.Table, c.Key)
+	}
+
+	delete(c.Row, key)
+	if found {
+		_, err = upsertRow(tx, c.Table, key, local, c.Row, cols)
+		return err == nil, err
+	}
+
+	local, err = upsertRow(tx, c.Table, key, 0, c.Row, cols)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`INSERT INTO SyncRowMap (Origin, Table_name, Origin_key, Row_key)
+					  VALUES (?, ?, ?, ?)`, c.Origin, c.Table, c.Key, local)
+
+	return err == nil, err
+}
+
+//updates the row with the key, or inserts it if there isn't one. id 0
+//inserts with a new id. Update then insert rather than INSERT OR REPLACE so
+//the delete triggers, like the customer search index's, aren't skipped.
+//Columns this db doesn't have are left out
+func upsertRow(tx *sql.Tx, table string, key string, id int64, row map[string]interface{},
+	cols map[string]bool) (rowId int64, err error) {
+
+	var names []string
+	var values []interface{}
+	for name, v := range row {
+		if !cols[name] {
+			continue
+		}
+
+		//rows sent as json have their numbers decoded as json.Number
+		if n, ok := v.(json.Number); ok {
+			if i, ierr := n.Int64(); ierr == nil {
+				v = i
+			} else {
+				v, _ = n.Float64()
+			}
+		}
+
+		names = append(names, name)
+		values = append(values, v)
+	}
+
+	if id != 0 {
+		var sets []string
+		for _, name := range names {
+			sets = append(sets, name+" = ?")
+		}
+
+		var res sql.Result
+		res, err = tx.Exec(fmt.Sprintf(`UPDATE %s SET %s WHERE %s = ?`, table,
+			strings.Join(sets, ", "), key), append(values, id)...)
+		if err != nil {
+			return
+		}
+
+		n, _ := res.RowsAffected()
+		if n > 0 {
+			return id, nil
+		}
+	}
+
+	res, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, table,
+		strings.Join(names, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")),
+		values...)
+	if err != nil {
+		return
+	}
+
+	return res.LastInsertId()
+}
+
+//SyncCursors are how far this location has pushed its changes to peer and
+//pulled peer's changes
+func SyncCursors(peer string) (pushed int64, pulled int64, err error) {
+	defer timeQuery("SyncCursors")()
+
+	err = db.QueryRow(`SELECT Pushed, Pulled
+					   FROM SyncCursor
+					   WHERE Peer = ?`, peer).Scan(&pushed, &pulled)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "SyncCursors")
+		err = nil
+	}
+
+	return
+}
+
+func SetPushCursor(peer string, pushed int64) (err error) {
+	defer timeQuery("SetPushCursor")()
+
+	_, err = db.Exec(`INSERT OR IGNORE INTO SyncCursor (Peer, Pushed, Pulled)
+					  VALUES (?, 0, 0)`, peer)
+	if err == nil {
+		_, err = db.Exec(`UPDATE SyncCursor SET Pushed = ? WHERE Peer = ?`, pushed, peer)
+	}
+	if err != nil {
+		logger.Error("query failed", "query", "SetPushCursor", "err", err)
+	}
+
+	return
+}
+
+//PendingChanges is how many changes made here haven't been pushed to peer
+func PendingChanges(peer string) (pending int, err error) {
+	defer timeQuery("PendingChanges")()
+
+	pushed, _, err := SyncCursors(peer)
+	if err != nil {
+		return
+	}
+
+	err = db.QueryRow(`SELECT COUNT(*)
+					   FROM ChangeLog
+					   WHERE Seq > ? AND Origin = ?`, pushed, localLocation).Scan(&pending)
+	return
+}
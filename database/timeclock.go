@@ -0,0 +1,271 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+//the shift the employee is clocked in to, Id is 0 if they aren't
+func OpenTimeEntry(employee_id int) (e TimeEntry, err error) {
+	defer timeQuery("OpenTimeEntry")()
+
+	err = db.QueryRow(`SELECT Id, Employee_id, Location_id, Clock_in, Clock_out, Source
+					   FROM TimeEntry
+					   WHERE Employee_id = ? AND Clock_out = 0
+					   ORDER BY Clock_in DESC
+					   LIMIT 1`, employee_id).Scan(&e.Id, &e.Employee_id, &e.Location_id,
+		&e.Clock_in, &e.Clock_out, &e.Source)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "OpenTimeEntry")
+		err = nil
+	}
+	if err != nil {
+		logger.Error("query failed", "query", "OpenTimeEntry", "err", err)
+	}
+
+	return
+}
+
+//unix time the employee last clocked in or out, 0 if never
+func LastPunch(employee_id int) (last int64, err error) {
+	defer timeQuery("LastPunch")()
+
+	err = db.QueryRow(`SELECT IFNULL(MAX(MAX(Clock_in, Clock_out)), 0)
+					   FROM TimeEntry
+					   WHERE Employee_id = ?`, employee_id).Scan(&last)
+	if err != nil {
+		logger.Error("query failed", "query", "LastPunch", "err", err)
+	}
+
+	return
+}
+
+func ClockOutTimeEntry(id int, clock_out int64) (err error) {
+	defer timeQuery("ClockOutTimeEntry")()
+
+	_, err = db.Exec(`UPDATE TimeEntry
+					  SET Clock_out = ?
+					  WHERE Id = ? AND Clock_out = 0`, clock_out, id)
+	if err != nil {
+		logger.Error("query failed", "query", "ClockOutTimeEntry", "err", err)
+	}
+
+	return
+}
+
+//TimeEntry with default values if not found, Id will be 0
+func FindTimeEntry(id int) (e TimeEntry, err error) {
+	defer timeQuery("FindTimeEntry")()
+
+	err = db.QueryRow(`SELECT TimeEntry.Id, Employee_id, TimeEntry.Location_id, Clock_in,
+						 Clock_out, Source, IFNULL(Name, '')
+					   FROM TimeEntry
+					   LEFT JOIN Employee
+					   ON TimeEntry.Employee_id == Employee.Id
+					   WHERE TimeEntry.Id = ?`, id).Scan(&e.Id, &e.Employee_id,
+		&e.Location_id, &e.Clock_in, &e.Clock_out, &e.Source, &e.Name)
+	if err == sql.ErrNoRows {
+		logger.Debug("no rows", "query", "FindTimeEntry")
+		err = nil
+	}
+	if err != nil {
+		logger.Error("query failed", "query", "FindTimeEntry", "err", err)
+	}
+
+	return
+}
+
+//shifts started from from until to at every location, all employees if
+//employee_id is 0. Ordered by employee then clock in
+func TimeEntries(employee_id int, from int64, to int64) (entries []TimeEntry, err error) {
+	defer timeQuery("TimeEntries")()
+
+	rows, err := db.Query(`SELECT TimeEntry.Id, Employee_id, TimeEntry.Location_id,
+							 Clock_in, Clock_out, Source, IFNULL(Name, '')
+						   FROM TimeEntry
+						   LEFT JOIN Employee
+						   ON TimeEntry.Employee_id == Employee.Id
+						   WHERE Clock_in >= ? AND Clock_in < ?
+						   AND (Employee_id = ? OR ? = 0)
+						   ORDER BY Name, Employee_id, Clock_in`,
+		from, to, employee_id, employee_id)
+	if err != nil {
+		logger.Error("query failed", "query", "TimeEntries", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e TimeEntry
+		err = rows.Scan(&e.Id, &e.Employee_id, &e.Location_id, &e.Clock_in, &e.Clock_out,
+			&e.Source, &e.Name)
+		if err != nil {
+			return
+		}
+
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+
+	return
+}
+
+//SaveTimeEntry is a manager's change to the time clock. It adds e if its Id
+//is 0, deletes it if del, or changes its times otherwise, and records the
+//change in TimeEntryEdit. An entry can't overlap another of the employee's,
+//and they can only have one open entry. Returns the entry's id
+func SaveTimeEntry(e TimeEntry, del bool, manager_id int, reason string) (id int, err error) {
+	defer timeQuery("SaveTimeEntry")()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Error("query failed", "query", "SaveTimeEntry", "err", err)
+			tx.Rollback()
+		}
+	}()
+
+	edit := TimeEntryEdit{Time_entry_id: e.Id, Manager_id: manager_id, Reason: reason,
+		New_clock_in: e.Clock_in, New_clock_out: e.Clock_out,
+		Time_stamp: time.Now().Unix()}
+
+	if e.Id != 0 {
+		err = tx.QueryRow(`SELECT Employee_id, Clock_in, Clock_out
+						   FROM TimeEntry
+						   WHERE Id = ?`, e.Id).Scan(&e.Employee_id, &edit.Old_clock_in,
+			&edit.Old_clock_out)
+		if err == sql.ErrNoRows {
+			err = errors.New("time entry not found")
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if !del {
+		err = checkTimeEntry(tx, e)
+		if err != nil {
+			return
+		}
+	}
+
+	switch {
+	case del:
+		edit.New_clock_in, edit.New_clock_out = 0, 0
+		_, err = tx.Exec(`DELETE FROM TimeEntry WHERE Id = ?`, e.Id)
+	case e.Id == 0:
+		var res sql.Result
+		res, err = tx.Exec(`INSERT INTO TimeEntry (Employee_id, Location_id, Clock_in,
+							  Clock_out, Source)
+							VALUES (?, ?, ?, ?, ?)`, e.Employee_id, e.Location_id,
+			e.Clock_in, e.Clock_out, e.Source)
+		if err == nil {
+			var last int64
+			last, err = res.LastInsertId()
+			edit.Time_entry_id = int(last)
+		}
+	default:
+		_, err = tx.Exec(`UPDATE TimeEntry
+						  SET Clock_in = ?, Clock_out = ?
+						  WHERE Id = ?`, e.Clock_in, e.Clock_out, e.Id)
+	}
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`INSERT INTO TimeEntryEdit (Time_entry_id, Manager_id, Old_clock_in,
+						Old_clock_out, New_clock_in, New_clock_out, Reason, Time_stamp)
+					  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, edit.Time_entry_id, edit.Manager_id,
+		edit.Old_clock_in, edit.Old_clock_out, edit.New_clock_in, edit.New_clock_out,
+		edit.Reason, edit.Time_stamp)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return edit.Time_entry_id, err
+}
+
+//e's employee must exist, and e can't overlap their other entries. A
+//Clock_out of 0 runs on forever, so an open entry overlaps everything after it
+func checkTimeEntry(tx *sql.Tx, e TimeEntry) (err error) {
+	var found bool
+	err = tx.QueryRow(`SELECT COUNT(*) > 0 FROM Employee WHERE Id = ?`,
+		e.Employee_id).Scan(&found)
+	if err != nil {
+		return
+	}
+	if !found {
+		return errors.New("employee not found")
+	}
+
+	if e.Clock_out == 0 {
+		err = tx.QueryRow(`SELECT COUNT(*) > 0
+						   FROM TimeEntry
+						   WHERE Employee_id = ? AND Id != ? AND Clock_out = 0`,
+			e.Employee_id, e.Id).Scan(&found)
+		if err != nil {
+			return
+		}
+		if found {
+			return errors.New("employee is already clocked in")
+		}
+	}
+
+	clockOut := e.Clock_out
+	if clockOut == 0 {
+		clockOut = math.MaxInt64
+	}
+	err = tx.QueryRow(`SELECT COUNT(*) > 0
+					   FROM TimeEntry
+					   WHERE Employee_id = ? AND Id != ?
+					   AND Clock_in < ? AND (Clock_out = 0 OR Clock_out > ?)`,
+		e.Employee_id, e.Id, clockOut, e.Clock_in).Scan(&found)
+	if err != nil {
+		return
+	}
+	if found {
+		return errors.New("time entry overlaps another of the employee's")
+	}
+
+	return
+}
+
+//the audit trail for a time entry, oldest first
+func TimeEntryEdits(time_entry_id int) (edits []TimeEntryEdit, err error) {
+	defer timeQuery("TimeEntryEdits")()
+
+	rows, err := db.Query(`SELECT TimeEntryEdit.Id, Time_entry_id, Manager_id,
+							 IFNULL(Name, ''), Old_clock_in, Old_clock_out, New_clock_in,
+							 New_clock_out, Reason, Time_stamp
+						   FROM TimeEntryEdit
+						   LEFT JOIN Employee
+						   ON TimeEntryEdit.Manager_id == Employee.Id
+						   WHERE Time_entry_id = ?
+						   ORDER BY Time_stamp, TimeEntryEdit.Id`, time_entry_id)
+	if err != nil {
+		logger.Error("query failed", "query", "TimeEntryEdits", "err", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e TimeEntryEdit
+		err = rows.Scan(&e.Id, &e.Time_entry_id, &e.Manager_id, &e.Manager_name,
+			&e.Old_clock_in, &e.Old_clock_out, &e.New_clock_in, &e.New_clock_out,
+			&e.Reason, &e.Time_stamp)
+		if err != nil {
+			return
+		}
+
+		edits = append(edits, e)
+	}
+	err = rows.Err()
+
+	return
+}
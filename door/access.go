@@ -0,0 +1,253 @@
+package door
+
+import (
+	"context"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/metrics"
+	"sync"
+	"time"
+)
+
+//The door decides from a list of keyfobs kept in memory, not the db, so it
+//opens as soon as a fob is read and a locked, slow or broken db doesn't keep
+//it shut.
+//
+//Policy when the db can't be read: the door keeps using the last list it
+//loaded, however old, so customers who could get in still can. A fob that
+//isn't on the list is always denied, and until a list has loaded every fob
+//is denied (fail secure).
+
+//how often the db is checked for customer and keyfob changes
+const listCheckInterval = 2 * time.Second
+
+//the list is reloaded this often even without changes
+const listReloadInterval = 5 * time.Minute
+
+//door accesses waiting to be written, reads past this aren't recorded
+const accessBuffer = 1000
+
+//how often unwritten door accesses are retried
+const accessRetryInterval = 5 * time.Second
+
+var listLoads = metrics.NewCounterVec("toasty_door_list_loads_total",
+	"Door allow list loads by outcome", "outcome")
+
+var accessWrites = metrics.NewCounterVec("toasty_door_access_writes_total",
+	"Door accesses by write outcome", "outcome")
+
+var allowList struct {
+	mu      sync.RWMutex
+	fobs    map[uint64]database.DoorEntry
+	version int64
+	loaded  int64 //unix time of the last load, 0 if never
+}
+
+var accesses = make(chan database.DoorAccess, accessBuffer)
+
+var alerts = make(chan database.DoorAlert, accessBuffer)
+
+//keeps the allow list and the door access log up to date until ctx is
+//cancelled, then writes any door accesses still waiting
+func runAccess(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		seedUsage()
+	}()
+	go func() {
+		defer wg.Done()
+		refreshAllowList(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		writeAccesses(ctx)
+	}()
+	wg.Wait()
+}
+
+func refreshAllowList(ctx context.Context) {
+	check := time.NewTicker(listCheckInterval)
+	defer check.Stop()
+	reload := time.NewTicker(listReloadInterval)
+	defer reload.Stop()
+
+	loadAllowList(true)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-check.C:
+			loadAllowList(false)
+		case <-reload.C:
+			loadAllowList(true)
+		}
+	}
+}
+
+//loads the list if it changed since the last load, or always if force. On
+//error the old list stays
+func loadAllowList(force bool) {
+	version, err := database.DoorAllowListVersion()
+	if err != nil {
+		listLoads.Inc("error")
+		logger.Warn("door allow list not checked, using the last one", "err", err)
+		return
+	}
+
+	allowList.mu.RLock()
+	current := allowList.loaded != 0 && allowList.version == version
+	allowList.mu.RUnlock()
+	if current && !force {
+		return
+	}
+
+	fobs, err := database.DoorAllowList(database.LocalLocation())
+	if err != nil {
+		listLoads.Inc("error")
+		logger.Warn("door allow list not loaded, using the last one", "err", err)
+		return
+	}
+
+	allowList.mu.Lock()
+	allowList.fobs = fobs
+	allowList.version = version
+	allowList.loaded = time.Now().Unix()
+	allowList.mu.Unlock()
+
+	listLoads.Inc("ok")
+	logger.Debug("door allow list loaded", "fobs", len(fobs), "version", version)
+}
+
+//decides from the allow list whether fob opens door d at time t. reason says
+//why not when it doesn't
+func decide(d database.Door, lockdown bool, fob uint64, t time.Time) (e database.DoorEntry,
+	granted bool, reason string) {
+	allowList.mu.RLock()
+	defer allowList.mu.RUnlock()
+
+	if allowList.loaded == 0 {
+		return e, false, "allow list not loaded"
+	}
+
+	e, ok := allowList.fobs[fob]
+	switch {
+	case !ok:
+		return e, false, "keyfob not found"
+	case e.Employee_id != 0 && !e.Status:
+		return e, false, "employee deactivated"
+	case e.Employee_id != 0 && !e.Allowed:
+		return e, false, "employee works at another location"
+	case lockdown && e.Level < OwnerLevel:
+		return e, false, "door locked down"
+	case e.Employee_id != 0:
+		return e, true, ""
+	case d.Policy == PolicyStaff:
+		return e, false, "staff only door"
+	case !e.Status:
+		return e, false, "customer suspended"
+	case !e.Allowed:
+		return e, false, "plan doesn't cover this location"
+	case !openAt(d, t):
+		return e, false, "door closed at this hour"
+	}
+
+	return e, true, ""
+}
+
+//queues a door access to be written, never blocks the door
+func recordAccess(d database.DoorAccess) {
+	select {
+	case accesses <- d:
+	default:
+		accessWrites.Inc("dropped")
+		logger.Error("door access not recorded, too many waiting",
+			"customer_id", d.Customer_id)
+	}
+}
+
+//queues an alert to be written with the door accesses, never blocks the door
+func recordAlert(a database.DoorAlert) {
+	select {
+	case alerts <- a:
+	default:
+		logger.Error("door alert not recorded, too many waiting",
+			"customer_id", a.Customer_id, "kind", a.Kind)
+	}
+}
+
+//door accesses and alerts not written yet
+type unwritten struct {
+	accesses []database.DoorAccess
+	alerts   []database.DoorAlert
+}
+
+func writeAccesses(ctx context.Context) {
+	retry := time.NewTicker(accessRetryInterval)
+	defer retry.Stop()
+
+	var pending unwritten
+	for {
+		select {
+		case <-ctx.Done():
+			pending.takeWaiting()
+			pending.flush()
+			return
+		case d := <-accesses:
+			pending.accesses = append(pending.accesses, d)
+			pending.takeWaiting()
+		case a := <-alerts:
+			pending.alerts = append(pending.alerts, a)
+			pending.takeWaiting()
+		case <-retry.C:
+		}
+
+		pending.flush()
+		setUnwritten(len(pending.accesses) + len(accesses))
+	}
+}
+
+//adds everything in the queues right now
+func (u *unwritten) takeWaiting() {
+	for {
+		select {
+		case d := <-accesses:
+			u.accesses = append(u.accesses, d)
+		case a := <-alerts:
+			u.alerts = append(u.alerts, a)
+		default:
+			return
+		}
+	}
+}
+
+//writes everything, keeping what's left to retry on error. Only the newest
+//accessBuffer accesses and alerts are kept so a db that stays down doesn't
+//grow this forever
+func (u *unwritten) flush() {
+	if len(u.accesses) == 0 && len(u.alerts) == 0 {
+		return
+	}
+
+	err := database.CreateDoorAccesses(u.accesses, u.alerts)
+	if err == nil {
+		accessWrites.Add(float64(len(u.accesses)), "ok")
+		u.accesses = u.accesses[:0]
+		u.alerts = u.alerts[:0]
+		return
+	}
+
+	logger.Warn("door accesses not written, will retry", "waiting", len(u.accesses),
+		"alerts_waiting", len(u.alerts), "err", err)
+	if len(u.accesses) > accessBuffer {
+		dropped := len(u.accesses) - accessBuffer
+		accessWrites.Add(float64(dropped), "dropped")
+		logger.Error("door accesses not recorded, too many waiting", "dropped", dropped)
+		u.accesses = u.accesses[dropped:]
+	}
+	if len(u.alerts) > accessBuffer {
+		dropped := len(u.alerts) - accessBuffer
+		logger.Error("door alerts not recorded, too many waiting", "dropped", dropped)
+		u.alerts = u.alerts[dropped:]
+	}
+}
@@ -3,9 +3,10 @@
 package door
 
 import (
-	"log"
+	"context"
 )
 
-func StartDoorControl() {
-	log.Println("Door control not enabled.")
-}
\ No newline at end of file
+func StartDoorControl(ctx context.Context) error {
+	logger.Info("door control not enabled")
+	return nil
+}
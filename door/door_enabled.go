@@ -5,116 +5,318 @@
 package door
 
 import (
-	"log"
+	"context"
+	"encoding/hex"
+	"errors"
 	"github.com/learc83/sio"
+	"sync"
 	"syscall"
-	"strconv"
 	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/readerproto"
 	"time"
 )
 
-//TODO remove most of the logs
-func StartDoorControl() {
-	log.Println("Door control enabled.")
+//how long a door waits to open its reader again after it fails
+const readerRetryInterval = 10 * time.Second
 
-	port, err := sio.Open("/dev/ttyUSB1", syscall.B9600)
+//a door with its reader format and responses decoded
+type reader struct {
+	database.Door
+	format readerproto.Format
+	grant  []byte
+	deny   []byte
+}
+
+//reads from whichever port is open now
+type portReader func([]byte) (int, error)
+
+func (f portReader) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+//Runs every active door at this location until ctx is cancelled, restarting
+//them when Reload is called. A door whose reader fails is retried on its own
+//so the others keep working. Returns an error if the doors can't be loaded
+func StartDoorControl(ctx context.Context) error {
+	logger.Info("door control enabled")
+
+	//the allow list and door access writer run as long as door control does,
+	//the accesses still waiting are written before it returns
+	accessCtx, stopAccess := context.WithCancel(ctx)
+	accessDone := make(chan struct{})
+	go func() {
+		runAccess(accessCtx)
+		close(accessDone)
+	}()
+	defer func() {
+		stopAccess()
+		<-accessDone
+	}()
+
+	for {
+		readers, err := loadReaders()
+		if err != nil {
+			return err
+		}
+
+		doorCtx, stopDoors := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		for _, r := range readers {
+			wg.Add(1)
+			go func(r reader) {
+				defer wg.Done()
+				runReader(doorCtx, r)
+			}(r)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-reload:
+		}
+		stopDoors()
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		logger.Info("doors changed, restarting readers")
+	}
+}
+
+//active doors at this location, adding the default door if there are none
+func loadReaders() (readers []reader, err error) {
+	doors, err := database.ListDoors(database.LocalLocation())
 	if err != nil {
-		log.Println(err)
 		return
 	}
+	if len(doors) == 0 {
+		d := defaultDoor
+		d.Location_id = database.LocalLocation()
+		err = database.CreateRecord(d)
+		if err != nil {
+			return
+		}
+		logger.Info("added default door", "name", d.Name, "device", d.Device)
+
+		doors, err = database.ListDoors(database.LocalLocation())
+		if err != nil {
+			return
+		}
+	}
 
-	// main loop
-	for { 
-		rBuf := make([]byte, 10) // tab, 8 byte hex keyfob #, carriage return
+	resetReaders()
+	for _, d := range doors {
+		if !d.Active {
+			continue
+		}
 
+		r := reader{Door: d}
+		r.format, err = readerproto.ParseFormat(d.Format)
+		if err == nil {
+			r.grant, err = hex.DecodeString(d.Grant_response)
+		}
+		if err == nil {
+			r.deny, err = hex.DecodeString(d.Deny_response)
+		}
+		if err != nil {
+			logger.Error("door not started, bad reader settings", "door", d.Name,
+				"err", err)
+			err = nil
+			continue
+		}
 
-		// Read first byte until we get to a tab
-		for {
-			log.Println("reading first byte")
-			_, err := port.Read(rBuf[:1]) 
-			if err != nil {
-				log.Println("error in first byte:")
-				log.Println(err)
-				port.Close()
-				port, err = sio.Open("/dev/ttyUSB1", syscall.B9600)
-				continue	
-			}
-			
-			if rBuf[0] == 9 {
-				break
-			}
+		readers = append(readers, r)
+	}
+
+	return
+}
 
-			log.Println("First byte wrong: ")
-			log.Println(rBuf[0])
+func runReader(ctx context.Context, r reader) {
+	for {
+		err := readDoor(ctx, r)
+		if ctx.Err() != nil {
+			return
 		}
-		
-		// Got first byte now read next 9 
-		i := 1
-		for i < 10 {	
-			n, err := port.Read(rBuf[i:]) //make a slice so it reads up to 8	
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			i = i + n
+		logger.Error("door reader failed, retrying", "door", r.Name, "device", r.Device,
+			"err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(readerRetryInterval):
 		}
+	}
+}
+
+//reads keyfobs at one door until ctx is cancelled. Returns an error if the
+//reader can't be opened
+func readDoor(ctx context.Context, r reader) error {
+	logger.Info("door started", "door", r.Name, "device", r.Device, "policy", r.Policy)
 
-		if i < 10 {
-			log.Println("Short read in door control")
+	port, err := sio.Open(r.Device, syscall.B9600)
+	if err != nil {
+		return err
+	}
+	setConnected(r.Name, true)
+
+	unlock, unregister, err := registerReader(r.Id)
+	if err != nil {
+		port.Close()
+		setConnected(r.Name, false)
+		return err
+	}
+	defer unregister()
+
+	//closing the port unblocks a pending Read so the loop notices ctx is done.
+	//port is nil under mu after a reopen fails
+	var mu sync.Mutex
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		mu.Lock()
+		if port != nil {
 			port.Close()
-			port, err = sio.Open("/dev/ttyUSB1", syscall.B9600)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			continue
+			port = nil
 		}
-		if (rBuf[0] != 9 && rBuf[9] != 13) {
-			log.Println("Misformed message in door control")
+		setConnected(r.Name, false)
+		mu.Unlock()
+	}()
+
+	reopen := func() (err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if port != nil {
 			port.Close()
-			port, err = sio.Open("/dev/ttyUSB1", syscall.B9600)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			continue
-		}		
+			port = nil
+		}
+		setConnected(r.Name, false)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p, err := sio.Open(r.Device, syscall.B9600)
+		if err != nil {
+			return
+		}
+		port = p
+		setConnected(r.Name, true)
+		return
+	}
 
-		i = 0
-		for i < 10 {
-			log.Println(rBuf[i])
-			i++
+	//the reader loop and remote unlocks both write
+	write := func(b []byte) {
+		mu.Lock()
+		if port != nil {
+			port.Write(b)
 		}
+		mu.Unlock()
+	}
+
+	//a remote unlock holds the door open by sending grant again before the
+	//relay closes, until it's over or a lockdown starts. Owners can unlock a
+	//door that's already locked down
+	go func() {
+		for {
+			var d time.Duration
+			select {
+			case <-stop:
+				return
+			case d = <-unlock:
+			}
 
-		s := string(rBuf[1:9])
+			end := time.Now().Add(d)
+			locked := lockedDown(r.Id)
+			for time.Now().Before(end) && (locked || !lockedDown(r.Id)) {
+				write(r.grant)
 
-		fobNum, _ := strconv.ParseUint(s, 16, 64)
+				select {
+				case <-stop:
+					return
+				case <-time.After(relayHold):
+				}
+			}
+		}
+	}()
 
-		log.Println(s)
-		log.Println(fobNum)
+	//port changes when it's reopened, a new decoder drops any partial frame
+	read := portReader(func(b []byte) (int, error) {
+		mu.Lock()
+		p := port
+		mu.Unlock()
+		if p == nil {
+			return 0, errors.New("reader port closed")
+		}
+		return p.Read(b)
+	})
+	dec := readerproto.NewDecoder(read, r.format)
 
-		id, _, _, _, err := database.FindCustomer(fobNum)
+	for {
+		rd, err := dec.Next()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if fe, ok := err.(*readerproto.FrameError); ok {
+			logger.Warn("bad frame from reader", "door", r.Name, "frame", fe.Frame,
+				"reason", fe.Reason)
+			continue
+		}
 		if err != nil {
-			log.Println(err)
+			logger.Warn("error reading from reader", "door", r.Name, "err", err)
+			err = reopen()
+			if err != nil {
+				return err
+			}
+			dec = readerproto.NewDecoder(read, r.format)
 			continue
 		}
 
-		//TODO log customers who aren't in the database
-		//also add a check for status so that customers can
-		//have tan access without door access 
-		//default id value 0 if no customer found
-		if id == 0 {
-			log.Println("Door Access: keyfob not found")
-			port.Write([]byte{9, 0, 0, 0, 13})
+		fobNum := rd.Fob
+		s := rd.Raw
+
+		logger.Debug("keyfob read", "door", r.Name, "raw", s, "fob_num", fobNum,
+			"facility", rd.Facility)
+
+		//decided from the allow list so the door doesn't wait on the db
+		now := time.Now()
+		entry, granted, reason := decide(r.Door, lockedDown(r.Id), fobNum, now)
+		if granted && entry.Customer_id != 0 {
+			alert, deny := checkPassback(r.Door, entry.Customer_id, now)
+			if alert != nil {
+				logger.Warn("door alert, "+alert.Detail, "door", r.Name,
+					"customer_id", entry.Customer_id, "kind", alert.Kind, "denied", deny)
+				recordAlert(*alert)
+			}
+			if deny {
+				granted, reason = false, alert.Kind
+			}
+		}
+		if !granted {
+			logger.Info("access denied, "+reason, "door", r.Name, "fob_num", fobNum,
+				"customer_id", entry.Customer_id, "employee_id", entry.Employee_id)
+			recordFobRead(s, false)
+			write(r.deny)
 		} else {
-			log.Println("Access granted")
+			logger.Info("access granted", "door", r.Name, "fob_num", fobNum,
+				"customer_id", entry.Customer_id, "employee_id", entry.Employee_id)
+			recordFobRead(s, true)
 
-			port.Write([]byte{9, 255, 254, 253, 13})
+			write(r.grant)
+			if entry.Customer_id != 0 {
+				recordGrant(entry.Customer_id, now)
+			}
+			if entry.Employee_id != 0 && r.Time_clock {
+				go punch(r.Door, entry.Employee_id, now)
+			}
 
-			doorAccess := database.DoorAccess{ Customer_id: id, 
-				Time_stamp: time.Now().Unix()}
+			doorAccess := database.DoorAccess{ Customer_id: entry.Customer_id, 
+				Employee_id: entry.Employee_id, Time_stamp: now.Unix(),
+				Location_id: database.LocalLocation(), Door_id: r.Id, Action: actionFob}
 			
-			database.CreateRecord(doorAccess)
+			recordAccess(doorAccess)
 		}
 	}
-}
\ No newline at end of file
+}
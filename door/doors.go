@@ -0,0 +1,101 @@
+package door
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/readerproto"
+	"github.com/learc83/toastyserver/timeclock"
+	"time"
+)
+
+//who a door opens for. Employees of this location get in through every
+//door at any hour
+const (
+	PolicyMembers = "members" //customers, during opening hours
+	PolicyStaff   = "staff"   //employees only
+)
+
+//what the reader is sent back, hex. The door opens on grant
+const (
+	DefaultGrant = "09fffefd0d"
+	DefaultDeny  = "090000000d"
+)
+
+//a location without any doors gets the one reader it always had
+var defaultDoor = database.Door{Name: "Front entrance", Device: "/dev/ttyUSB1",
+	Format: string(readerproto.Hex), Policy: PolicyMembers, Grant_response: DefaultGrant,
+	Deny_response: DefaultDeny, Active: true}
+
+//wakes StartDoorControl to restart the readers when doors change
+var reload = make(chan struct{}, 1)
+
+//Reload restarts the door readers so door changes take effect
+func Reload() {
+	select {
+	case reload <- struct{}{}:
+	default:
+	}
+}
+
+//CheckDoor returns an error if d can't be used as a door
+func CheckDoor(d database.Door) error {
+	if d.Name == "" {
+		return errors.New("name can't be blank")
+	}
+	if d.Device == "" {
+		return errors.New("device can't be blank")
+	}
+	if _, err := readerproto.ParseFormat(d.Format); err != nil {
+		return err
+	}
+	if d.Policy != PolicyMembers && d.Policy != PolicyStaff {
+		return errors.New("policy must be " + PolicyMembers + " or " + PolicyStaff)
+	}
+	if d.Opens < 0 || d.Opens >= 24*60 || d.Closes < 0 || d.Closes >= 24*60 {
+		return errors.New("opens and closes are minutes after midnight, 0 to 1439")
+	}
+	if d.Min_interval < 0 || d.Max_per_day < 0 {
+		return errors.New("min interval and max per day can't be negative")
+	}
+
+	for _, r := range []string{d.Grant_response, d.Deny_response} {
+		b, err := hex.DecodeString(r)
+		if err != nil || len(b) == 0 {
+			return errors.New("grant and deny responses must be hex bytes")
+		}
+	}
+
+	return nil
+}
+
+//customers can get in at t. Hours that end before they start run past
+//midnight
+func openAt(d database.Door, t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	switch {
+	case d.Opens == d.Closes:
+		return true
+	case d.Opens < d.Closes:
+		return m >= d.Opens && m < d.Closes
+	default:
+		return m >= d.Opens || m < d.Closes
+	}
+}
+
+//clocks an employee in or out when their fob opens a time clock door. Runs
+//after the door has opened, so a slow db never holds anyone outside
+func punch(d database.Door, employee_id int, t time.Time) {
+	in, ok, err := timeclock.Punch(employee_id, timeclock.SourceDoor, t)
+	switch {
+	case err != nil:
+		logger.Error("time clock punch failed", "door", d.Name, "employee_id", employee_id,
+			"err", err)
+	case !ok:
+		logger.Debug("time clock double tap ignored", "door", d.Name,
+			"employee_id", employee_id)
+	default:
+		logger.Info("time clock punch", "door", d.Name, "employee_id", employee_id,
+			"clocked_in", in)
+	}
+}
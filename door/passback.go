@@ -0,0 +1,114 @@
+package door
+
+import (
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Anti-passback catches a member fob shared between friends: used again soon
+//after it let someone in, or too many times in a day. Each door has its own
+//rules, but uses are counted across every door here. Only customers are
+//checked. Uses are kept in memory so the door doesn't wait on the db, and
+//today's are read back from the door log the first time door control starts
+
+//DoorAlert kinds
+const (
+	alertPassback  = "passback"
+	alertMaxPerDay = "max_per_day"
+)
+
+var alertCount = metrics.NewCounterVec("toasty_door_alerts_total",
+	"Door anti-passback alerts by kind and whether the fob was denied", "kind", "denied")
+
+var usage struct {
+	mu     sync.Mutex
+	day    string          //the local day grants are for
+	grants map[int][]int64 //customer id to unix times their fob let them in
+}
+
+var seedOnce sync.Once
+
+//checks a customer about to be let in through d at t against its rules.
+//alert is nil if nothing's wrong, deny is true if the door should stay shut
+func checkPassback(d database.Door, customer_id int, t time.Time) (alert *database.DoorAlert,
+	deny bool) {
+	if d.Min_interval <= 0 && d.Max_per_day <= 0 {
+		return
+	}
+
+	//a copy, seedUsage sorts the slices in place
+	usage.mu.Lock()
+	var grants []int64
+	if usage.day == t.Format("2006-01-02") {
+		grants = append(grants, usage.grants[customer_id]...)
+	}
+	usage.mu.Unlock()
+
+	kind, detail := "", ""
+	if n := len(grants); n > 0 && d.Min_interval > 0 {
+		since := t.Unix() - grants[n-1]
+		if since < int64(d.Min_interval) {
+			kind = alertPassback
+			detail = fmt.Sprintf("used again %ds after the last entry, minimum %ds",
+				since, d.Min_interval)
+		}
+	}
+	if kind == "" && d.Max_per_day > 0 && len(grants) >= d.Max_per_day {
+		kind = alertMaxPerDay
+		detail = fmt.Sprintf("%d entries today, limit %d", len(grants)+1, d.Max_per_day)
+	}
+	if kind == "" {
+		return
+	}
+
+	alertCount.Inc(kind, fmt.Sprint(d.Passback_deny))
+	return &database.DoorAlert{Customer_id: customer_id,
+		Location_id: database.LocalLocation(), Door_id: d.Id, Kind: kind, Detail: detail,
+		Denied: d.Passback_deny, Time_stamp: t.Unix()}, d.Passback_deny
+}
+
+//remembers a customer's fob let them in at t
+func recordGrant(customer_id int, t time.Time) {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	day := t.Format("2006-01-02")
+	if usage.day != day || usage.grants == nil {
+		usage.day = day
+		usage.grants = make(map[int][]int64)
+	}
+	usage.grants[customer_id] = append(usage.grants[customer_id], t.Unix())
+}
+
+//reads back today's uses from the door log, once per run of the server.
+//Without them the rules only see uses since startup
+func seedUsage() {
+	seedOnce.Do(func() {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+		accesses, err := database.DoorGrantsSince(database.LocalLocation(), midnight.Unix())
+		if err != nil {
+			logger.Warn("anti-passback starting without today's door accesses", "err", err)
+			return
+		}
+
+		usage.mu.Lock()
+		defer usage.mu.Unlock()
+
+		if usage.day != now.Format("2006-01-02") || usage.grants == nil {
+			usage.day = now.Format("2006-01-02")
+			usage.grants = make(map[int][]int64)
+		}
+		for _, a := range accesses {
+			usage.grants[a.Customer_id] = append(usage.grants[a.Customer_id], a.Time_stamp)
+		}
+		for _, grants := range usage.grants {
+			sort.Slice(grants, func(i, j int) bool { return grants[i] < grants[j] })
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package door
+
+import (
+	"errors"
+	"github.com/learc83/toastyserver/database"
+	"sync"
+	"time"
+)
+
+//employees at this level or above still get in during a lockdown, and only
+//they can end one
+const OwnerLevel = 3
+
+//how long the relay keeps the door open after a grant. A timed unlock sends
+//grant again this often until it's over
+const relayHold = 5 * time.Second
+
+//longest a door can be unlocked from the admin api
+const MaxUnlock = 10 * time.Minute
+
+//DoorAccess actions
+const (
+	actionFob         = "fob"
+	actionUnlock      = "unlock"
+	actionLockdown    = "lockdown"
+	actionEndLockdown = "end_lockdown"
+)
+
+//doors with a running reader the admin api can reach, by door id, and
+//whether each door is locked down. lockdown is kept for doors whose reader is
+//down too, so a lockdown started while it reconnects isn't missed
+var remote = struct {
+	mu       sync.Mutex
+	unlock   map[int]chan time.Duration
+	lockdown map[int]bool
+}{
+	unlock:   make(map[int]chan time.Duration),
+	lockdown: make(map[int]bool),
+}
+
+//called by a door's reader when it starts, unlocks for it arrive on the
+//channel. The returned func is called when the reader stops. The door's
+//lockdown is read from the db, the reader's copy of the door may be older
+//than a lockdown. It's read under the lock so a SetLockdown at the same time
+//can't be overwritten
+func registerReader(door_id int) (unlock chan time.Duration, unregister func(), err error) {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	d, err := database.FindDoor(door_id)
+	if err != nil {
+		return
+	}
+
+	unlock = make(chan time.Duration, 1)
+	remote.unlock[door_id] = unlock
+	remote.lockdown[door_id] = d.Lockdown
+
+	return unlock, func() {
+		remote.mu.Lock()
+		if remote.unlock[door_id] == unlock {
+			delete(remote.unlock, door_id)
+		}
+		remote.mu.Unlock()
+	}, nil
+}
+
+func lockedDown(door_id int) bool {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	return remote.lockdown[door_id]
+}
+
+//Unlock opens door_id for d, on behalf of the employee with keyfob
+//employeeFob, and records it. Locked down doors can only be unlocked by an
+//owner
+func Unlock(door_id int, d time.Duration, employeeFob uint64) (err error) {
+	e, err := actingEmployee(employeeFob)
+	if err != nil {
+		return
+	}
+	if d <= 0 || d > MaxUnlock {
+		return errors.New("unlock must be more than 0 and at most " + MaxUnlock.String())
+	}
+
+	remote.mu.Lock()
+	unlock, running := remote.unlock[door_id]
+	locked := remote.lockdown[door_id]
+	remote.mu.Unlock()
+
+	if !running {
+		return errors.New("door reader isn't running")
+	}
+	if locked && e.Level < OwnerLevel {
+		return errors.New("door is locked down, only an owner can unlock it")
+	}
+
+	//recorded before the door opens so every remote unlock is in the log
+	err = database.CreateDoorAccesses([]database.DoorAccess{remoteAccess(e, door_id,
+		actionUnlock)}, nil)
+	if err != nil {
+		return
+	}
+
+	select {
+	case unlock <- d:
+	default:
+		//an unlock is already waiting, the door opens for that one
+	}
+	logger.Info("door unlocked remotely", "door_id", door_id, "employee_id", e.Id,
+		"for", d.String())
+
+	return
+}
+
+//SetLockdown locks down door_id, or every door here if door_id is 0, so only
+//owners get in, or ends the lockdown. Any employee can start a lockdown,
+//only an owner can end one. Returns the doors changed
+func SetLockdown(door_id int, lockdown bool, employeeFob uint64) (doors []int, err error) {
+	e, err := actingEmployee(employeeFob)
+	if err != nil {
+		return
+	}
+	if !lockdown && e.Level < OwnerLevel {
+		return nil, errors.New("only an owner can end a lockdown")
+	}
+
+	doors, err = database.SetDoorLockdown(database.LocalLocation(), door_id, lockdown)
+	if err != nil {
+		return
+	}
+	if len(doors) == 0 {
+		return nil, errors.New("door not found at this location")
+	}
+
+	action := actionLockdown
+	if !lockdown {
+		action = actionEndLockdown
+	}
+
+	var accesses []database.DoorAccess
+	remote.mu.Lock()
+	for _, id := range doors {
+		remote.lockdown[id] = lockdown
+		accesses = append(accesses, remoteAccess(e, id, action))
+	}
+	remote.mu.Unlock()
+
+	logger.Warn("door "+action, "doors", doors, "employee_id", e.Id)
+
+	err = database.CreateDoorAccesses(accesses, nil)
+	return
+}
+
+func actingEmployee(fob uint64) (e database.Employee, err error) {
+	e, err = database.FindEmployeeByFob(fob)
+	if err == nil && e.Id == 0 {
+		err = errors.New("employee not found")
+	}
+	return
+}
+
+func remoteAccess(e database.Employee, door_id int, action string) database.DoorAccess {
+	return database.DoorAccess{Employee_id: e.Id, Time_stamp: time.Now().Unix(),
+		Location_id: database.LocalLocation(), Door_id: door_id, Action: action}
+}
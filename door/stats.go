@@ -0,0 +1,96 @@
+package door
+
+import (
+	"github.com/learc83/toastyserver/logging"
+	"github.com/learc83/toastyserver/metrics"
+	"sync"
+	"time"
+)
+
+//Stats is a snapshot of the state of the door reader
+type Stats struct {
+	Enabled     bool            //false when built without the door tag
+	Connected   bool            //every door's reader is open
+	Readers     map[string]bool //door name to whether its reader is open
+	LastFobRead int64           //unix time of the last complete keyfob read
+	LastFob     string          //hex keyfob number of the last read
+	Granted     int             //door accesses granted since startup
+	Denied      int             //door accesses denied since startup
+	ListFobs    int             //keyfobs on the allow list
+	ListLoaded  int64           //unix time the allow list last loaded, 0 if never
+	Unwritten   int             //door accesses not yet written to the db
+}
+
+var logger = logging.For("door")
+
+var decisionCount = metrics.NewCounterVec("toasty_door_decisions_total",
+	"Door keyfob reads by decision", "decision")
+
+var stats struct {
+	mu sync.Mutex
+	Stats
+}
+
+func GetStats() Stats {
+	stats.mu.Lock()
+	s := stats.Stats
+	s.Readers = make(map[string]bool)
+	for name, connected := range stats.Readers {
+		s.Readers[name] = connected
+	}
+	stats.mu.Unlock()
+
+	allowList.mu.RLock()
+	s.ListFobs = len(allowList.fobs)
+	s.ListLoaded = allowList.loaded
+	allowList.mu.RUnlock()
+
+	return s
+}
+
+func setConnected(door string, connected bool) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.Enabled = true
+	if stats.Readers == nil {
+		stats.Readers = make(map[string]bool)
+	}
+	stats.Readers[door] = connected
+	stats.Connected = true
+	for _, c := range stats.Readers {
+		stats.Connected = stats.Connected && c
+	}
+}
+
+//forgets the readers when the doors are reloaded
+func resetReaders() {
+	stats.mu.Lock()
+	stats.Readers = make(map[string]bool)
+	stats.Connected = false
+	stats.mu.Unlock()
+}
+
+func setUnwritten(n int) {
+	stats.mu.Lock()
+	stats.Unwritten = n
+	stats.mu.Unlock()
+}
+
+func recordFobRead(fob string, granted bool) {
+	stats.mu.Lock()
+	stats.LastFobRead = time.Now().Unix()
+	stats.LastFob = fob
+	if granted {
+		stats.Granted++
+	} else {
+		stats.Denied++
+	}
+	stats.mu.Unlock()
+
+	if granted {
+		decisionCount.Inc("grant")
+	} else {
+		decisionCount.Inc("deny")
+	}
+}
@@ -0,0 +1,109 @@
+//Package logging sets up leveled, structured logs for every component.
+//Output format and starting level come from the environment:
+//
+//	TOASTY_LOG_FORMAT=json|logfmt (default logfmt)
+//	TOASTY_LOG_LEVEL=debug|info|warn|error (default info)
+//
+//The level can be changed while running with SetLevel.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+var level = new(slog.LevelVar)
+
+var base *slog.Logger
+
+func init() {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if os.Getenv("TOASTY_LOG_FORMAT") == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	base = slog.New(handler)
+
+	//anything still using the standard log package ends up here too
+	slog.SetDefault(base)
+
+	if l := os.Getenv("TOASTY_LOG_LEVEL"); l != "" {
+		err := SetLevel(l)
+		if err != nil {
+			base.Error("bad TOASTY_LOG_LEVEL", "err", err)
+		}
+	}
+}
+
+//For returns the logger for a component, e.g. "door", "tmak" or "db"
+func For(component string) *slog.Logger {
+	return base.With("component", component)
+}
+
+//SetLevel changes the level of every logger, takes debug, info, warn or error
+func SetLevel(name string) error {
+	var l slog.Level
+	switch strings.ToLower(name) {
+	case "debug":
+		l = slog.LevelDebug
+	case "info":
+		l = slog.LevelInfo
+	case "warn":
+		l = slog.LevelWarn
+	case "error":
+		l = slog.LevelError
+	default:
+		return fmt.Errorf("unknown log level %q", name)
+	}
+
+	level.Set(l)
+	return nil
+}
+
+//Level returns the current level name
+func Level() string {
+	return strings.ToLower(level.Level().String())
+}
+
+//Bytes logs a serial buffer as a list of byte values, the handlers would
+//otherwise print it as a string or base64
+func Bytes(key string, b []byte) slog.Attr {
+	return slog.String(key, fmt.Sprint(b))
+}
+
+type requestIDKey struct{}
+
+//NewRequestID returns a random id for correlating the logs of one request
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+//FromContext returns the logger for a component with the request id from ctx
+//attached, if there is one
+func FromContext(ctx context.Context, component string) *slog.Logger {
+	l := For(component)
+	if id := RequestID(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	return l
+}
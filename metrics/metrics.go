@@ -0,0 +1,249 @@
+//Package metrics is a minimal Prometheus exporter. It only supports the
+//counters, histograms and gauges toastyserver needs, written out in the
+//Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//DefaultBuckets are latency buckets in seconds, from 1ms up to 10s
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}{collectors: make(map[string]collector)}
+
+func register(name string, c collector) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, ok := registry.collectors[name]; ok {
+		panic("metrics: " + name + " registered twice")
+	}
+	registry.collectors[name] = c
+}
+
+//labelSet keeps label values in the order the label names were declared
+type labelSet struct {
+	names []string
+}
+
+func (l labelSet) key(values []string) string {
+	if len(values) != len(l.names) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d",
+			len(l.names), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+//formats labels as {a="1",b="2"}, extra is appended as is for the le label
+func (l labelSet) format(key string, extra string) string {
+	var pairs []string
+	if len(l.names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, n := range l.names {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", n, values[i]))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels labelSet
+	values map[string]float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labelSet{labels},
+		values: make(map[string]float64)}
+	register(name, c)
+	return c
+}
+
+//Inc adds one to the counter for the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	k := c.labels.key(labelValues)
+
+	c.mu.Lock()
+	c.values[k]++
+	c.mu.Unlock()
+}
+
+//Add adds v, which must not be negative, to the counter for the given label
+//values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	k := c.labels.key(labelValues)
+
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, c.labels.format(k, ""), c.values[k])
+	}
+}
+
+type histogram struct {
+	counts []uint64 //cumulative counts per bucket
+	count  uint64
+	sum    float64
+}
+
+//HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  labelSet
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func NewHistogramVec(name string, help string, buckets []float64,
+	labels ...string) *HistogramVec {
+
+	h := &HistogramVec{name: name, help: help, labels: labelSet{labels},
+		buckets: buckets, values: make(map[string]*histogram)}
+	register(name, h)
+	return h
+}
+
+//Observe records v for the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	k := h.labels.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hist
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	var keys []string
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		hist := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				h.labels.format(k, fmt.Sprintf("le=\"%g\"", b)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			h.labels.format(k, `le="+Inf"`), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, h.labels.format(k, ""), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels.format(k, ""), hist.count)
+	}
+}
+
+//GaugeFunc is a gauge whose values are computed by fn every time /metrics is
+//scraped. fn returns values keyed by the value of the single label.
+type GaugeFunc struct {
+	name  string
+	help  string
+	label string
+	fn    func() (map[string]float64, error)
+}
+
+func NewGaugeFunc(name string, help string, label string,
+	fn func() (map[string]float64, error)) *GaugeFunc {
+
+	g := &GaugeFunc{name: name, help: help, label: label, fn: fn}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	values, err := g.fn()
+	if err != nil {
+		//leave the gauge out rather than report wrong numbers
+		fmt.Fprintf(w, "# %s unavailable: %s\n", g.name, err)
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", g.name, g.label, k, values[k])
+	}
+}
+
+//WriteTo writes every registered metric in the text exposition format
+func WriteTo(w io.Writer) {
+	registry.mu.Lock()
+	var names []string
+	for n := range registry.collectors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var collectors []collector
+	for _, n := range names {
+		collectors = append(collectors, registry.collectors[n])
+	}
+	registry.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+//Handler serves the /metrics endpoint
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteTo(w)
+}
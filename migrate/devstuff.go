@@ -21,26 +21,37 @@ func createDevelopmentDB() {
 	keyfob := database.Keyfob{Fob_num: 12107728, Admin: true}
 	database.CreateRecord(keyfob)
 
-	employee := database.Employee{Name: "Seth", Level: 3, Fob_num: 12107728}
+	employee := database.Employee{Name: "Seth", Level: 3, Fob_num: 12107728,
+		Location_id: 1, Active: true}
 	database.CreateRecord(employee)
 
 	keyfob2 := database.Keyfob{Fob_num: 9873, Admin: false}
 	database.CreateRecord(keyfob2)
 
 	customer := database.Customer{Name: "Jane Tanner", Level: 3, Fob_num: 9873,
-		Phone: "770-949-1622", Status: true}
+		Phone: "+17709491622", Status: true, Location_id: 1}
 	database.CreateRecord(customer)
 
 	customer2 := database.Customer{Name: "Fred Tanner", Level: 3, Fob_num: 9871,
-		Phone: "770-949-1622", Status: false}
+		Phone: "+17709491622", Status: false, Location_id: 1}
 	database.CreateRecord(customer2)
 
+	//everyone has signed a consent form, ids 1-10 are the fake customers,
+	//11 and 12 are Jane and Fred
+	for id := 1; id <= 12; id++ {
+		compliance := database.CustomerCompliance{Customer_id: id,
+			Skin_type: r.Intn(5) + 2, Consent_signed: time.Now().Unix(),
+			Consent_version: 1, Eye_protection_ack: true,
+			Updated: time.Now().Unix()}
+		database.SaveCompliance(compliance)
+	}
+
 	//create 550 of each
 	database.AddFakeDoorAccesses()
 	database.AddFakeSessions()
 
 	session := database.Session{Bed_num: 5, Customer_id: 11, Session_time: 4,
-	Time_stamp: time.Now().Unix() - 43201}
+	Time_stamp: time.Now().Unix() - 43201, Location_id: 1}
 
 	database.CreateRecord(session)
 }
@@ -74,7 +85,8 @@ func addFakeKeyfobs() (adminKeyfobs []uint64, customerKeyfobs []uint64) {
 
 func addFakeEmployees(keyfobs []uint64) {
 	for e := range keyfobs {
-		employee := database.Employee{Name: fakeName(), Level: 1, Fob_num: keyfobs[e]}
+		employee := database.Employee{Name: fakeName(), Level: 1, Fob_num: keyfobs[e],
+			Location_id: 1}
 		database.CreateRecord(employee)
 	}
 }
@@ -82,7 +94,7 @@ func addFakeEmployees(keyfobs []uint64) {
 func addFakeCustomers(keyfobs []uint64) {
 	for e := range keyfobs {
 		customer := database.Customer{Name: fakeName(), Level: 3, Fob_num: keyfobs[e],
-			Phone: fakePhone(), Status: true}
+			Phone: fakePhone(), Status: true, Location_id: 1}
 		database.CreateRecord(customer)
 	}
 }
@@ -90,17 +102,17 @@ func addFakeCustomers(keyfobs []uint64) {
 func addFakeBeds() {
 	//Need to fix numbering, quick hax
 	for i := 0; i < 10; i++ {
-		bed := database.Bed{Bed_num: i + 1, Level: 1, Max_time: 15, Name: "Sundash 232"}
+		bed := database.Bed{Location_id: 1, Bed_num: i + 1, Level: 1, Max_time: 15, Name: "Sundash 232"}
 		database.CreateRecord(bed)
 	}
 
 	for i := 0; i < 5; i++ {
-		bed := database.Bed{Bed_num: i + 11, Level: 2, Max_time: 12, Name: "Ameribed 64"}
+		bed := database.Bed{Location_id: 1, Bed_num: i + 11, Level: 2, Max_time: 12, Name: "Ameribed 64"}
 		database.CreateRecord(bed)
 	}
 
 	for i := 0; i < 2; i++ {
-		bed := database.Bed{Bed_num: i + 16, Level: 3, Max_time: 10, Name: "Bad Ass Bed"}
+		bed := database.Bed{Location_id: 1, Bed_num: i + 16, Level: 3, Max_time: 10, Name: "Bad Ass Bed"}
 		database.CreateRecord(bed)
 	}
 }
@@ -119,10 +131,11 @@ func fakeName() string {
 func fakePhone() string {
 	area := []string{"770", "404", "680", "755", "804", "925"}
 
-	first := fmt.Sprintf("%d%d%d", r.Intn(10), r.Intn(10), r.Intn(10))
+	//exchanges can't start with 0 or 1
+	first := fmt.Sprintf("%d%d%d", r.Intn(8)+2, r.Intn(10), r.Intn(10))
 	last := fmt.Sprintf("%d%d%d%d", r.Intn(10), r.Intn(10), r.Intn(10), r.Intn(10))
 
-	return area[r.Intn(len(area))] + "-" + first + "-" + last
+	return "+1" + area[r.Intn(len(area))] + first + last
 }
 
 //could make duplicates
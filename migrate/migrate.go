@@ -8,7 +8,7 @@ import (
 
 func main() {
 	envPtr := flag.String("env", "",
-		"<production | development>, determines which db to migrate")
+		"<production | development | upgrade>, determines which db to migrate")
 	flag.Parse()
 
 	fmt.Println(*envPtr)
@@ -31,8 +31,18 @@ func main() {
 		}
 		fmt.Println("Creating Development DB")
 		createDevelopmentDB()
+	case "upgrade":
+		fmt.Println("Upgrading DB")
+		database.OpenDB()
+		defer database.CloseDB()
+
+		err := database.UpgradeSchema()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 	default:
-		fmt.Println("No environment selected. Please pass env flag (migrate -env=development or -env=production")
+		fmt.Println("No environment selected. Please pass env flag (migrate -env=development, -env=production or -env=upgrade")
 	}
 }
 
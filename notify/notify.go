@@ -0,0 +1,289 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/logging"
+	"github.com/learc83/toastyserver/metrics"
+	"time"
+)
+
+var logger = logging.For("notify")
+
+//how often the outbox is checked for messages to retry, new messages are
+//sent as soon as they are queued
+const sendInterval = 30 * time.Second
+
+//how often memberships are checked for ending soon
+const expiryCheckInterval = 1 * time.Hour
+
+//how long before a membership ends the customer is told
+const expiryNotice = 3 * 24 * time.Hour
+
+//messages sent per pass through the outbox
+const sendBatch = 50
+
+//failed sends are retried after minRetry, doubling up to maxRetry, and given
+//up on after maxAttempts
+const minRetry = 1 * time.Minute
+const maxRetry = 6 * time.Hour
+const maxAttempts = 8
+
+var sent = metrics.NewCounterVec("toasty_notifications_total",
+	"Notification send attempts by channel and outcome", "channel", "outcome")
+
+//wakes Run when a message is queued
+var wake = make(chan struct{}, 1)
+
+//Run sends the outbox and queues membership expiry notices until ctx is
+//cancelled. Errors are db failures, a failed send is just retried
+func Run(ctx context.Context) error {
+	logger.Info("notifications started")
+
+	send := time.NewTicker(sendInterval)
+	defer send.Stop()
+	expiry := time.NewTicker(expiryCheckInterval)
+	defer expiry.Stop()
+
+	err := queueExpiring(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = sendDue(ctx)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		case <-send.C:
+		case <-expiry.C:
+			err = queueExpiring(time.Now())
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sendDue(ctx context.Context) (err error) {
+	msgs, err := database.DueMessages(time.Now().Unix(), sendBatch)
+	if err != nil {
+		return
+	}
+
+	for _, m := range msgs {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		attempts := m.Attempts + 1
+		log := logger.With("outbox_id", m.Id, "kind", m.Kind, "channel", m.Channel,
+			"customer_id", m.Customer_id, "attempt", attempts)
+
+		p := provider(m.Channel)
+		sendErr := errors.New("no provider for channel")
+		if p != nil {
+			sendErr = p.Send(ctx, m)
+		}
+
+		if sendErr == nil {
+			sent.Inc(m.Channel, "sent")
+			log.Debug("notification sent")
+			err = database.MarkMessageSent(m.Id, attempts)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		sent.Inc(m.Channel, "failed")
+
+		var next int64
+		if attempts < maxAttempts {
+			next = time.Now().Add(backoff(attempts)).Unix()
+			log.Warn("notification failed, will retry", "err", sendErr)
+		} else {
+			log.Error("notification failed, giving up", "err", sendErr)
+		}
+
+		err = database.MarkMessageFailed(m.Id, attempts, next, sendErr.Error())
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func backoff(attempts int) time.Duration {
+	d := minRetry
+	for i := 1; i < attempts && d < maxRetry; i++ {
+		d *= 2
+	}
+	if d > maxRetry {
+		d = maxRetry
+	}
+	return d
+}
+
+//Retry puts a message that failed for good back in the outbox
+func Retry(id int) (err error) {
+	err = database.RequeueMessage(id)
+	if err == nil {
+		poke()
+	}
+	return
+}
+
+func poke() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+//Prefs is every kind and channel with whether the customer gets it, their
+//own prefs over the defaults
+func Prefs(cust_id int) (prefs []database.NotificationPref, err error) {
+	set, err := database.NotificationPrefs(cust_id)
+	if err != nil {
+		return
+	}
+
+	for _, kind := range []string{KindReceipt, KindMembershipExpiring, KindBedReady} {
+		for _, channel := range channels {
+			p := database.NotificationPref{Customer_id: cust_id, Kind: kind,
+				Channel: channel, Enabled: defaults[kind][channel]}
+			for _, s := range set {
+				if s.Kind == kind && s.Channel == channel {
+					p.Enabled = s.Enabled
+				}
+			}
+			prefs = append(prefs, p)
+		}
+	}
+
+	return
+}
+
+//SetPref opts a customer in or out of a kind on a channel
+func SetPref(p database.NotificationPref) error {
+	if !validKind(p.Kind) {
+		return fmt.Errorf("unknown notification kind %q", p.Kind)
+	}
+	if !validChannel(p.Channel) {
+		return fmt.Errorf("unknown channel %q", p.Channel)
+	}
+
+	return database.SetNotificationPref(p)
+}
+
+//renders a kind for every channel the customer gets it on and has an address
+//for, then queues them. key identifies the event so it is only sent once
+func queue(kind string, cust_id int, key string, data map[string]interface{}) (err error) {
+	c, err := database.FindCustomerById(cust_id)
+	if err != nil {
+		return
+	}
+	if c.Id == 0 {
+		return fmt.Errorf("customer %d not found", cust_id)
+	}
+	data["Customer"] = c
+
+	prefs, err := Prefs(cust_id)
+	if err != nil {
+		return
+	}
+
+	addresses := map[string]string{ChannelSMS: c.Phone, ChannelEmail: c.Email}
+
+	var msgs []database.Outbox
+	for _, p := range prefs {
+		if p.Kind != kind || !p.Enabled || addresses[p.Channel] == "" {
+			continue
+		}
+
+		m := database.Outbox{Customer_id: cust_id, Kind: kind, Channel: p.Channel,
+			Address: addresses[p.Channel], Dedupe_key: key + ":" + p.Channel}
+		m.Subject, m.Body, err = render(kind, p.Channel, data)
+		if err != nil {
+			return
+		}
+
+		msgs = append(msgs, m)
+	}
+
+	if len(msgs) == 0 {
+		return
+	}
+
+	queued, err := database.QueueMessages(msgs)
+	if queued > 0 {
+		poke()
+	}
+
+	return
+}
+
+//Receipt queues a receipt for a sale. Walk in sales have no one to send to
+//and are skipped
+func Receipt(sale_id int) (err error) {
+	sale, err := database.FindSale(sale_id)
+	if err != nil {
+		return
+	}
+	if sale.Id == 0 {
+		return fmt.Errorf("sale %d not found", sale_id)
+	}
+	if sale.Customer_id == 0 {
+		return
+	}
+
+	return queue(KindReceipt, sale.Customer_id, fmt.Sprintf("receipt:%d", sale_id),
+		map[string]interface{}{"Sale": sale})
+}
+
+//BedReady tells a customer their bed is ready. It's the hook for a waitlist
+//to call when the customer's turn comes up, turn is the unix time it did so
+//the same turn is only sent once
+func BedReady(cust_id int, bed_num int, turn int64) (err error) {
+	bed, err := database.FindBed(bed_num)
+	if err != nil {
+		return
+	}
+	if bed.Bed_num == 0 {
+		return fmt.Errorf("bed %d not found", bed_num)
+	}
+
+	return queue(KindBedReady, cust_id, fmt.Sprintf("bed_ready:%d:%d", cust_id, turn),
+		map[string]interface{}{"Bed": bed})
+}
+
+//queues a notice for memberships ending within expiryNotice. Keyed by the
+//end date, so renewing and then lapsing again gets a new notice
+func queueExpiring(now time.Time) (err error) {
+	accounts, err := database.ExpiringMemberships(now.Unix(),
+		now.Add(expiryNotice).Unix())
+	if err != nil {
+		return
+	}
+
+	for _, a := range accounts {
+		key := fmt.Sprintf("membership_expiring:%d:%d", a.Customer_id, a.Member_until)
+		err = queue(KindMembershipExpiring, a.Customer_id, key,
+			map[string]interface{}{"Until": a.Member_until})
+		if err != nil {
+			logger.Warn("membership notice not queued", "customer_id", a.Customer_id,
+				"err", err)
+		}
+	}
+
+	return nil
+}
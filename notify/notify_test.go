@@ -0,0 +1,305 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//a fresh db with messages written to a file in dir instead of sent
+func setup(t *testing.T) (dir string) {
+	t.Helper()
+
+	dir = t.TempDir()
+	database.SetPath(filepath.Join(dir, "toasty.sqlite"))
+	database.CreateAndOpenDB()
+	t.Cleanup(database.CloseDB)
+
+	err := database.UpgradeSchema()
+	if err != nil {
+		t.Fatalf("UpgradeSchema: %v", err)
+	}
+
+	for _, c := range channels {
+		c := c
+		SetProvider(c, &FileProvider{Path: filepath.Join(dir, "sent.json")})
+		t.Cleanup(func() { SetProvider(c, LogProvider{}) })
+	}
+
+	return dir
+}
+
+//a customer with a phone and an email, returns their id
+func customer(t *testing.T, fob uint64) int {
+	t.Helper()
+
+	err := database.CreateRecord(database.Customer{Name: "Pat", Phone: "5555550100",
+		Email: "pat@example.com", Status: true, Level: 1, Fob_num: fob, Location_id: 1})
+	if err != nil {
+		t.Fatalf("CreateRecord customer: %v", err)
+	}
+	id, _, _, _, err := database.FindCustomer(fob)
+	if err != nil || id == 0 {
+		t.Fatalf("FindCustomer: %d %v", id, err)
+	}
+	return id
+}
+
+func outbox(t *testing.T, cust_id int) []database.Outbox {
+	t.Helper()
+
+	msgs, err := database.ListOutbox("", cust_id, 100)
+	if err != nil {
+		t.Fatalf("ListOutbox: %v", err)
+	}
+	return msgs
+}
+
+//messages FileProvider wrote
+func sentMessages(t *testing.T, path string) (msgs []database.Outbox) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var m database.Outbox
+		err = json.Unmarshal(s.Bytes(), &m)
+		if err != nil {
+			t.Fatalf("unmarshal %q: %v", s.Text(), err)
+		}
+		msgs = append(msgs, m)
+	}
+	return
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 1 * time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, maxRetry},
+		{50, maxRetry},
+	}
+
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestPrefDefaults(t *testing.T) {
+	setup(t)
+	cust_id := customer(t, 201)
+
+	enabled := func() map[string]bool {
+		prefs, err := Prefs(cust_id)
+		if err != nil {
+			t.Fatalf("Prefs: %v", err)
+		}
+		if len(prefs) != len(defaults)*len(channels) {
+			t.Fatalf("%d prefs, want %d", len(prefs), len(defaults)*len(channels))
+		}
+
+		m := make(map[string]bool)
+		for _, p := range prefs {
+			m[p.Kind+":"+p.Channel] = p.Enabled
+		}
+		return m
+	}
+
+	for k, want := range map[string]bool{
+		"receipt:email":             true,
+		"receipt:sms":               false,
+		"membership_expiring:email": true,
+		"membership_expiring:sms":   false,
+		"bed_ready:sms":             true,
+		"bed_ready:email":           false,
+	} {
+		if got := enabled()[k]; got != want {
+			t.Errorf("default %s = %v, want %v", k, got, want)
+		}
+	}
+
+	//the customer's own pref wins, the rest keep their defaults
+	err := SetPref(database.NotificationPref{Customer_id: cust_id, Kind: KindReceipt,
+		Channel: ChannelSMS, Enabled: true})
+	if err != nil {
+		t.Fatalf("SetPref: %v", err)
+	}
+	err = SetPref(database.NotificationPref{Customer_id: cust_id, Kind: KindBedReady,
+		Channel: ChannelSMS, Enabled: false})
+	if err != nil {
+		t.Fatalf("SetPref: %v", err)
+	}
+
+	got := enabled()
+	if !got["receipt:sms"] || got["bed_ready:sms"] || !got["receipt:email"] {
+		t.Errorf("prefs after opting in and out = %v", got)
+	}
+
+	err = SetPref(database.NotificationPref{Customer_id: cust_id, Kind: "coupon",
+		Channel: ChannelSMS})
+	if err == nil {
+		t.Error("SetPref unknown kind, want error")
+	}
+	err = SetPref(database.NotificationPref{Customer_id: cust_id, Kind: KindReceipt,
+		Channel: "fax"})
+	if err == nil {
+		t.Error("SetPref unknown channel, want error")
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	setup(t)
+	cust_id := customer(t, 202)
+
+	err := database.CreateRecord(database.Bed{Location_id: database.LocalLocation(),
+		Bed_num: 1, Level: 1, Max_time: 20, Name: "Stand up"})
+	if err != nil {
+		t.Fatalf("CreateRecord bed: %v", err)
+	}
+
+	//bed ready is text only by default, the same turn is queued once
+	for i := 0; i < 2; i++ {
+		err = BedReady(cust_id, 1, 1000)
+		if err != nil {
+			t.Fatalf("BedReady: %v", err)
+		}
+	}
+	msgs := outbox(t, cust_id)
+	key := fmt.Sprintf("bed_ready:%d:1000:sms", cust_id)
+	if len(msgs) != 1 || msgs[0].Dedupe_key != key {
+		t.Fatalf("outbox after the same turn twice = %+v", msgs)
+	}
+
+	//a new turn is a new message
+	err = BedReady(cust_id, 1, 2000)
+	if err != nil {
+		t.Fatalf("BedReady: %v", err)
+	}
+	if n := len(outbox(t, cust_id)); n != 2 {
+		t.Errorf("%d messages after a second turn, want 2", n)
+	}
+
+	err = BedReady(cust_id, 9, 3000)
+	if err == nil {
+		t.Error("BedReady missing bed, want error")
+	}
+
+	//one message per channel the customer gets it on
+	err = SetPref(database.NotificationPref{Customer_id: cust_id, Kind: KindBedReady,
+		Channel: ChannelEmail, Enabled: true})
+	if err != nil {
+		t.Fatalf("SetPref: %v", err)
+	}
+	err = BedReady(cust_id, 1, 4000)
+	if err != nil {
+		t.Fatalf("BedReady: %v", err)
+	}
+
+	keys := make(map[string]bool)
+	for _, m := range outbox(t, cust_id) {
+		keys[m.Dedupe_key] = true
+	}
+	for _, c := range channels {
+		k := fmt.Sprintf("bed_ready:%d:4000:%s", cust_id, c)
+		if !keys[k] {
+			t.Errorf("no message keyed %s in %v", k, keys)
+		}
+	}
+}
+
+func TestSendRetriesAndGivesUp(t *testing.T) {
+	dir := setup(t)
+	cust_id := customer(t, 203)
+	ctx := context.Background()
+
+	//a provider that can't write fails every send
+	broken := &FileProvider{Path: filepath.Join(dir, "missing", "sent.json")}
+	SetProvider(ChannelEmail, broken)
+
+	_, err := database.QueueMessages([]database.Outbox{{Customer_id: cust_id,
+		Kind: KindReceipt, Channel: ChannelEmail, Address: "pat@example.com",
+		Subject: "Receipt", Body: "Thanks", Dedupe_key: "receipt:1:email"}})
+	if err != nil {
+		t.Fatalf("QueueMessages: %v", err)
+	}
+
+	before := time.Now()
+	err = sendDue(ctx)
+	if err != nil {
+		t.Fatalf("sendDue: %v", err)
+	}
+
+	m := outbox(t, cust_id)[0]
+	if m.Status != database.OutboxPending || m.Attempts != 1 || m.Last_error == "" {
+		t.Fatalf("after a failed send = %+v", m)
+	}
+	wait := time.Unix(m.Next_attempt, 0).Sub(before)
+	if wait < minRetry-time.Second || wait > minRetry+time.Second {
+		t.Errorf("retried after %v, want %v", wait, minRetry)
+	}
+
+	//not due yet, so not tried again
+	err = sendDue(ctx)
+	if err != nil {
+		t.Fatalf("sendDue: %v", err)
+	}
+	if m = outbox(t, cust_id)[0]; m.Attempts != 1 {
+		t.Errorf("attempts = %d before the retry was due", m.Attempts)
+	}
+
+	//the last attempt fails for good
+	err = database.MarkMessageFailed(m.Id, maxAttempts-1, time.Now().Unix(), "down")
+	if err != nil {
+		t.Fatalf("MarkMessageFailed: %v", err)
+	}
+	err = sendDue(ctx)
+	if err != nil {
+		t.Fatalf("sendDue: %v", err)
+	}
+	m = outbox(t, cust_id)[0]
+	if m.Status != database.OutboxFailed || m.Attempts != maxAttempts || m.Next_attempt != 0 {
+		t.Fatalf("after the last attempt = %+v", m)
+	}
+
+	//retried by hand once the provider works
+	SetProvider(ChannelEmail, &FileProvider{Path: filepath.Join(dir, "sent.json")})
+	err = Retry(m.Id)
+	if err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	err = sendDue(ctx)
+	if err != nil {
+		t.Fatalf("sendDue: %v", err)
+	}
+
+	m = outbox(t, cust_id)[0]
+	if m.Status != database.OutboxSent {
+		t.Errorf("status after retry = %q, want sent", m.Status)
+	}
+	sent := sentMessages(t, filepath.Join(dir, "sent.json"))
+	if len(sent) != 1 || sent[0].Address != "pat@example.com" || sent[0].Body != "Thanks" {
+		t.Errorf("file provider wrote %+v", sent)
+	}
+}
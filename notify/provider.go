@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"os"
+	"sync"
+)
+
+//Provider delivers a message on one channel, e.g. an SMS gateway or an SMTP
+//server. Any error is retried with backoff
+type Provider interface {
+	Send(ctx context.Context, m database.Outbox) error
+}
+
+//LogProvider logs messages instead of sending them. It's the default until a
+//real provider is set
+type LogProvider struct{}
+
+func (LogProvider) Send(ctx context.Context, m database.Outbox) error {
+	logger.Info("notification", "outbox_id", m.Id, "channel", m.Channel,
+		"address", m.Address, "subject", m.Subject, "body", m.Body)
+	return nil
+}
+
+//FileProvider appends each message to Path as a line of JSON, so what would
+//have been sent can be checked
+type FileProvider struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (p *FileProvider) Send(ctx context.Context, m database.Outbox) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	return
+}
+
+var providersMu sync.Mutex
+var providers = map[string]Provider{
+	ChannelSMS:   LogProvider{},
+	ChannelEmail: LogProvider{},
+}
+
+//SetProvider replaces the provider for a channel
+func SetProvider(channel string, p Provider) error {
+	if !validChannel(channel) {
+		return fmt.Errorf("unknown channel %q", channel)
+	}
+
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[channel] = p
+	return nil
+}
+
+func provider(channel string) Provider {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	return providers[channel]
+}
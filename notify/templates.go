@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+//kinds of notification
+const (
+	KindReceipt            = "receipt"
+	KindMembershipExpiring = "membership_expiring"
+	KindBedReady           = "bed_ready"
+)
+
+//channels a notification can go out on
+const (
+	ChannelSMS   = "sms"   //sent to Customer.Phone
+	ChannelEmail = "email" //sent to Customer.Email
+)
+
+var channels = []string{ChannelSMS, ChannelEmail}
+
+//whether a customer gets a kind on a channel if they haven't said. Texts are
+//opt in except for bed ready, which they asked for by joining the waitlist
+var defaults = map[string]map[string]bool{
+	KindReceipt:            {ChannelSMS: false, ChannelEmail: true},
+	KindMembershipExpiring: {ChannelSMS: false, ChannelEmail: true},
+	KindBedReady:           {ChannelSMS: true, ChannelEmail: false},
+}
+
+func validKind(kind string) bool {
+	_, ok := defaults[kind]
+	return ok
+}
+
+func validChannel(channel string) bool {
+	for _, c := range channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+//subject and body templates, sms has no subject. Each template gets the
+//customer as .Customer plus what its trigger passes in
+type messageTemplate struct {
+	subject string
+	body    string
+}
+
+var templates = map[string]map[string]messageTemplate{
+	KindReceipt: {
+		ChannelSMS: {body: `Thanks {{.Customer.Name}}! Your receipt for sale #{{.Sale.Id}}: ` +
+			`{{money .Sale.Total}} paid.`},
+		ChannelEmail: {subject: `Your receipt for sale #{{.Sale.Id}}`,
+			body: `Hi {{.Customer.Name}},
+
+Thanks for your purchase on {{date .Sale.Time_stamp}}.
+{{range .Sale.Lines}}
+{{.Quantity}} x {{.Name}}  {{money .Amount}}{{end}}
+{{if .Sale.Discount}}
+Discount  -{{money .Sale.Discount}}{{end}}
+Total  {{money .Sale.Total}}
+{{range .Sale.Payments}}
+Paid by {{.Method}}  {{money .Amount}}{{end}}
+{{range .Sale.Gift_cards}}
+Gift card {{.Display}} worth {{money .Initial}}{{end}}
+`},
+	},
+	KindMembershipExpiring: {
+		ChannelSMS: {body: `Hi {{.Customer.Name}}, your tanning membership ends ` +
+			`{{date .Until}}. Stop by the front desk to renew.`},
+		ChannelEmail: {subject: `Your membership ends {{date .Until}}`,
+			body: `Hi {{.Customer.Name}},
+
+Your unlimited tanning membership ends on {{date .Until}}. Renew at the front
+desk to keep tanning without interruption.
+`},
+	},
+	KindBedReady: {
+		ChannelSMS: {body: `Hi {{.Customer.Name}}, {{.Bed.Name}} is ready for you. ` +
+			`Please check in at the front desk.`},
+		ChannelEmail: {subject: `{{.Bed.Name}} is ready`,
+			body: `Hi {{.Customer.Name}},
+
+It's your turn, {{.Bed.Name}} is ready for you. Please check in at the front
+desk.
+`},
+	},
+}
+
+var funcs = template.FuncMap{
+	//cents to dollars
+	"money": func(cents int) string {
+		return fmt.Sprintf("$%d.%02d", cents/100, cents%100)
+	},
+	//unix time to a local date
+	"date": func(unix int64) string {
+		return time.Unix(unix, 0).Format("Jan 2, 2006")
+	},
+}
+
+func render(kind string, channel string, data map[string]interface{}) (subject string, body string, err error) {
+	t, ok := templates[kind][channel]
+	if !ok {
+		err = fmt.Errorf("no %s template for %s", channel, kind)
+		return
+	}
+
+	subject, err = execute(t.subject, data)
+	if err != nil {
+		return
+	}
+
+	body, err = execute(t.body, data)
+	return
+}
+
+func execute(text string, data map[string]interface{}) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+
+	t, err := template.New("").Funcs(funcs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	err = t.Execute(&b, data)
+	return b.String(), err
+}
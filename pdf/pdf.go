@@ -0,0 +1,130 @@
+//Package pdf writes simple printable text documents, one monospaced line at a
+//time, with automatic page breaks. It's just enough PDF for reports.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//US letter in points
+const pageWidth = 612
+const pageHeight = 792
+const margin = 36
+
+const fontSize = 8
+const leading = 10 //distance between lines
+
+//LineWidth is how many characters fit on a line at the font size used
+const LineWidth = (pageWidth - 2*margin) * 10 / (fontSize * 6) //courier is 0.6em wide
+
+const linesPerPage = (pageHeight - 2*margin) / leading
+
+type Document struct {
+	title string
+	pages [][]string
+}
+
+//New starts a document, the title is printed at the top of every page
+func New(title string) *Document {
+	return &Document{title: title}
+}
+
+//Line adds a line of text, longer lines than LineWidth are cut off
+func (d *Document) Line(text string) {
+	//room for the title and a blank line on each page
+	if len(d.pages) == 0 || len(d.pages[len(d.pages)-1]) >= linesPerPage-2 {
+		d.pages = append(d.pages, nil)
+	}
+
+	if len(text) > LineWidth {
+		text = text[:LineWidth]
+	}
+
+	p := len(d.pages) - 1
+	d.pages[p] = append(d.pages[p], text)
+}
+
+//escapes a string for a PDF literal string, only ascii is supported by the
+//standard fonts without an encoding so everything else becomes ?
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (d *Document) content(page int) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", fontSize, leading, margin,
+		pageHeight-margin)
+	fmt.Fprintf(&b, "(%s) Tj\nT*\nT*\n", escape(fmt.Sprintf("%s  (page %d of %d)",
+		d.title, page+1, len(d.pages))))
+	for _, line := range d.pages[page] {
+		fmt.Fprintf(&b, "(%s) Tj\nT*\n", escape(line))
+	}
+	b.WriteString("ET\n")
+
+	return b.Bytes()
+}
+
+//WriteTo writes the finished document
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	if len(d.pages) == 0 {
+		d.pages = append(d.pages, nil)
+	}
+
+	var b bytes.Buffer
+	var offsets []int
+
+	obj := func(body string) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	b.WriteString("%PDF-1.4\n")
+
+	//objects 1-3 are the catalog, page tree and font, then each page is
+	//followed by its content stream
+	var kids []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+2*i))
+	}
+
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>",
+		strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+
+	for i := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] "+
+			"/Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 5+2*i))
+
+		c := d.content(i)
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(c), c))
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(offsets)+1, xref)
+
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
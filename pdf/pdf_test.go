@@ -0,0 +1,121 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"(a) b\\c", `\(a\) b\\c`},
+		{"tab\there", "tab?here"},
+		{"café ☀", "caf? ?"},
+	}
+
+	for _, tt := range tests {
+		if got := escape(tt.in); got != tt.want {
+			t.Errorf("escape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPages(t *testing.T) {
+	tests := []struct {
+		lines int
+		pages int
+	}{
+		{0, 0},
+		{1, 1},
+		{linesPerPage - 2, 1},
+		{linesPerPage - 1, 2},
+		{3 * (linesPerPage - 2), 3},
+	}
+
+	for _, tt := range tests {
+		d := New("Report")
+		for i := 0; i < tt.lines; i++ {
+			d.Line(strconv.Itoa(i))
+		}
+		if len(d.pages) != tt.pages {
+			t.Errorf("%d lines on %d pages, want %d", tt.lines, len(d.pages), tt.pages)
+		}
+	}
+}
+
+func TestLineCutOff(t *testing.T) {
+	d := New("Report")
+	d.Line(strings.Repeat("x", LineWidth+10))
+	if got := len(d.pages[0][0]); got != LineWidth {
+		t.Errorf("line is %d characters, want %d", got, LineWidth)
+	}
+}
+
+//every xref entry must point at the start of its object, and startxref at
+//the xref table, or readers refuse the file
+func TestWriteTo(t *testing.T) {
+	d := New("Tan Report (all)")
+	for i := 0; i < linesPerPage; i++ {
+		d.Line(fmt.Sprintf("line %d", i))
+	}
+
+	var b bytes.Buffer
+	n, err := d.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d", n, b.Len())
+	}
+	out := b.String()
+
+	if !strings.HasPrefix(out, "%PDF-1.4\n") || !strings.HasSuffix(out, "%%EOF\n") {
+		t.Fatalf("missing header or trailer:\n%s", out)
+	}
+	if !strings.Contains(out, "/Count 2 ") {
+		t.Errorf("want 2 pages")
+	}
+	if !strings.Contains(out, `(Tan Report \(all\)  \(page 2 of 2\)) Tj`) {
+		t.Errorf("missing escaped title on page 2")
+	}
+
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(m[1])
+	if !strings.HasPrefix(out[xref:], "xref\n") {
+		t.Fatalf("startxref %d doesn't point at the xref table", xref)
+	}
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(out[xref:], -1)
+	//catalog, page tree, font, then a page and its contents for each page
+	if len(entries) != 3+2*2 {
+		t.Fatalf("%d xref entries, want %d", len(entries), 3+2*2)
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(e[1])
+		want := fmt.Sprintf("%d 0 obj\n", i+1)
+		if !strings.HasPrefix(out[off:], want) {
+			t.Errorf("xref entry %d points at %q", i+1, out[off:off+10])
+		}
+	}
+}
+
+func TestEmptyDocument(t *testing.T) {
+	var b bytes.Buffer
+	_, err := New("Nothing").WriteTo(&b)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if !strings.Contains(b.String(), "/Count 1 ") {
+		t.Errorf("an empty document should still have a page")
+	}
+}
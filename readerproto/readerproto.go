@@ -0,0 +1,270 @@
+//Package readerproto decodes keyfob reads from the serial output of door
+//readers. Reads arrive a few bytes at a time and the line can carry noise,
+//so the decoder buffers partial frames and skips garbage until the next
+//frame starts instead of giving up on the port.
+package readerproto
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//Format is what a reader sends for each keyfob
+type Format string
+
+const (
+	//tab, the fob number as 8 hex digits, carriage return. The reader the
+	//salon always had
+	Hex Format = "hex"
+
+	//the raw bits of a Wiegand-26 or Wiegand-34 read as 7 or 9 hex digits,
+	//then CR and/or LF, as sent by a Wiegand to serial bridge. Parity is
+	//checked
+	Wiegand Format = "wiegand"
+
+	//the card number in decimal, or the facility code and card number
+	//separated by a comma or colon as printed on the card, then CR and/or LF
+	Decimal Format = "decimal"
+)
+
+//longest line a line based format can send, anything longer is garbage
+const maxLine = 32
+
+//reads in a row that return nothing and no error before Next gives up with
+//io.ErrNoProgress, the same as bufio
+const maxEmptyReads = 100
+
+//ParseFormat returns the Format named s
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case Hex, Wiegand, Decimal:
+		return f, nil
+	}
+	return "", fmt.Errorf("reader format must be %s, %s or %s", Hex, Wiegand, Decimal)
+}
+
+//Read is one keyfob read. Fob is the number stored in Keyfob.Fob_num. For
+//cards with a facility code it's facility code * 65536 + card number, the
+//same number a hex reader gives for the card
+type Read struct {
+	Fob      uint64
+	Facility int    //0 when the format doesn't have one
+	Raw      string //the frame as sent, for logs
+}
+
+//FrameError is a frame that started right but couldn't be decoded. The
+//decoder has already moved past it, so reading can go on
+type FrameError struct {
+	Frame  string
+	Reason string
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("bad reader frame %q: %s", e.Frame, e.Reason)
+}
+
+//Decoder reads keyfob reads from a reader's serial port
+type Decoder struct {
+	r      io.Reader
+	format Format
+
+	chunk [64]byte
+	in    []byte //read from r and not looked at yet
+	err   error  //from r, returned once in is used up
+
+	frame    []byte //the frame so far
+	inFrame  bool
+	overflow bool //line too long, skipping to the end of it
+
+	Skipped int //garbage bytes skipped outside frames
+}
+
+func NewDecoder(r io.Reader, f Format) *Decoder {
+	return &Decoder{r: r, format: f}
+}
+
+//Next blocks until the next read. A *FrameError is a bad frame and the
+//decoder can be used again, any other error is from the underlying reader
+func (d *Decoder) Next() (Read, error) {
+	empty := 0
+	for {
+		for len(d.in) > 0 {
+			b := d.in[0]
+			d.in = d.in[1:]
+
+			var rd Read
+			var err error
+			var done bool
+			if d.format == Hex {
+				rd, err, done = d.feedHex(b)
+			} else {
+				rd, err, done = d.feedLine(b)
+			}
+			if done {
+				return rd, err
+			}
+		}
+
+		if d.err != nil {
+			err := d.err
+			d.err = nil
+			return Read{}, err
+		}
+
+		n, err := d.r.Read(d.chunk[:])
+		d.in = d.chunk[:n]
+		d.err = err
+
+		if n > 0 || err != nil {
+			empty = 0
+		} else if empty++; empty >= maxEmptyReads {
+			return Read{}, io.ErrNoProgress
+		}
+	}
+}
+
+//tab, 8 hex digits, CR. A tab always starts a new frame, so a frame cut off
+//by noise doesn't swallow the next one
+func (d *Decoder) feedHex(b byte) (rd Read, err error, done bool) {
+	if b == '\t' {
+		d.Skipped += len(d.frame)
+		d.frame = append(d.frame[:0], b)
+		d.inFrame = true
+		return
+	}
+	if !d.inFrame {
+		d.Skipped++
+		return
+	}
+
+	d.frame = append(d.frame, b)
+	if len(d.frame) < 10 {
+		if !isHex(b) {
+			return d.badFrame("not a hex digit")
+		}
+		return
+	}
+
+	if b != '\r' {
+		return d.badFrame("no carriage return after 8 hex digits")
+	}
+	frame := string(d.frame[1:9])
+	d.inFrame = false
+	d.frame = d.frame[:0]
+
+	fob, perr := strconv.ParseUint(frame, 16, 64)
+	if perr != nil {
+		return Read{}, &FrameError{Frame: frame, Reason: perr.Error()}, true
+	}
+	return Read{Fob: fob, Raw: frame}, nil, true
+}
+
+//a line ended by CR or LF. Blank lines, e.g. between CR and LF, are skipped
+func (d *Decoder) feedLine(b byte) (rd Read, err error, done bool) {
+	if b != '\r' && b != '\n' {
+		if d.overflow {
+			d.Skipped++
+			return
+		}
+		d.frame = append(d.frame, b)
+		if len(d.frame) > maxLine {
+			d.overflow = true
+			return d.badFrame("line too long")
+		}
+		return
+	}
+
+	line := strings.TrimSpace(string(d.frame))
+	d.frame = d.frame[:0]
+	if d.overflow || line == "" {
+		d.overflow = false
+		return
+	}
+
+	if d.format == Wiegand {
+		rd, err = parseWiegand(line)
+	} else {
+		rd, err = parseDecimal(line)
+	}
+	return rd, err, true
+}
+
+//drops the frame so far
+func (d *Decoder) badFrame(reason string) (Read, error, bool) {
+	frame := string(d.frame)
+	d.frame = d.frame[:0]
+	d.inFrame = false
+	return Read{}, &FrameError{Frame: frame, Reason: reason}, true
+}
+
+func isHex(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+//Wiegand-26: even parity, 8 bit facility code, 16 bit card number, odd
+//parity. Wiegand-34 is the same with a 16 bit facility code. The first
+//parity bit covers the first half of the data bits, the last one the rest
+func parseWiegand(line string) (Read, error) {
+	bits := 0
+	switch len(line) {
+	case 7:
+		bits = 26
+	case 9:
+		bits = 34
+	default:
+		return Read{}, &FrameError{Frame: line, Reason: "wiegand reads are 7 or 9 hex digits"}
+	}
+
+	v, err := strconv.ParseUint(line, 16, 64)
+	if err != nil {
+		return Read{}, &FrameError{Frame: line, Reason: err.Error()}
+	}
+	if v>>uint(bits) != 0 {
+		return Read{}, &FrameError{Frame: line,
+			Reason: fmt.Sprintf("more than %d bits", bits)}
+	}
+
+	//bits numbered from the first sent, the most significant
+	bit := func(i int) uint64 { return (v >> uint(bits-1-i)) & 1 }
+	half := (bits - 2) / 2
+
+	var even, odd uint64
+	for i := 1; i <= half; i++ {
+		even ^= bit(i)
+	}
+	for i := half + 1; i <= 2*half; i++ {
+		odd ^= bit(i)
+	}
+	if even != bit(0) || odd == bit(bits-1) {
+		return Read{}, &FrameError{Frame: line, Reason: "parity check failed"}
+	}
+
+	data := (v >> 1) & (1<<uint(bits-2) - 1)
+	card := data & 0xffff
+	facility := data >> 16
+
+	return Read{Fob: facility<<16 | card, Facility: int(facility), Raw: line}, nil
+}
+
+//"12345678" or "123,45678"
+func parseDecimal(line string) (Read, error) {
+	sep := strings.IndexAny(line, ",:")
+	if sep < 0 {
+		fob, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return Read{}, &FrameError{Frame: line, Reason: "not a decimal card number"}
+		}
+		return Read{Fob: fob, Raw: line}, nil
+	}
+
+	facility, ferr := strconv.ParseUint(strings.TrimSpace(line[:sep]), 10, 16)
+	card, cerr := strconv.ParseUint(strings.TrimSpace(line[sep+1:]), 10, 16)
+	if ferr != nil || cerr != nil {
+		return Read{}, &FrameError{Frame: line,
+			Reason: "facility code and card number must be 0 to 65535"}
+	}
+
+	return Read{Fob: facility<<16 | card, Facility: int(facility), Raw: line}, nil
+}
@@ -0,0 +1,217 @@
+package readerproto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+//hands out chunks one Read at a time, then err. lastErr returns err with the
+//last chunk instead of after it, like a port closed mid read
+type chunkReader struct {
+	chunks  []string
+	err     error
+	lastErr bool
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, r.err
+	}
+
+	n := copy(b, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	if len(r.chunks) == 0 && r.lastErr {
+		return n, r.err
+	}
+	return n, nil
+}
+
+//every read as "fob N" or "bad reason", until the first error that isn't a
+//FrameError which ends it as "err message"
+func decodeAll(f Format, r io.Reader) (got []string, skipped int) {
+	d := NewDecoder(r, f)
+	for i := 0; i < 100; i++ {
+		rd, err := d.Next()
+
+		var fe *FrameError
+		switch {
+		case errors.As(err, &fe):
+			got = append(got, "bad "+fe.Reason)
+		case err != nil:
+			return append(got, "err "+err.Error()), d.Skipped
+		default:
+			got = append(got, fmt.Sprintf("fob %d", rd.Fob))
+		}
+	}
+	return append(got, "too many reads"), d.Skipped
+}
+
+func TestDecoder(t *testing.T) {
+	errPort := errors.New("port gone")
+
+	tests := []struct {
+		name    string
+		format  Format
+		r       *chunkReader
+		want    []string
+		skipped int
+	}{
+		{
+			name:   "hex frame in one read",
+			format: Hex,
+			r:      &chunkReader{chunks: []string{"\t0000ABCD\r"}, err: io.EOF},
+			want:   []string{"fob 43981", "err EOF"},
+		},
+		{
+			name:   "hex frames split across reads",
+			format: Hex,
+			r: &chunkReader{chunks: []string{"\t00", "00AB", "CD\r\t0", "0000", "001", "\r"},
+				err: io.EOF},
+			want: []string{"fob 43981", "fob 1", "err EOF"},
+		},
+		{
+			name:    "noise before a tab",
+			format:  Hex,
+			r:       &chunkReader{chunks: []string{"xy\x00\r\n", "\t00000002\r"}, err: io.EOF},
+			want:    []string{"fob 2", "err EOF"},
+			skipped: 5,
+		},
+		{
+			name:    "tab mid frame starts over",
+			format:  Hex,
+			r:       &chunkReader{chunks: []string{"\t0000\t00000003\r"}, err: io.EOF},
+			want:    []string{"fob 3", "err EOF"},
+			skipped: 5,
+		},
+		{
+			name:   "missing CR",
+			format: Hex,
+			r:      &chunkReader{chunks: []string{"\t00000004X\t00000005\r"}, err: io.EOF},
+			want: []string{"bad no carriage return after 8 hex digits", "fob 5",
+				"err EOF"},
+		},
+		{
+			name:    "non hex digit",
+			format:  Hex,
+			r:       &chunkReader{chunks: []string{"\t00G00000\r\t00000006\r"}, err: io.EOF},
+			want:    []string{"bad not a hex digit", "fob 6", "err EOF"},
+			skipped: 6,
+		},
+		{
+			name:   "reader error after buffered frames",
+			format: Hex,
+			r: &chunkReader{chunks: []string{"\t00000007\r\t0000000", "8\r\t00"},
+				err: errPort, lastErr: true},
+			want: []string{"fob 7", "fob 8", "err port gone"},
+		},
+		{
+			name:   "wiegand 26",
+			format: Wiegand,
+			r:      &chunkReader{chunks: []string{"2F623AE\r\n", "0000002\n1FFFFFF\r"}, err: io.EOF},
+			want:   []string{"fob 8065495", "fob 1", "fob 16777215", "err EOF"},
+		},
+		{
+			name:   "wiegand 34",
+			format: Wiegand,
+			r:      &chunkReader{chunks: []string{"007D1", "A862\r\n"}, err: io.EOF},
+			want:   []string{"fob 65590321", "err EOF"},
+		},
+		{
+			name:   "wiegand parity fails",
+			format: Wiegand,
+			r: &chunkReader{chunks: []string{"2F623AF\n0F623AE\n007D1A863\n207D1A862\n"},
+				err: io.EOF},
+			want: []string{"bad parity check failed", "bad parity check failed",
+				"bad parity check failed", "bad parity check failed", "err EOF"},
+		},
+		{
+			name:   "wiegand length",
+			format: Wiegand,
+			r: &chunkReader{chunks: []string{"2F623A\n2F623AE0\n007D1A8620\n4000000\nZZZZZZZ\n"},
+				err: io.EOF},
+			want: []string{"bad wiegand reads are 7 or 9 hex digits",
+				"bad wiegand reads are 7 or 9 hex digits",
+				"bad wiegand reads are 7 or 9 hex digits", "bad more than 26 bits",
+				`bad strconv.ParseUint: parsing "ZZZZZZZ": invalid syntax`, "err EOF"},
+		},
+		{
+			name:   "decimal card number",
+			format: Decimal,
+			r:      &chunkReader{chunks: []string{"1234", "5678\r\n", " 42 \n"}, err: io.EOF},
+			want:   []string{"fob 12345678", "fob 42", "err EOF"},
+		},
+		{
+			name:   "decimal facility code",
+			format: Decimal,
+			r:      &chunkReader{chunks: []string{"123,45678\n123:45678\r 1 , 2 \n"}, err: io.EOF},
+			want:   []string{"fob 8106606", "fob 8106606", "fob 65538", "err EOF"},
+		},
+		{
+			name:   "decimal overflow",
+			format: Decimal,
+			r: &chunkReader{chunks: []string{"65536,1\n1:65536\n65535:65535\n",
+				"99999999999999999999\n12a4\n"}, err: io.EOF},
+			want: []string{"bad facility code and card number must be 0 to 65535",
+				"bad facility code and card number must be 0 to 65535", "fob 4294967295",
+				"bad not a decimal card number", "bad not a decimal card number", "err EOF"},
+		},
+		{
+			name:   "line too long recovers at the next line",
+			format: Decimal,
+			r: &chunkReader{chunks: []string{strings.Repeat("1", 20),
+				strings.Repeat("2", 20) + "\r\n", "99\n"}, err: io.EOF},
+			want:    []string{"bad line too long", "fob 99", "err EOF"},
+			skipped: 40 - maxLine - 1,
+		},
+		{
+			name:   "reader error after a buffered line",
+			format: Wiegand,
+			r:      &chunkReader{chunks: []string{"0000002\n00"}, err: errPort, lastErr: true},
+			want:   []string{"fob 1", "err port gone"},
+		},
+		{
+			name:   "empty reads then data",
+			format: Hex,
+			r: &chunkReader{chunks: []string{"", "", "\t00000009", "", "\r"},
+				err: io.EOF},
+			want: []string{"fob 9", "err EOF"},
+		},
+		{
+			name:   "reader that never makes progress",
+			format: Hex,
+			r:      &chunkReader{chunks: []string{"\t0000"}, err: nil},
+			want:   []string{"err " + io.ErrNoProgress.Error()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped := decodeAll(tt.format, tt.r)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+			if skipped != tt.skipped {
+				t.Errorf("skipped %d, want %d", skipped, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, s := range []string{"hex", "wiegand", "decimal"} {
+		f, err := ParseFormat(s)
+		if err != nil || string(f) != s {
+			t.Errorf("ParseFormat(%q) = %q, %v", s, f, err)
+		}
+	}
+
+	if _, err := ParseFormat("HEX"); err == nil {
+		t.Error(`ParseFormat("HEX") want error`)
+	}
+}
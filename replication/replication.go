@@ -0,0 +1,280 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/logging"
+	"github.com/learc83/toastyserver/metrics"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+//Every location's server syncs with head office, see database/sync.go for
+//what is synced and how conflicts are settled. Each pass pushes the changes
+//made here since the last push then pulls the changes head office has from
+//everywhere else. If head office can't be reached nothing is lost, changes
+//wait in the change log and go on the next pass that gets through.
+//
+//TOASTY_SYNC_URL is head office's server, e.g. http://office:9000, head
+//office itself leaves it unset. TOASTY_SYNC_KEY must be the same everywhere,
+//head office won't sync without it
+
+var logger = logging.For("sync")
+
+const defaultInterval = 1 * time.Minute
+
+//changes per request
+const batchSize = 500
+
+const requestTimeout = 30 * time.Second
+
+//KeyHeader carries TOASTY_SYNC_KEY on every sync request
+const KeyHeader = "X-Toasty-Sync-Key"
+
+var synced = metrics.NewCounterVec("toasty_sync_changes_total",
+	"Changes sent to or applied from head office", "direction")
+
+var passes = metrics.NewCounterVec("toasty_sync_passes_total",
+	"Sync passes by outcome", "outcome")
+
+//PushRequest is the body of /sync/push
+type PushRequest struct {
+	Node    int
+	Changes []database.Change
+}
+
+//PullResponse is the body /sync/pull answers with, Last is the since for the
+//next pull
+type PullResponse struct {
+	Changes []database.Change
+	Last    int64
+	More    bool
+}
+
+//head office couldn't be reached or said no, the pass is tried again later
+type remoteError struct {
+	err error
+}
+
+func (e remoteError) Error() string {
+	return e.err.Error()
+}
+
+type client struct {
+	url  string
+	key  string
+	http *http.Client
+}
+
+//Run syncs with head office every TOASTY_SYNC_INTERVAL (a duration, 1m by
+//default) until ctx is cancelled. Returns nil straight away if there is no
+//TOASTY_SYNC_URL. Errors are local db failures, head office being down is
+//only logged
+func Run(ctx context.Context) error {
+	c := client{url: os.Getenv("TOASTY_SYNC_URL"), key: os.Getenv("TOASTY_SYNC_KEY"),
+		http: &http.Client{Timeout: requestTimeout}}
+	if c.url == "" {
+		logger.Info("sync disabled, no head office")
+		return nil
+	}
+
+	interval := defaultInterval
+	if i := os.Getenv("TOASTY_SYNC_INTERVAL"); i != "" {
+		d, err := time.ParseDuration(i)
+		if err != nil {
+			return fmt.Errorf("bad TOASTY_SYNC_INTERVAL: %s", err)
+		}
+		interval = d
+	}
+
+	tracked, err := database.TrackExistingRows()
+	if err != nil {
+		return err
+	}
+	if tracked > 0 {
+		logger.Info("existing rows added to the change log", "count", tracked)
+	}
+
+	logger.Info("sync started", "head_office", c.url, "interval", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err = c.syncOnce(ctx)
+
+		var remote remoteError
+		if errors.As(err, &remote) {
+			passes.Inc("offline")
+			pending, _ := database.PendingChanges(c.url)
+			logger.Warn("head office unreachable, will retry", "err", err,
+				"pending", pending)
+		} else if err != nil {
+			return err
+		} else {
+			passes.Inc("ok")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c client) syncOnce(ctx context.Context) (err error) {
+	pushed, err := c.push(ctx)
+	if err != nil {
+		return
+	}
+
+	pulled, err := c.pull(ctx)
+	if err != nil {
+		return
+	}
+
+	if pushed > 0 || pulled > 0 {
+		logger.Info("synced", "pushed", pushed, "applied", pulled)
+	}
+
+	return
+}
+
+//sends changes made here in batches, the cursor only moves once head office
+//has them
+func (c client) push(ctx context.Context) (pushed int, err error) {
+	for ctx.Err() == nil {
+		var since int64
+		since, _, err = database.SyncCursors(c.url)
+		if err != nil {
+			return
+		}
+
+		var changes []database.Change
+		changes, err = database.LocalChanges(since, batchSize)
+		if err != nil || len(changes) == 0 {
+			return
+		}
+
+		body, jerr := json.Marshal(PushRequest{Node: database.LocalLocation(),
+			Changes: changes})
+		if jerr != nil {
+			return pushed, jerr
+		}
+
+		err = c.do(ctx, http.MethodPost, "/sync/push", bytes.NewReader(body), nil)
+		if err != nil {
+			return
+		}
+
+		err = database.SetPushCursor(c.url, changes[len(changes)-1].Seq)
+		if err != nil {
+			return
+		}
+
+		pushed += len(changes)
+		synced.Add(float64(len(changes)), "push")
+		if len(changes) < batchSize {
+			return
+		}
+	}
+
+	return
+}
+
+//applies head office's changes in batches, each batch and the cursor move
+//together
+func (c client) pull(ctx context.Context) (applied int, err error) {
+	for ctx.Err() == nil {
+		var since int64
+		_, since, err = database.SyncCursors(c.url)
+		if err != nil {
+			return
+		}
+
+		q := url.Values{}
+		q.Set("node", strconv.Itoa(database.LocalLocation()))
+		q.Set("since", strconv.FormatInt(since, 10))
+		q.Set("limit", strconv.Itoa(batchSize))
+
+		var resp PullResponse
+		err = c.do(ctx, http.MethodGet, "/sync/pull?"+q.Encode(), nil, &resp)
+		if err != nil {
+			return
+		}
+
+		var n int
+		n, err = database.ApplyPulled(c.url, resp.Changes, resp.Last)
+		if err != nil {
+			return
+		}
+
+		applied += n
+		synced.Add(float64(n), "pull")
+		if !resp.More {
+			return
+		}
+	}
+
+	return
+}
+
+//any failure talking to head office is a remoteError
+func (c client) do(ctx context.Context, method string, path string, body *bytes.Reader,
+	out interface{}) error {
+
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequestWithContext(ctx, method, c.url+path, body)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, c.url+path, nil)
+	}
+	if err != nil {
+		return remoteError{err}
+	}
+	req.Header.Set(KeyHeader, c.key)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return remoteError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		return remoteError{fmt.Errorf("%s %s: %s %s", method, path, resp.Status, e.Error)}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	d := json.NewDecoder(resp.Body)
+	d.UseNumber()
+	err = d.Decode(out)
+	if err != nil {
+		return remoteError{err}
+	}
+
+	return nil
+}
+
+//Authorized checks a sync request has the sync key. No key configured means
+//sync is off
+func Authorized(req *http.Request) bool {
+	key := os.Getenv("TOASTY_SYNC_KEY")
+	got := req.Header.Get(KeyHeader)
+	return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(got)) == 1
+}
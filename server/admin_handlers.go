@@ -1,7 +1,10 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/logging"
 	"net/http"
 )
 
@@ -27,14 +30,22 @@ func employeeLogin(req *http.Request, result map[string]interface{}) {
 	result["name"] = name
 }
 
+//sort: id, name, level or status--see getReportFilter for paging params
 func customerList(req *http.Request, result map[string]interface{}) {
-	customers, err := database.RecentFiftyCustomers()
+	filter, err := getReportFilter(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Customer List")
+		return
+	}
+
+	customers, total, err := database.ListCustomers(filter)
 	if err != nil {
 		result["error"] = stringifyErr(err, "Error Displaying Customer List")
 		return
 	}
 
 	result["customers"] = customers
+	result["total"] = total
 }
 
 func customerListByName(req *http.Request, result map[string]interface{}) {
@@ -44,7 +55,54 @@ func customerListByName(req *http.Request, result map[string]interface{}) {
 		return
 	}
 
-	customers, err := database.FindCustomersByName(params["name"].(string))
+	//best matches only, customer_search pages through the rest
+	customers, _, err := database.SearchCustomers(params["name"].(string), 0, 0)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Searching Customers")
+		return
+	}
+
+	result["customers"] = customers
+}
+
+//q searches names, phone numbers and emails, see database.SearchCustomers.
+//limit and offset page through the results. total can be short of every
+//match for a very broad q
+func customerSearch(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"q", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Searching Customers")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"limit", "int"}, param{"offset", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Searching Customers")
+		return
+	}
+	limit, _ := opts["limit"].(int)
+	offset, _ := opts["offset"].(int)
+
+	customers, total, err := database.SearchCustomers(params["q"].(string), limit, offset)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Searching Customers")
+		return
+	}
+
+	result["customers"] = customers
+	result["total"] = total
+}
+
+//phone is a whole phone number in any format or its last 4 digits, for
+//finding customers who forgot their keyfob
+func customerListByPhone(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"phone", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Searching Customers")
+		return
+	}
+
+	customers, err := database.FindCustomersByPhone(params["phone"].(string))
 	if err != nil {
 		result["error"] = stringifyErr(err, "Error Searching Customers")
 		return
@@ -53,11 +111,103 @@ func customerListByName(req *http.Request, result map[string]interface{}) {
 	result["customers"] = customers
 }
 
+//number of sessions and door accesses shown on the customer profile
+const (
+	profileHistoryDefault = 10
+	profileHistoryMax     = 200
+)
+
+//full profile for one customer: /customer/{id}?history=N, N is capped at
+//profileHistoryMax
+func customerProfile(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Customer")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"history", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Customer")
+		return
+	}
+
+	history := profileHistoryDefault
+	if h, ok := opts["history"]; ok {
+		history = h.(int)
+	}
+	if history < 1 {
+		result["error"] = stringifyErr(errors.New("history must be at least 1"),
+			"Error Displaying Customer")
+		return
+	}
+	if history > profileHistoryMax {
+		history = profileHistoryMax
+	}
+
+	id := params["id"].(int)
+	customer, err := database.FindCustomerById(id)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Customer")
+		return
+	}
+
+	//customer id has a default value of 0
+	if customer.Id == 0 {
+		result["error"] = stringifyErr(errors.New("Customer not found"),
+			"Error Displaying Customer")
+		return
+	}
+
+	sessions, err := database.CustomerSessions(id, history)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Customer")
+		return
+	}
+
+	doorAccesses, err := database.CustomerDoorAccesses(id, history)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Customer")
+		return
+	}
+
+	monthCount, err := database.SessionsThisMonth(id)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Customer")
+		return
+	}
+
+	//default values are 0 if there is no session or cancellation
+	_, lastSessionTime, lastSessionBed, err := database.FindMostRecentSession(id)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Customer")
+		return
+	}
+
+	lastCancelled, err := database.LastCancelledSessionTime(id)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Customer")
+		return
+	}
+
+	result["customer"] = customer
+	result["keyfobTen"] = customer.Fob_num
+	result["keyfobHex"] = fmt.Sprintf("%X", customer.Fob_num)
+	result["active"] = customer.Status
+	result["billing_suspended"] = customer.Billing_suspended
+	result["tanSessions"] = sessions
+	result["doorAccesses"] = doorAccesses
+	result["sessionsThisMonth"] = monthCount
+	result["lastSessionTime"] = lastSessionTime
+	result["lastSessionBed"] = lastSessionBed
+	result["lastCancelledTime"] = lastCancelled
+}
+
 //TODO enforce non-blank customer name string
 func addNewCustomer(req *http.Request, result map[string]interface{}) {
 	params, err := getParams(req,
 		param{"name", "str"},
-		param{"phone_number", "str"},
+		param{"phone_number", "phone"},
 		param{"level", "int"},
 		param{"keyfob_number", "uint64"})
 
@@ -66,12 +216,38 @@ func addNewCustomer(req *http.Request, result map[string]interface{}) {
 		return
 	}
 
+	//email is optional, it's only used for notifications. New customers
+	//belong to this location unless another is given
+	opts, err := getOptionalParams(req, param{"email", "string"},
+		param{"location_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Customer")
+		return
+	}
+	email, _ := opts["email"].(string)
+	location, ok := opts["location_id"].(int)
+	if !ok {
+		location = database.LocalLocation()
+	} else {
+		var l database.Location
+		l, err = database.FindLocation(location)
+		if err == nil && l.Id == 0 {
+			err = errors.New("location not found")
+		}
+		if err != nil {
+			result["error"] = stringifyErr(err, "Error Adding New Customer")
+			return
+		}
+	}
+
 	customer := database.Customer{
-		Name:    params["name"].(string),
-		Phone:   params["phone_number"].(string),
-		Status:  true,
-		Level:   params["level"].(int),
-		Fob_num: params["keyfob_number"].(uint64)}
+		Name:        params["name"].(string),
+		Phone:       params["phone_number"].(string),
+		Email:       email,
+		Status:      true,
+		Level:       params["level"].(int),
+		Fob_num:     params["keyfob_number"].(uint64),
+		Location_id: location}
 
 	err = database.CreateRecord(customer)
 
@@ -81,6 +257,30 @@ func addNewCustomer(req *http.Request, result map[string]interface{}) {
 	}
 }
 
+//a blank email stops email notifications
+func updateCustomerContact(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"customer_id", "int"},
+		param{"phone_number", "phone"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Customer")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"email", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Customer")
+		return
+	}
+	email, _ := opts["email"].(string)
+
+	err = database.UpdateCustomerContact(params["customer_id"].(int),
+		params["phone_number"].(string), email)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Customer")
+		return
+	}
+}
+
 func deleteCustomer(req *http.Request, result map[string]interface{}) {
 	params, err := getParams(req, param{"customer_id", "int"})
 
@@ -109,24 +309,42 @@ func availableCustomerKeyfobs(req *http.Request, result map[string]interface{})
 	result["keyfobsHex"] = keyfobsHex
 }
 
+//sort: time, name, location or door--see getReportFilter for filter and
+//paging params, door_id filters by door
 func doorReport(req *http.Request, result map[string]interface{}) {
-	accesses, err := database.RecentDoorAccesses() //500
+	filter, err := getReportFilter(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Door Report")
+		return
+	}
+
+	accesses, total, err := database.RecentDoorAccesses(filter)
 	if err != nil {
 		result["error"] = stringifyErr(err, "Error Displaying Door Report")
 		return
 	}
 
 	result["doorAccesses"] = accesses
+	result["total"] = total
 }
 
+//sort: time, name, bed or session_time--see getReportFilter for filter and
+//paging params
 func tanReport(req *http.Request, result map[string]interface{}) {
-	sessions, err := database.RecentTanSessions() //500
+	filter, err := getReportFilter(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Tan Report")
+		return
+	}
+
+	sessions, total, err := database.RecentTanSessions(filter)
 	if err != nil {
 		result["error"] = stringifyErr(err, "Error Displaying Tan Report")
 		return
 	}
 
 	result["tanSessions"] = sessions
+	result["total"] = total
 }
 
 //TODO enforce non-blank bed name string
@@ -146,12 +364,15 @@ func addNewBed(req *http.Request, result map[string]interface{}) {
 		Max_time: params["max_time"].(int),
 		Name:	  params["name"].(string)}
 
-	err = database.CreateRecord(bed)
+	//beds are added to this location
+	bedNum, err := database.AddBed(bed)
 
 	if err != nil {
 		result["error"] = stringifyErr(err, "Error Adding New Bed")
 		return
 	}
+
+	result["bed_num"] = bedNum
 }
 
 func deleteBed(req *http.Request, result map[string]interface{}) {
@@ -237,4 +458,25 @@ func moveBedUp(req *http.Request, result map[string]interface{}) {
 		result["error"] = stringifyErr(err, "Error Moving Bed Up")
 		return
 	}
-}
\ No newline at end of file
+}
+
+func logLevel(req *http.Request, result map[string]interface{}) {
+	result["level"] = logging.Level()
+}
+
+//debug level turns on serial byte dumps from the door and tmak
+func setLogLevel(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"level", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Setting Log Level")
+		return
+	}
+
+	err = logging.SetLevel(params["level"].(string))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Setting Log Level")
+		return
+	}
+
+	result["level"] = logging.Level()
+}
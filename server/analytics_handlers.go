@@ -0,0 +1,241 @@
+package server
+
+import (
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//dashboard numbers don't need to be up to the second, and some of these
+//queries scan the whole Session table
+const analyticsCacheTTL = 5 * time.Minute
+
+//range used when from and to aren't given
+const analyticsDefaultDays = 30
+
+//customers who haven't tanned in this many days are lapsed
+const activeCustomerDays = 30
+
+//used for bed utilization when open_hours isn't given
+const defaultOpenHours = 12
+
+type cachedResult struct {
+	result  map[string]interface{}
+	expires time.Time
+}
+
+var analyticsCache = struct {
+	mu      sync.Mutex
+	results map[string]cachedResult
+}{results: make(map[string]cachedResult)}
+
+//wraps an analytics handler so results are cached by url. Errors aren't cached
+func cachedAnalytics(handler toastyHndlrFnc) toastyHndlrFnc {
+	return func(req *http.Request, result map[string]interface{}) {
+		key := req.URL.Path + "?" + req.URL.RawQuery
+
+		analyticsCache.mu.Lock()
+		c, ok := analyticsCache.results[key]
+		analyticsCache.mu.Unlock()
+
+		if ok && time.Now().Before(c.expires) {
+			for k, v := range c.result {
+				result[k] = v
+			}
+			result["cached"] = true
+			return
+		}
+
+		fresh := make(map[string]interface{})
+		handler(req, fresh)
+		for k, v := range fresh {
+			result[k] = v
+		}
+
+		if resultError(fresh) != "" {
+			return
+		}
+
+		analyticsCache.mu.Lock()
+		//drop stale entries so odd date ranges don't pile up
+		for k, c := range analyticsCache.results {
+			if time.Now().After(c.expires) {
+				delete(analyticsCache.results, k)
+			}
+		}
+		analyticsCache.results[key] = cachedResult{result: fresh,
+			expires: time.Now().Add(analyticsCacheTTL)}
+		analyticsCache.mu.Unlock()
+	}
+}
+
+//from and to are dates, to is inclusive. Defaults to the last 30 days.
+//location_id limits the numbers to one location, without it they're for
+//every location
+func getAnalyticsRange(req *http.Request) (from time.Time, to time.Time, location int, err error) {
+	params, err := getOptionalParams(req, param{"from", "date"}, param{"to", "date"},
+		param{"location_id", "int"})
+	if err != nil {
+		return
+	}
+
+	location, _ = params["location_id"].(int)
+
+	t := time.Now()
+	to = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+	if p, ok := params["to"]; ok {
+		to = p.(time.Time).AddDate(0, 0, 1)
+	}
+
+	from = to.AddDate(0, 0, -analyticsDefaultDays)
+	if p, ok := params["from"]; ok {
+		from = p.(time.Time)
+	}
+
+	return
+}
+
+//period: day, week or month
+func sessionsPerPeriod(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"period", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Counting Sessions")
+		return
+	}
+
+	from, to, location, err := getAnalyticsRange(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Counting Sessions")
+		return
+	}
+
+	counts, err := database.SessionsPerPeriod(params["period"].(string),
+		from.Unix(), to.Unix(), location)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Counting Sessions")
+		return
+	}
+
+	result["periods"] = counts
+}
+
+//utilization is minutes in use divided by minutes open, open_hours is the
+//number of hours a day the salon is open
+func bedUtilization(req *http.Request, result map[string]interface{}) {
+	params, err := getOptionalParams(req, param{"open_hours", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Bed Utilization")
+		return
+	}
+
+	openHours := defaultOpenHours
+	if h, ok := params["open_hours"]; ok {
+		openHours = h.(int)
+	}
+
+	from, to, location, err := getAnalyticsRange(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Bed Utilization")
+		return
+	}
+
+	usage, err := database.BedUtilization(from.Unix(), to.Unix(), location)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Bed Utilization")
+		return
+	}
+
+	days := int(to.Sub(from).Hours()/24 + 0.5)
+	openMinutes := days * openHours * 60
+
+	//keyed by bed number, which repeats across locations, so beds at
+	//other locations are keyed by location_id-bed_num
+	utilization := make(map[string]float64)
+	for _, u := range usage {
+		key := strconv.Itoa(u.Bed_num)
+		if location == 0 && u.Location_id != database.LocalLocation() {
+			key = fmt.Sprintf("%d-%d", u.Location_id, u.Bed_num)
+		}
+		if openMinutes > 0 {
+			utilization[key] = float64(u.Minutes) / float64(openMinutes)
+		}
+	}
+
+	result["beds"] = usage
+	result["utilization"] = utilization
+	result["openMinutes"] = openMinutes
+}
+
+//heatmap[weekday][hour], weekday 0 is Sunday
+func peakHours(req *http.Request, result map[string]interface{}) {
+	from, to, location, err := getAnalyticsRange(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Peak Hours")
+		return
+	}
+
+	heatmap, err := database.PeakHours(from.Unix(), to.Unix(), location)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Peak Hours")
+		return
+	}
+
+	result["heatmap"] = heatmap
+}
+
+func cancellationRate(req *http.Request, result map[string]interface{}) {
+	from, to, location, err := getAnalyticsRange(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Cancellation Rate")
+		return
+	}
+
+	c, err := database.Cancellations(from.Unix(), to.Unix(), location)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Cancellation Rate")
+		return
+	}
+
+	var rate float64
+	if c.Sessions > 0 {
+		rate = float64(c.Cancelled) / float64(c.Sessions)
+	}
+
+	result["sessions"] = c.Sessions
+	result["cancelled"] = c.Cancelled
+	result["rate"] = rate
+}
+
+//active vs lapsed customers as of now, and average visits per customer who
+//tanned in the range
+func customerActivity(req *http.Request, result map[string]interface{}) {
+	from, to, location, err := getAnalyticsRange(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Customer Activity")
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -activeCustomerDays).Unix()
+	activity, err := database.CustomerActivitySince(since, location)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Customer Activity")
+		return
+	}
+
+	sessions, customers, err := database.Visits(from.Unix(), to.Unix(), location)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Calculating Customer Activity")
+		return
+	}
+
+	var average float64
+	if customers > 0 {
+		average = float64(sessions) / float64(customers)
+	}
+
+	result["activity"] = activity
+	result["averageVisits"] = average
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"github.com/learc83/toastyserver/billing"
+	"github.com/learc83/toastyserver/database"
+	"net/http"
+	"time"
+)
+
+//recurring membership billing, see the billing package for the dunning rules
+
+//first_bill is a date and defaults to now, so the first charge happens on the
+//next billing run
+func startBilling(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"customer_id", "int"}, param{"product_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Starting Billing")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"first_bill", "date"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Starting Billing")
+		return
+	}
+
+	firstBill := time.Now()
+	if d, ok := opts["first_bill"]; ok {
+		firstBill = d.(time.Time)
+	}
+
+	err = database.StartBillingCycle(params["customer_id"].(int),
+		params["product_id"].(int), firstBill.Unix())
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Starting Billing")
+		return
+	}
+}
+
+func cancelBilling(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"customer_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Cancelling Billing")
+		return
+	}
+
+	err = database.CancelBillingCycle(params["customer_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Cancelling Billing")
+		return
+	}
+}
+
+//the customer's billing cycle and all their invoices
+func billingStatus(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"customer_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Billing")
+		return
+	}
+
+	cycle, found, err := database.FindBillingCycle(params["customer_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Billing")
+		return
+	}
+
+	invoices, err := database.CustomerInvoices(params["customer_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Billing")
+		return
+	}
+
+	result["found"] = found
+	result["cycle"] = cycle
+	result["invoices"] = invoices
+}
+
+//customers whose payments are failing, for calling them up
+func pastDueReport(req *http.Request, result map[string]interface{}) {
+	cycles, err := database.BillingCyclesByStatus(database.BillingPastDue,
+		database.BillingSuspended)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Past Due Report")
+		return
+	}
+
+	result["cycles"] = cycles
+}
+
+//charges an invoice now instead of waiting for the next retry. The charge
+//carries on if the desk hangs up, see billing.chargeTimeout
+func retryInvoice(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"invoice_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Retrying Invoice")
+		return
+	}
+
+	paid, err := billing.Retry(req.Context(), params["invoice_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Retrying Invoice")
+		return
+	}
+
+	inv, err := database.FindInvoice(params["invoice_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Retrying Invoice")
+		return
+	}
+
+	result["paid"] = paid
+	result["invoice"] = inv
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"errors"
+	"github.com/learc83/toastyserver/database"
+	"net/http"
+	"time"
+)
+
+//bump when the wording of the consent form changes, everyone has to sign the
+//new one before tanning again
+const currentConsentVersion = 1
+
+//consent forms have to be signed again after a year
+const consentValidDays = 365
+
+//most minutes per session by Fitzpatrick skin type, from the exposure
+//schedules on bed labels. Type I burns and never tans, so can't tan at all
+var skinTypeMaxMinutes = map[int]int{1: 0, 2: 8, 3: 12, 4: 15, 5: 20, 6: 20}
+
+//returns why a customer isn't allowed to tan, nil if they are
+func checkCompliance(c database.CustomerCompliance, found bool) error {
+	if !found {
+		return errors.New("No consent form on file")
+	}
+
+	if c.Consent_version < currentConsentVersion {
+		return errors.New("Consent form out of date, please sign the new form")
+	}
+
+	expires := time.Unix(c.Consent_signed, 0).AddDate(0, 0, consentValidDays)
+	if time.Now().After(expires) {
+		return errors.New("Consent form expired, please sign a new form")
+	}
+
+	if !c.Eye_protection_ack {
+		return errors.New("Eye protection not acknowledged")
+	}
+
+	if c.Minor && !c.Parental_consent {
+		return errors.New("Parental consent required")
+	}
+
+	if c.Photosensitizing_meds {
+		return errors.New("Photosensitizing medication, see front desk")
+	}
+
+	if _, ok := skinTypeMaxMinutes[c.Skin_type]; !ok {
+		return errors.New("Skin type not on file")
+	}
+
+	if skinTypeMaxMinutes[c.Skin_type] == 0 {
+		return errors.New("Skin type I, tanning not allowed")
+	}
+
+	return nil
+}
+
+//caps a bed's max time by the customer's skin type
+func skinTypeCap(skinType int, maxTime int) int {
+	if m := skinTypeMaxMinutes[skinType]; m < maxTime {
+		return m
+	}
+	return maxTime
+}
+
+func customerCompliance(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"customer_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Compliance Profile")
+		return
+	}
+
+	c, found, err := database.FindCompliance(params["customer_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Compliance Profile")
+		return
+	}
+
+	result["found"] = found
+	result["compliance"] = c
+	result["currentConsentVersion"] = currentConsentVersion
+	//blank means allowed to tan
+	result["problem"] = ""
+	if err := checkCompliance(c, found); err != nil {
+		result["problem"] = err.Error()
+	}
+}
+
+//records a newly signed consent form. consent_signed is a date, the flags
+//are 0 or 1. Earlier forms are kept, see customer_consent_history
+func updateCustomerCompliance(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"customer_id", "int"},
+		param{"skin_type", "int"},
+		param{"consent_signed", "date"},
+		param{"consent_version", "int"},
+		param{"eye_protection_ack", "int"},
+		param{"minor", "int"},
+		param{"parental_consent", "int"},
+		param{"photosensitizing_meds", "int"})
+
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Compliance Profile")
+		return
+	}
+
+	skinType := params["skin_type"].(int)
+	if _, ok := skinTypeMaxMinutes[skinType]; !ok {
+		err = errors.New("skin_type must be 1 through 6")
+		result["error"] = stringifyErr(err, "Error Updating Compliance Profile")
+		return
+	}
+
+	c := database.CustomerCompliance{
+		Customer_id:           params["customer_id"].(int),
+		Skin_type:             skinType,
+		Consent_signed:        params["consent_signed"].(time.Time).Unix(),
+		Consent_version:       params["consent_version"].(int),
+		Eye_protection_ack:    params["eye_protection_ack"].(int) != 0,
+		Minor:                 params["minor"].(int) != 0,
+		Parental_consent:      params["parental_consent"].(int) != 0,
+		Photosensitizing_meds: params["photosensitizing_meds"].(int) != 0,
+		Updated:               time.Now().Unix()}
+
+	id, err := database.SaveCompliance(c)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Compliance Profile")
+		return
+	}
+
+	result["consent_record_id"] = id
+}
+
+//every consent form customer_id has signed, latest first
+func customerConsentHistory(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"customer_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Consent History")
+		return
+	}
+
+	records, err := database.ConsentHistory(params["customer_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Consent History")
+		return
+	}
+
+	result["consent_records"] = records
+}
@@ -3,10 +3,10 @@ package server
 import (
 	"github.com/learc83/toastyserver/database"
 	"github.com/learc83/toastyserver/tmak"
-	"log"
 	"time"
 	//"github.com/learc83/toastyserver/tmak"
 	"errors"
+	"fmt"
 	"net/http"
 )
 
@@ -19,6 +19,9 @@ func customerLogin(req *http.Request, result map[string]interface{}) {
 	//            2: Tanner not found in database
 	//            3: Tanner not authorized
 	//            4: Already tanned today.
+	//            5: Session in progress, can be cancelled
+	//            6: Consent missing or expired, or otherwise not compliant
+	//            7: Tanner's plan doesn't cover this location
 
 	//Params Error
 	params, err := getParams(req, param{"fob_num", "uint64"})
@@ -52,6 +55,35 @@ func customerLogin(req *http.Request, result map[string]interface{}) {
 		return
 	}
 
+	//Customers without a roaming plan can only tan at their home location
+	allowed, err := database.CustomerCanUseLocation(id, database.LocalLocation())
+	if err != nil {
+		result["error_code"] = 1
+		result["error_message"] = stringifyErr(err, "Error With Customer Login")
+		return
+	}
+	if !allowed {
+		err = errors.New("Tanner's plan doesn't cover this location")
+		result["error_code"] = 7
+		result["error_message"] = stringifyErr(err, "Error With Customer Login")
+		return
+	}
+
+	//Consent form and skin type on file and current
+	compliance, found, err := database.FindCompliance(id)
+	if err != nil {
+		result["error_code"] = 1
+		result["error_message"] = stringifyErr(err, "Error With Customer Login")
+		return
+	}
+
+	err = checkCompliance(compliance, found)
+	if err != nil {
+		result["error_code"] = 6
+		result["error_message"] = stringifyErr(err, "Error With Customer Login")
+		return
+	}
+
 	//get last session information--time, and bed number default values
 	//for both are 0, so if there is no last session both with be set to 0
 	_, lastSessionTime, lastSessionBedId, err := database.FindMostRecentSession(id)
@@ -104,6 +136,7 @@ func customerLogin(req *http.Request, result map[string]interface{}) {
 	result["id"] = id
 	result["name"] = name
 	result["level"] = lvl
+	result["skin_type"] = compliance.Skin_type
 }
 
 func cancelSession(req *http.Request, result map[string]interface{}) {
@@ -150,16 +183,20 @@ func cancelSession(req *http.Request, result map[string]interface{}) {
 
 	//stop bed--send 1 minute to do that, 0 doesn't work--I think b/c the prop code on the toasty board is handling 0 oddly
 	//1 works b/c tanning beds have a minimum time of 2 minutes
+	l := reqLogger(req).With("bed", bed, "customer_id", id)
+	bedCommands.Add(1)
 	go func() {
+		defer bedCommands.Done()
+
 		err := tmak.StartBed(bed, 1)
 		time.Sleep(0.10 * 1e9)
 		err = tmak.StartBed(bed, 1)
 		if err != nil {
-			log.Println(err)
+			l.Error("failed to stop bed", "err", err)
 			return
 		}
 
-		log.Println("bed stopped by customer")
+		l.Info("bed stopped by customer")
 	}()
 
 	//Empty braces == succcess or no sessions to delete
@@ -177,7 +214,29 @@ func bedStatus(req *http.Request, result map[string]interface{}) {
 		result["error"] = stringifyErr(err, "Error Checking Customer Bed Status")
 		return
 	}
-	log.Println(beds)
+
+	compliance, _, err := database.FindCompliance(params["customer_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Checking Customer Bed Status")
+		return
+	}
+
+	visit, err := visitNumber(params["customer_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Checking Customer Bed Status")
+		return
+	}
+
+	//can't tan longer than the skin type or the bed's schedule allows
+	for i := range beds {
+		beds[i].Recommended_time, beds[i].Max_time, err = sessionLimits(beds[i],
+			compliance.Skin_type, visit)
+		if err != nil {
+			result["error"] = stringifyErr(err, "Error Checking Customer Bed Status")
+			return
+		}
+	}
+	reqLogger(req).Debug("beds customer can access", "beds", beds)
 
 	//edits bed statuses in place--true means ready for tanning
 	tmak.BedStatuses(beds)
@@ -196,16 +255,28 @@ func startBed(req *http.Request, result map[string]interface{}) {
 		return
 	}
 
-	log.Println(params)
+	l := reqLogger(req).With("bed", params["bed_num"], "time", params["time"],
+		"customer_id", params["cust_num"])
+	l.Debug("starting bed")
+
+	skinType, err := checkSessionAllowed(params["cust_num"].(int),
+		params["bed_num"].(int), params["time"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Creating Session")
+		return
+	}
 
 	//starts bed and creates session in the background b/c it may take a few seconds
 	//TODO try to start bed 3 or 4 times, starting bed twice to handle dirty beds
+	bedCommands.Add(1)
 	go func() {
+		defer bedCommands.Done()
+
 		err := tmak.StartBed(params["bed_num"].(int), 1)
 		time.Sleep(0.10 * 1e9)
 		err = tmak.StartBed(params["bed_num"].(int), params["time"].(int))
 		if err != nil {
-			log.Println(err)
+			l.Error("failed to start bed", "err", err)
 			return
 		}
 
@@ -214,14 +285,70 @@ func startBed(req *http.Request, result map[string]interface{}) {
 			Bed_num:      params["bed_num"].(int),
 			Customer_id:  params["cust_num"].(int),
 			Session_time: params["time"].(int),
-			Time_stamp:   time.Now().Unix()}
+			Time_stamp:   time.Now().Unix(),
+			Skin_type:    skinType,
+			Location_id:  database.LocalLocation()}
 
-		err = database.CreateRecord(session)
+		err = database.StartSession(session)
 		if err != nil {
-			log.Println(err)
+			l.Error("bed started but session not recorded", "err", err)
 			return
 		}
 
-		log.Println("bed started, session created")
+		l.Info("bed started, session created")
 	}()
 }
+
+//checks the kiosk isn't asking for more time than the bed, the customer's
+//skin type or the bed's exposure schedule for this visit allows, or for less
+//than a minute. A max of 0 means no session at all. Returns the skin type to
+//record with the session
+func checkSessionAllowed(cust_id int, bed_num int, minutes int) (skinType int, err error) {
+	bed, err := database.FindBed(bed_num)
+	if err != nil {
+		return
+	}
+	if bed.Bed_num == 0 {
+		err = errors.New("Bed not found")
+		return
+	}
+
+	allowed, err := database.CustomerCanUseLocation(cust_id, database.LocalLocation())
+	if err != nil {
+		return
+	}
+	if !allowed {
+		err = errors.New("Customer's plan doesn't cover this location")
+		return
+	}
+
+	compliance, found, err := database.FindCompliance(cust_id)
+	if err != nil {
+		return
+	}
+	err = checkCompliance(compliance, found)
+	if err != nil {
+		return
+	}
+
+	visit, err := visitNumber(cust_id)
+	if err != nil {
+		return
+	}
+	_, max, err := sessionLimits(bed, compliance.Skin_type, visit)
+	if err != nil {
+		return
+	}
+
+	if max < 1 {
+		err = errors.New("No session allowed for this skin type on this bed")
+		return
+	}
+	if minutes < 1 || minutes > max {
+		err = fmt.Errorf("%d minutes must be 1 to the %d allowed", minutes, max)
+		return
+	}
+
+	skinType = compliance.Skin_type
+	return
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"errors"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/door"
+	"github.com/learc83/toastyserver/readerproto"
+	"net/http"
+	"time"
+)
+
+//doors are managed on their own location's server. Changes restart the
+//readers
+
+func listDoors(req *http.Request, result map[string]interface{}) {
+	doors, err := database.ListDoors(database.LocalLocation())
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Doors")
+		return
+	}
+
+	result["doors"] = doors
+}
+
+//policy is members or staff. format is what the reader sends: hex, wiegand
+//or decimal, hex if left out. opens and closes are minutes after midnight,
+//left out the door is open all day. grant_response and deny_response are hex
+//bytes for the reader, left out they're the standard ones. Anti-passback:
+//min_interval is seconds between uses of a fob, max_per_day is entries a
+//day, both off if left out, and passback_deny=1 denies the fob instead of
+//only raising an alert. time_clock=1 clocks employees in and out when their
+//fob opens the door
+func addNewDoor(req *http.Request, result map[string]interface{}) {
+	d, err := getDoorParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Door")
+		return
+	}
+	d.Location_id = database.LocalLocation()
+	d.Active = true
+
+	err = door.CheckDoor(d)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Door")
+		return
+	}
+
+	err = database.CreateRecord(d)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Door")
+		return
+	}
+
+	door.Reload()
+}
+
+//same params as add_new_door plus door_id and active, active=0 stops the
+//door's reader
+func updateDoor(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"door_id", "int"},
+		param{"active", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Door")
+		return
+	}
+
+	d, err := getDoorParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Door")
+		return
+	}
+	d.Id = params["door_id"].(int)
+	d.Active = params["active"].(int) != 0
+
+	existing, err := database.FindDoor(d.Id)
+	if err == nil && existing.Location_id != database.LocalLocation() {
+		err = errors.New("door not found at this location")
+	}
+	if err == nil {
+		err = door.CheckDoor(d)
+	}
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Door")
+		return
+	}
+
+	err = database.UpdateDoor(d)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Door")
+		return
+	}
+
+	door.Reload()
+}
+
+func getDoorParams(req *http.Request) (d database.Door, err error) {
+	params, err := getParams(req,
+		param{"name", "string"},
+		param{"device", "string"},
+		param{"policy", "string"})
+	if err != nil {
+		return
+	}
+
+	opts, err := getOptionalParams(req,
+		param{"opens", "int"},
+		param{"closes", "int"},
+		param{"grant_response", "string"},
+		param{"deny_response", "string"},
+		param{"min_interval", "int"},
+		param{"max_per_day", "int"},
+		param{"passback_deny", "int"},
+		param{"format", "string"},
+		param{"time_clock", "int"})
+	if err != nil {
+		return
+	}
+
+	d = database.Door{Name: params["name"].(string), Device: params["device"].(string),
+		Policy: params["policy"].(string), Format: string(readerproto.Hex),
+		Grant_response: door.DefaultGrant, Deny_response: door.DefaultDeny}
+	d.Opens, _ = opts["opens"].(int)
+	d.Closes, _ = opts["closes"].(int)
+	d.Min_interval, _ = opts["min_interval"].(int)
+	d.Max_per_day, _ = opts["max_per_day"].(int)
+	deny, _ := opts["passback_deny"].(int)
+	d.Passback_deny = deny != 0
+	clock, _ := opts["time_clock"].(int)
+	d.Time_clock = clock != 0
+	if grant, ok := opts["grant_response"].(string); ok {
+		d.Grant_response = grant
+	}
+	if format, ok := opts["format"].(string); ok {
+		d.Format = format
+	}
+	if response, ok := opts["deny_response"].(string); ok {
+		d.Deny_response = response
+	}
+
+	return
+}
+
+//opens door_id for seconds, 5 if left out, for someone without a fob.
+//employee_fob is the employee doing it
+func unlockDoor(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"door_id", "int"},
+		param{"employee_fob", "uint64"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Unlocking Door")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"seconds", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Unlocking Door")
+		return
+	}
+	seconds, ok := opts["seconds"].(int)
+	if !ok {
+		seconds = 5
+	}
+
+	err = door.Unlock(params["door_id"].(int), time.Duration(seconds)*time.Second,
+		params["employee_fob"].(uint64))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Unlocking Door")
+		return
+	}
+}
+
+//locks down door_id, or every door here if it's left out, so only owners'
+//fobs open it
+func lockdown(req *http.Request, result map[string]interface{}) {
+	setLockdown(req, result, true, "Error Locking Down")
+}
+
+//only an owner's employee_fob can end a lockdown
+func endLockdown(req *http.Request, result map[string]interface{}) {
+	setLockdown(req, result, false, "Error Ending Lockdown")
+}
+
+func setLockdown(req *http.Request, result map[string]interface{}, on bool, errMsg string) {
+	params, err := getParams(req, param{"employee_fob", "uint64"})
+	if err != nil {
+		result["error"] = stringifyErr(err, errMsg)
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"door_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, errMsg)
+		return
+	}
+	door_id, _ := opts["door_id"].(int)
+
+	doors, err := door.SetLockdown(door_id, on, params["employee_fob"].(uint64))
+	if err != nil {
+		result["error"] = stringifyErr(err, errMsg)
+		return
+	}
+
+	result["doors"] = doors
+}
+
+//anti-passback alerts, newest first. unresolved=1 leaves out resolved ones.
+//sort: time, name or kind--see getReportFilter for filter and paging params
+func doorAlerts(req *http.Request, result map[string]interface{}) {
+	filter, err := getReportFilter(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Door Alerts")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"unresolved", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Door Alerts")
+		return
+	}
+	unresolved, _ := opts["unresolved"].(int)
+
+	alerts, total, err := database.DoorAlerts(filter, unresolved != 0)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Door Alerts")
+		return
+	}
+
+	result["alerts"] = alerts
+	result["total"] = total
+}
+
+func resolveDoorAlert(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"alert_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Resolving Door Alert")
+		return
+	}
+
+	err = database.ResolveDoorAlert(params["alert_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Resolving Door Alert")
+		return
+	}
+}
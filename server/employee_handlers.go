@@ -0,0 +1,187 @@
+package server
+
+import (
+	"errors"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/door"
+	"net/http"
+	"strconv"
+)
+
+//employees are shared by every location. Their fobs are admin keyfobs, see
+//available_employee_keyfobs. The doors pick up changes on their own
+
+func listEmployees(req *http.Request, result map[string]interface{}) {
+	employees, err := database.ListEmployees()
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Employees")
+		return
+	}
+
+	result["employees"] = employees
+}
+
+func employeeProfile(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Employee")
+		return
+	}
+
+	e, err := database.FindEmployeeById(params["id"].(int))
+	if err == nil && e.Id == 0 {
+		err = errors.New("employee not found")
+	}
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Employee")
+		return
+	}
+
+	result["employee"] = e
+}
+
+//level is 1 to 3, 3 is an owner. keyfob_number must be an admin keyfob
+//nobody has. New employees work at this location unless location_id is
+//given. owner_fob is the owner making the change, same for update and delete
+func addNewEmployee(req *http.Request, result map[string]interface{}) {
+	err := checkOwnerFob(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Employee")
+		return
+	}
+
+	e, err := getEmployeeParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Employee")
+		return
+	}
+	e.Active = true
+
+	id, err := database.CreateEmployee(e)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Employee")
+		return
+	}
+
+	result["employee_id"] = id
+}
+
+//same params as add_new_employee plus employee_id and active, active=0
+//deactivates the employee so their fob stops working. The last active owner
+//can't be deactivated or moved to a lower level
+func updateEmployee(req *http.Request, result map[string]interface{}) {
+	err := checkOwnerFob(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Employee")
+		return
+	}
+
+	params, err := getParams(req,
+		param{"employee_id", "int"},
+		param{"active", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Employee")
+		return
+	}
+
+	e, err := getEmployeeParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Employee")
+		return
+	}
+	e.Id = params["employee_id"].(int)
+	e.Active = params["active"].(int) != 0
+
+	err = database.UpdateEmployee(e, door.OwnerLevel)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Employee")
+		return
+	}
+}
+
+//the last active owner can't be deleted. Deactivating keeps the employee's
+//name on their door accesses and time entries
+func deleteEmployee(req *http.Request, result map[string]interface{}) {
+	err := checkOwnerFob(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Deleting Employee")
+		return
+	}
+
+	params, err := getParams(req, param{"employee_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Deleting Employee")
+		return
+	}
+
+	err = database.DeleteEmployee(params["employee_id"].(int), door.OwnerLevel)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Deleting Employee")
+		return
+	}
+}
+
+func availableEmployeeKeyfobs(req *http.Request, result map[string]interface{}) {
+	keyfobsTen, keyfobsHex, err := database.AvailableEmployeeKeyfobs()
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Finding Available Employee Keyfobs")
+		return
+	}
+
+	result["keyfobsTen"] = keyfobsTen
+	result["keyfobsHex"] = keyfobsHex
+}
+
+func getEmployeeParams(req *http.Request) (e database.Employee, err error) {
+	params, err := getParams(req,
+		param{"name", "string"},
+		param{"level", "int"},
+		param{"keyfob_number", "uint64"})
+	if err != nil {
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"location_id", "int"})
+	if err != nil {
+		return
+	}
+
+	e = database.Employee{Name: params["name"].(string), Level: params["level"].(int),
+		Fob_num: params["keyfob_number"].(uint64), Location_id: database.LocalLocation()}
+	if location, ok := opts["location_id"].(int); ok {
+		var l database.Location
+		l, err = database.FindLocation(location)
+		if err == nil && l.Id == 0 {
+			err = errors.New("location not found")
+		}
+		if err != nil {
+			return
+		}
+		e.Location_id = location
+	}
+
+	if e.Level < 1 || e.Level > door.OwnerLevel {
+		err = errors.New("level must be 1 to " + strconv.Itoa(door.OwnerLevel))
+	}
+	return
+}
+
+//only an active owner's owner_fob can add, change or remove employees
+func checkOwnerFob(req *http.Request) error {
+	params, err := getParams(req, param{"owner_fob", "uint64"})
+	if err != nil {
+		return err
+	}
+
+	e, err := database.FindEmployeeByFob(params["owner_fob"].(uint64))
+	if err != nil {
+		return err
+	}
+	if e.Id == 0 || !e.Active {
+		return errors.New("employee not found")
+	}
+	if e.Level < door.OwnerLevel {
+		return errors.New("only an owner can change employees")
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/pdf"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//export handlers take the same filter params as the reports they export, see
+//getReportFilter, plus format=csv or format=pdf. Paging params are ignored,
+//every matching row is exported
+
+type table struct {
+	title   string
+	headers []string
+	rows    [][]string
+}
+
+func tanReportExport(w http.ResponseWriter, req *http.Request) {
+	t := table{title: "Tan Report",
+		headers: []string{"Date", "Time", "Customer", "Location", "Bed", "Minutes",
+			"Cancelled"}}
+
+	locations, err := locationNames()
+	if err == nil {
+		err = exportPages(req, func(f database.ReportFilter) (int, error) {
+			sessions, _, err := database.RecentTanSessions(f)
+			for _, s := range sessions {
+				t.rows = append(t.rows, []string{s.Month + "/" + s.Day, s.Local_time,
+					s.Name, locations[s.Location_id], strconv.Itoa(s.Bed_num),
+					strconv.Itoa(s.Session_time), yesNo(s.Cancelled)})
+			}
+			return len(sessions), err
+		})
+	}
+
+	writeExport(w, req, t, err, "Error Exporting Tan Report")
+}
+
+func doorReportExport(w http.ResponseWriter, req *http.Request) {
+	t := table{title: "Door Report",
+		headers: []string{"Date", "Time", "Name", "Phone", "Location", "Door",
+			"Action"}}
+
+	locations, err := locationNames()
+	if err == nil {
+		err = exportPages(req, func(f database.ReportFilter) (int, error) {
+			accesses, _, err := database.RecentDoorAccesses(f)
+			for _, d := range accesses {
+				t.rows = append(t.rows, []string{d.Month + "/" + d.Day, d.Local_time,
+					d.Name, d.Phone, locations[d.Location_id], d.Door_name,
+					d.Action})
+			}
+			return len(accesses), err
+		})
+	}
+
+	writeExport(w, req, t, err, "Error Exporting Door Report")
+}
+
+func customerListExport(w http.ResponseWriter, req *http.Request) {
+	t := table{title: "Customer List",
+		headers: []string{"Id", "Name", "Phone", "Active", "Level"}}
+
+	err := exportPages(req, func(f database.ReportFilter) (int, error) {
+		customers, _, err := database.ListCustomers(f)
+		for _, c := range customers {
+			t.rows = append(t.rows, []string{strconv.Itoa(c.Id), c.Name, c.Phone,
+				yesNo(c.Status), strconv.Itoa(c.Level)})
+		}
+		return len(customers), err
+	})
+
+	writeExport(w, req, t, err, "Error Exporting Customer List")
+}
+
+//location names by id
+func locationNames() (names map[int]string, err error) {
+	locations, err := database.ListLocations()
+	names = make(map[int]string)
+	for _, l := range locations {
+		names[l.Id] = l.Name
+	}
+	return
+}
+
+//calls page with the request's filter until every row has been read. page
+//returns the number of rows it got
+func exportPages(req *http.Request, page func(database.ReportFilter) (int, error)) error {
+	f, err := getReportFilter(req)
+	if err != nil {
+		return err
+	}
+
+	const pageSize = 500
+	f.Limit = pageSize
+	f.Offset = 0
+
+	for {
+		n, err := page(f)
+		if err != nil {
+			return err
+		}
+		if n < pageSize {
+			return nil
+		}
+		f.Offset += n
+	}
+}
+
+func writeExport(w http.ResponseWriter, req *http.Request, t table, err error,
+	callingFunc string) {
+
+	if err == nil {
+		switch req.FormValue("format") {
+		case "csv":
+			writeCSV(w, t)
+			return
+		case "pdf":
+			writePDF(w, t)
+			return
+		default:
+			err = errors.New("format must be csv or pdf")
+		}
+	}
+
+	errs := stringifyErr(err, callingFunc)
+	reqLogger(req).Warn("export failed", "error", errs)
+	writeStatus(w, http.StatusBadRequest, map[string]interface{}{"error": errs})
+}
+
+func exportFilename(t table, ext string) string {
+	name := strings.ToLower(strings.Replace(t.title, " ", "_", -1))
+	return fmt.Sprintf("%s_%s.%s", name, time.Now().Format("2006-01-02"), ext)
+}
+
+func writeCSV(w http.ResponseWriter, t table) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", exportFilename(t, "csv")))
+
+	c := csv.NewWriter(w)
+	c.Write(t.headers)
+	for _, row := range t.rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			cells[i] = csvCell(v)
+		}
+		c.Write(cells)
+	}
+	c.Flush()
+}
+
+//names typed at the desk can start with a character a spreadsheet reads as
+//a formula, a leading ' makes it show them as text
+func csvCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+//rows are laid out in fixed width columns, each as wide as its widest value
+//but never so wide the row won't fit on the page
+func writePDF(w http.ResponseWriter, t table) {
+	widths := make([]int, len(t.headers))
+	for i, h := range t.headers {
+		widths[i] = len(h)
+	}
+	for _, row := range t.rows {
+		for i, v := range row {
+			if len(v) > widths[i] {
+				widths[i] = len(v)
+			}
+		}
+	}
+
+	//shrink the widest column until the row fits, 2 spaces between columns
+	for {
+		total := 0
+		widest := 0
+		for i, wd := range widths {
+			total += wd + 2
+			if wd > widths[widest] {
+				widest = i
+			}
+		}
+		if total <= pdf.LineWidth || widths[widest] <= 4 {
+			break
+		}
+		widths[widest]--
+	}
+
+	line := func(values []string) string {
+		var b strings.Builder
+		for i, v := range values {
+			if len(v) > widths[i] {
+				v = v[:widths[i]]
+			}
+			fmt.Fprintf(&b, "%-*s  ", widths[i], v)
+		}
+		return strings.TrimRight(b.String(), " ")
+	}
+
+	doc := pdf.New(fmt.Sprintf("%s - printed %s", t.title,
+		time.Now().Format("Jan 2, 2006 3:04pm")))
+	doc.Line(line(t.headers))
+	for _, row := range t.rows {
+		doc.Line(line(row))
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", exportFilename(t, "pdf")))
+	doc.WriteTo(w)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
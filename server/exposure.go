@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"github.com/learc83/toastyserver/database"
+	"net/http"
+	"time"
+)
+
+//a gap this long between sessions starts the exposure schedule over at visit 1
+const scheduleGapDays = 7
+
+//how many past sessions to look at when counting visits
+const visitHistory = 100
+
+//visit number for the next session--1 plus the number of sessions in an
+//unbroken run with no gap longer than scheduleGapDays, counting back from now
+func visitNumber(cust_id int) (visit int, err error) {
+	sessions, err := database.CustomerSessions(cust_id, visitHistory)
+	if err != nil {
+		return
+	}
+
+	gap := int64(scheduleGapDays * 24 * 60 * 60)
+
+	visit = 1
+	last := time.Now().Unix()
+	for _, s := range sessions { //most recent first
+		if s.Cancelled {
+			continue
+		}
+		if last-s.Time_stamp > gap {
+			break
+		}
+
+		visit++
+		last = s.Time_stamp
+	}
+
+	return
+}
+
+//max is the most the customer can tan on the bed this visit: the bed's max
+//capped by their skin type, and by the bed's exposure schedule for the visit
+//if it has one for their skin type, since the label minutes are a maximum.
+//recommended is the same, kiosks offer it as the default
+func sessionLimits(bed database.Bed, skinType int, visit int) (recommended int, max int, err error) {
+	max = skinTypeCap(skinType, bed.Max_time)
+
+	minutes, found, err := database.ExposureMinutes(bed.Bed_num, skinType, visit)
+	if err != nil {
+		return
+	}
+
+	if found && minutes < max {
+		max = minutes
+	}
+	recommended = max
+
+	return
+}
+
+func exposureSchedule(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"bed_num", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Exposure Schedule")
+		return
+	}
+
+	schedule, err := database.BedExposureSchedule(params["bed_num"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Exposure Schedule")
+		return
+	}
+
+	result["schedule"] = schedule
+}
+
+//adds or replaces one entry of a bed's schedule
+func setExposureSchedule(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"bed_num", "int"},
+		param{"skin_type", "int"},
+		param{"visit", "int"},
+		param{"minutes", "int"})
+
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Exposure Schedule")
+		return
+	}
+
+	e := database.ExposureSchedule{
+		Bed_num:   params["bed_num"].(int),
+		Skin_type: params["skin_type"].(int),
+		Visit:     params["visit"].(int),
+		Minutes:   params["minutes"].(int)}
+
+	if _, ok := skinTypeMaxMinutes[e.Skin_type]; !ok {
+		err = errors.New("skin_type must be 1 through 6")
+	} else if e.Visit < 1 {
+		err = errors.New("visit must be 1 or more")
+	} else if e.Minutes < 0 {
+		err = errors.New("minutes can't be negative")
+	}
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Exposure Schedule")
+		return
+	}
+
+	bed, err := database.FindBed(e.Bed_num)
+	if err == nil && bed.Bed_num == 0 {
+		err = errors.New("Bed not found")
+	}
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Exposure Schedule")
+		return
+	}
+
+	err = database.SetExposureMinutes(e)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Exposure Schedule")
+		return
+	}
+}
+
+func deleteExposureSchedule(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"bed_num", "int"},
+		param{"skin_type", "int"},
+		param{"visit", "int"})
+
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Deleting Exposure Schedule")
+		return
+	}
+
+	//WARNING doesn't return error if record doesn't exist
+	err = database.DeleteExposureMinutes(params["bed_num"].(int),
+		params["skin_type"].(int), params["visit"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Deleting Exposure Schedule")
+		return
+	}
+}
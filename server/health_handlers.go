@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/door"
+	"github.com/learc83/toastyserver/tmak"
+	"net/http"
+	"time"
+)
+
+//Version is set at build time with
+//go install -ldflags "-X github.com/learc83/toastyserver/server.Version=1.2.3"
+var Version = "dev"
+
+var startTime = time.Now()
+
+//health handlers are registered without handlerWrapper because load balancers
+//and monitors look at the status code, not the json body
+
+//liveness--if we can answer at all the process is alive
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+//readiness--can't do anything useful without the db
+func readyz(w http.ResponseWriter, r *http.Request) {
+	err := database.Ping()
+	if err != nil {
+		writeStatus(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status": "unavailable",
+			"error":  stringifyErr(err, "Database Not Ready")})
+		return
+	}
+
+	writeStatus(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+func writeStatus(w http.ResponseWriter, code int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func diagnostics(req *http.Request, result map[string]interface{}) {
+	dbResult := make(map[string]interface{})
+	dbResult["ping_error"] = stringifyErr(database.Ping(), "Database Ping Failed")
+	walSize, err := database.WalSize()
+	dbResult["wal_size"] = walSize
+	dbResult["wal_error"] = stringifyErr(err, "Error Reading WAL Size")
+	result["database"] = dbResult
+
+	result["tmak"] = tmak.GetStats()
+	result["door"] = door.GetStats()
+
+	result["uptime_seconds"] = int64(time.Since(startTime).Seconds())
+	result["version"] = Version
+}
@@ -4,23 +4,42 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/logging"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type toastyHndlrFnc func(*http.Request, map[string]interface{})
 
-func handlerWrapper(handler toastyHndlrFnc) http.HandlerFunc {
+//route is the key from getRoutes, used to label metrics and logs
+func handlerWrapper(route string, handler toastyHndlrFnc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
+		r = withRequestID(w, r)
+		l := reqLogger(r).With("route", route)
+
+		start := time.Now()
+
 		result := make(map[string]interface{})
 		handler(r, result) //result set as a side effect
 
+		duration := time.Since(start)
+		requestDuration.Observe(duration.Seconds(), route)
+		requestCount.Inc(route, resultOutcome(result))
+
+		if e := resultError(result); e != "" {
+			l.Warn("request failed", "error", e, "duration", duration)
+		} else {
+			l.Debug("request", "duration", duration)
+		}
+
 		j, err := json.Marshal(result)
 		if err != nil {
-			log.Println(err)
+			l.Error("json.Marshal failed", "err", err)
 			errs := `{"error": "json.Marshal failed"}`
 			w.Write([]byte(errs))
 			return
@@ -29,8 +48,55 @@ func handlerWrapper(handler toastyHndlrFnc) http.HandlerFunc {
 	}
 }
 
-//used for get Params arguments. Only supports ints and strings, add support for
-//checking things like phone numbers
+//same logging and metrics as handlerWrapper for handlers that write their own
+//response, a status of 400 or more counts as an error
+func rawWrapper(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(w, r)
+		l := reqLogger(r).With("route", route)
+
+		start := time.Now()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+
+		duration := time.Since(start)
+		requestDuration.Observe(duration.Seconds(), route)
+
+		outcome := "ok"
+		if sw.status >= 400 {
+			outcome = "error"
+		}
+		requestCount.Inc(route, outcome)
+
+		l.Debug("request", "status", sw.status, "duration", duration)
+	}
+}
+
+//keep the caller's request id if it sent one so logs can be matched up
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		id = logging.NewRequestID()
+	}
+	w.Header().Set("X-Request-Id", id)
+	return r.WithContext(logging.WithRequestID(r.Context(), id))
+}
+
+//remembers the status a raw handler wrote
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+//used for get Params arguments. Supports ints, uint64s, strings, dates,
+//datetimes (YYYY-MM-DD HH:MM, local time) and phone numbers, which are
+//normalized to E.164
 type param struct {
 	Name string
 	Type string
@@ -39,14 +105,33 @@ type param struct {
 //TODO redo this function to take advantage of structs defined in database/structs.go
 //and to use reflection. See CreateRecord function in database/sql.go
 func getParams(req *http.Request, paramList ...param) (params map[string]interface{}, err error) {
+	return parseParams(req, true, paramList)
+}
+
+//same as getParams but blank params are left out of the map instead of being
+//an error
+func getOptionalParams(req *http.Request, paramList ...param) (params map[string]interface{}, err error) {
+	return parseParams(req, false, paramList)
+}
+
+func parseParams(req *http.Request, required bool, paramList []param) (params map[string]interface{}, err error) {
 	params = make(map[string]interface{})
 	blanks := ""
 	notInts := ""
+	notDates := ""
+	notTimes := ""
+	notPhones := ""
 
 	for _, p := range paramList {
 		param := req.FormValue(p.Name)
 		if param == "" {
-			blanks = blanks + " " + p.Name + ","
+			//routes like /customer/{id} pass params in the path
+			param = req.PathValue(p.Name)
+		}
+		if param == "" {
+			if required {
+				blanks = blanks + " " + p.Name + ","
+			}
 			continue
 		}
 
@@ -64,6 +149,28 @@ func getParams(req *http.Request, paramList ...param) (params map[string]interfa
 				continue
 			}
 			params[p.Name] = num
+		} else if p.Type == "date" {
+			//local midnight at the start of the day
+			day, errr := time.ParseInLocation("2006-01-02", param, time.Local)
+			if errr != nil {
+				notDates = notDates + " " + p.Name + ","
+				continue
+			}
+			params[p.Name] = day
+		} else if p.Type == "datetime" {
+			t, errr := time.ParseInLocation("2006-01-02 15:04", param, time.Local)
+			if errr != nil {
+				notTimes = notTimes + " " + p.Name + ","
+				continue
+			}
+			params[p.Name] = t
+		} else if p.Type == "phone" {
+			phone, errr := database.NormalizePhone(param)
+			if errr != nil {
+				notPhones = notPhones + " " + p.Name + ","
+				continue
+			}
+			params[p.Name] = phone
 		} else {
 			params[p.Name] = param
 		}
@@ -77,16 +184,95 @@ func getParams(req *http.Request, paramList ...param) (params map[string]interfa
 		err = errors.New(fmt.Sprintf("These fields must be numbers:%s", notInts))
 	}
 
+	if notDates != "" {
+		err = errors.New(fmt.Sprintf("These fields must be dates (YYYY-MM-DD):%s", notDates))
+	}
+
+	if notTimes != "" {
+		err = errors.New(fmt.Sprintf("These fields must be times (YYYY-MM-DD HH:MM):%s", notTimes))
+	}
+
+	if notPhones != "" {
+		err = errors.New(fmt.Sprintf("These fields must be phone numbers:%s", notPhones))
+	}
+
 	return
 }
 
 //This is required because errors default strinfigy method: Error()
-//returns nil instead of an empty string
+//returns nil instead of an empty string. Not logged here, handlerWrapper logs
+//the error with the request id
 func stringifyErr(err error, callingFunc string) string {
 	if err != nil {
-		errs := fmt.Sprintf("%s: %s", callingFunc, err)
-		log.Println(errs)
-		return errs
+		return fmt.Sprintf("%s: %s", callingFunc, err)
 	}
 	return ""
 }
+
+//logger for a handler, tagged with the request id set by handlerWrapper
+func reqLogger(req *http.Request) *slog.Logger {
+	return logging.FromContext(req.Context(), "server")
+}
+
+//filter, sort and paging params shared by the customer list and the reports:
+//from and to are dates (to is inclusive), cancelled is 0 or 1, order is asc
+//or desc. Without location_id every location is included
+func getReportFilter(req *http.Request) (f database.ReportFilter, err error) {
+	params, err := getOptionalParams(req,
+		param{"from", "date"},
+		param{"to", "date"},
+		param{"customer_id", "int"},
+		param{"location_id", "int"},
+		param{"bed_num", "int"},
+		param{"door_id", "int"},
+		param{"cancelled", "int"},
+		param{"sort", "string"},
+		param{"order", "string"},
+		param{"limit", "int"},
+		param{"offset", "int"})
+	if err != nil {
+		return
+	}
+
+	if from, ok := params["from"]; ok {
+		f.From = from.(time.Time).Unix()
+	}
+	if to, ok := params["to"]; ok {
+		f.To = to.(time.Time).AddDate(0, 0, 1).Unix()
+	}
+	if id, ok := params["customer_id"]; ok {
+		f.Customer_id = id.(int)
+	}
+	if location, ok := params["location_id"]; ok {
+		f.Location_id = location.(int)
+	}
+	if bed, ok := params["bed_num"]; ok {
+		f.Bed_num = bed.(int)
+	}
+	if door, ok := params["door_id"]; ok {
+		f.Door_id = door.(int)
+	}
+	if c, ok := params["cancelled"]; ok {
+		cancelled := c.(int) != 0
+		f.Cancelled = &cancelled
+	}
+	if sort, ok := params["sort"]; ok {
+		f.Sort = sort.(string)
+	}
+	if order, ok := params["order"]; ok {
+		if order != "asc" && order != "desc" {
+			err = errors.New("order must be asc or desc")
+			return
+		}
+		desc := order == "desc"
+		f.Desc = &desc
+	}
+	if limit, ok := params["limit"]; ok {
+		f.Limit = limit.(int)
+	}
+	if offset, ok := params["offset"]; ok {
+		f.Offset = offset.(int)
+	}
+
+	return
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"github.com/learc83/toastyserver/database"
+	"net/http"
+)
+
+//locations are the salons, this server runs at local_location. Beds and the
+//exposure schedules are managed on each location's own server
+
+func listLocations(req *http.Request, result map[string]interface{}) {
+	locations, err := database.ListLocations()
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Locations")
+		return
+	}
+
+	result["locations"] = locations
+	result["local_location"] = database.LocalLocation()
+}
+
+//address is optional
+func addNewLocation(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"name", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Location")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"address", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Location")
+		return
+	}
+	address, _ := opts["address"].(string)
+
+	l := database.Location{Name: params["name"].(string), Address: address,
+		Active: true}
+	if l.Name == "" {
+		result["error"] = stringifyErr(errors.New("name can't be blank"),
+			"Error Adding New Location")
+		return
+	}
+
+	err = database.CreateRecord(l)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Location")
+		return
+	}
+}
+
+//active=0 closes a location, its history stays in the reports
+func updateLocation(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"location_id", "int"},
+		param{"name", "string"},
+		param{"active", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Location")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"address", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Location")
+		return
+	}
+	address, _ := opts["address"].(string)
+
+	l := database.Location{Id: params["location_id"].(int),
+		Name: params["name"].(string), Address: address,
+		Active: params["active"].(int) != 0}
+
+	err = database.UpdateLocation(l)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Location")
+		return
+	}
+}
+
+//moves a customer to another home location. roaming is 0 or 1, roaming is
+//also turned on by buying a roaming plan
+func updateCustomerLocation(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"customer_id", "int"},
+		param{"location_id", "int"},
+		param{"roaming", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Customer Location")
+		return
+	}
+
+	l, err := database.FindLocation(params["location_id"].(int))
+	if err == nil && l.Id == 0 {
+		err = errors.New("location not found")
+	}
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Customer Location")
+		return
+	}
+
+	err = database.UpdateCustomerLocation(params["customer_id"].(int), l.Id,
+		params["roaming"].(int) != 0)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Customer Location")
+		return
+	}
+}
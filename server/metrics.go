@@ -0,0 +1,45 @@
+package server
+
+import (
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/metrics"
+	"strconv"
+)
+
+var requestCount = metrics.NewCounterVec("toasty_http_requests_total",
+	"HTTP requests by route and outcome", "route", "outcome")
+
+var requestDuration = metrics.NewHistogramVec("toasty_http_request_duration_seconds",
+	"HTTP request latency by route", metrics.DefaultBuckets, "route")
+
+var activeSessions = metrics.NewGaugeFunc("toasty_active_sessions",
+	"Sessions currently running by bed", "bed", func() (map[string]float64, error) {
+		active, err := database.ActiveSessionsPerBed()
+		if err != nil {
+			return nil, err
+		}
+
+		values := make(map[string]float64)
+		for bed, count := range active {
+			values[strconv.Itoa(bed)] = float64(count)
+		}
+		return values, nil
+	})
+
+func resultOutcome(result map[string]interface{}) string {
+	if resultError(result) != "" {
+		return "error"
+	}
+	return "ok"
+}
+
+//handlers report errors under either "error" or "error_message", an empty
+//string means no error
+func resultError(result map[string]interface{}) string {
+	for _, key := range []string{"error", "error_message"} {
+		if e, ok := result[key].(string); ok && e != "" {
+			return e
+		}
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/notify"
+	"net/http"
+	"time"
+)
+
+const (
+	outboxLimitDefault = 50
+	outboxLimitMax     = 500
+)
+
+//every kind and channel with whether the customer gets it
+func notificationPrefs(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"customer_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Notification Preferences")
+		return
+	}
+
+	prefs, err := notify.Prefs(params["customer_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Notification Preferences")
+		return
+	}
+
+	result["prefs"] = prefs
+}
+
+//kind is receipt, membership_expiring or bed_ready, channel is sms or email
+//and enabled is 0 or 1
+func setNotificationPref(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"customer_id", "int"},
+		param{"kind", "string"},
+		param{"channel", "string"},
+		param{"enabled", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Notification Preferences")
+		return
+	}
+
+	err = notify.SetPref(database.NotificationPref{
+		Customer_id: params["customer_id"].(int),
+		Kind:        params["kind"].(string),
+		Channel:     params["channel"].(string),
+		Enabled:     params["enabled"].(int) != 0})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Notification Preferences")
+		return
+	}
+}
+
+//status (pending, sent or failed) and customer_id are optional filters. limit
+//is capped at outboxLimitMax
+func outbox(req *http.Request, result map[string]interface{}) {
+	params, err := getOptionalParams(req,
+		param{"status", "string"},
+		param{"customer_id", "int"},
+		param{"limit", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Outbox")
+		return
+	}
+
+	status, _ := params["status"].(string)
+	cust_id, _ := params["customer_id"].(int)
+	limit := outboxLimitDefault
+	if l, ok := params["limit"]; ok {
+		limit = l.(int)
+	}
+	if limit < 1 {
+		result["error"] = stringifyErr(errors.New("limit must be at least 1"),
+			"Error Displaying Outbox")
+		return
+	}
+	if limit > outboxLimitMax {
+		limit = outboxLimitMax
+	}
+
+	msgs, err := database.ListOutbox(status, cust_id, limit)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Outbox")
+		return
+	}
+
+	result["messages"] = msgs
+}
+
+//sends a message that failed for good again
+func retryNotification(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"outbox_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Retrying Notification")
+		return
+	}
+
+	err = notify.Retry(params["outbox_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Retrying Notification")
+		return
+	}
+}
+
+//tells a customer waiting at the desk their bed is ready. turn is the unix
+//time their turn came up, it defaults to now. Calling again with the same
+//turn doesn't send again
+func bedReady(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"customer_id", "int"},
+		param{"bed_num", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Sending Bed Ready")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"turn", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Sending Bed Ready")
+		return
+	}
+
+	turn := time.Now().Unix()
+	if t, ok := opts["turn"]; ok {
+		turn = int64(t.(int))
+	}
+
+	err = notify.BedReady(params["customer_id"].(int), params["bed_num"].(int), turn)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Sending Bed Ready")
+		return
+	}
+
+	result["turn"] = turn
+}
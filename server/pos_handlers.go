@@ -0,0 +1,335 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/notify"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//point of sale handlers, all amounts are in cents
+
+var productKinds = map[string]bool{
+	database.KindRetail:      true,
+	database.KindSessionPack: true,
+	database.KindMembership:  true,
+	database.KindCredit:      true,
+	database.KindGiftCard:    true,
+}
+
+func listProducts(req *http.Request, result map[string]interface{}) {
+	params, err := getOptionalParams(req, param{"all", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Products")
+		return
+	}
+
+	//inactive products are only listed when all=1
+	all, _ := params["all"].(int)
+	products, err := database.ListProducts(all == 0)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Products")
+		return
+	}
+
+	result["products"] = products
+}
+
+//sessions and days only matter for session packs and memberships. roaming is
+//0 or 1, roaming plans work at every location
+func getProductParams(req *http.Request) (p database.Product, err error) {
+	params, err := getParams(req,
+		param{"name", "string"},
+		param{"kind", "string"},
+		param{"price", "int"})
+	if err != nil {
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"sessions", "int"}, param{"days", "int"},
+		param{"roaming", "int"})
+	if err != nil {
+		return
+	}
+
+	p.Name = params["name"].(string)
+	p.Kind = params["kind"].(string)
+	p.Price = params["price"].(int)
+	p.Sessions, _ = opts["sessions"].(int)
+	p.Days, _ = opts["days"].(int)
+	roaming, _ := opts["roaming"].(int)
+	p.Roaming = roaming != 0
+	p.Active = true
+
+	if !productKinds[p.Kind] {
+		err = fmt.Errorf("unknown product kind %q", p.Kind)
+	} else if p.Price < 0 {
+		err = errors.New("price can't be negative")
+	} else if p.Kind == database.KindSessionPack && p.Sessions < 1 {
+		err = errors.New("session packs need a number of sessions")
+	} else if p.Kind == database.KindMembership && p.Days < 1 {
+		err = errors.New("memberships need a number of days")
+	}
+
+	return
+}
+
+func addNewProduct(req *http.Request, result map[string]interface{}) {
+	p, err := getProductParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Product")
+		return
+	}
+
+	err = database.CreateRecord(p)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Product")
+		return
+	}
+}
+
+//products are never deleted since old sales point at them, set active=0
+//to stop selling one
+func updateProduct(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"product_id", "int"}, param{"active", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Product")
+		return
+	}
+
+	p, err := getProductParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Product")
+		return
+	}
+
+	p.Id = params["product_id"].(int)
+	p.Active = params["active"].(int) != 0
+
+	err = database.UpdateProduct(p)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Product")
+		return
+	}
+}
+
+//items are product_id:quantity pairs separated by commas, e.g. 3:1,7:2
+func parseSaleLines(items string) (lines []database.SaleLine, err error) {
+	for _, item := range strings.Split(items, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 2 {
+			err = fmt.Errorf("item %q should be product_id:quantity", item)
+			return
+		}
+
+		var l database.SaleLine
+		l.Product_id, err = strconv.Atoi(parts[0])
+		if err == nil {
+			l.Quantity, err = strconv.Atoi(parts[1])
+		}
+		if err != nil {
+			err = fmt.Errorf("item %q should be product_id:quantity", item)
+			return
+		}
+
+		lines = append(lines, l)
+	}
+
+	return
+}
+
+//payments are method:amount or method:amount:reference separated by commas,
+//e.g. cash:2000,card:1500:AUTH123. Gift card payments need the code as the
+//reference
+func parsePayments(payments string) (parsed []database.Payment, err error) {
+	for _, payment := range strings.Split(payments, ",") {
+		parts := strings.SplitN(strings.TrimSpace(payment), ":", 3)
+		if len(parts) < 2 {
+			err = fmt.Errorf("payment %q should be method:amount", payment)
+			return
+		}
+
+		var p database.Payment
+		p.Method = parts[0]
+		p.Amount, err = strconv.Atoi(parts[1])
+		if err != nil || p.Amount <= 0 {
+			err = fmt.Errorf("payment %q needs an amount in cents", payment)
+			return
+		}
+		if len(parts) == 3 {
+			p.Reference = parts[2]
+		}
+		if p.Method == database.MethodGiftCard {
+			p.Reference = database.NormalizeCode(p.Reference)
+		}
+
+		parsed = append(parsed, p)
+	}
+
+	return
+}
+
+//cash tendered over the total is given back as change and only what was kept
+//is recorded. Returns the change due
+func makeChange(payments []database.Payment, total int) (change int) {
+	paid := 0
+	for _, p := range payments {
+		paid += p.Amount
+	}
+
+	change = paid - total
+	if change <= 0 {
+		return 0
+	}
+
+	for i := range payments {
+		if payments[i].Method == database.MethodCash && payments[i].Amount >= change {
+			payments[i].Amount -= change
+			return
+		}
+	}
+
+	//overpaid by card or account, let CreateSale reject it
+	return 0
+}
+
+//customer_id is optional, leave it out for walk ins. promotion is an
+//optional promotion code. See parseSaleLines and parsePayments for the items
+//and payments formats
+func ringUpSale(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"items", "string"}, param{"payments", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Ringing Up Sale")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"customer_id", "int"},
+		param{"promotion", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Ringing Up Sale")
+		return
+	}
+
+	var sale database.Sale
+	sale.Customer_id, _ = opts["customer_id"].(int)
+	sale.Promotion_code, _ = opts["promotion"].(string)
+
+	sale.Lines, err = parseSaleLines(params["items"].(string))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Ringing Up Sale")
+		return
+	}
+
+	sale.Payments, err = parsePayments(params["payments"].(string))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Ringing Up Sale")
+		return
+	}
+
+	total, err := database.PriceSale(sale)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Ringing Up Sale")
+		return
+	}
+
+	change := makeChange(sale.Payments, total)
+
+	id, err := database.CreateSale(sale)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Ringing Up Sale")
+		return
+	}
+
+	sale, err = database.FindSale(id)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Ringing Up Sale")
+		return
+	}
+
+	//the sale went through, a receipt that can't be queued isn't worth failing
+	//it over
+	err = notify.Receipt(id)
+	if err != nil {
+		reqLogger(req).Warn("receipt not queued", "sale_id", id, "err", err)
+	}
+
+	result["sale"] = sale
+	result["change"] = change
+}
+
+func saleDetails(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"sale_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Sale")
+		return
+	}
+
+	sale, err := database.FindSale(params["sale_id"].(int))
+	if err == nil && sale.Id == 0 {
+		err = errors.New("Sale not found")
+	}
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Sale")
+		return
+	}
+
+	result["sale"] = sale
+}
+
+func voidSale(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"sale_id", "int"}, param{"reason", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Voiding Sale")
+		return
+	}
+
+	err = database.VoidSale(params["sale_id"].(int), params["reason"].(string))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Voiding Sale")
+		return
+	}
+}
+
+func customerAccount(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"customer_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Account")
+		return
+	}
+
+	account, err := database.FindAccount(params["customer_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Account")
+		return
+	}
+
+	result["account"] = account
+}
+
+//end of day report, date defaults to today
+func cashDrawerReport(req *http.Request, result map[string]interface{}) {
+	params, err := getOptionalParams(req, param{"date", "date"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Cash Drawer Report")
+		return
+	}
+
+	t := time.Now()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if d, ok := params["date"]; ok {
+		day = d.(time.Time)
+	}
+
+	report, err := database.CashDrawer(day.Unix(), day.AddDate(0, 0, 1).Unix())
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Cash Drawer Report")
+		return
+	}
+
+	result["date"] = day.Format("2006-01-02")
+	result["report"] = report
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"github.com/learc83/toastyserver/database"
+	"net/http"
+	"time"
+)
+
+//promotions and gift cards, both are redeemed through ring_up_sale
+
+func listPromotions(req *http.Request, result map[string]interface{}) {
+	promotions, err := database.ListPromotions()
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Promotions")
+		return
+	}
+
+	result["promotions"] = promotions
+}
+
+//everything but code, name and one of percent_off or amount_off is optional.
+//starts and ends are dates, ends is the last day the promotion can be used.
+//product_id limits it to one product, e.g. 20% off the 10 pack, and
+//new_customers_only=1 with max_quantity=1 makes a first session free offer
+func getPromotionParams(req *http.Request) (p database.Promotion, err error) {
+	params, err := getParams(req, param{"code", "string"}, param{"name", "string"})
+	if err != nil {
+		return
+	}
+
+	opts, err := getOptionalParams(req,
+		param{"percent_off", "int"},
+		param{"amount_off", "int"},
+		param{"product_id", "int"},
+		param{"max_quantity", "int"},
+		param{"starts", "date"},
+		param{"ends", "date"},
+		param{"max_uses", "int"},
+		param{"max_uses_per_customer", "int"},
+		param{"new_customers_only", "int"})
+	if err != nil {
+		return
+	}
+
+	p.Code = database.NormalizeCode(params["code"].(string))
+	p.Name = params["name"].(string)
+	p.Percent_off, _ = opts["percent_off"].(int)
+	p.Amount_off, _ = opts["amount_off"].(int)
+	p.Product_id, _ = opts["product_id"].(int)
+	p.Max_quantity, _ = opts["max_quantity"].(int)
+	p.Max_uses, _ = opts["max_uses"].(int)
+	p.Max_uses_per_customer, _ = opts["max_uses_per_customer"].(int)
+	newOnly, _ := opts["new_customers_only"].(int)
+	p.New_customers_only = newOnly != 0
+	p.Active = true
+
+	if d, ok := opts["starts"]; ok {
+		p.Starts = d.(time.Time).Unix()
+	}
+	if d, ok := opts["ends"]; ok {
+		p.Ends = d.(time.Time).AddDate(0, 0, 1).Unix()
+	}
+
+	if p.Code == "" {
+		err = errors.New("code can't be blank")
+	} else if p.Percent_off < 0 || p.Percent_off > 100 {
+		err = errors.New("percent_off must be from 0 to 100")
+	} else if p.Amount_off < 0 {
+		err = errors.New("amount_off can't be negative")
+	} else if p.Percent_off == 0 && p.Amount_off == 0 {
+		err = errors.New("promotions need a percent_off or amount_off")
+	} else if p.Starts != 0 && p.Ends != 0 && p.Ends <= p.Starts {
+		err = errors.New("promotions must end after they start")
+	}
+
+	return
+}
+
+func addNewPromotion(req *http.Request, result map[string]interface{}) {
+	p, err := getPromotionParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Promotion")
+		return
+	}
+
+	err = database.CreateRecord(p)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding New Promotion")
+		return
+	}
+}
+
+//takes the same params as add_new_promotion, set active=0 to end one early
+func updatePromotion(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"promotion_id", "int"}, param{"active", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Promotion")
+		return
+	}
+
+	p, err := getPromotionParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Promotion")
+		return
+	}
+
+	p.Id = params["promotion_id"].(int)
+	p.Active = params["active"].(int) != 0
+
+	err = database.UpdatePromotion(p)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Promotion")
+		return
+	}
+}
+
+//gives away a gift card, sell them with a gift card product instead
+func issueGiftCard(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"amount", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Issuing Gift Card")
+		return
+	}
+
+	g, err := database.IssueGiftCard(params["amount"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Issuing Gift Card")
+		return
+	}
+
+	result["giftCard"] = g
+}
+
+func giftCardBalance(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"code", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Checking Gift Card")
+		return
+	}
+
+	g, err := database.FindGiftCard(params["code"].(string))
+	if err == nil && g.Id == 0 {
+		err = errors.New("Gift card not found")
+	}
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Checking Gift Card")
+		return
+	}
+
+	result["giftCard"] = g
+}
@@ -1,7 +1,8 @@
 package server
 
 import (
-//"net/http"
+	"github.com/learc83/toastyserver/metrics"
+	"net/http"
 )
 
 //routes to match handlers to url strings
@@ -13,9 +14,22 @@ func getRoutes() map[string]toastyHndlrFnc {
 	r["/employee_login"] = employeeLogin
 	r["/customer_list"] = customerList
 	r["/customer_list_by_name"] = customerListByName
+	r["/customer_list_by_phone"] = customerListByPhone
+	r["/customer_search"] = customerSearch
+	r["/customer/{id}"] = customerProfile
+	r["/customer_compliance"] = customerCompliance
+	r["/update_customer_compliance"] = updateCustomerCompliance
+	r["/customer_consent_history"] = customerConsentHistory
 	r["/add_new_customer"] = addNewCustomer
 	r["/available_customer_keyfobs"] = availableCustomerKeyfobs
 	r["/delete_customer"] = deleteCustomer
+	r["/update_customer_contact"] = updateCustomerContact
+	r["/employees"] = listEmployees
+	r["/employee/{id}"] = employeeProfile
+	r["/add_new_employee"] = addNewEmployee
+	r["/update_employee"] = updateEmployee
+	r["/delete_employee"] = deleteEmployee
+	r["/available_employee_keyfobs"] = availableEmployeeKeyfobs
 	r["/door_report"] = doorReport
 	r["/tan_report"] = tanReport
 	r["/add_new_bed"] = addNewBed
@@ -24,6 +38,67 @@ func getRoutes() map[string]toastyHndlrFnc {
 	r["/list_beds"] = listBeds
 	r["/move_bed_down"] = moveBedDown
 	r["/move_bed_up"] = moveBedUp
+	r["/exposure_schedule"] = exposureSchedule
+	r["/set_exposure_schedule"] = setExposureSchedule
+	r["/delete_exposure_schedule"] = deleteExposureSchedule
+	r["/products"] = listProducts
+	r["/add_new_product"] = addNewProduct
+	r["/update_product"] = updateProduct
+	r["/ring_up_sale"] = ringUpSale
+	r["/sale"] = saleDetails
+	r["/void_sale"] = voidSale
+	r["/customer_account"] = customerAccount
+	r["/cash_drawer_report"] = cashDrawerReport
+	r["/promotions"] = listPromotions
+	r["/add_new_promotion"] = addNewPromotion
+	r["/update_promotion"] = updatePromotion
+	r["/issue_gift_card"] = issueGiftCard
+	r["/gift_card"] = giftCardBalance
+	r["/start_billing"] = startBilling
+	r["/cancel_billing"] = cancelBilling
+	r["/billing"] = billingStatus
+	r["/past_due_report"] = pastDueReport
+	r["/retry_invoice"] = retryInvoice
+	r["/notification_prefs"] = notificationPrefs
+	r["/set_notification_pref"] = setNotificationPref
+	r["/outbox"] = outbox
+	r["/retry_notification"] = retryNotification
+	r["/bed_ready"] = bedReady
+	r["/locations"] = listLocations
+	r["/add_new_location"] = addNewLocation
+	r["/update_location"] = updateLocation
+	r["/update_customer_location"] = updateCustomerLocation
+	r["/doors"] = listDoors
+	r["/add_new_door"] = addNewDoor
+	r["/update_door"] = updateDoor
+	r["/unlock_door"] = unlockDoor
+	r["/lockdown"] = lockdown
+	r["/end_lockdown"] = endLockdown
+	r["/door_alerts"] = doorAlerts
+	r["/resolve_door_alert"] = resolveDoorAlert
+	r["/sync_conflicts"] = syncConflicts
+	r["/resolve_sync_conflict"] = resolveSyncConflict
+	r["/clock_in"] = clockIn
+	r["/clock_out"] = clockOut
+	r["/time_clock_status"] = timeClockStatus
+	r["/time_entries"] = timeEntries
+	r["/add_time_entry"] = addTimeEntry
+	r["/update_time_entry"] = updateTimeEntry
+	r["/delete_time_entry"] = deleteTimeEntry
+	r["/time_entry_edits"] = timeEntryEdits
+	r["/payroll_report"] = payrollReport
+	r["/diagnostics"] = diagnostics
+
+	//analytics routes
+	r["/analytics/sessions"] = cachedAnalytics(sessionsPerPeriod)
+	r["/analytics/bed_utilization"] = cachedAnalytics(bedUtilization)
+	r["/analytics/peak_hours"] = cachedAnalytics(peakHours)
+	r["/analytics/cancellation_rate"] = cachedAnalytics(cancellationRate)
+	r["/analytics/customer_activity"] = cachedAnalytics(customerActivity)
+
+	//logging routes
+	r["/log_level"] = logLevel
+	r["/set_log_level"] = setLogLevel
 
 	//customer routes
 	r["/customer_login"] = customerLogin
@@ -33,3 +108,34 @@ func getRoutes() map[string]toastyHndlrFnc {
 
 	return r
 }
+
+//routes that write their own response instead of going through handlerWrapper
+func getRawRoutes() map[string]http.HandlerFunc {
+	r := make(map[string]http.HandlerFunc)
+
+	//health routes
+	r["/healthz"] = healthz
+	r["/readyz"] = readyz
+
+	//monitoring routes
+	r["/metrics"] = metrics.Handler
+
+	//sync routes, head office answers these
+	r["/sync/push"] = syncPush
+	r["/sync/pull"] = syncPull
+
+	return r
+}
+
+//routes that write their own response but still get handlerWrapper's request
+//id, logging and metrics, see rawWrapper
+func getExportRoutes() map[string]http.HandlerFunc {
+	r := make(map[string]http.HandlerFunc)
+
+	r["/tan_report_export"] = tanReportExport
+	r["/door_report_export"] = doorReportExport
+	r["/customer_list_export"] = customerListExport
+	r["/payroll_report_export"] = payrollReportExport
+
+	return r
+}
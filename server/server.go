@@ -1,20 +1,68 @@
 package server
 
 import (
-	"github.com/learc83/toastyserver/database"
-	"log"
+	"context"
+	"github.com/learc83/toastyserver/logging"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
-func StartServer() {
-	database.OpenDB()
+//how long to wait for in flight requests when shutting down
+const shutdownTimeout = 10 * time.Second
 
+//tracks bed starts and stops running in the background so shutdown can wait
+//for them to finish and record their sessions
+var bedCommands sync.WaitGroup
+
+//StartServer serves until ctx is cancelled, then shuts down gracefully.
+//The db must already be open.
+func StartServer(ctx context.Context) error {
+	//new mux every time so the server can be restarted without registering
+	//the routes on http.DefaultServeMux twice
+	mux := http.NewServeMux()
 	for key, value := range getRoutes() {
-		http.HandleFunc(key, handlerWrapper(value))
+		mux.HandleFunc(key, handlerWrapper(key, value))
+	}
+	for key, value := range getRawRoutes() {
+		mux.HandleFunc(key, value)
 	}
+	for key, value := range getExportRoutes() {
+		mux.HandleFunc(key, rawWrapper(key, value))
+	}
+
+	//TOASTY_HTTP_ADDR is for running more than one server on a machine
+	addr := ":9000"
+	if a := os.Getenv("TOASTY_HTTP_ADDR"); a != "" {
+		addr = a
+	}
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
 
-	err := http.ListenAndServe(":9000", nil)
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger := logging.For("server")
+	logger.Info("shutting down http server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
 	if err != nil {
-		log.Fatal("ListenAndServer: ", err)
+		logger.Error("http server shutdown", "err", err)
 	}
+
+	bedCommands.Wait()
+
+	return nil
 }
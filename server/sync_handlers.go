@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/replication"
+	"net/http"
+	"strconv"
+)
+
+//head office's side of sync, the other locations push their changes here and
+//pull everyone else's. Both need the sync key, see replication.Authorized
+
+const maxPullLimit = 1000
+
+//body is a replication.PushRequest, every change must be from the pushing
+//location
+func syncPush(w http.ResponseWriter, req *http.Request) {
+	if !replication.Authorized(req) {
+		writeSyncError(w, req, http.StatusForbidden, errors.New("bad sync key"))
+		return
+	}
+
+	var push replication.PushRequest
+	d := json.NewDecoder(req.Body)
+	d.UseNumber()
+	err := d.Decode(&push)
+	if err != nil {
+		writeSyncError(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, c := range push.Changes {
+		if c.Origin != push.Node {
+			writeSyncError(w, req, http.StatusBadRequest,
+				fmt.Errorf("location %d can't push changes from %d", push.Node, c.Origin))
+			return
+		}
+	}
+
+	applied, err := database.ApplyChanges(push.Changes)
+	if err != nil {
+		writeSyncError(w, req, http.StatusInternalServerError, err)
+		return
+	}
+
+	reqLogger(req).Debug("sync push", "node", push.Node, "changes", len(push.Changes),
+		"applied", applied)
+	writeStatus(w, http.StatusOK, map[string]interface{}{"applied": applied})
+}
+
+//node is the pulling location, since is the Last from its previous pull
+func syncPull(w http.ResponseWriter, req *http.Request) {
+	if !replication.Authorized(req) {
+		writeSyncError(w, req, http.StatusForbidden, errors.New("bad sync key"))
+		return
+	}
+
+	var args [3]int64
+	for i, name := range []string{"node", "since", "limit"} {
+		v, err := strconv.ParseInt(req.FormValue(name), 10, 64)
+		if err != nil {
+			writeSyncError(w, req, http.StatusBadRequest,
+				fmt.Errorf("%s must be a number", name))
+			return
+		}
+		args[i] = v
+	}
+
+	limit := int(args[2])
+	if limit <= 0 || limit > maxPullLimit {
+		limit = maxPullLimit
+	}
+
+	changes, last, more, err := database.ChangesFor(int(args[0]), args[1], limit)
+	if err != nil {
+		writeSyncError(w, req, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(replication.PullResponse{Changes: changes, Last: last,
+		More: more})
+}
+
+func writeSyncError(w http.ResponseWriter, req *http.Request, code int, err error) {
+	errs := stringifyErr(err, "Sync Failed")
+	reqLogger(req).Warn("sync request failed", "error", errs)
+	writeStatus(w, code, map[string]interface{}{"error": errs})
+}
+
+//changes from other locations that were rejected here, e.g. a keyfob given to
+//two customers at once
+func syncConflicts(req *http.Request, result map[string]interface{}) {
+	conflicts, err := database.SyncConflicts()
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Sync Conflicts")
+		return
+	}
+
+	result["conflicts"] = conflicts
+}
+
+//applies a rejected change again after the rows it clashed with are fixed.
+//discard set to 1 drops it instead, keeping this location's rows
+func resolveSyncConflict(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"conflict_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Resolving Sync Conflict")
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"discard", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Resolving Sync Conflict")
+		return
+	}
+	discard, _ := opts["discard"].(int)
+
+	applied, err := database.ResolveSyncConflict(params["conflict_id"].(int), discard != 0)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Resolving Sync Conflict")
+		return
+	}
+
+	result["applied"] = applied
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/timeclock"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//employees clock in and out with their fob at the desk, or at a door with
+//time_clock set. Changing an entry takes a manager's fob and a reason, and
+//every change is kept. Times are YYYY-MM-DD HH:MM local time
+
+func clockIn(req *http.Request, result map[string]interface{}) {
+	e, err := timeClockEmployee(req)
+	if err == nil {
+		err = timeclock.ClockIn(e.Id, timeclock.SourceDesk, time.Now())
+	}
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Clocking In")
+		return
+	}
+
+	result["name"] = e.Name
+}
+
+func clockOut(req *http.Request, result map[string]interface{}) {
+	e, err := timeClockEmployee(req)
+	if err == nil {
+		err = timeclock.ClockOut(e.Id, time.Now())
+	}
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Clocking Out")
+		return
+	}
+
+	result["name"] = e.Name
+}
+
+//whether employee_fob is clocked in, and since when
+func timeClockStatus(req *http.Request, result map[string]interface{}) {
+	e, err := timeClockEmployee(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Time Clock Status")
+		return
+	}
+
+	open, err := database.OpenTimeEntry(e.Id)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Time Clock Status")
+		return
+	}
+
+	result["name"] = e.Name
+	result["clocked_in"] = open.Id != 0
+	result["clock_in"] = open.Clock_in
+}
+
+func timeClockEmployee(req *http.Request) (e database.Employee, err error) {
+	params, err := getParams(req, param{"employee_fob", "uint64"})
+	if err != nil {
+		return
+	}
+	return timeclock.Employee(params["employee_fob"].(uint64))
+}
+
+//shifts started from from until to (dates, to is inclusive), the current
+//pay period if left out. Every employee unless employee_id is given
+func timeEntries(req *http.Request, result map[string]interface{}) {
+	opts, err := getOptionalParams(req, param{"employee_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Time Entries")
+		return
+	}
+	employee_id, _ := opts["employee_id"].(int)
+
+	start, end, err := payrollDates(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Time Entries")
+		return
+	}
+
+	entries, err := database.TimeEntries(employee_id, start.Unix(), end.Unix())
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Time Entries")
+		return
+	}
+
+	result["time_entries"] = entries
+	result["from"] = start.Unix()
+	result["to"] = end.Unix()
+}
+
+//a shift the employee forgot to punch. clock_out left out leaves them
+//clocked in. Needs manager_fob and reason
+func addTimeEntry(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"employee_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding Time Entry")
+		return
+	}
+
+	e, managerFob, reason, err := getTimeEntryParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding Time Entry")
+		return
+	}
+	e.Employee_id = params["employee_id"].(int)
+	e.Location_id = database.LocalLocation()
+	e.Source = timeclock.SourceManager
+
+	id, err := timeclock.Save(e, false, managerFob, reason)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Adding Time Entry")
+		return
+	}
+
+	result["time_entry_id"] = id
+}
+
+//same params as add_time_entry with time_entry_id instead of employee_id
+func updateTimeEntry(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"time_entry_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Time Entry")
+		return
+	}
+
+	e, managerFob, reason, err := getTimeEntryParams(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Time Entry")
+		return
+	}
+	e.Id = params["time_entry_id"].(int)
+
+	_, err = timeclock.Save(e, false, managerFob, reason)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Updating Time Entry")
+		return
+	}
+}
+
+func deleteTimeEntry(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req,
+		param{"time_entry_id", "int"},
+		param{"manager_fob", "uint64"},
+		param{"reason", "string"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Deleting Time Entry")
+		return
+	}
+
+	e := database.TimeEntry{Id: params["time_entry_id"].(int)}
+	_, err = timeclock.Save(e, true, params["manager_fob"].(uint64),
+		params["reason"].(string))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Deleting Time Entry")
+		return
+	}
+}
+
+func getTimeEntryParams(req *http.Request) (e database.TimeEntry, managerFob uint64,
+	reason string, err error) {
+	params, err := getParams(req,
+		param{"manager_fob", "uint64"},
+		param{"reason", "string"},
+		param{"clock_in", "datetime"})
+	if err != nil {
+		return
+	}
+
+	opts, err := getOptionalParams(req, param{"clock_out", "datetime"})
+	if err != nil {
+		return
+	}
+
+	e.Clock_in = params["clock_in"].(time.Time).Unix()
+	if out, ok := opts["clock_out"].(time.Time); ok {
+		e.Clock_out = out.Unix()
+	}
+
+	return e, params["manager_fob"].(uint64), params["reason"].(string), nil
+}
+
+//every change made to time_entry_id, oldest first
+func timeEntryEdits(req *http.Request, result map[string]interface{}) {
+	params, err := getParams(req, param{"time_entry_id", "int"})
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Time Entry Edits")
+		return
+	}
+
+	edits, err := database.TimeEntryEdits(params["time_entry_id"].(int))
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Time Entry Edits")
+		return
+	}
+
+	result["edits"] = edits
+}
+
+//regular and overtime hours per employee for a pay period. period is pay
+//periods back from the current one, 0 or left out for the current one, -1
+//for the last. from and to dates pick any other range. Overtime is hours
+//past 40 in each workweek, weeks start on the weekday of
+//TOASTY_PAY_PERIOD_START whatever the range, see timeclock.Workweek
+func payrollReport(req *http.Request, result map[string]interface{}) {
+	start, end, err := payrollDates(req)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Payroll Report")
+		return
+	}
+
+	hours, err := timeclock.Payroll(start, end)
+	if err != nil {
+		result["error"] = stringifyErr(err, "Error Displaying Payroll Report")
+		return
+	}
+
+	result["hours"] = hours
+	result["from"] = start.Unix()
+	result["to"] = end.Unix()
+}
+
+//same params as payroll_report plus format=csv or format=pdf
+func payrollReportExport(w http.ResponseWriter, req *http.Request) {
+	t := table{title: "Payroll Report",
+		headers: []string{"Employee Id", "Name", "Regular Hours", "Overtime Hours",
+			"Shifts", "Clocked In"}}
+
+	start, end, err := payrollDates(req)
+	if err == nil {
+		var hours []timeclock.Hours
+		hours, err = timeclock.Payroll(start, end)
+		t.title = fmt.Sprintf("Payroll Report %s to %s", start.Format("2006-01-02"),
+			end.AddDate(0, 0, -1).Format("2006-01-02"))
+		for _, h := range hours {
+			t.rows = append(t.rows, []string{strconv.Itoa(h.Employee_id), h.Name,
+				strconv.FormatFloat(h.Regular, 'f', 2, 64),
+				strconv.FormatFloat(h.Overtime, 'f', 2, 64), strconv.Itoa(h.Shifts),
+				yesNo(h.Clocked_in)})
+		}
+	}
+
+	writeExport(w, req, t, err, "Error Exporting Payroll Report")
+}
+
+//the range a payroll route covers, see payrollReport. end is exclusive
+func payrollDates(req *http.Request) (start time.Time, end time.Time, err error) {
+	opts, err := getOptionalParams(req,
+		param{"period", "int"},
+		param{"from", "date"},
+		param{"to", "date"})
+	if err != nil {
+		return
+	}
+
+	from, hasFrom := opts["from"].(time.Time)
+	to, hasTo := opts["to"].(time.Time)
+	if hasFrom != hasTo {
+		return start, end, errors.New("from and to go together")
+	}
+	if hasFrom {
+		if to.Before(from) {
+			return start, end, errors.New("to can't be before from")
+		}
+		return from, to.AddDate(0, 0, 1), nil
+	}
+
+	period, _ := opts["period"].(int)
+	return timeclock.PayPeriod(time.Now(), period)
+}
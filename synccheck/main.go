@@ -0,0 +1,295 @@
+//synccheck runs head office and one salon as two local servers and checks
+//changes sync between them, including while head office is down.
+//
+//	go run -tags development ./synccheck
+//
+//It writes to each server's db directly, the way the servers themselves do,
+//and waits for the change to show up on the other side. Exits 1 if a check
+//fails
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/learc83/go-sqlite3"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/replication"
+	"github.com/learc83/toastyserver/server"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const hubAddr = "localhost:9101"
+const salonAddr = "localhost:9102"
+
+const syncInterval = 500 * time.Millisecond
+
+//how long a change has to show up on the other server
+const syncTimeout = 10 * time.Second
+
+//ids the salon's server would hand out, see nextBlockId
+const salonIds = 1000000000
+
+type node struct {
+	name string
+	env  []string
+	path string
+	cmd  *exec.Cmd
+	db   *sql.DB
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "node" {
+		runNode()
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "synccheck")
+	if err != nil {
+		fail(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hub := newNode("head office", dir, 1, hubAddr, "")
+	salon := newNode("salon", dir, 2, salonAddr, "http://"+hubAddr)
+
+	for _, n := range []*node{hub, salon} {
+		err = n.start()
+		if err != nil {
+			fail(err)
+		}
+		defer n.stop()
+	}
+
+	failed := 0
+	check := func(name string, fn func() error) {
+		err := fn()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", name, err)
+			return
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+
+	check("location set up at head office reaches the salon", func() error {
+		hub.exec(`INSERT INTO Location (Id, Name, Address, Active)
+				  VALUES (2, 'Second', '', 1)`)
+		return salon.eventually(`SELECT COUNT(*) FROM Location WHERE Id = 2`, 1)
+	})
+
+	customer := salonIds + 1
+	check("customer who joins at the salon reaches head office", func() error {
+		salon.exec(`INSERT INTO Keyfob (Fob_num, Admin) VALUES (5001, 0)`)
+		salon.exec(`INSERT INTO Customer (Id, Name, Phone, Email, Status, Level, Fob_num,
+					  Location_id, Roaming)
+					VALUES (?, 'Sally Salon', '+17705550101', '', 1, 3, 5001, 2, 1)`, customer)
+		salon.exec(`INSERT INTO Account (Customer_id, Balance, Sessions, Member_until)
+					VALUES (?, 0, 0, ?)`, customer, time.Now().AddDate(0, 1, 0).Unix())
+
+		err := hub.eventually(`SELECT COUNT(*) FROM Customer WHERE Fob_num = 5001`, 1)
+		if err == nil {
+			err = hub.eventually(fmt.Sprintf(`SELECT COUNT(*) FROM Account
+											  WHERE Customer_id = %d`, customer), 1)
+		}
+		return err
+	})
+
+	check("customer who joins at head office reaches the salon", func() error {
+		hub.exec(`INSERT INTO Customer (Name, Phone, Email, Status, Level, Fob_num,
+					Location_id, Roaming)
+				  VALUES ('Harry Head', '+17705550102', '', 1, 3, 5002, 1, 0)`)
+		return salon.eventually(`SELECT COUNT(*) FROM Customer WHERE Fob_num = 5002`, 1)
+	})
+
+	check("later change wins when both change a customer", func() error {
+		salon.exec(`UPDATE Customer SET Phone = '+17705550111' WHERE Id = ?`, customer)
+		time.Sleep(50 * time.Millisecond)
+		hub.exec(`UPDATE Customer SET Phone = '+17705550222' WHERE Id = ?`, customer)
+
+		q := fmt.Sprintf(`SELECT COUNT(*) FROM Customer
+						  WHERE Id = %d AND Phone = '+17705550222'`, customer)
+		err := hub.eventually(q, 1)
+		if err == nil {
+			err = salon.eventually(q, 1)
+		}
+		return err
+	})
+
+	check("door access at the salon reaches head office", func() error {
+		salon.exec(`INSERT INTO DoorAccess (Customer_id, Time_stamp, Location_id)
+					VALUES (?, ?, 2)`, customer, time.Now().Unix())
+		return hub.eventually(fmt.Sprintf(`SELECT COUNT(*) FROM DoorAccess
+										   WHERE Customer_id = %d AND Location_id = 2`,
+			customer), 1)
+	})
+
+	check("changes made while head office is down sync when it's back", func() error {
+		hub.stop()
+		salon.exec(`INSERT INTO Customer (Id, Name, Phone, Email, Status, Level, Fob_num,
+					  Location_id, Roaming)
+					VALUES (?, 'Olive Offline', '+17705550103', '', 1, 3, 5003, 2, 0)`,
+			customer+1)
+		time.Sleep(4 * syncInterval)
+
+		err := hub.start()
+		if err != nil {
+			return err
+		}
+		return hub.eventually(`SELECT COUNT(*) FROM Customer WHERE Fob_num = 5003`, 1)
+	})
+
+	check("customer deleted at head office is deleted at the salon", func() error {
+		hub.exec(`DELETE FROM Customer WHERE Fob_num = 5002`)
+		return salon.eventually(`SELECT COUNT(*) FROM Customer WHERE Fob_num = 5002`, 0)
+	})
+
+	if failed > 0 {
+		fmt.Printf("%d checks failed\n", failed)
+		for _, n := range []*node{hub, salon} {
+			n.stop()
+		}
+		os.Exit(1)
+	}
+	fmt.Println("all checks passed")
+}
+
+func newNode(name string, dir string, location int, addr string, syncURL string) *node {
+	path := filepath.Join(dir, strconv.Itoa(location)+".sqlite")
+	return &node{name: name, path: path, env: append(os.Environ(),
+		"TOASTY_DB="+path,
+		"TOASTY_LOCATION="+strconv.Itoa(location),
+		"TOASTY_HTTP_ADDR="+addr,
+		"TOASTY_SYNC_URL="+syncURL,
+		"TOASTY_SYNC_KEY=synccheck",
+		"TOASTY_SYNC_INTERVAL="+syncInterval.String(),
+		"TOASTY_LOG_LEVEL=warn")}
+}
+
+//starts the server and waits for it to answer
+func (n *node) start() (err error) {
+	self, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	n.cmd = exec.Command(self, "node")
+	n.cmd.Env = n.env
+	n.cmd.Stdout = os.Stdout
+	n.cmd.Stderr = os.Stderr
+	err = n.cmd.Start()
+	if err != nil {
+		return
+	}
+
+	addr := ""
+	for _, e := range n.env {
+		if len(e) > 17 && e[:17] == "TOASTY_HTTP_ADDR=" {
+			addr = e[17:]
+		}
+	}
+
+	deadline := time.Now().Add(syncTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get("http://" + addr + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if n.db == nil {
+		n.db, err = sql.Open("sqlite3", n.path)
+		if err != nil {
+			return
+		}
+		//the server has the db open too
+		_, err = n.db.Exec("PRAGMA busy_timeout = 5000")
+	}
+
+	return
+}
+
+func (n *node) stop() {
+	if n.cmd == nil || n.cmd.Process == nil || n.cmd.ProcessState != nil {
+		return
+	}
+	n.cmd.Process.Signal(syscall.SIGTERM)
+	n.cmd.Wait()
+}
+
+func (n *node) exec(query string, args ...interface{}) {
+	_, err := n.db.Exec(query, args...)
+	if err != nil {
+		fail(fmt.Errorf("%s: %s", n.name, err))
+	}
+}
+
+//waits for a count query to give want
+func (n *node) eventually(query string, want int) error {
+	var got int
+	deadline := time.Now().Add(syncTimeout)
+	for time.Now().Before(deadline) {
+		err := n.db.QueryRow(query).Scan(&got)
+		if err == nil && got == want {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return fmt.Errorf("%s: got %d, want %d", n.name, got, want)
+}
+
+func fail(err error) {
+	fmt.Println("synccheck:", err)
+	os.Exit(1)
+}
+
+//one server, set up by the env from newNode. The db is made on first start
+func runNode() {
+	path := os.Getenv("TOASTY_DB")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		database.CreateAndOpenDB()
+		database.UpSchema()
+	} else {
+		database.OpenDB()
+		err = database.UpgradeSchema()
+		if err != nil {
+			fail(err)
+		}
+	}
+	defer database.CloseDB()
+
+	location, _ := strconv.Atoi(os.Getenv("TOASTY_LOCATION"))
+	err := database.SetLocalLocation(location)
+	if err != nil {
+		fail(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer cancel()
+
+	go server.StartServer(ctx)
+
+	//the checks write to the db too, so a locked db is retried rather than
+	//stopping sync
+	for ctx.Err() == nil {
+		err = replication.Run(ctx)
+		if err == nil {
+			<-ctx.Done()
+			break
+		}
+		fmt.Println(os.Getenv("TOASTY_LOCATION"), "sync:", err)
+		time.Sleep(syncInterval)
+	}
+}
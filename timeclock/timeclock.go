@@ -0,0 +1,356 @@
+//Package timeclock clocks employees in and out and works out their hours for
+//payroll. Employees punch by tapping their fob at a door set up as a time
+//clock, or at the desk. Managers fix mistakes, every fix is kept in
+//TimeEntryEdit.
+package timeclock
+
+import (
+	"errors"
+	"fmt"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/logging"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var logger = logging.For("timeclock")
+
+//employees at this level or above can change time entries
+const ManagerLevel = 2
+
+//hours past this in a week are overtime
+const overtimeAfter = 40 * time.Hour
+
+//a tap this soon after the last punch is ignored, so a double tap at the door
+//doesn't clock someone straight back out
+const doubleTap = 1 * time.Minute
+
+//where a punch came from, TimeEntry.Source
+const (
+	SourceDoor    = "door"
+	SourceDesk    = "desk"
+	SourceManager = "manager"
+)
+
+//punches read an employee's open entry and then write, one at a time
+var mu sync.Mutex
+
+//Punch clocks the employee in, or out if they're clocked in. in is true if
+//it clocked them in. A tap within a minute of their last punch does nothing
+//and returns ok false
+func Punch(employee_id int, source string, t time.Time) (in bool, ok bool, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	last, err := database.LastPunch(employee_id)
+	if err != nil || t.Unix()-last < int64(doubleTap/time.Second) {
+		return
+	}
+
+	open, err := database.OpenTimeEntry(employee_id)
+	if err != nil {
+		return
+	}
+
+	if open.Id != 0 {
+		err = database.ClockOutTimeEntry(open.Id, t.Unix())
+		return false, err == nil, err
+	}
+
+	err = database.CreateRecord(database.TimeEntry{Employee_id: employee_id,
+		Location_id: database.LocalLocation(), Clock_in: t.Unix(), Source: source})
+	return true, err == nil, err
+}
+
+//ClockIn starts a shift, unless the employee is already clocked in
+func ClockIn(employee_id int, source string, t time.Time) (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	open, err := database.OpenTimeEntry(employee_id)
+	if err != nil {
+		return
+	}
+	if open.Id != 0 {
+		return errors.New("already clocked in since " + formatTime(open.Clock_in))
+	}
+
+	return database.CreateRecord(database.TimeEntry{Employee_id: employee_id,
+		Location_id: database.LocalLocation(), Clock_in: t.Unix(), Source: source})
+}
+
+//ClockOut ends the employee's shift
+func ClockOut(employee_id int, t time.Time) (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	open, err := database.OpenTimeEntry(employee_id)
+	if err != nil {
+		return
+	}
+	if open.Id == 0 {
+		return errors.New("not clocked in")
+	}
+
+	return database.ClockOutTimeEntry(open.Id, t.Unix())
+}
+
+//Employee is the employee with keyfob fob
+func Employee(fob uint64) (e database.Employee, err error) {
+	e, err = database.FindEmployeeByFob(fob)
+	if err == nil && e.Id == 0 {
+		err = errors.New("employee not found")
+	}
+	return
+}
+
+//Manager is the employee with keyfob fob if they're a manager
+func Manager(fob uint64) (e database.Employee, err error) {
+	e, err = Employee(fob)
+	if err == nil && e.Level < ManagerLevel {
+		err = errors.New("only a manager can change time entries")
+	}
+	return
+}
+
+//Save is a manager's change to a time entry, see database.SaveTimeEntry. A
+//reason is required. Clock_out 0 leaves the employee clocked in
+func Save(e database.TimeEntry, del bool, managerFob uint64, reason string) (id int, err error) {
+	m, err := Manager(managerFob)
+	if err != nil {
+		return
+	}
+	if reason == "" {
+		return 0, errors.New("reason can't be blank")
+	}
+	if !del {
+		if e.Clock_in == 0 {
+			return 0, errors.New("clock in can't be blank")
+		}
+		if e.Clock_out != 0 && e.Clock_out <= e.Clock_in {
+			return 0, errors.New("clock out must be after clock in")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	id, err = database.SaveTimeEntry(e, del, m.Id, reason)
+	if err == nil {
+		logger.Info("time entry changed", "time_entry_id", id, "manager_id", m.Id,
+			"deleted", del, "reason", reason)
+	}
+	return
+}
+
+//PayPeriod is the pay period offset periods from the one t is in, 0 for
+//t's own. Pay periods are TOASTY_PAY_PERIOD_DAYS long, 14 by default, and
+//one of them starts on TOASTY_PAY_PERIOD_START, 2024-01-01 by default. The
+//length has to be whole weeks so periods line up with Workweek
+func PayPeriod(t time.Time, offset int) (start time.Time, end time.Time, err error) {
+	days := 14
+	if d := os.Getenv("TOASTY_PAY_PERIOD_DAYS"); d != "" {
+		days, err = strconv.Atoi(d)
+		if err != nil || days < 7 || days%7 != 0 {
+			return start, end, fmt.Errorf("bad TOASTY_PAY_PERIOD_DAYS %q, must be a multiple of 7", d)
+		}
+	}
+
+	first, err := payAnchor()
+	if err != nil {
+		return
+	}
+
+	start = periodStart(first, t, days, offset)
+	end = start.AddDate(0, 0, days)
+	return
+}
+
+//Workweek is the start of the week t is in for overtime. Weeks start on the
+//weekday of TOASTY_PAY_PERIOD_START whatever range a report covers
+func Workweek(t time.Time) (start time.Time, err error) {
+	first, err := payAnchor()
+	if err != nil {
+		return
+	}
+	return periodStart(first, t, 7, 0), nil
+}
+
+//the day pay periods and workweeks are counted from
+func payAnchor() (first time.Time, err error) {
+	anchor := "2024-01-01"
+	if a := os.Getenv("TOASTY_PAY_PERIOD_START"); a != "" {
+		anchor = a
+	}
+	first, err = time.ParseInLocation("2006-01-02", anchor, time.Local)
+	if err != nil {
+		err = fmt.Errorf("bad TOASTY_PAY_PERIOD_START %q", anchor)
+	}
+	return
+}
+
+//the start of the run of days days long that t is in, offset runs on.
+//Runs are counted from first
+func periodStart(first time.Time, t time.Time, days int, offset int) time.Time {
+	//whole days between, counted on the calendar so DST doesn't matter
+	day := func(t time.Time) int64 {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400
+	}
+	since := day(t) - day(first)
+	n := since / int64(days)
+	if since < 0 && since%int64(days) != 0 {
+		n--
+	}
+	n += int64(offset)
+
+	return first.AddDate(0, 0, int(n)*days)
+}
+
+//Hours is an employee's time in a pay period
+type Hours struct {
+	Employee_id  int
+	Name         string
+	Regular      float64 //hours
+	Overtime     float64 //hours past 40 in a workweek
+	Shifts       int     //started in the period
+	Clocked_in   bool    //a shift in the period is still open, it isn't counted
+	Time_entries []database.TimeEntry
+}
+
+//longest shift looked back for, a shift from before the range can still
+//count towards overtime in its first week
+const maxShift = 7 * 24 * time.Hour
+
+//Payroll is every employee's hours worked from start until end. Overtime is
+//by Workweek, so a shift that crosses into a new week is split there, and a
+//range that starts mid week still counts the hours before it in that week
+//towards overtime
+func Payroll(start time.Time, end time.Time) (hours []Hours, err error) {
+	firstWeek, err := Workweek(start)
+	if err != nil {
+		return
+	}
+
+	entries, err := database.TimeEntries(0, firstWeek.Add(-maxShift).Unix(), end.Unix())
+	if err != nil {
+		return
+	}
+
+	byEmployee := make(map[int]*Hours)
+	weeks := make(map[int]map[int64]time.Duration) //employee id to week to time worked
+	employee := func(e database.TimeEntry) *Hours {
+		h, ok := byEmployee[e.Employee_id]
+		if !ok {
+			h = &Hours{Employee_id: e.Employee_id, Name: e.Name}
+			byEmployee[e.Employee_id] = h
+		}
+		return h
+	}
+
+	//entries are in clock in order for each employee, so each week's time
+	//adds up in the order it was worked
+	for _, e := range entries {
+		started := e.Clock_in >= start.Unix()
+		if e.Clock_out == 0 {
+			if started {
+				h := employee(e)
+				h.Time_entries = append(h.Time_entries, e)
+				h.Clocked_in = true
+			}
+			continue
+		}
+
+		if weeks[e.Employee_id] == nil {
+			weeks[e.Employee_id] = make(map[int64]time.Duration)
+		}
+
+		var counted bool //some of the shift is in the range
+		var pieces []piece
+		pieces, err = splitShift(e, start, end)
+		if err != nil {
+			return
+		}
+		for _, p := range pieces {
+			before := weeks[e.Employee_id][p.week]
+			weeks[e.Employee_id][p.week] += p.worked
+			if !p.inRange {
+				continue
+			}
+
+			regular := overtimeAfter - before
+			if regular < 0 {
+				regular = 0
+			}
+			if regular > p.worked {
+				regular = p.worked
+			}
+
+			h := employee(e)
+			h.Regular += regular.Hours()
+			h.Overtime += (p.worked - regular).Hours()
+			counted = true
+		}
+
+		if started || counted {
+			h := employee(e)
+			h.Time_entries = append(h.Time_entries, e)
+			if started {
+				h.Shifts++
+			}
+		}
+	}
+
+	for _, h := range byEmployee {
+		hours = append(hours, *h)
+	}
+
+	sort.Slice(hours, func(i, j int) bool {
+		if hours[i].Name != hours[j].Name {
+			return hours[i].Name < hours[j].Name
+		}
+		return hours[i].Employee_id < hours[j].Employee_id
+	})
+
+	return
+}
+
+//part of a shift inside one workweek
+type piece struct {
+	week    int64 //unix start of the workweek
+	worked  time.Duration
+	inRange bool
+}
+
+//cuts a closed shift at every workweek boundary and at start and end
+func splitShift(e database.TimeEntry, start time.Time, end time.Time) (pieces []piece, err error) {
+	from := time.Unix(e.Clock_in, 0)
+	out := time.Unix(e.Clock_out, 0)
+
+	for from.Before(out) {
+		var week time.Time
+		week, err = Workweek(from)
+		if err != nil {
+			return
+		}
+
+		to := week.AddDate(0, 0, 7)
+		for _, cut := range []time.Time{start, end, out} {
+			if cut.After(from) && cut.Before(to) {
+				to = cut
+			}
+		}
+
+		pieces = append(pieces, piece{week: week.Unix(), worked: to.Sub(from),
+			inRange: !from.Before(start) && from.Before(end)})
+		from = to
+	}
+
+	return
+}
+
+func formatTime(unix int64) string {
+	return time.Unix(unix, 0).Format("2006-01-02 15:04")
+}
@@ -0,0 +1,379 @@
+package timeclock
+
+import (
+	"github.com/learc83/toastyserver/database"
+	"path/filepath"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+//a fresh db, with times in zone. Workweeks start on Monday 2024-01-01
+func setup(t *testing.T, zone string) {
+	t.Helper()
+
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	local := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = local })
+
+	t.Setenv("TOASTY_PAY_PERIOD_START", "")
+	t.Setenv("TOASTY_PAY_PERIOD_DAYS", "")
+
+	database.SetPath(filepath.Join(t.TempDir(), "toasty.sqlite"))
+	database.CreateAndOpenDB()
+	t.Cleanup(database.CloseDB)
+
+	err = database.UpgradeSchema()
+	if err != nil {
+		t.Fatalf("UpgradeSchema: %v", err)
+	}
+}
+
+//local time, "2006-01-02 15:04"
+func at(t *testing.T, s string) time.Time {
+	t.Helper()
+
+	tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		t.Fatalf("bad time %q: %v", s, err)
+	}
+	return tm
+}
+
+type shift struct {
+	in, out string //out blank for clocked in
+}
+
+func TestSplitShift(t *testing.T) {
+	tests := []struct {
+		name       string
+		zone       string
+		shift      shift
+		start, end string
+		want       []piece //week as "2006-01-02 15:04" in .week of wantWeeks
+		wantWeeks  []string
+	}{
+		{
+			name:      "inside a week",
+			zone:      "UTC",
+			shift:     shift{"2024-01-03 09:00", "2024-01-03 17:00"},
+			start:     "2024-01-01 00:00",
+			end:       "2024-01-15 00:00",
+			want:      []piece{{worked: 8 * time.Hour, inRange: true}},
+			wantWeeks: []string{"2024-01-01 00:00"},
+		},
+		{
+			name:  "across a week boundary",
+			zone:  "UTC",
+			shift: shift{"2024-01-07 20:00", "2024-01-08 04:00"},
+			start: "2024-01-01 00:00",
+			end:   "2024-01-15 00:00",
+			want: []piece{{worked: 4 * time.Hour, inRange: true},
+				{worked: 4 * time.Hour, inRange: true}},
+			wantWeeks: []string{"2024-01-01 00:00", "2024-01-08 00:00"},
+		},
+		{
+			name:  "across the start of the range",
+			zone:  "UTC",
+			shift: shift{"2024-01-03 20:00", "2024-01-04 04:00"},
+			start: "2024-01-04 00:00",
+			end:   "2024-01-08 00:00",
+			want: []piece{{worked: 4 * time.Hour, inRange: false},
+				{worked: 4 * time.Hour, inRange: true}},
+			wantWeeks: []string{"2024-01-01 00:00", "2024-01-01 00:00"},
+		},
+		{
+			name:  "across the end of the range and a week",
+			zone:  "UTC",
+			shift: shift{"2024-01-14 22:00", "2024-01-15 02:00"},
+			start: "2024-01-01 00:00",
+			end:   "2024-01-15 00:00",
+			want: []piece{{worked: 2 * time.Hour, inRange: true},
+				{worked: 2 * time.Hour, inRange: false}},
+			wantWeeks: []string{"2024-01-08 00:00", "2024-01-15 00:00"},
+		},
+		{
+			name:      "clocks go forward",
+			zone:      "America/New_York",
+			shift:     shift{"2024-03-09 22:00", "2024-03-10 06:00"},
+			start:     "2024-03-04 00:00",
+			end:       "2024-03-18 00:00",
+			want:      []piece{{worked: 7 * time.Hour, inRange: true}},
+			wantWeeks: []string{"2024-03-04 00:00"},
+		},
+		{
+			name:  "clocks go back the night before a new week",
+			zone:  "America/New_York",
+			shift: shift{"2024-11-03 00:00", "2024-11-04 02:00"},
+			start: "2024-10-28 00:00",
+			end:   "2024-11-11 00:00",
+			want: []piece{{worked: 25 * time.Hour, inRange: true},
+				{worked: 2 * time.Hour, inRange: true}},
+			wantWeeks: []string{"2024-10-28 00:00", "2024-11-04 00:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, tt.zone)
+
+			e := database.TimeEntry{Clock_in: at(t, tt.shift.in).Unix(),
+				Clock_out: at(t, tt.shift.out).Unix()}
+			got, err := splitShift(e, at(t, tt.start), at(t, tt.end))
+			if err != nil {
+				t.Fatalf("splitShift: %v", err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d pieces %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i, p := range got {
+				want := tt.want[i]
+				want.week = at(t, tt.wantWeeks[i]).Unix()
+				if p != want {
+					t.Errorf("piece %d = %+v, want %+v", i, p, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPayroll(t *testing.T) {
+	type want struct {
+		regular, overtime float64
+		shifts            int
+		clockedIn         bool
+		entries           int
+	}
+
+	//five 8 hour days from Monday the 4th, the week the clocks go forward
+	var dstWeek []shift
+	for _, d := range []string{"04", "05", "06", "07", "08"} {
+		dstWeek = append(dstWeek, shift{"2024-03-" + d + " 09:00", "2024-03-" + d + " 17:00"})
+	}
+
+	tests := []struct {
+		name       string
+		zone       string
+		shifts     []shift
+		start, end string
+		want       want
+	}{
+		{
+			name: "over 40 in a week",
+			zone: "UTC",
+			shifts: []shift{
+				{"2024-01-01 08:00", "2024-01-01 17:00"},
+				{"2024-01-02 08:00", "2024-01-02 17:00"},
+				{"2024-01-03 08:00", "2024-01-03 17:00"},
+				{"2024-01-04 08:00", "2024-01-04 17:00"},
+				{"2024-01-05 08:00", "2024-01-05 17:00"},
+			},
+			start: "2024-01-01 00:00",
+			end:   "2024-01-15 00:00",
+			want:  want{regular: 40, overtime: 5, shifts: 5, entries: 5},
+		},
+		{
+			name: "two weeks of 30 hours",
+			zone: "UTC",
+			shifts: []shift{
+				{"2024-01-05 06:00", "2024-01-06 12:00"},
+				{"2024-01-08 06:00", "2024-01-09 12:00"},
+			},
+			start: "2024-01-01 00:00",
+			end:   "2024-01-15 00:00",
+			want:  want{regular: 60, shifts: 2, entries: 2},
+		},
+		{
+			name: "shift into a new week",
+			zone: "UTC",
+			shifts: []shift{
+				{"2024-01-01 08:00", "2024-01-01 18:00"},
+				{"2024-01-02 08:00", "2024-01-02 18:00"},
+				{"2024-01-03 08:00", "2024-01-03 18:00"},
+				{"2024-01-04 08:00", "2024-01-04 18:00"},
+				{"2024-01-07 20:00", "2024-01-08 04:00"},
+			},
+			start: "2024-01-01 00:00",
+			end:   "2024-01-15 00:00",
+			want:  want{regular: 44, overtime: 4, shifts: 5, entries: 5},
+		},
+		{
+			name: "range starts mid week",
+			zone: "UTC",
+			shifts: []shift{
+				{"2024-01-01 06:00", "2024-01-01 18:00"},
+				{"2024-01-02 06:00", "2024-01-02 18:00"},
+				{"2024-01-03 06:00", "2024-01-03 18:00"},
+				{"2024-01-04 08:00", "2024-01-04 18:00"},
+			},
+			start: "2024-01-04 00:00",
+			end:   "2024-01-08 00:00",
+			want:  want{regular: 4, overtime: 6, shifts: 1, entries: 1},
+		},
+		{
+			name: "shift started before the range",
+			zone: "UTC",
+			shifts: []shift{
+				{"2024-01-03 20:00", "2024-01-04 04:00"},
+			},
+			start: "2024-01-04 00:00",
+			end:   "2024-01-08 00:00",
+			want:  want{regular: 4, entries: 1},
+		},
+		{
+			name: "still clocked in",
+			zone: "UTC",
+			shifts: []shift{
+				{"2024-01-02 08:00", "2024-01-02 12:00"},
+				{"2024-01-03 08:00", ""},
+			},
+			start: "2024-01-01 00:00",
+			end:   "2024-01-15 00:00",
+			want:  want{regular: 4, shifts: 1, clockedIn: true, entries: 2},
+		},
+		{
+			name:   "clocks go forward",
+			zone:   "America/New_York",
+			shifts: append(dstWeek, shift{"2024-03-09 22:00", "2024-03-10 06:00"}),
+			start:  "2024-03-04 00:00",
+			end:    "2024-03-18 00:00",
+			want:   want{regular: 40, overtime: 7, shifts: 6, entries: 6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, tt.zone)
+
+			for _, s := range tt.shifts {
+				e := database.TimeEntry{Employee_id: 1, Location_id: 1,
+					Clock_in: at(t, s.in).Unix(), Source: SourceDesk}
+				if s.out != "" {
+					e.Clock_out = at(t, s.out).Unix()
+				}
+				err := database.CreateRecord(e)
+				if err != nil {
+					t.Fatalf("CreateRecord: %v", err)
+				}
+			}
+
+			hours, err := Payroll(at(t, tt.start), at(t, tt.end))
+			if err != nil {
+				t.Fatalf("Payroll: %v", err)
+			}
+			if len(hours) != 1 {
+				t.Fatalf("hours for %d employees, want 1", len(hours))
+			}
+
+			h := hours[0]
+			got := want{h.Regular, h.Overtime, h.Shifts, h.Clocked_in, len(h.Time_entries)}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPayPeriod(t *testing.T) {
+	setup(t, "UTC")
+
+	tests := []struct {
+		days    string
+		t       string
+		offset  int
+		start   string
+		wantErr bool
+	}{
+		{"", "2024-01-20 12:00", 0, "2024-01-15 00:00", false},
+		{"", "2024-01-20 12:00", -1, "2024-01-01 00:00", false},
+		{"", "2023-12-31 12:00", 0, "2023-12-18 00:00", false},
+		{"7", "2024-01-20 12:00", 0, "2024-01-15 00:00", false},
+		{"21", "2024-01-20 12:00", 0, "2024-01-01 00:00", false},
+		{"10", "2024-01-20 12:00", 0, "", true},
+		{"0", "2024-01-20 12:00", 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("TOASTY_PAY_PERIOD_DAYS", tt.days)
+
+		start, _, err := PayPeriod(at(t, tt.t), tt.offset)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q days: want error", tt.days)
+			}
+			continue
+		}
+		if err != nil || !start.Equal(at(t, tt.start)) {
+			t.Errorf("%q days, %s offset %d = %v %v, want %s", tt.days, tt.t, tt.offset,
+				start, err, tt.start)
+		}
+	}
+}
+
+func TestSave(t *testing.T) {
+	setup(t, "UTC")
+
+	for _, e := range []database.Employee{
+		{Name: "Manager", Level: ManagerLevel, Fob_num: 1, Location_id: 1, Active: true},
+		{Name: "Staff", Level: 1, Fob_num: 2, Location_id: 1, Active: true},
+	} {
+		err := database.CreateRecord(e)
+		if err != nil {
+			t.Fatalf("CreateRecord: %v", err)
+		}
+	}
+	staff, err := Employee(2)
+	if err != nil {
+		t.Fatalf("Employee: %v", err)
+	}
+
+	save := func(employee_id int, s shift) error {
+		e := database.TimeEntry{Employee_id: employee_id, Location_id: 1,
+			Clock_in: at(t, s.in).Unix(), Source: SourceManager}
+		if s.out != "" {
+			e.Clock_out = at(t, s.out).Unix()
+		}
+		_, err := Save(e, false, 1, "forgot to punch")
+		return err
+	}
+
+	tests := []struct {
+		name     string
+		employee int
+		shift    shift
+		want     string
+	}{
+		{"first", staff.Id, shift{"2024-01-02 08:00", "2024-01-02 12:00"}, ""},
+		{"overlaps", staff.Id, shift{"2024-01-02 11:00", "2024-01-02 13:00"},
+			"time entry overlaps another of the employee's"},
+		{"right after", staff.Id, shift{"2024-01-02 12:00", "2024-01-02 13:00"}, ""},
+		{"open", staff.Id, shift{"2024-01-03 08:00", ""}, ""},
+		{"second open", staff.Id, shift{"2024-01-04 08:00", ""},
+			"employee is already clocked in"},
+		{"after an open one", staff.Id, shift{"2024-01-04 08:00", "2024-01-04 09:00"},
+			"time entry overlaps another of the employee's"},
+		{"unknown employee", 99, shift{"2024-01-02 08:00", "2024-01-02 12:00"},
+			"employee not found"},
+	}
+
+	for _, tt := range tests {
+		err := save(tt.employee, tt.shift)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s: err %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	_, err = Save(database.TimeEntry{Employee_id: staff.Id, Clock_in: 1}, false, 2, "no")
+	if err == nil {
+		t.Error("Save by staff, want error")
+	}
+}
@@ -0,0 +1,90 @@
+package tmak
+
+import (
+	"github.com/learc83/toastyserver/metrics"
+	"sync"
+	"time"
+)
+
+//error types counted in Stats.Errors
+const (
+	errPort       = "port"
+	errShortRead  = "short_read"
+	errStartBytes = "bad_start_bytes"
+	errChksum     = "bad_checksum"
+)
+
+//command and outcome labels for the command counter
+const (
+	cmdBedStatus   = "bed_status"
+	cmdStartBed    = "start_bed"
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeRetry   = "retry"
+)
+
+var commandCount = metrics.NewCounterVec("toasty_tmak_commands_total",
+	"TMAK commands by command and outcome, retry counts failed attempts that were retried",
+	"command", "outcome")
+
+var errorCount = metrics.NewCounterVec("toasty_tmak_errors_total",
+	"TMAK errors by type", "type")
+
+//Stats is a snapshot of the health of the link to the TMAK board
+type Stats struct {
+	LastStatusPoll int64          //unix time of the last successful status poll
+	LastBedStart   int64          //unix time of the last successful bed start
+	Errors         map[string]int //error counts by type since startup
+}
+
+var stats = struct {
+	mu             sync.Mutex
+	lastStatusPoll int64
+	lastBedStart   int64
+	errors         map[string]int
+}{errors: make(map[string]int)}
+
+func GetStats() (s Stats) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	s.LastStatusPoll = stats.lastStatusPoll
+	s.LastBedStart = stats.lastBedStart
+	s.Errors = make(map[string]int)
+	for k, v := range stats.errors {
+		s.Errors[k] = v
+	}
+
+	return
+}
+
+func recordStatusPoll() {
+	stats.mu.Lock()
+	stats.lastStatusPoll = time.Now().Unix()
+	stats.mu.Unlock()
+}
+
+func recordBedStart() {
+	stats.mu.Lock()
+	stats.lastBedStart = time.Now().Unix()
+	stats.mu.Unlock()
+}
+
+func recordError(errType string) {
+	stats.mu.Lock()
+	stats.errors[errType]++
+	stats.mu.Unlock()
+
+	errorCount.Inc(errType)
+}
+
+func recordCommand(command string, outcome string) {
+	commandCount.Inc(command, outcome)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
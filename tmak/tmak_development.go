@@ -5,13 +5,15 @@
 package tmak
 
 import (
-	"fmt"
 	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/logging"
 	"time"
 )
 
+var logger = logging.For("tmak")
+
 func init() {
-	fmt.Println("Fake Tmax Started")
+	logger.Info("fake tmak started")
 }
 
 //Side Effects: edits beds in place
@@ -20,7 +22,10 @@ func BedStatuses(beds []database.Bed) (err error) {
 		beds[i].Status = !(beds[i].Bed_num%3 == 0)
 	}
 
-	fmt.Println("Fake Bed Statuses Called")
+	logger.Debug("fake bed statuses called")
+
+	recordStatusPoll()
+	recordCommand(cmdBedStatus, outcomeSuccess)
 
 	return
 }
@@ -28,7 +33,14 @@ func BedStatuses(beds []database.Bed) (err error) {
 func StartBed(bed int, t int) (err error) {
 	time.Sleep(1.5 * 1e9)
 
-	fmt.Println("Fake Bed Started")
+	logger.Debug("fake bed started")
+
+	recordBedStart()
+	recordCommand(cmdStartBed, outcomeSuccess)
 
 	return
 }
+
+func Close() {
+	logger.Debug("fake tmak closed")
+}
@@ -8,7 +8,7 @@ import (
 	"errors"
 	"github.com/learc83/sio"
 	"github.com/learc83/toastyserver/database"
-	"log"
+	"github.com/learc83/toastyserver/logging"
 	"sync"
 	"syscall"
 	"time"
@@ -21,34 +21,40 @@ type tmak struct {
 
 var T tmak
 
+var logger = logging.For("tmak")
+
 func init() {
 	var err error
 	T.port, err = sio.Open("/dev/ttyUSB0", syscall.B115200)
 	if err != nil {
-		log.Println(err)
+		logger.Error("failed to open TMAK port", "err", err)
 	}
 
-	log.Println(T.port)
-
 	//StartBed(7)
 }
 
 //Side Effects: edits beds in place
 func BedStatuses(beds []database.Bed) (err error) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
 	rBuf := make([]byte, 37) //37 bytes--3 start, 1 command, 32 data, 1 chksum
 	err = tryBedStatus(rBuf)
 	if err != nil {
+		recordCommand(cmdBedStatus, outcomeRetry)
 		T.port.Close()
 		T.port, err = sio.Open("/dev/ttyUSB0", syscall.B115200)
 		time.Sleep(0.020 * 1e9)
 		err = tryBedStatus(rBuf)
 		if err != nil {
+			recordCommand(cmdBedStatus, outcomeRetry)
 			T.port.Close()
 			T.port, err = sio.Open("/dev/ttyUSB0", syscall.B115200)
 			time.Sleep(0.020 * 1e9)
 			err = tryBedStatus(rBuf)
 		}
 	}
+	recordCommand(cmdBedStatus, outcome(err))
 
 	//Order of passed bed array doesn't matter. Loops through passed bed array
 	//and using the Bed_num from each bed gets it's status from rBuf
@@ -62,12 +68,23 @@ func BedStatuses(beds []database.Bed) (err error) {
 	return
 }
 
+//Close waits for any command in progress to finish then closes the port
+func Close() {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
+	if T.port != nil {
+		T.port.Close()
+	}
+}
+
 func tryBedStatus(buf []byte) (err error) {
 	//TODO WARNING write error handling for uint8 conversion
 	//bytes 4 and 5 are start and end for # of beds returned
 	n, err := T.port.Write([]byte{255, 254, 253, 4, 1, 32, 0, 0})
 	if err != nil {
-		log.Println(err)
+		logger.Warn("serial port error", "err", err)
+		recordError(errPort)
 		return
 	}
 
@@ -75,47 +92,55 @@ func tryBedStatus(buf []byte) (err error) {
 
 	n, err = T.port.Read(buf)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("serial port error", "err", err)
+		recordError(errPort)
 		return
 	}
 	if n < 37 {
-		log.Println("Short Read in Bed Status")
+		logger.Warn("short read in bed status", "bytes", n, logging.Bytes("buf", buf))
+		recordError(errShortRead)
 		err = errors.New("Short Read Error in Bed Status")
-		log.Println(buf)
 		return
 	}
 	if !startBytesCorrect(buf) {
-		log.Println("Starting Bytes not correct in Bed Status")
+		logger.Warn("starting bytes not correct in bed status", logging.Bytes("buf", buf))
+		recordError(errStartBytes)
 		err = errors.New("Starting Bytes bad Error in Bed Status")
-		log.Println(buf)
 		return
 	}
 	if !chksumCorrectStatus(buf) {
-		log.Println("Chksum bad in Bed Status")
+		logger.Warn("chksum bad in bed status", logging.Bytes("buf", buf))
+		recordError(errChksum)
 		err = errors.New("Chksum Error in Bed Status")
-		log.Println(buf)
 		return
 	}
 
-	log.Println(n)
-	log.Println(buf)
+	recordStatusPoll()
+
+	logger.Debug("bed status read", "bytes", n, logging.Bytes("buf", buf))
 	return
 }
 
 //TODO WARNING this is AWFUL--FIX IT. The port closes and to resync the stream,
 //b/c the serial library we are using has no flush method exposed.
 func StartBed(bed int, time int) (err error) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
 	err = tryStartBed(bed, time)
 	if err != nil {
+		recordCommand(cmdStartBed, outcomeRetry)
 		T.port.Close()
 		T.port, err = sio.Open("/dev/ttyUSB0", syscall.B115200)
 		err = tryStartBed(bed, time)
 		if err != nil {
+			recordCommand(cmdStartBed, outcomeRetry)
 			T.port.Close()
 			T.port, err = sio.Open("/dev/ttyUSB0", syscall.B115200)
 			err = tryStartBed(bed, time)
 		}
 	}
+	recordCommand(cmdStartBed, outcome(err))
 	return
 }
 
@@ -123,7 +148,8 @@ func tryStartBed(bed int, t int) (err error) {
 	//TODO WARNING write error handling for uint8 conversion
 	n, err := T.port.Write([]byte{255, 254, 253, 1, uint8(bed), uint8(t), 5, 0})
 	if err != nil {
-		log.Println(err)
+		logger.Warn("serial port error", "err", err)
+		recordError(errPort)
 		return
 	}
 
@@ -134,29 +160,32 @@ func tryStartBed(bed int, t int) (err error) {
 
 	n, err = T.port.Read(rxbuf)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("serial port error", "err", err)
+		recordError(errPort)
 		return
 	}
 	if n < 8 {
-		log.Println("Short Read in Bed Start")
+		logger.Warn("short read in bed start", "bytes", n, logging.Bytes("buf", rxbuf))
+		recordError(errShortRead)
 		err = errors.New("Short Read Error in Bed Start")
 		return
 	}
 	if !startBytesCorrect(rxbuf) {
-		log.Println("Starting Bytes not correct in Bed Start")
+		logger.Warn("starting bytes not correct in bed start", logging.Bytes("buf", rxbuf))
+		recordError(errStartBytes)
 		err = errors.New("Starting Bytes bad Error in Bed Start")
-		log.Println(rxbuf)
 		return
 	}
 	if !chksumCorrect(rxbuf) {
-		log.Println("Chksum bad in Bed Start")
+		logger.Warn("chksum bad in bed start", logging.Bytes("buf", rxbuf))
+		recordError(errChksum)
 		err = errors.New("Chksum Error in Bed Start")
-		log.Println(rxbuf)
 		return
 	}
 
-	//log.Println(n)
-	log.Println(rxbuf)
+	recordBedStart()
+
+	logger.Debug("bed start read", "bed", bed, "time", t, logging.Bytes("buf", rxbuf))
 
 	return
 }
@@ -174,15 +203,13 @@ func chksumCorrect(chksum []byte) (correct bool) {
 
 	for i := 0; i < 7; i++ {
 		sum = sum + int(chksum[i])
-		//log.Println(i)
-		//log.Println(sum)
 	}
 
 	if chksum[7] == uint8(sum%255) {
 		correct = true
 	}
 
-	log.Println(sum)
+	logger.Debug("chksum", "sum", sum)
 
 	return
 }
@@ -192,15 +219,13 @@ func chksumCorrectStatus(chksum []byte) (correct bool) {
 
 	for i := 0; i < 36; i++ {
 		sum = sum + int(chksum[i])
-		//log.Println(i)
-		//log.Println(sum)
 	}
 
 	if chksum[36] == uint8(sum%255) {
 		correct = true
 	}
 
-	log.Println(sum)
+	logger.Debug("chksum", "sum", sum)
 
 	return
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const minBackoff = 1 * time.Second
+const maxBackoff = 1 * time.Minute
+
+//a subsystem that has run at least this long without failing is considered
+//healthy again, so the next failure starts over at minBackoff
+const healthyRun = 5 * time.Minute
+
+//supervise runs fn in its own goroutine until ctx is cancelled. If fn returns
+//an error or panics it is restarted after an exponential backoff. If fn returns
+//nil the subsystem has nothing left to do and is not restarted.
+func supervise(ctx context.Context, wg *sync.WaitGroup, name string,
+	fn func(context.Context) error) {
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		backoff := minBackoff
+		for {
+			started := time.Now()
+			err := runSafely(ctx, fn)
+
+			if ctx.Err() != nil {
+				logger.Info("subsystem stopped", "subsystem", name)
+				return
+			}
+			if err == nil {
+				logger.Info("subsystem exited", "subsystem", name)
+				return
+			}
+
+			if time.Since(started) > healthyRun {
+				backoff = minBackoff
+			}
+
+			logger.Error("subsystem crashed", "subsystem", name, "err", err,
+				"restart_in", backoff)
+
+			select {
+			case <-ctx.Done():
+				logger.Info("subsystem stopped", "subsystem", name)
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff = backoff * 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}()
+}
+
+//turns a panic in fn into an error so a crashed subsystem can be restarted
+//instead of taking down the whole process
+func runSafely(ctx context.Context, fn func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return fn(ctx)
+}
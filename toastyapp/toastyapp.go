@@ -1,16 +1,75 @@
 package main
 
 import (
+	"context"
+	"github.com/learc83/toastyserver/billing"
+	"github.com/learc83/toastyserver/database"
+	"github.com/learc83/toastyserver/door"
+	"github.com/learc83/toastyserver/logging"
+	"github.com/learc83/toastyserver/notify"
+	"github.com/learc83/toastyserver/replication"
 	"github.com/learc83/toastyserver/server"
+	"github.com/learc83/toastyserver/tmak"
+	"os"
+	"os/signal"
 	"runtime"
-	"github.com/learc83/toastyserver/door"
+	"strconv"
+	"sync"
+	"syscall"
 )
 
+var logger = logging.For("app")
+
 func main() {
 	//Set max number of OS threads, no default so must set here
 	runtime.GOMAXPROCS(1)
 
-	go door.StartDoorControl() //start door control in another thread
+	database.OpenDB()
+
+	//add any tables or columns this version needs to an older db
+	err := database.UpgradeSchema()
+	if err != nil {
+		logger.Error("schema upgrade failed", "err", err)
+		os.Exit(1)
+	}
+
+	//the location this server runs at, defaults to the first one
+	if l := os.Getenv("TOASTY_LOCATION"); l != "" {
+		id, err := strconv.Atoi(l)
+		if err == nil {
+			err = database.SetLocalLocation(id)
+		}
+		if err != nil {
+			logger.Error("bad TOASTY_LOCATION", "location", l, "err", err)
+			os.Exit(1)
+		}
+	}
+	logger.Info("running at location", "location_id", database.LocalLocation())
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	//cancel everything on SIGINT or SIGTERM, subsystems watch ctx
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Info("shutting down", "signal", sig.String())
+		cancel()
+	}()
+
+	var wg sync.WaitGroup
+	supervise(ctx, &wg, "door control", door.StartDoorControl)
+	supervise(ctx, &wg, "http server", server.StartServer)
+	supervise(ctx, &wg, "billing", billing.Run)
+	supervise(ctx, &wg, "notifications", notify.Run)
+	supervise(ctx, &wg, "sync", replication.Run)
+
+	wg.Wait()
+
+	//nothing is running anymore, so it's safe to close the serial port and
+	//the db. Closing the last db connection checkpoints the WAL
+	tmak.Close()
+	database.CloseDB()
 
-	server.StartServer()
+	logger.Info("shutdown complete")
 }